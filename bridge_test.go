@@ -86,9 +86,10 @@ func TestHandlePacket(t *testing.T) {
 			in:   "foo:200|ms",
 			out: event.Events{
 				&event.ObserverEvent{
-					OMetricName: "foo",
-					OValue:      0.2,
-					OLabels:     map[string]string{},
+					OMetricName:   "foo",
+					OValue:        200,
+					OLabels:       map[string]string{},
+					OMilliseconds: true,
 				},
 			},
 		}, {
@@ -398,14 +399,16 @@ func TestHandlePacket(t *testing.T) {
 			in:   "foo:200|ms:300|ms:5|c|@0.1:6|g\nbar:1|c:5|ms",
 			out: event.Events{
 				&event.ObserverEvent{
-					OMetricName: "foo",
-					OValue:      .200,
-					OLabels:     map[string]string{},
+					OMetricName:   "foo",
+					OValue:        200,
+					OLabels:       map[string]string{},
+					OMilliseconds: true,
 				},
 				&event.ObserverEvent{
-					OMetricName: "foo",
-					OValue:      .300,
-					OLabels:     map[string]string{},
+					OMetricName:   "foo",
+					OValue:        300,
+					OLabels:       map[string]string{},
+					OMilliseconds: true,
 				},
 				&event.CounterEvent{
 					CMetricName: "foo",
@@ -423,25 +426,26 @@ func TestHandlePacket(t *testing.T) {
 					CLabels:     map[string]string{},
 				},
 				&event.ObserverEvent{
-					OMetricName: "bar",
-					OValue:      .005,
-					OLabels:     map[string]string{},
+					OMetricName:   "bar",
+					OValue:        5,
+					OLabels:       map[string]string{},
+					OMilliseconds: true,
 				},
 			},
 		}, {
 			name: "timings with sampling factor",
 			in:   "foo.timing:0.5|ms|@0.1",
 			out: event.Events{
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
 			},
 		}, {
 			name: "bad line",
@@ -503,9 +507,10 @@ func TestHandlePacket(t *testing.T) {
 			in:   "foo:200|ms",
 			out: event.Events{
 				&event.ObserverEvent{
-					OMetricName: "foo",
-					OValue:      0.2,
-					OLabels:     map[string]string{},
+					OMetricName:   "foo",
+					OValue:        200,
+					OLabels:       map[string]string{},
+					OMilliseconds: true,
 				},
 			},
 		}, {
@@ -537,32 +542,33 @@ func TestHandlePacket(t *testing.T) {
 	parser.EnableLibratoParsing()
 	parser.EnableSignalFXParsing()
 
+	labels := listenerLabels("test", "")
 	for k, l := range []statsDPacketHandler{&listener.StatsDUDPListener{
 		Conn:            nil,
 		EventHandler:    nil,
 		Logger:          log.NewNopLogger(),
 		LineParser:      parser,
-		UDPPackets:      udpPackets,
-		LinesReceived:   linesReceived,
+		UDPPackets:      udpPackets.With(labels),
+		LinesReceived:   linesReceived.With(labels),
 		EventsFlushed:   eventsFlushed,
-		SampleErrors:    *sampleErrors,
-		SamplesReceived: samplesReceived,
-		TagErrors:       tagErrors,
-		TagsReceived:    tagsReceived,
+		SampleErrors:    *sampleErrors.MustCurryWith(labels),
+		SamplesReceived: samplesReceived.With(labels),
+		TagErrors:       tagErrors.With(labels),
+		TagsReceived:    tagsReceived.With(labels),
 	}, &mockStatsDTCPListener{listener.StatsDTCPListener{
 		Conn:            nil,
 		EventHandler:    nil,
 		Logger:          log.NewNopLogger(),
 		LineParser:      parser,
-		LinesReceived:   linesReceived,
+		LinesReceived:   linesReceived.With(labels),
 		EventsFlushed:   eventsFlushed,
-		SampleErrors:    *sampleErrors,
-		SamplesReceived: samplesReceived,
-		TagErrors:       tagErrors,
-		TagsReceived:    tagsReceived,
-		TCPConnections:  tcpConnections,
-		TCPErrors:       tcpErrors,
-		TCPLineTooLong:  tcpLineTooLong,
+		SampleErrors:    *sampleErrors.MustCurryWith(labels),
+		SamplesReceived: samplesReceived.With(labels),
+		TagErrors:       tagErrors.With(labels),
+		TagsReceived:    tagsReceived.With(labels),
+		TCPConnections:  tcpConnections.With(labels),
+		TCPErrors:       tcpErrors.With(labels),
+		TCPLineTooLong:  tcpLineTooLong.With(labels),
 	}, log.NewNopLogger()}} {
 		events := make(chan event.Events, 32)
 		l.SetEventHandler(&event.UnbufferedEventHandler{C: events})
@@ -589,6 +595,68 @@ func TestHandlePacket(t *testing.T) {
 	}
 }
 
+func TestHandlePacketTenants(t *testing.T) {
+	parser := line.NewParser()
+	parser.EnableDogstatsdParsing()
+
+	tenants, err := newTenantResolver([]string{"local=127.0.0.0/8"}, nil, "team", "", "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := listenerLabels("test", "")
+	for _, s := range []struct {
+		name     string
+		l        statsDPacketHandler
+		expected map[string]string
+	}{
+		{
+			// The UDP listener has no source address without a connection.
+			name: "udp",
+			l: &listener.StatsDUDPListener{
+				Logger:          log.NewNopLogger(),
+				LineParser:      parser,
+				UDPPackets:      udpPackets.With(labels),
+				LinesReceived:   linesReceived.With(labels),
+				SampleErrors:    *sampleErrors.MustCurryWith(labels),
+				SamplesReceived: samplesReceived.With(labels),
+				TagErrors:       tagErrors.With(labels),
+				TagsReceived:    tagsReceived.With(labels),
+				Tenants:         tenants,
+			},
+			expected: map[string]string{"tenant": "checkout", "la": "foo"},
+		},
+		{
+			name: "tcp",
+			l: &mockStatsDTCPListener{listener.StatsDTCPListener{
+				Logger:          log.NewNopLogger(),
+				LineParser:      parser,
+				LinesReceived:   linesReceived.With(labels),
+				SampleErrors:    *sampleErrors.MustCurryWith(labels),
+				SamplesReceived: samplesReceived.With(labels),
+				TagErrors:       tagErrors.With(labels),
+				TagsReceived:    tagsReceived.With(labels),
+				TCPConnections:  tcpConnections.With(labels),
+				TCPErrors:       tcpErrors.With(labels),
+				TCPLineTooLong:  tcpLineTooLong.With(labels),
+				Tenants:         tenants,
+			}, log.NewNopLogger()},
+			expected: map[string]string{"tenant": "local", "la": "foo"},
+		},
+	} {
+		events := make(chan event.Events, 32)
+		s.l.SetEventHandler(&event.UnbufferedEventHandler{C: events})
+		s.l.HandlePacket([]byte("foo:1|c|#la:foo,team:checkout,tenant:spoofed"))
+
+		ev := <-events
+		if len(ev) != 1 {
+			t.Fatalf("%s: expected 1 event, got %d", s.name, len(ev))
+		}
+		if got := ev[0].Labels(); !reflect.DeepEqual(got, s.expected) {
+			t.Errorf("%s: expected labels %v, got %v", s.name, s.expected, got)
+		}
+	}
+}
+
 type statsDPacketHandler interface {
 	HandlePacket(packet []byte)
 	SetEventHandler(eh event.EventHandler)
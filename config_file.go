@@ -0,0 +1,179 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+const (
+	configFileFlag    = "config.file"
+	configFileMapping = "mapping"
+)
+
+// configFileFromArgs returns the value of the config file flag in args, which
+// has to be known before the command line is parsed.
+func configFileFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--"+configFileFlag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--"+configFileFlag+"=") {
+			return strings.TrimPrefix(arg, "--"+configFileFlag+"=")
+		}
+	}
+	return ""
+}
+
+// applyConfigFile sets the defaults of the flags of app from the settings in
+// the YAML config file fileName, so that flags given on the command line
+// override them. A section such as
+//
+//	web:
+//	  listen_address: :9102
+//
+// sets the flag --web.listen-address. The mapping section, if any, holds a
+// mapping config and is returned as YAML.
+func applyConfigFile(app *kingpin.Application, fileName string) (string, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	return applyConfig(app, b)
+}
+
+func applyConfig(app *kingpin.Application, b []byte) (string, error) {
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return "", err
+	}
+
+	settings := map[string][]string{}
+	var mapping string
+	for key, value := range config {
+		if key == configFileMapping {
+			out, err := yaml.Marshal(value)
+			if err != nil {
+				return "", fmt.Errorf("mapping: %v", err)
+			}
+			mapping = string(out)
+			continue
+		}
+		section, ok := value.(map[interface{}]interface{})
+		if !ok {
+			values, err := settingValues(key, value)
+			if err != nil {
+				return "", err
+			}
+			settings[flagName(key)] = values
+			continue
+		}
+		for k, v := range section {
+			name := fmt.Sprintf("%s.%v", key, k)
+			values, err := settingValues(name, v)
+			if err != nil {
+				return "", err
+			}
+			settings[flagName(name)] = values
+		}
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flag := app.GetFlag(name)
+		if flag == nil || name == configFileFlag {
+			return "", fmt.Errorf("unknown setting %q", name)
+		}
+		flag.Default(settings[name]...)
+	}
+	if mapping != "" && len(settings["statsd.mapping-config"]) > 0 {
+		return "", fmt.Errorf("both a mapping section and statsd.mapping_config are set")
+	}
+	return mapping, nil
+}
+
+// flagName returns the flag set by the setting name.
+func flagName(name string) string {
+	return strings.Replace(name, "_", "-", -1)
+}
+
+func settingValues(name string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return []string{""}, nil
+	case map[interface{}]interface{}:
+		return nil, fmt.Errorf("setting %q: unexpected nested section", name)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, fmt.Sprint(e))
+		}
+		return values, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// mappingSource is where the mapping config is loaded and reloaded from:
+// either a mapping config file, or the mapping section of the config file.
+type mappingSource struct {
+	fileName string
+	section  bool
+}
+
+func (s mappingSource) load(m *mapper.MetricMapper, cacheSize int, options ...mapper.CacheOption) error {
+	if !s.section {
+		return m.InitFromFile(s.fileName, cacheSize, options...)
+	}
+	mapping, err := mappingSection(s.fileName)
+	if err != nil {
+		return err
+	}
+	return m.InitFromYAMLString(mapping, cacheSize, options...)
+}
+
+// mappingSection returns the mapping section of the config file fileName as
+// YAML. The other settings are only applied on startup.
+func mappingSection(fileName string) (string, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		Mapping interface{} `yaml:"mapping"`
+	}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return "", err
+	}
+	if config.Mapping == nil {
+		return "", fmt.Errorf("%s has no mapping section", fileName)
+	}
+	out, err := yaml.Marshal(config.Mapping)
+	return string(out), err
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(fileName, []byte(`
+web:
+  listen_address: :9108
+statsd:
+  listen_tcp: ""
+  cache_size: 10
+  event_flush_interval: 1s
+check_config: true
+mapping:
+  mappings:
+  - match: test.*
+    name: "test"
+    labels:
+      name: "$1"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"--statsd.cache-size=20", "--config.file", fileName}
+	if got := configFileFromArgs(args); got != fileName {
+		t.Fatalf("expected config file %q, got %q", fileName, got)
+	}
+
+	app := kingpin.New("test", "")
+	app.Flag(configFileFlag, "").String()
+	listenAddress := app.Flag("web.listen-address", "").Default(":9102").String()
+	listenTCP := app.Flag("statsd.listen-tcp", "").Default(":9125").String()
+	cacheSize := app.Flag("statsd.cache-size", "").Default("1000").Int()
+	flushInterval := app.Flag("statsd.event-flush-interval", "").Default("200ms").Duration()
+	checkConfig := app.Flag("check-config", "").Bool()
+	app.Flag("statsd.mapping-config", "").String()
+
+	mapping, err := applyConfigFile(app, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if *listenAddress != ":9108" {
+		t.Errorf("expected listen address :9108, got %q", *listenAddress)
+	}
+	if *listenTCP != "" {
+		t.Errorf("expected TCP listener to be disabled, got %q", *listenTCP)
+	}
+	if *cacheSize != 20 {
+		t.Errorf("expected the command line to override the cache size, got %d", *cacheSize)
+	}
+	if *flushInterval != time.Second {
+		t.Errorf("expected flush interval 1s, got %v", *flushInterval)
+	}
+	if !*checkConfig {
+		t.Error("expected check-config to be set")
+	}
+
+	m := &mapper.MetricMapper{}
+	if err := m.InitFromYAMLString(mapping, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, labels, present := m.GetMapping("test.foo", mapper.MetricTypeCounter); !present || labels["name"] != "foo" {
+		t.Errorf("expected the mapping section to map test.foo, got %v %v", labels, present)
+	}
+
+	// Reloading only reads the mapping section.
+	reloaded := &mapper.MetricMapper{}
+	if err := (mappingSource{fileName: fileName, section: true}).load(reloaded, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, present := reloaded.GetMapping("test.foo", mapper.MetricTypeCounter); !present {
+		t.Error("expected the reloaded mapping section to map test.foo")
+	}
+
+	for _, config := range []string{
+		"web:\n  unknown_setting: 1\n",
+		"statsd:\n  cache:\n    size: 1\n",
+		"config:\n  file: other.yml\n",
+		"statsd:\n  mapping_config: m.yml\nmapping:\n  mappings: []\n",
+	} {
+		if _, err := applyConfig(app, []byte(config)); err == nil {
+			t.Errorf("expected an error for config %q", config)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// diffConfig reports how the StatsD metrics in sample would be handled
+// differently by the mapping configs in oldFile and newFile. The sample holds
+// one StatsD line per line; a bare metric name is treated as a counter. It
+// returns the number of metrics whose handling changes.
+func diffConfig(oldFile, newFile string, sample io.Reader, parser *line.Parser, out io.Writer) (int, error) {
+	oldMapper := &mapper.MetricMapper{}
+	if err := oldMapper.InitFromFile(oldFile, 0); err != nil {
+		return 0, fmt.Errorf("loading %s: %v", oldFile, err)
+	}
+	newMapper := &mapper.MetricMapper{}
+	if err := newMapper.InitFromFile(newFile, 0); err != nil {
+		return 0, fmt.Errorf("loading %s: %v", newFile, err)
+	}
+
+	// The sample is only parsed, so the parser's own metrics are discarded.
+	sampleErrors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sample_errors"}, []string{"reason"})
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded"})
+
+	seen := map[string]bool{}
+	var events event.Events
+	scanner := bufio.NewScanner(sample)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" {
+			continue
+		}
+		if !strings.Contains(l, ":") {
+			l += ":0|c"
+		}
+		for _, e := range parser.LineToEvents(l, *sampleErrors, counter, counter, counter, log.NewNopLogger()) {
+			key := describeEvent(e)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			events = append(events, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].MetricName() < events[j].MetricName()
+	})
+
+	changed := 0
+	for _, e := range events {
+		before := describeHandling(oldMapper, e)
+		after := describeHandling(newMapper, e)
+		if strings.Join(before, "\n") == strings.Join(after, "\n") {
+			continue
+		}
+		changed++
+		fmt.Fprintln(out, describeEvent(e))
+		for _, d := range before {
+			fmt.Fprintf(out, "  - %s\n", d)
+		}
+		for _, d := range after {
+			fmt.Fprintf(out, "  + %s\n", d)
+		}
+	}
+	fmt.Fprintf(out, "%d of %d metrics change\n", changed, len(events))
+	return changed, nil
+}
+
+// describeHandling returns how the exporter would handle an event with the
+// given mapper: the metrics it is recorded in, or why it is dropped.
+func describeHandling(m *mapper.MetricMapper, e event.Event) []string {
+	mapping, mappingLabels, present := m.GetMapping(e.MetricName(), e.MetricType())
+	if !present {
+		if m.Defaults.Action == mapper.ActionTypeDrop {
+			return []string{"drop (unmapped)"}
+		}
+		return []string{"unmapped " + formatMetric(mapper.EscapeMetricName(e.MetricName()), e.Labels())}
+	}
+	if mapping.Action == mapper.ActionTypeDrop {
+		return []string{"drop (" + mapping.Match + ")"}
+	}
+
+	labels := prometheus.Labels{}
+	for k, v := range e.Labels() {
+		labels[k] = v
+	}
+	for k, v := range mappingLabels {
+		labels[k] = v
+	}
+	if mapping.DropsLabels(labels) {
+		return []string{"drop (label value, " + mapping.Match + ")"}
+	}
+
+	descriptions := []string{formatMetric(mapper.EscapeMetricName(mapping.Name), labels)}
+	for _, target := range mapping.Targets {
+		targetLabels := prometheus.Labels{}
+		for k, v := range e.Labels() {
+			targetLabels[k] = v
+		}
+		for k, v := range target.Labels {
+			targetLabels[k] = v
+		}
+		descriptions = append(descriptions, formatMetric(mapper.EscapeMetricName(target.Name), targetLabels))
+	}
+	return descriptions
+}
+
+// describeEvent identifies an event of the sample by name, type and tags.
+func describeEvent(e event.Event) string {
+	return fmt.Sprintf("%s (%s)", formatMetric(e.MetricName(), e.Labels()), e.MetricType())
+}
+
+// formatMetric formats a metric name and its labels like the exposition
+// format does.
+func formatMetric(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	set := make(model.LabelSet, len(labels))
+	for k, v := range labels {
+		set[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return name + set.String()
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+func TestDiffConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldFile := filepath.Join(dir, "old.yml")
+	newFile := filepath.Join(dir, "new.yml")
+	if err := ioutil.WriteFile(oldFile, []byte(`
+mappings:
+- match: app.*.requests
+  name: "app_requests_total"
+  labels:
+    service: "$1"
+- match: app.*.errors
+  name: "app_errors_total"
+  labels:
+    service: "$1"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newFile, []byte(`
+mappings:
+- match: app.*.requests
+  name: "app_requests_total"
+  labels:
+    service: "$1"
+- match: app.*.errors
+  name: "app_failures_total"
+  labels:
+    app: "$1"
+- match: debug.*
+  name: "dropped"
+  action: drop
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sample := strings.NewReader(`app.api.requests:1|c
+app.api.errors:1|c|#code:500
+app.api.errors:2|c|#code:500
+debug.foo
+`)
+	parser := line.NewParser()
+	parser.EnableDogstatsdParsing()
+
+	var out bytes.Buffer
+	changed, err := diffConfig(oldFile, newFile, sample, parser, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `app.api.errors{code="500"} (counter)
+  - app_errors_total{code="500", service="api"}
+  + app_failures_total{app="api", code="500"}
+debug.foo (counter)
+  - unmapped debug_foo
+  + drop (debug.*)
+2 of 3 metrics change
+`
+	if changed != 2 {
+		t.Errorf("expected 2 changed metrics, got %d", changed)
+	}
+	if out.String() != expected {
+		t.Errorf("unexpected diff:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
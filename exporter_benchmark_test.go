@@ -43,6 +43,7 @@ func benchmarkUDPListener(times int, b *testing.B) {
 	}
 	bytesInput := make([]string, len(input)*times)
 	logger := log.NewNopLogger()
+	labels := listenerLabels("udp", "")
 	for run := 0; run < times; run++ {
 		for i := 0; i < len(input); i++ {
 			bytesInput[run*len(input)+i] = fmt.Sprintf("run%d%s", run, input[i])
@@ -69,10 +70,10 @@ func benchmarkUDPListener(times int, b *testing.B) {
 			EventHandler:    &event.UnbufferedEventHandler{C: events},
 			Logger:          logger,
 			LineParser:      parser,
-			UDPPackets:      udpPackets,
-			LinesReceived:   linesReceived,
-			SamplesReceived: samplesReceived,
-			TagsReceived:    tagsReceived,
+			UDPPackets:      udpPackets.With(labels),
+			LinesReceived:   linesReceived.With(labels),
+			SamplesReceived: samplesReceived.With(labels),
+			TagsReceived:    tagsReceived.With(labels),
 		}
 
 		// resume benchmark timer
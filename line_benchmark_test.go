@@ -37,6 +37,12 @@ var (
 		"some_very_useful_metrics_with_quite_a_log_name:13|c",
 	}
 	nopLogger = log.NewNopLogger()
+
+	lineLabels          = listenerLabels("test", "")
+	lineSampleErrors    = *sampleErrors.MustCurryWith(lineLabels)
+	lineSamplesReceived = samplesReceived.With(lineLabels)
+	lineTagErrors       = tagErrors.With(lineLabels)
+	lineTagsReceived    = tagsReceived.With(lineLabels)
 )
 
 func benchmarkLinesToEvents(times int, b *testing.B, input []string) {
@@ -55,7 +61,7 @@ func benchmarkLinesToEvents(times int, b *testing.B, input []string) {
 	for n := 0; n < b.N; n++ {
 		for i := 0; i < times; i++ {
 			for _, l := range input {
-				parser.LineToEvents(l, *sampleErrors, samplesReceived, tagErrors, tagsReceived, nopLogger)
+				parser.LineToEvents(l, lineSampleErrors, lineSamplesReceived, lineTagErrors, lineTagsReceived, nopLogger)
 			}
 		}
 	}
@@ -98,7 +104,7 @@ func BenchmarkLineFormats(b *testing.B) {
 			// always report allocations since this is a hot path
 			b.ReportAllocs()
 			for n := 0; n < b.N; n++ {
-				parser.LineToEvents(l, *sampleErrors, samplesReceived, tagErrors, tagsReceived, nopLogger)
+				parser.LineToEvents(l, lineSampleErrors, lineSamplesReceived, lineTagErrors, lineTagsReceived, nopLogger)
 			}
 		})
 	}
@@ -15,19 +15,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
@@ -36,9 +44,21 @@ import (
 	"github.com/prometheus/statsd_exporter/pkg/address"
 	"github.com/prometheus/statsd_exporter/pkg/event"
 	"github.com/prometheus/statsd_exporter/pkg/exporter"
+	"github.com/prometheus/statsd_exporter/pkg/filter"
+	"github.com/prometheus/statsd_exporter/pkg/graphite"
+	"github.com/prometheus/statsd_exporter/pkg/ha"
+	"github.com/prometheus/statsd_exporter/pkg/handoff"
 	"github.com/prometheus/statsd_exporter/pkg/line"
 	"github.com/prometheus/statsd_exporter/pkg/listener"
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/registry"
+	"github.com/prometheus/statsd_exporter/pkg/relay"
+	"github.com/prometheus/statsd_exporter/pkg/remotewrite"
+	"github.com/prometheus/statsd_exporter/pkg/runtimestats"
+	"github.com/prometheus/statsd_exporter/pkg/sender"
+	"github.com/prometheus/statsd_exporter/pkg/stream"
+	"github.com/prometheus/statsd_exporter/pkg/tenant"
+	"github.com/prometheus/statsd_exporter/pkg/web"
 )
 
 const (
@@ -47,147 +67,228 @@ const (
 )
 
 var (
-	eventStats = prometheus.NewCounterVec(
+	// statsdMetrics are the metrics shared with exporter.Server.
+	statsdMetrics = exporter.NewMetrics()
+
+	eventStats            = statsdMetrics.EventStats
+	eventsFlushed         = statsdMetrics.EventsFlushed
+	eventsUnmapped        = statsdMetrics.EventsUnmapped
+	udpPackets            = statsdMetrics.UDPPackets
+	tcpConnections        = statsdMetrics.TCPConnections
+	tcpErrors             = statsdMetrics.TCPErrors
+	tcpLineTooLong        = statsdMetrics.TCPLineTooLong
+	linesReceived         = statsdMetrics.LinesReceived
+	samplesReceived       = statsdMetrics.SamplesReceived
+	sampleErrors          = statsdMetrics.SampleErrors
+	tagsReceived          = statsdMetrics.TagsReceived
+	tagErrors             = statsdMetrics.TagErrors
+	conflictingEventStats = statsdMetrics.ConflictingEventStats
+	errorEventStats       = statsdMetrics.ErrorEventStats
+	eventsActions         = statsdMetrics.EventsActions
+	metricsCount          = statsdMetrics.MetricsCount
+
+	sctpAssociations = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_total",
-			Help: "The total number of StatsD events seen.",
+			Name: "statsd_exporter_sctp_associations_total",
+			Help: "The total number of SCTP associations handled.",
 		},
-		[]string{"type"},
+		[]string{"listener"},
 	)
-	eventsFlushed = prometheus.NewCounter(
+	sctpErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_event_queue_flushed_total",
-			Help: "Number of times events were flushed to exporter",
+			Name: "statsd_exporter_sctp_association_errors_total",
+			Help: "The number of errors encountered reading from SCTP associations.",
 		},
+		[]string{"listener"},
 	)
-	eventsUnmapped = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_unmapped_total",
-			Help: "The total number of StatsD events no mapping was found for.",
-		})
-	udpPackets = prometheus.NewCounter(
+	sctpLineTooLong = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_udp_packets_total",
-			Help: "The total number of StatsD packets received over UDP.",
+			Name: "statsd_exporter_sctp_too_long_lines_total",
+			Help: "The number of lines received over SCTP discarded due to being too long.",
 		},
+		[]string{"listener"},
 	)
-	tcpConnections = prometheus.NewCounter(
+	unixgramPackets = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_connections_total",
-			Help: "The total number of TCP connections handled.",
+			Name: "statsd_exporter_unixgram_packets_total",
+			Help: "The total number of StatsD packets received over Unixgram.",
 		},
+		[]string{"listener"},
 	)
-	tcpErrors = prometheus.NewCounter(
+	configLoads = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_connection_errors_total",
-			Help: "The number of errors encountered reading from TCP.",
+			Name: "statsd_exporter_config_reloads_total",
+			Help: "The number of configuration reloads.",
+		},
+		[]string{"outcome"},
+	)
+	mappingsCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_loaded_mappings",
+		Help: "The current number of configured metric mappings.",
+	})
+	mappingConfigInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_mapping_config_info",
+			Help: "Information about the loaded mapping config, with the config_version it declares.",
 		},
+		[]string{"version"},
 	)
-	tcpLineTooLong = prometheus.NewCounter(
+	eventsShed = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_too_long_lines_total",
-			Help: "The number of lines discarded due to being too long.",
+			Name: "statsd_exporter_events_shed_total",
+			Help: "The total number of StatsD events dropped for exceeding the byte budget of the event queue.",
 		},
 	)
-	unixgramPackets = prometheus.NewCounter(
+	eventsDropped = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_unixgram_packets_total",
-			Help: "The total number of StatsD packets received over Unixgram.",
+			Name: "statsd_exporter_event_queue_dropped_total",
+			Help: "The total number of StatsD events dropped because the event queue was full.",
 		},
 	)
-	linesReceived = prometheus.NewCounter(
+	eventQueueBlocked = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_lines_total",
-			Help: "The total number of StatsD lines received.",
+			Name: "statsd_exporter_event_queue_blocked_seconds_total",
+			Help: "The total time the listeners waited for room in the full event queue.",
 		},
 	)
-	samplesReceived = prometheus.NewCounter(
+	suppressedLabels = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_suppressed_labels",
+			Help: "Labels suppressed for exceeding the label cardinality limit, by metric.",
+		},
+		[]string{"metric", "label"},
+	)
+	candidateEvents = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_samples_total",
-			Help: "The total number of StatsD samples received.",
+			Name: "statsd_exporter_candidate_events_total",
+			Help: "The total number of StatsD events evaluated against the candidate mapping config.",
 		},
 	)
-	sampleErrors = prometheus.NewCounterVec(
+	candidateDivergences = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_sample_errors_total",
-			Help: "The total number of errors parsing StatsD samples.",
+			Name: "statsd_exporter_candidate_divergent_events_total",
+			Help: "The total number of StatsD events the candidate mapping config would handle differently, by the first difference found.",
 		},
 		[]string{"reason"},
 	)
-	tagsReceived = prometheus.NewCounter(
+	relayLines = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_tags_total",
-			Help: "The total number of DogStatsD tags processed.",
+			Name: "statsd_exporter_relay_lines_total",
+			Help: "The number of StatsD lines relayed, by target.",
 		},
+		[]string{"target"},
 	)
-	tagErrors = prometheus.NewCounter(
+	relayDropped = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_tag_errors_total",
-			Help: "The number of errors parsing DogStatsD tags.",
+			Name: "statsd_exporter_relay_dropped_lines_total",
+			Help: "The number of StatsD lines that could not be relayed, by target.",
 		},
+		[]string{"target"},
 	)
-	configLoads = prometheus.NewCounterVec(
+	relayFiltered = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_config_reloads_total",
-			Help: "The number of configuration reloads.",
+			Name: "statsd_exporter_relay_filtered_lines_total",
+			Help: "The number of StatsD lines not relayed because of the relay rules or their sample rate.",
 		},
-		[]string{"outcome"},
 	)
-	mappingsCount = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "statsd_exporter_loaded_mappings",
-		Help: "The current number of configured metric mappings.",
-	})
-	conflictingEventStats = prometheus.NewCounterVec(
+	relayErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_conflict_total",
-			Help: "The total number of StatsD events with conflicting names.",
+			Name: "statsd_exporter_relay_errors_total",
+			Help: "The number of errors sending relayed packets, by target.",
 		},
-		[]string{"type"},
+		[]string{"target"},
 	)
-	errorEventStats = prometheus.NewCounterVec(
+	clusterForwarded = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_error_total",
-			Help: "The total number of StatsD events discarded due to errors.",
+			Name: "statsd_exporter_cluster_forwarded_lines_total",
+			Help: "The number of StatsD lines forwarded to the exporter of the cluster responsible for them, by peer.",
 		},
-		[]string{"reason"},
+		[]string{"peer"},
 	)
-	eventsActions = prometheus.NewCounterVec(
+	clusterDropped = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_actions_total",
-			Help: "The total number of StatsD events by action.",
+			Name: "statsd_exporter_cluster_dropped_lines_total",
+			Help: "The number of StatsD lines that could not be forwarded, by peer.",
 		},
-		[]string{"action"},
+		[]string{"peer"},
 	)
-	metricsCount = prometheus.NewGaugeVec(
+	clusterErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_cluster_errors_total",
+			Help: "The number of errors sending forwarded packets, by peer.",
+		},
+		[]string{"peer"},
+	)
+	tenantEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tenant_events_total",
+			Help: "The number of events handled, by tenant.",
+		},
+		[]string{"tenant"},
+	)
+	tenantSeries = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "statsd_exporter_metrics_total",
-			Help: "The total number of metrics.",
+			Name: "statsd_exporter_tenant_series",
+			Help: "The number of series exported, by tenant.",
+		},
+		[]string{"tenant"},
+	)
+	tenantLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tenant_series_limited_events_total",
+			Help: "The number of events dropped because their tenant reached its series limit, by tenant.",
+		},
+		[]string{"tenant"},
+	)
+	eventsFiltered = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_filtered_total",
+			Help: "The number of events dropped by filter plugins.",
+		},
+	)
+	eventsClamped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_clamped_total",
+			Help: "The number of events whose values were clamped to the bounds of their mapping.",
+		},
+	)
+	labelValuesTruncated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_label_values_truncated_total",
+			Help: "The number of label values truncated because they were longer than the limit.",
 		},
-		[]string{"type"},
 	)
 )
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("statsd_exporter"))
-	prometheus.MustRegister(eventStats)
-	prometheus.MustRegister(eventsFlushed)
-	prometheus.MustRegister(eventsUnmapped)
-	prometheus.MustRegister(udpPackets)
-	prometheus.MustRegister(tcpConnections)
-	prometheus.MustRegister(tcpErrors)
-	prometheus.MustRegister(tcpLineTooLong)
+	prometheus.MustRegister(statsdMetrics.Collectors()...)
+	prometheus.MustRegister(sctpAssociations)
+	prometheus.MustRegister(sctpErrors)
+	prometheus.MustRegister(sctpLineTooLong)
 	prometheus.MustRegister(unixgramPackets)
-	prometheus.MustRegister(linesReceived)
-	prometheus.MustRegister(samplesReceived)
-	prometheus.MustRegister(sampleErrors)
-	prometheus.MustRegister(tagsReceived)
-	prometheus.MustRegister(tagErrors)
 	prometheus.MustRegister(configLoads)
 	prometheus.MustRegister(mappingsCount)
-	prometheus.MustRegister(conflictingEventStats)
-	prometheus.MustRegister(errorEventStats)
-	prometheus.MustRegister(eventsActions)
-	prometheus.MustRegister(metricsCount)
+	prometheus.MustRegister(mappingConfigInfo)
+	prometheus.MustRegister(suppressedLabels)
+	prometheus.MustRegister(eventsShed)
+	prometheus.MustRegister(eventsDropped)
+	prometheus.MustRegister(eventQueueBlocked)
+	prometheus.MustRegister(candidateEvents)
+	prometheus.MustRegister(candidateDivergences)
+	prometheus.MustRegister(relayLines)
+	prometheus.MustRegister(relayDropped)
+	prometheus.MustRegister(relayFiltered)
+	prometheus.MustRegister(relayErrors)
+	prometheus.MustRegister(clusterForwarded)
+	prometheus.MustRegister(clusterDropped)
+	prometheus.MustRegister(clusterErrors)
+	prometheus.MustRegister(tenantEvents)
+	prometheus.MustRegister(tenantSeries)
+	prometheus.MustRegister(tenantLimited)
+	prometheus.MustRegister(labelValuesTruncated)
+	prometheus.MustRegister(eventsClamped)
+	prometheus.MustRegister(eventsFiltered)
 }
 
 // uncheckedCollector wraps a Collector but its Describe method yields no Desc.
@@ -201,29 +302,41 @@ func (u uncheckedCollector) Collect(c chan<- prometheus.Metric) {
 	u.c.Collect(c)
 }
 
-func serveHTTP(mux http.Handler, listenAddress string, logger log.Logger) {
-	level.Error(logger).Log("msg", http.ListenAndServe(listenAddress, mux))
+func serveHTTP(mux http.Handler, l net.Listener, webConfig *web.Config, logger log.Logger) {
+	level.Error(logger).Log("msg", webConfig.Serve(l, mux))
 	os.Exit(1)
 }
 
-func sighupConfigReloader(fileName string, mapper *mapper.MetricMapper, cacheSize int, logger log.Logger, option mapper.CacheOption) {
+// pprofHandler serves the pprof profiles. Importing net/http/pprof also
+// registers them on http.DefaultServeMux, which the exporter does not serve.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func sighupConfigReloader(source mappingSource, mapper *mapper.MetricMapper, cacheSize int, logger log.Logger, options ...mapper.CacheOption) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGHUP)
 
 	for s := range signals {
-		if fileName == "" {
+		if source.fileName == "" {
 			level.Warn(logger).Log("msg", "Received signal but no mapping config to reload", "signal", s)
 			continue
 		}
 
 		level.Info(logger).Log("msg", "Received signal, attempting reload", "signal", s)
 
-		reloadConfig(fileName, mapper, cacheSize, logger, option)
+		reloadConfig(source, mapper, cacheSize, logger, options...)
 	}
 }
 
-func reloadConfig(fileName string, mapper *mapper.MetricMapper, cacheSize int, logger log.Logger, option mapper.CacheOption) {
-	err := mapper.InitFromFile(fileName, cacheSize, option)
+func reloadConfig(source mappingSource, mapper *mapper.MetricMapper, cacheSize int, logger log.Logger, options ...mapper.CacheOption) {
+	err := source.load(mapper, cacheSize, options...)
 	if err != nil {
 		level.Info(logger).Log("msg", "Error reloading config", "error", err)
 		configLoads.WithLabelValues("failure").Inc()
@@ -233,6 +346,227 @@ func reloadConfig(fileName string, mapper *mapper.MetricMapper, cacheSize int, l
 	}
 }
 
+const (
+	defaultTemporaryMappingDuration = time.Hour
+	maxTemporaryMappingDuration     = 24 * time.Hour
+)
+
+// temporaryMappingsHandler adds a temporary mapping from the YAML request body
+// on POST or PUT, for the optional "duration", and lists the temporary
+// mappings on GET.
+func temporaryMappingsHandler(mapper *mapper.MetricMapper, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut:
+			d := defaultTemporaryMappingDuration
+			if v := r.FormValue("duration"); v != "" {
+				var err error
+				if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+					http.Error(w, fmt.Sprintf("invalid duration %q", v), http.StatusBadRequest)
+					return
+				}
+			}
+			if d > maxTemporaryMappingDuration {
+				d = maxTemporaryMappingDuration
+			}
+			config, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			expires := time.Now().Add(d)
+			if err := mapper.AddTemporaryMapping(string(config), expires); err != nil {
+				http.Error(w, fmt.Sprintf("invalid mapping: %v", err), http.StatusBadRequest)
+				return
+			}
+			level.Info(logger).Log("msg", "Added temporary mapping", "expires", expires)
+			fmt.Fprintf(w, "Added temporary mapping until %s\n", expires.Format(time.RFC3339))
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(mapper.TemporaryMappings())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// newRuntimeSampler registers the runtime sampling metrics. drops may be nil
+// if there is no UDP listener to correlate with.
+func newRuntimeSampler(interval time.Duration, window int, drops func() (uint64, error), logger log.Logger) *runtimestats.Sampler {
+	buckets := prometheus.ExponentialBuckets(0.00001, 4, 10)
+	schedulerLatency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "statsd_exporter_scheduler_latency_seconds",
+		Help:    "How late the runtime sampler ran after its ticker fired.",
+		Buckets: buckets,
+	})
+	gcPauses := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "statsd_exporter_gc_pause_seconds",
+		Help:    "The stop-the-world pauses of the garbage collector seen by the runtime sampler.",
+		Buckets: buckets,
+	})
+	prometheus.MustRegister(schedulerLatency, gcPauses)
+
+	sampler := &runtimestats.Sampler{
+		Interval:         interval,
+		Window:           window,
+		Drops:            drops,
+		Logger:           logger,
+		SchedulerLatency: schedulerLatency,
+		GCPauses:         gcPauses,
+	}
+	if drops != nil {
+		sampler.DropsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "statsd_exporter_udp_receive_drops_total",
+			Help: "The number of datagrams the kernel dropped on the UDP socket since the exporter started.",
+		})
+		sampler.Correlation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "statsd_exporter_udp_drop_correlation",
+			Help: "The correlation coefficient of a runtime signal with UDP drops per sample interval over the correlation window.",
+		}, []string{"signal"})
+		prometheus.MustRegister(sampler.DropsTotal, sampler.Correlation)
+	}
+	return sampler
+}
+
+// fsmHandler dumps the FSM of the current mapping config in the format of the
+// "format" parameter: dot (the default), json or mermaid.
+func fsmHandler(m *mapper.MetricMapper) http.HandlerFunc {
+	contentTypes := map[string]string{
+		mapper.FSMFormatDot:     "text/vnd.graphviz",
+		mapper.FSMFormatJSON:    "application/json",
+		mapper.FSMFormatMermaid: "text/plain; charset=utf-8",
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.FormValue("format")
+		if format == "" {
+			format = mapper.FSMFormatDot
+		}
+		contentType, ok := contentTypes[format]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := m.DumpFSM(&buf, format); err != nil {
+			status := http.StatusInternalServerError
+			if err == mapper.ErrNoFSM {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(buf.Bytes())
+	}
+}
+
+// cardinalityHandler reports the metrics with the most series and the labels
+// with the most distinct values as JSON. The "limit" parameter sets how many
+// of each are listed.
+func cardinalityHandler(g prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := exporter.DefaultCardinalityReportLimit
+		if l := r.FormValue("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", l), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		report, err := exporter.ReportCardinality(g, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// activeMappingsHandler serves the loaded mapping config, with the hit count
+// of every mapping, as JSON.
+func activeMappingsHandler(m *mapper.MetricMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Only GET requests list the mappings", http.StatusMethodNotAllowed)
+			return
+		}
+		config, err := m.ActiveConfig()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+	}
+}
+
+// seriesHandler lists the series of the metric in the "metric" parameter, or
+// of all metrics, with their TTLs and when they were last updated, as JSON.
+func seriesHandler(ex *exporter.Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metricName := r.FormValue("metric")
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		var series []registry.Series
+		if err := ex.Run(ctx, func() { series = ex.Registry.Series(metricName) }); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(series)
+	}
+}
+
+// deleteSeriesHandler removes the series of the metric in the "metric"
+// parameter that have the label values of the "labels" parameters, given as
+// comma-separated name=value pairs, or all series of the metric without
+// "labels". It responds with the number of deleted series as JSON.
+func deleteSeriesHandler(ex *exporter.Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "Only DELETE requests delete series", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metricName := r.Form.Get("metric")
+		if metricName == "" {
+			http.Error(w, "missing metric parameter", http.StatusBadRequest)
+			return
+		}
+		labels := prometheus.Labels{}
+		for _, param := range r.Form["labels"] {
+			for _, pair := range strings.Split(param, ",") {
+				nameValue := strings.SplitN(pair, "=", 2)
+				if len(nameValue) != 2 || nameValue[0] == "" {
+					http.Error(w, fmt.Sprintf("invalid label %q, expected name=value", pair), http.StatusBadRequest)
+					return
+				}
+				labels[nameValue[0]] = nameValue[1]
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		var deleted int
+		if err := ex.Run(ctx, func() { deleted = ex.Registry.DeleteSeries(metricName, labels) }); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+	}
+}
+
 func dumpFSM(mapper *mapper.MetricMapper, dumpFilename string, logger log.Logger) error {
 	f, err := os.Create(dumpFilename)
 	if err != nil {
@@ -247,64 +581,462 @@ func dumpFSM(mapper *mapper.MetricMapper, dumpFilename string, logger log.Logger
 	return nil
 }
 
+func migrateConfig(fileName, outputFileName string) error {
+	in, err := mapper.ReadConfigFile(fileName)
+	if err != nil {
+		return err
+	}
+	out, err := mapper.MigrateConfig([]byte(in))
+	if err != nil {
+		return err
+	}
+	if outputFileName == "" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	return ioutil.WriteFile(outputFileName, out, 0644)
+}
+
+// newTenantResolver builds the resolver of the tenancy flags.
+func newTenantResolver(networks, ports []string, tag, defaultTenant, label string) (*tenant.Resolver, error) {
+	if !model.LabelName(label).IsValid() {
+		return nil, fmt.Errorf("invalid tenant label %q", label)
+	}
+	r := &tenant.Resolver{Label: label, Tag: tag, Default: defaultTenant}
+	for _, n := range networks {
+		rule, err := tenant.ParseNetworkRule(n)
+		if err != nil {
+			return nil, err
+		}
+		r.Rules = append(r.Rules, rule)
+	}
+	for _, p := range ports {
+		rule, err := tenant.ParsePortRule(p)
+		if err != nil {
+			return nil, err
+		}
+		r.Rules = append(r.Rules, rule)
+	}
+	return r, nil
+}
+
+// listenerLabels identifies a listener in the labels of its metrics, so
+// that traffic and errors can be attributed to it.
+func listenerLabels(proto, address string) prometheus.Labels {
+	return prometheus.Labels{"listener": proto + "://" + address}
+}
+
+// shutdown stops accepting StatsD traffic and waits for the queued events to be
+// handled, up to drainTimeout, and then for the grace period so that a final
+// scrape can pick them up. Another signal skips the waiting.
+func shutdown(listeners []io.Closer, eventQueue *event.EventQueue, listenDone <-chan struct{}, drainTimeout, gracePeriod time.Duration, signals <-chan os.Signal, logger log.Logger) {
+	if drainTimeout > 0 {
+		level.Info(logger).Log("msg", "Draining queued events", "timeout", drainTimeout)
+		for _, l := range listeners {
+			l.Close()
+		}
+		eventQueue.Close()
+
+		select {
+		case <-listenDone:
+			level.Info(logger).Log("msg", "Drained queued events")
+		case <-time.After(drainTimeout):
+			level.Warn(logger).Log("msg", "Timed out draining queued events")
+		case sig := <-signals:
+			level.Warn(logger).Log("msg", "Received os signal, not waiting for queued events", "signal", sig.String())
+			return
+		}
+	}
+
+	if gracePeriod > 0 {
+		level.Info(logger).Log("msg", "Waiting for a final scrape", "grace_period", gracePeriod)
+		select {
+		case <-time.After(gracePeriod):
+		case sig := <-signals:
+			level.Warn(logger).Log("msg", "Received os signal, not waiting for a final scrape", "signal", sig.String())
+		}
+	}
+}
+
+// warmCache looks up the metrics saved in the mapping cache of the previous
+// run. A missing file is not an error, as there is none on the first start.
+func warmCache(mapper *mapper.MetricMapper, fileName string, logger log.Logger) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Warn(logger).Log("msg", "Unable to warm the mapping cache", "file", fileName, "error", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	count, err := mapper.WarmCache(f)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Unable to warm the mapping cache", "file", fileName, "error", err)
+	}
+	level.Info(logger).Log("msg", "Warmed the mapping cache", "file", fileName, "entries", count)
+}
+
+// saveCache saves the metrics in the mapping cache for the next run. The file
+// is replaced atomically, so that an interrupted save keeps the previous one.
+func saveCache(mapper *mapper.MetricMapper, fileName string, logger log.Logger) {
+	tmpFile := fileName + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error saving the mapping cache", "file", fileName, "error", err)
+		return
+	}
+	count, err := mapper.SaveCache(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		level.Error(logger).Log("msg", "Error saving the mapping cache", "file", fileName, "error", err)
+		return
+	}
+	level.Info(logger).Log("msg", "Saved the mapping cache", "file", fileName, "entries", count)
+}
+
+// newCluster returns the relay that forwards lines to the exporters of the
+// cluster responsible for them.
+func newCluster(peers []string, self string, packetLength int, logger log.Logger) (*relay.Relay, error) {
+	found := false
+	for _, peer := range peers {
+		found = found || peer == self
+	}
+	if !found {
+		return nil, fmt.Errorf("the cluster listen address %q is not among the peers", self)
+	}
+	cluster, err := relay.NewRelay(peers, relay.ModeHash, packetLength, logger, clusterForwarded, clusterDropped, clusterErrors)
+	if err != nil {
+		return nil, err
+	}
+	cluster.Self = self
+	return cluster, nil
+}
+
+// startHA exports the metrics translated from StatsD only while this exporter
+// holds the HA lease. The returned function releases the lease.
+func startHA(reg *registry.Registry, leaseName, identity string, leaseDuration time.Duration, logger log.Logger) func() {
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			level.Error(logger).Log("msg", "unable to get the hostname for the HA identity", "error", err)
+			os.Exit(1)
+		}
+		identity = hostname
+	}
+	elector, err := ha.NewInClusterElector(leaseName, identity, leaseDuration, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "unable to set up the HA lease", "error", err)
+		os.Exit(1)
+	}
+
+	haActive := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_ha_active",
+		Help: "Whether this exporter holds the HA lease and exports the metrics translated from StatsD.",
+	})
+	prometheus.MustRegister(haActive)
+	reg.SetHidden(true)
+	elector.OnChange = func(active bool) {
+		reg.SetHidden(!active)
+		if active {
+			haActive.Set(1)
+		} else {
+			haActive.Set(0)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		elector.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// restoreState restores the counters and gauges saved on the shutdown of the
+// previous run. A missing file is not an error, as there is none on the first
+// start.
+func restoreState(exporter *exporter.Exporter, fileName string, logger log.Logger) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Warn(logger).Log("msg", "Unable to restore the metric state", "file", fileName, "error", err)
+		}
+		return
+	}
+	var state registry.State
+	if err := json.Unmarshal(content, &state); err != nil {
+		level.Warn(logger).Log("msg", "Unable to restore the metric state", "file", fileName, "error", err)
+		return
+	}
+	count := exporter.RestoreState(state)
+	level.Info(logger).Log("msg", "Restored the metric state", "file", fileName, "series", count, "saved_at", state.SavedAt)
+}
+
+// saveState saves the counters and gauges for the next run. The registry is
+// read on the goroutine that handles events, or directly once the exporter
+// stopped listening. The file is replaced atomically, so that an interrupted
+// save keeps the previous one.
+func saveState(exporter *exporter.Exporter, listenDone <-chan struct{}, fileName string, logger log.Logger) {
+	var state registry.State
+	snapshot := func() {
+		state = exporter.Registry.Snapshot()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		select {
+		case <-listenDone:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := exporter.Run(ctx, snapshot); err != nil {
+		select {
+		case <-listenDone:
+			snapshot()
+		default:
+			level.Error(logger).Log("msg", "Error saving the metric state", "file", fileName, "error", err)
+			return
+		}
+	}
+
+	out, err := json.Marshal(state)
+	if err == nil {
+		tmpFile := fileName + ".tmp"
+		if err = ioutil.WriteFile(tmpFile, out, 0644); err == nil {
+			err = os.Rename(tmpFile, fileName)
+		}
+		if err != nil {
+			os.Remove(tmpFile)
+		}
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "Error saving the metric state", "file", fileName, "error", err)
+		return
+	}
+	level.Info(logger).Log("msg", "Saved the metric state", "file", fileName, "series", len(state.Series))
+}
+
+func writeShutdownReport(fileName string, report exporter.ShutdownReport) error {
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, out, 0644)
+}
+
 func main() {
+	kingpin.Command("run", "Run the exporter. This is the default command.").Default()
+
 	var (
+		_                    = kingpin.Flag(configFileFlag, "Path to a YAML file setting the defaults of these flags, and optionally holding the mapping config in its mapping section.").Default("").String()
 		listenAddress        = kingpin.Flag("web.listen-address", "The address on which to expose the web interface and generated Prometheus metrics.").Default(":9102").String()
+		webConfigFile        = kingpin.Flag("web.config", "Path to a configuration file that enables TLS and authentication of the web interface.").Default("").String()
 		enableLifecycle      = kingpin.Flag("web.enable-lifecycle", "Enable shutdown and reload via HTTP request.").Default("false").Bool()
+		enableAdminAPI       = kingpin.Flag("web.enable-admin-api", "Enable the API to delete series. Requires authentication of the admin endpoint group in --web.config.").Default("false").Bool()
+		enableDebugAPI       = kingpin.Flag("web.enable-debug-api", "Serve the debug endpoints /debug/fsm, /debug/cardinality, /debug/series and /api/v1/mappings, which expose the mapping config and the series.").Default("false").Bool()
+		enablePprof          = kingpin.Flag("web.enable-pprof", "Serve the pprof profiles on /debug/pprof/ of the web interface.").Default("false").Bool()
+		pprofAddress         = kingpin.Flag("web.pprof-address", "Address to serve the pprof profiles on /debug/pprof/ on, separately from the web interface and without its web config. \"\" disables it.").Default("").String()
+		enableEventStream    = kingpin.Flag("web.enable-event-stream", "Enable streaming of handled events as Server-Sent Events on /debug/events/stream.").Default("false").Bool()
 		metricsEndpoint      = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+		selfMetricsAddress   = kingpin.Flag("web.self-metrics-address", "Address to expose the exporter's own metrics on, apart from the metrics translated from StatsD. \"\" exposes them together.").Default("").String()
+		selfMetricsPath      = kingpin.Flag("web.self-metrics-path", "Path under which to expose the exporter's own metrics on the self-metrics address.").Default("/metrics").String()
+		omitDefaultHelp      = kingpin.Flag("web.omit-default-help", "Omit the HELP text of metrics that use the autogenerated help text.").Default("false").Bool()
+		enableOpenMetrics    = kingpin.Flag("web.enable-openmetrics", "Serve the OpenMetrics format, which includes exemplars, to scrapers that request it.").Default("false").Bool()
 		statsdListenUDP      = kingpin.Flag("statsd.listen-udp", "The UDP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
 		statsdListenTCP      = kingpin.Flag("statsd.listen-tcp", "The TCP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
+		statsdListenSCTP     = kingpin.Flag("statsd.listen-sctp", "The SCTP address on which to receive statsd metric lines. \"\" disables it. Only supported on Linux.").Default("").String()
 		statsdListenUnixgram = kingpin.Flag("statsd.listen-unixgram", "The Unixgram socket path to receive statsd metric lines in datagram. \"\" disables it.").Default("").String()
 		// not using Int here because flag displays default in decimal, 0755 will show as 493
 		statsdUnixSocketMode = kingpin.Flag("statsd.unixsocket-mode", "The permission mode of the unix socket.").Default("755").String()
+		unixgramOriginLabel  = kingpin.Flag("statsd.unixgram-origin-label", "Label to add the client that sent each line over Unixgram as, the ID of its container or the name of its process. \"\" disables it. Only supported on Linux.").Default("").String()
 		mappingConfig        = kingpin.Flag("statsd.mapping-config", "Metric mapping configuration file name.").String()
+		candidateConfig      = kingpin.Flag("statsd.candidate-mapping-config", "Mapping configuration file to evaluate in shadow of the active one, without changing the exported metrics.").Default("").String()
 		readBuffer           = kingpin.Flag("statsd.read-buffer", "Size (in bytes) of the operating system's transmit read buffer associated with the UDP or Unixgram connection. Please make sure the kernel parameters net.core.rmem_max is set to a value greater than the value specified.").Int()
-		cacheSize            = kingpin.Flag("statsd.cache-size", "Maximum size of your metric mapping cache. Relies on least recently used replacement policy if max size is reached.").Default("1000").Int()
+		cacheSize            = kingpin.Flag("statsd.cache-size", "Maximum number of entries in your metric mapping cache. Relies on least recently used replacement policy if max size is reached.").Default("1000").Int()
 		cacheType            = kingpin.Flag("statsd.cache-type", "Metric mapping cache type. Valid options are \"lru\" and \"random\"").Default("lru").Enum("lru", "random")
+		localCacheSize       = kingpin.Flag("statsd.local-cache-size", "Maximum number of matches to hold in a cache local to the event handler, in front of the shared mapping cache. 0 disables it.").Default("0").Int()
+		cacheMissTTL         = kingpin.Flag("statsd.cache-miss-ttl", "How long to cache lookups that did not match any mapping. 0 caches them as long as matches.").Default("0s").Duration()
+		cachePersistPath     = kingpin.Flag("statsd.cache-persist-path", "The file to save the metric names in the mapping cache to on shutdown, and to warm the cache from on startup. \"\" disables it.").Default("").String()
+		stateFile            = kingpin.Flag("statsd.state-file", "The file to save the counter and gauge values to on shutdown, and to restore them from on startup. \"\" disables it.").Default("").String()
 		eventQueueSize       = kingpin.Flag("statsd.event-queue-size", "Size of internal queue for processing events.").Default("10000").Int()
 		eventFlushThreshold  = kingpin.Flag("statsd.event-flush-threshold", "Number of events to hold in queue before flushing.").Default("1000").Int()
 		eventFlushInterval   = kingpin.Flag("statsd.event-flush-interval", "Maximum time between event queue flushes.").Default("200ms").Duration()
+		eventQueueBytes      = kingpin.Flag("statsd.event-queue-bytes", "Approximate maximum memory of queued events, in bytes. 0 disables the limit.").Default("0").Int64()
+		eventShedPolicy      = kingpin.Flag("statsd.event-shed-policy", "What to do with events exceeding the event queue bytes. Valid options are \"drop-newest\", \"drop-oldest\" and \"block\".").Default("drop-newest").Enum(string(event.ShedDropNewest), string(event.ShedDropOldest), string(event.ShedBlock))
+		eventQueueOverflow   = kingpin.Flag("statsd.event-queue-overflow", "What to do with events when the event queue is full. Valid options are \"block\", \"drop-newest\" and \"drop-oldest\".").Default("block").Enum(string(event.ShedBlock), string(event.ShedDropNewest), string(event.ShedDropOldest))
+		dropUnmapped         = kingpin.Flag("statsd.drop-unmapped", "Drop events that do not match any mapping instead of exporting them under their escaped StatsD name.").Default("false").Bool()
+		cardinalityLimit     = kingpin.Flag("statsd.label-cardinality-limit", "Maximum number of distinct values of a label per metric. Labels exceeding it are suppressed. 0 disables the limit.").Default("0").Int()
+		cardinalityAction    = kingpin.Flag("statsd.label-cardinality-action", "How to suppress labels exceeding the cardinality limit. Valid options are \"drop\" and \"hash\".").Default("drop").Enum("drop", "hash")
+		conflictPolicy       = kingpin.Flag("statsd.conflict-policy", "What to do with events whose metric name is already registered with another type. Valid options are \"reject\", \"replace\" and \"suffix\".").Default(string(registry.ConflictReject)).Enum(string(registry.ConflictReject), string(registry.ConflictReplace), string(registry.ConflictSuffix))
+		eventMaxAge          = kingpin.Flag("statsd.event-max-age", "Drop events that were received longer ago than this when they are handled, for example after a stall. 0 disables the limit.").Default("0s").Duration()
+		aggregationInterval  = kingpin.Flag("statsd.aggregation-interval", "Aggregate the events of each metric and apply them once per interval. 0 applies every event as it is received.").Default("0s").Duration()
+		createdTimestamps    = kingpin.Flag("statsd.created-timestamps", "Export the time each counter and histogram series was first seen as a <name>_created gauge.").Default("false").Bool()
+		exemplars            = kingpin.Flag("statsd.exemplars", "Attach the trace_id and span_id tags of timers and histograms to histogram observations as exemplars instead of labels.").Default("false").Bool()
+		tenantNetworks       = kingpin.Flag("statsd.tenant.network", "Assign the events from a network to a tenant, as tenant=cidr. Can be repeated; the first matching rule wins.").Strings()
+		tenantPorts          = kingpin.Flag("statsd.tenant.port", "Assign the events received on a listener port to a tenant, as tenant=port. Can be repeated; the first matching rule wins.").Strings()
+		tenantTag            = kingpin.Flag("statsd.tenant.tag", "Tag holding the tenant of events that match no network or port rule.").Default("").String()
+		tenantDefault        = kingpin.Flag("statsd.tenant.default", "Tenant of events that match no rule and have no tenant tag. \"\" leaves them without tenant.").Default("").String()
+		tenantLabel          = kingpin.Flag("statsd.tenant.label", "Label to export the tenant of series in.").Default(tenant.DefaultLabel).String()
+		tenantMaxSeries      = kingpin.Flag("statsd.tenant.max-series", "Maximum number of series of each tenant. 0 disables the limit.").Default("0").Int()
+		sourceLabel          = kingpin.Flag("statsd.source-label", "Label to add the address of the host that sent each line over UDP, TCP or SCTP as. \"\" disables it.").Default("").String()
+		sourceNames          = kingpin.Flag("statsd.source-names", "YAML file mapping IP addresses or CIDR networks to the names to export as the source label instead of the address.").Default("").String()
+		filterPlugins        = kingpin.Flag("filter.plugin", "Go plugin to load a filter from, that may modify or drop every event before it is mapped. Can be repeated; the filters are applied in order.").Strings()
+		nameEscaping         = kingpin.Flag("statsd.name-escaping", "How to handle characters that are invalid in Prometheus metric names. Valid options are \"underscores\", \"dots\", \"values\" and \"drop\".").Default(string(mapper.EscapeUnderscores)).Enum(string(mapper.EscapeUnderscores), string(mapper.EscapeDots), string(mapper.EscapeValues), string(mapper.EscapeDrop))
+		rateWindow           = kingpin.Flag("statsd.rate-window", "Window the rates of the counters of mappings with emit_rate are computed over.").Default(exporter.DefaultRateWindow.String()).Duration()
+		maxLabelValueLength  = kingpin.Flag("statsd.max-label-value-length", "Truncate label values longer than this many bytes, ending them with a hash of the whole value. 0 disables the limit.").Default("0").Int()
+		staticLabelFlags     = kingpin.Flag("statsd.static-label", "Label to add to every series exported from StatsD, as name=value. Can be repeated. Also read from STATSD_EXPORTER_LABEL_<name> environment variables.").StringMap()
+		relayAddresses       = kingpin.Flag("statsd.relay.address", "The UDP address to relay the received StatsD lines to. Can be repeated.").Strings()
+		relayMode            = kingpin.Flag("statsd.relay.mode", "How to relay lines to multiple addresses. Valid options are \"fanout\", which sends every line to every address, and \"hash\", which sends the lines of each metric to one address.").Default(string(relay.ModeFanout)).Enum(string(relay.ModeFanout), string(relay.ModeHash))
+		relayPacketLength    = kingpin.Flag("statsd.relay.packet-length", "Maximum length of the packets relayed lines are batched into.").Default("1400").Int()
+		clusterPeers         = kingpin.Flag("cluster.peer", "The cluster address of an exporter of the cluster, including this one. Can be repeated. The lines of the metrics other exporters are responsible for are forwarded to them.").Strings()
+		clusterListen        = kingpin.Flag("cluster.listen-address", "The UDP address to receive the lines forwarded by the other exporters of the cluster on. It must be one of the --cluster.peer addresses, as given there.").Default("").String()
+		drainTimeout         = kingpin.Flag("shutdown.drain-timeout", "On shutdown, stop the listeners and wait up to this long for queued events to be handled. 0 exits without handling them.").Default("0s").Duration()
+		gracePeriod          = kingpin.Flag("shutdown.grace-period", "On shutdown, keep serving metrics for this long after draining events, to allow a final scrape.").Default("0s").Duration()
+		upgradeTimeout       = kingpin.Flag("upgrade.timeout", "On a hot upgrade, wait up to this long for the new process to check its configuration and to take over the sockets.").Default("30s").Duration()
+		haLeaseName          = kingpin.Flag("ha.lease-name", "The name of the Kubernetes Lease that elects which exporter of a pair receiving mirrored traffic exports the metrics. \"\" disables it.").Default("").String()
+		haIdentity           = kingpin.Flag("ha.identity", "The identity of this exporter in the HA lease. Defaults to the hostname.").Default("").String()
+		haLeaseDuration      = kingpin.Flag("ha.lease-duration", "How long the HA lease is valid without being renewed, after which another exporter takes over.").Default("15s").Duration()
+		runtimeInterval      = kingpin.Flag("runtime.sample-interval", "How often to sample scheduler latency, GC pauses and UDP drops. 0 disables the sampling.").Default("0s").Duration()
+		correlationWindow    = kingpin.Flag("runtime.correlation-window", "Number of samples to correlate GC pauses and scheduler latency with UDP drops over.").Default("60").Int()
+		remoteWriteURL       = kingpin.Flag("remote-write.url", "URL of a Prometheus remote write endpoint to push the exported metrics to. \"\" disables pushing.").Default("").String()
+		remoteWriteInterval  = kingpin.Flag("remote-write.interval", "How often to push the exported metrics.").Default("15s").Duration()
+		remoteWriteRetries   = kingpin.Flag("remote-write.retries", "How often to retry a push that failed with a network or server error.").Default("3").Int()
+		remoteWriteWALDir    = kingpin.Flag("remote-write.wal-dir", "Directory to keep pushes that failed after all retries in until they can be sent. \"\" discards them.").Default("").String()
+		remoteWriteWALBytes  = kingpin.Flag("remote-write.wal-max-bytes", "Maximum size of the pushes kept in the WAL. The oldest are dropped beyond it.").Default("16777216").Int64()
+		graphiteAddress      = kingpin.Flag("graphite.address", "Address of a Graphite/Carbon plaintext listener to write the exported metrics to. \"\" disables writing.").Default("").String()
+		graphiteInterval     = kingpin.Flag("graphite.interval", "How often to write the exported metrics to Graphite.").Default("10s").Duration()
+		graphitePrefix       = kingpin.Flag("graphite.prefix", "Prefix of the metric names written to Graphite.").Default("").String()
+		shutdownReport       = kingpin.Flag("debug.shutdown-report", "The path to write a JSON report of processed, dropped and unprocessed events to on shutdown. \"\" only logs the report.").Default("").String()
 		dumpFSMPath          = kingpin.Flag("debug.dump-fsm", "The path to dump internal FSM generated for glob matching as Dot file.").Default("").String()
 		checkConfig          = kingpin.Flag("check-config", "Check configuration and exit.").Default("false").Bool()
 		dogstatsdTagsEnabled = kingpin.Flag("statsd.parse-dogstatsd-tags", "Parse DogStatsd style tags. Enabled by default.").Default("true").Bool()
 		influxdbTagsEnabled  = kingpin.Flag("statsd.parse-influxdb-tags", "Parse InfluxDB style tags. Enabled by default.").Default("true").Bool()
 		libratoTagsEnabled   = kingpin.Flag("statsd.parse-librato-tags", "Parse Librato style tags. Enabled by default.").Default("true").Bool()
 		signalFXTagsEnabled  = kingpin.Flag("statsd.parse-signalfx-tags", "Parse SignalFX style tags. Enabled by default.").Default("true").Bool()
+		tagKeyPolicy         = kingpin.Flag("statsd.tag-key-policy", "How to handle tag keys that are not valid label names. Valid options are \"prefix\", which escapes them, and \"drop\", which drops the tags and counts them as tag errors.").Default(string(line.TagKeysPrefix)).Enum(string(line.TagKeysPrefix), string(line.TagKeysDrop))
+
+		migrateCmd    = kingpin.Command("migrate-config", "Upgrade a mapping config file to the latest schema version.")
+		migrateInput  = migrateCmd.Arg("file", "Mapping config file to upgrade.").Required().ExistingFile()
+		migrateOutput = migrateCmd.Flag("output", "File to write the upgraded config to. Defaults to stdout.").Short('o').String()
+
+		diffCmd    = kingpin.Command("diff-config", "Report how a sample of StatsD metrics would be handled differently by two mapping configs.")
+		diffOld    = diffCmd.Arg("old", "Current mapping config file.").Required().ExistingFile()
+		diffNew    = diffCmd.Arg("new", "New mapping config file.").Required().ExistingFile()
+		diffSample = diffCmd.Flag("sample", "File with StatsD lines or metric names, one per line. Defaults to stdin.").String()
 	)
 
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.Version(version.Print("statsd_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	configFile := configFileFromArgs(os.Args[1:])
+	var inlineMapping string
+	if configFile != "" {
+		var err error
+		inlineMapping, err = applyConfigFile(kingpin.CommandLine, configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config file %s: %v\n", configFile, err)
+			os.Exit(1)
+		}
+	}
+	command := kingpin.Parse()
 	logger := promlog.New(promlogConfig)
-
-	parser := line.NewParser()
-	if *dogstatsdTagsEnabled {
-		parser.EnableDogstatsdParsing()
+	escapingScheme := mapper.EscapingScheme(*nameEscaping)
+	if *maxLabelValueLength != 0 && *maxLabelValueLength < exporter.MinLabelValueLength {
+		level.Error(logger).Log("msg", "the maximum label value length is too small", "min", exporter.MinLabelValueLength)
+		os.Exit(1)
 	}
-	if *influxdbTagsEnabled {
-		parser.EnableInfluxdbParsing()
+
+	source := mappingSource{fileName: *mappingConfig}
+	if source.fileName == "" && inlineMapping != "" {
+		source = mappingSource{fileName: configFile, section: true}
 	}
-	if *libratoTagsEnabled {
-		parser.EnableLibratoParsing()
+
+	parser := exporter.NewParser(exporter.TagFormats{
+		DogStatsD: *dogstatsdTagsEnabled,
+		InfluxDB:  *influxdbTagsEnabled,
+		Librato:   *libratoTagsEnabled,
+		SignalFX:  *signalFXTagsEnabled,
+	})
+	parser.TagKeys = line.TagKeyPolicy(*tagKeyPolicy)
+
+	if command == migrateCmd.FullCommand() {
+		if err := migrateConfig(*migrateInput, *migrateOutput); err != nil {
+			level.Error(logger).Log("msg", "error migrating config", "file_name", *migrateInput, "error", err)
+			os.Exit(1)
+		}
+		return
 	}
-	if *signalFXTagsEnabled {
-		parser.EnableSignalFXParsing()
+
+	if command == diffCmd.FullCommand() {
+		sample := os.Stdin
+		if *diffSample != "" {
+			f, err := os.Open(*diffSample)
+			if err != nil {
+				level.Error(logger).Log("msg", "error opening sample", "file_name", *diffSample, "error", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			sample = f
+		}
+		if _, err := diffConfig(*diffOld, *diffNew, sample, parser, os.Stdout); err != nil {
+			level.Error(logger).Log("msg", "error comparing configs", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	cacheOption := mapper.WithCacheType(*cacheType)
+	cacheOptions := []mapper.CacheOption{mapper.WithCacheType(*cacheType), mapper.WithMissTTL(*cacheMissTTL)}
 
 	level.Info(logger).Log("msg", "Starting StatsD -> Prometheus Exporter", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "context", version.BuildContext())
 
 	events := make(chan event.Events, *eventQueueSize)
-	defer close(events)
 	eventQueue := event.NewEventQueue(events, *eventFlushThreshold, *eventFlushInterval, eventsFlushed)
+	eventQueue.Overflow = event.ShedPolicy(*eventQueueOverflow)
+	eventQueue.Dropped = eventsDropped
+	eventQueue.Blocked = eventQueueBlocked
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_event_queue_length",
+			Help: "The number of batches of StatsD events waiting for the exporter.",
+		},
+		func() float64 { return float64(len(events)) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_event_queue_capacity",
+			Help: "The maximum number of batches of StatsD events that can wait for the exporter.",
+		},
+		func() float64 { return float64(cap(events)) },
+	))
+	if *eventQueueBytes > 0 {
+		budget := event.NewByteBudget(*eventQueueBytes, event.ShedPolicy(*eventShedPolicy), eventsShed)
+		eventQueue.Budget = budget
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_event_queue_bytes",
+				Help: "The approximate memory of the StatsD events waiting to be handled.",
+			},
+			func() float64 { return float64(budget.Bytes()) },
+		))
+	}
 
-	mapper := &mapper.MetricMapper{Registerer: prometheus.DefaultRegisterer, MappingsCount: mappingsCount}
-	if *mappingConfig != "" {
-		err := mapper.InitFromFile(*mappingConfig, *cacheSize, cacheOption)
+	mapper := &mapper.MetricMapper{Registerer: prometheus.DefaultRegisterer, Logger: logger, MappingsCount: mappingsCount, ConfigInfo: mappingConfigInfo}
+	if source.fileName != "" {
+		err := source.load(mapper, *cacheSize, cacheOptions...)
 		if err != nil {
 			level.Error(logger).Log("msg", "error loading config", "error", err)
 			os.Exit(1)
@@ -319,35 +1051,182 @@ func main() {
 			}
 		}
 	} else {
-		mapper.InitCache(*cacheSize, cacheOption)
+		mapper.InitCache(*cacheSize, cacheOptions...)
+	}
+	if *cachePersistPath != "" {
+		warmCache(mapper, *cachePersistPath, logger)
+	}
+
+	webConfig, err := web.LoadConfig(*webConfigFile)
+	if err != nil {
+		level.Error(logger).Log("msg", "error loading web config", "error", err)
+		os.Exit(1)
+	}
+	if *enableAdminAPI && !webConfig.Authenticates(web.GroupAdmin) {
+		level.Error(logger).Log("msg", "the admin API requires authentication of the admin endpoint group in the web config")
+		os.Exit(1)
 	}
 
-	exporter := exporter.NewExporter(prometheus.DefaultRegisterer, mapper, logger, eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	tracer := &exporter.EventTracer{}
+	var cardinality *exporter.CardinalityLimiter
+	if *cardinalityLimit > 0 {
+		cardinality = exporter.NewCardinalityLimiter(*cardinalityLimit, *cardinalityAction == "hash", suppressedLabels)
+	}
+	candidate := &exporter.Candidate{
+		Active:       mapper,
+		CacheSize:    *cacheSize,
+		CacheOptions: cacheOptions,
+		Events:       candidateEvents,
+		Divergences:  candidateDivergences,
+	}
+	if *candidateConfig != "" {
+		if err := candidate.LoadFile(*candidateConfig); err != nil {
+			level.Error(logger).Log("msg", "error loading candidate config", "error", err)
+			os.Exit(1)
+		}
+	}
+	// With a separate self-metrics address, the metrics translated from
+	// StatsD are kept in their own registry.
+	var statsdRegisterer prometheus.Registerer = prometheus.DefaultRegisterer
+	var statsdGatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *selfMetricsAddress != "" {
+		statsdRegistry := prometheus.NewRegistry()
+		statsdRegisterer, statsdGatherer = statsdRegistry, statsdRegistry
+	}
+	exporter := statsdMetrics.NewExporter(statsdRegisterer, mapper, logger)
+	exporter.MaxEventAge = *eventMaxAge
+	exporter.AggregationInterval = *aggregationInterval
+	exporter.Exemplars = *exemplars
+	exporter.StaticLabels, err = staticLabels(*staticLabelFlags, os.Environ())
+	if err != nil {
+		level.Error(logger).Log("msg", "error parsing static labels", "error", err)
+		os.Exit(1)
+	}
+	exporter.DropUnmapped = *dropUnmapped
+	exporter.NameEscaping = escapingScheme
+	exporter.MaxLabelValueLength = *maxLabelValueLength
+	exporter.LabelValuesTruncated = labelValuesTruncated
+	exporter.EventsClamped = eventsClamped
+	if len(*filterPlugins) > 0 {
+		var chain filter.Chain
+		for _, path := range *filterPlugins {
+			f, err := filter.Load(path, logger)
+			if err != nil {
+				level.Error(logger).Log("msg", "failed to load filter plugin", "plugin", path, "error", err)
+				os.Exit(1)
+			}
+			chain = append(chain, f)
+		}
+		exporter.Filter = chain
+		exporter.EventsFiltered = eventsFiltered
+	}
+	exporter.RateWindow = *rateWindow
+	exporter.RecycleEvents = true
+	exporter.Registry.(*registry.Registry).ConflictPolicy = registry.ConflictPolicy(*conflictPolicy)
+	exporter.Registry.(*registry.Registry).CreatedTimestamps = *createdTimestamps
+	exporter.Cardinality = cardinality
+	exporter.Budget = eventQueue.Budget
+	exporter.Candidate = candidate
+	if *localCacheSize > 0 {
+		exporter.LocalCache = mapper.NewLocalCache(*localCacheSize)
+	}
 
 	if *checkConfig {
 		level.Info(logger).Log("msg", "Configuration check successful, exiting")
 		return
 	}
 
-	level.Info(logger).Log("msg", "Accepting StatsD Traffic", "udp", *statsdListenUDP, "tcp", *statsdListenTCP, "unixgram", *statsdListenUnixgram)
+	stopHA := func() {}
+	if *haLeaseName != "" {
+		stopHA = startHA(exporter.Registry.(*registry.Registry), *haLeaseName, *haIdentity, *haLeaseDuration, logger)
+	}
+
+	level.Info(logger).Log("msg", "Accepting StatsD Traffic", "udp", *statsdListenUDP, "tcp", *statsdListenTCP, "sctp", *statsdListenSCTP, "unixgram", *statsdListenUnixgram)
 	level.Info(logger).Log("msg", "Accepting Prometheus Requests", "addr", *listenAddress)
 
-	if *statsdListenUDP == "" && *statsdListenTCP == "" && *statsdListenUnixgram == "" {
-		level.Error(logger).Log("At least one of UDP/TCP/Unixgram listeners must be specified.")
+	if *statsdListenUDP == "" && *statsdListenTCP == "" && *statsdListenSCTP == "" && *statsdListenUnixgram == "" {
+		level.Error(logger).Log("At least one of UDP/TCP/SCTP/Unixgram listeners must be specified.")
 		os.Exit(1)
 	}
 
+	inherited, err := handoff.Inherit()
+	if err != nil {
+		level.Error(logger).Log("msg", "unable to take over the sockets of the upgraded process", "error", err)
+		os.Exit(1)
+	}
+
+	var tenants *tenant.Resolver
+	if len(*tenantNetworks) > 0 || len(*tenantPorts) > 0 || *tenantTag != "" || *tenantDefault != "" {
+		tenants, err = newTenantResolver(*tenantNetworks, *tenantPorts, *tenantTag, *tenantDefault, *tenantLabel)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid tenancy settings", "error", err)
+			os.Exit(1)
+		}
+		tenancy := &registry.Tenancy{
+			Label:     *tenantLabel,
+			MaxSeries: *tenantMaxSeries,
+			Events:    tenantEvents,
+			Series:    tenantSeries,
+			Limited:   tenantLimited,
+		}
+		exporter.Tenancy = tenancy
+		exporter.Registry.(*registry.Registry).Tenancy = tenancy
+	}
+
+	var sources *sender.Labeler
+	if *sourceLabel != "" {
+		if !model.LabelName(*sourceLabel).IsValid() {
+			level.Error(logger).Log("msg", "invalid source label", "label", *sourceLabel)
+			os.Exit(1)
+		}
+		sources, err = sender.LoadLabeler(*sourceLabel, *sourceNames)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to load the source names", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var statsdRelay *relay.Relay
+	if len(*relayAddresses) > 0 {
+		statsdRelay, err = relay.NewRelay(*relayAddresses, relay.Mode(*relayMode), *relayPacketLength, logger, relayLines, relayDropped, relayErrors)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to start the relay", "error", err)
+			os.Exit(1)
+		}
+		statsdRelay.Mapper = mapper
+		statsdRelay.Filtered = relayFiltered
+	}
+
+	var cluster *relay.Relay
+	if len(*clusterPeers) > 0 || *clusterListen != "" {
+		cluster, err = newCluster(*clusterPeers, *clusterListen, *relayPacketLength, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to set up the cluster", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// listeners are closed first on shutdown.
+	var listeners []io.Closer
+	// handoffSockets are passed to the new process on upgrades, after which
+	// handedOff is set.
+	var handoffSockets []namedSocket
+	handedOff := false
+	var udpDrops func() (uint64, error)
+
 	if *statsdListenUDP != "" {
 		udpListenAddr, err := address.UDPAddrFromString(*statsdListenUDP)
 		if err != nil {
 			level.Error(logger).Log("msg", "invalid UDP listen address", "address", *statsdListenUDP, "error", err)
 			os.Exit(1)
 		}
-		uconn, err := net.ListenUDP("udp", udpListenAddr)
+		uconn, err := listenUDP(inherited, "udp", udpListenAddr)
 		if err != nil {
 			level.Error(logger).Log("msg", "failed to start UDP listener", "error", err)
 			os.Exit(1)
 		}
+		listeners = append(listeners, uconn)
+		handoffSockets = append(handoffSockets, namedSocket{"udp", uconn})
 
 		if *readBuffer != 0 {
 			err = uconn.SetReadBuffer(*readBuffer)
@@ -357,20 +1236,19 @@ func main() {
 			}
 		}
 
-		ul := &listener.StatsDUDPListener{
-			Conn:            uconn,
-			EventHandler:    eventQueue,
-			Logger:          logger,
-			LineParser:      parser,
-			UDPPackets:      udpPackets,
-			LinesReceived:   linesReceived,
-			EventsFlushed:   eventsFlushed,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
+		if *runtimeInterval > 0 {
+			udpDrops, err = listener.UDPDrops(uconn)
+			if err != nil {
+				level.Warn(logger).Log("msg", "UDP drops will not be correlated", "error", err)
+			}
 		}
 
+		ul := statsdMetrics.UDPListener(uconn, *statsdListenUDP, eventQueue, parser, logger)
+		ul.Relay = statsdRelay
+		ul.Cluster = cluster
+		ul.Tenants = tenants
+		ul.Sources = sources
+
 		go ul.Listen()
 	}
 
@@ -380,48 +1258,91 @@ func main() {
 			level.Error(logger).Log("msg", "invalid TCP listen address", "address", *statsdListenUDP, "error", err)
 			os.Exit(1)
 		}
-		tconn, err := net.ListenTCP("tcp", tcpListenAddr)
+		tconn, err := listenTCP(inherited, "tcp", func() (*net.TCPListener, error) {
+			return net.ListenTCP("tcp", tcpListenAddr)
+		})
 		if err != nil {
 			level.Error(logger).Log("msg", err)
 			os.Exit(1)
 		}
 		defer tconn.Close()
+		listeners = append(listeners, tconn)
+		handoffSockets = append(handoffSockets, namedSocket{"tcp", tconn})
+
+		tl := statsdMetrics.TCPListener(tconn, *statsdListenTCP, eventQueue, parser, logger)
+		tl.Relay = statsdRelay
+		tl.Cluster = cluster
+		tl.Tenants = tenants
+		tl.Sources = sources
+
+		go tl.Listen()
+	}
 
-		tl := &listener.StatsDTCPListener{
-			Conn:            tconn,
+	if *statsdListenSCTP != "" {
+		sctpListenAddr, err := address.TCPAddrFromString(*statsdListenSCTP)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid SCTP listen address", "address", *statsdListenSCTP, "error", err)
+			os.Exit(1)
+		}
+		sconn, err := listenTCP(inherited, "sctp", listenSCTP(sctpListenAddr))
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to start SCTP listener", "error", err)
+			os.Exit(1)
+		}
+		defer sconn.Close()
+		listeners = append(listeners, sconn)
+		handoffSockets = append(handoffSockets, namedSocket{"sctp", sconn})
+
+		labels := listenerLabels("sctp", *statsdListenSCTP)
+		// SCTP associations are read like TCP connections, but counted
+		// separately.
+		sl := &listener.StatsDTCPListener{
+			Conn:            sconn,
 			EventHandler:    eventQueue,
 			Logger:          logger,
 			LineParser:      parser,
-			LinesReceived:   linesReceived,
+			LinesReceived:   linesReceived.With(labels),
 			EventsFlushed:   eventsFlushed,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
-			TCPConnections:  tcpConnections,
-			TCPErrors:       tcpErrors,
-			TCPLineTooLong:  tcpLineTooLong,
+			SampleErrors:    *sampleErrors.MustCurryWith(labels),
+			SamplesReceived: samplesReceived.With(labels),
+			TagErrors:       tagErrors.With(labels),
+			TagsReceived:    tagsReceived.With(labels),
+			TCPConnections:  sctpAssociations.With(labels),
+			TCPErrors:       sctpErrors.With(labels),
+			TCPLineTooLong:  sctpLineTooLong.With(labels),
+			Relay:           statsdRelay,
+			Cluster:         cluster,
+			Tenants:         tenants,
+			Sources:         sources,
 		}
 
-		go tl.Listen()
+		go sl.Listen()
 	}
 
 	if *statsdListenUnixgram != "" {
-		var err error
-		if _, err = os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			level.Error(logger).Log("msg", "Unixgram socket already exists", "socket_name", *statsdListenUnixgram)
-			os.Exit(1)
-		}
-		uxgconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
-			Net:  "unixgram",
-			Name: *statsdListenUnixgram,
-		})
+		uxgconn, err := inheritUnixgram(inherited)
 		if err != nil {
 			level.Error(logger).Log("msg", "failed to listen on Unixgram socket", "error", err)
 			os.Exit(1)
 		}
+		if uxgconn == nil {
+			if _, err = os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
+				level.Error(logger).Log("msg", "Unixgram socket already exists", "socket_name", *statsdListenUnixgram)
+				os.Exit(1)
+			}
+			uxgconn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{
+				Net:  "unixgram",
+				Name: *statsdListenUnixgram,
+			})
+			if err != nil {
+				level.Error(logger).Log("msg", "failed to listen on Unixgram socket", "error", err)
+				os.Exit(1)
+			}
+		}
 
 		defer uxgconn.Close()
+		listeners = append(listeners, uxgconn)
+		handoffSockets = append(handoffSockets, namedSocket{"unixgram", uxgconn})
 
 		if *readBuffer != 0 {
 			err = uxgconn.SetReadBuffer(*readBuffer)
@@ -431,18 +1352,36 @@ func main() {
 			}
 		}
 
+		var origins *listener.Origins
+		if *unixgramOriginLabel != "" {
+			if !model.LabelName(*unixgramOriginLabel).IsValid() {
+				level.Error(logger).Log("msg", "invalid Unixgram origin label", "label", *unixgramOriginLabel)
+				os.Exit(1)
+			}
+			origins, err = listener.NewOrigins(uxgconn, *unixgramOriginLabel)
+			if err != nil {
+				level.Error(logger).Log("msg", "failed to enable Unixgram origin detection", "error", err)
+				os.Exit(1)
+			}
+		}
+
+		labels := listenerLabels("unixgram", *statsdListenUnixgram)
 		ul := &listener.StatsDUnixgramListener{
 			Conn:            uxgconn,
 			EventHandler:    eventQueue,
 			Logger:          logger,
 			LineParser:      parser,
-			UnixgramPackets: unixgramPackets,
-			LinesReceived:   linesReceived,
+			UnixgramPackets: unixgramPackets.With(labels),
+			LinesReceived:   linesReceived.With(labels),
 			EventsFlushed:   eventsFlushed,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
+			SampleErrors:    *sampleErrors.MustCurryWith(labels),
+			SamplesReceived: samplesReceived.With(labels),
+			TagErrors:       tagErrors.With(labels),
+			TagsReceived:    tagsReceived.With(labels),
+			Relay:           statsdRelay,
+			Cluster:         cluster,
+			Tenants:         tenants,
+			Origins:         origins,
 		}
 
 		go ul.Listen()
@@ -450,7 +1389,12 @@ func main() {
 		// if it's an abstract unix domain socket, it won't exist on fs
 		// so we can't chmod it either
 		if _, err := os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			defer os.Remove(*statsdListenUnixgram)
+			// After an upgrade, the new process uses the socket.
+			defer func() {
+				if !handedOff {
+					os.Remove(*statsdListenUnixgram)
+				}
+			}()
 
 			// convert the string to octet
 			perm, err := strconv.ParseInt("0"+string(*statsdUnixSocketMode), 8, 32)
@@ -466,9 +1410,147 @@ func main() {
 
 	}
 
+	if *clusterListen != "" {
+		clusterListenAddr, err := address.UDPAddrFromString(*clusterListen)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid cluster listen address", "address", *clusterListen, "error", err)
+			os.Exit(1)
+		}
+		cconn, err := listenUDP(inherited, "cluster", clusterListenAddr)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to start cluster listener", "error", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, cconn)
+		handoffSockets = append(handoffSockets, namedSocket{"cluster", cconn})
+
+		// Forwarded lines are handled here, without relaying or forwarding
+		// them again.
+		cl := statsdMetrics.UDPListener(cconn, *clusterListen, eventQueue, parser, logger)
+		cl.Tenants = tenants
+
+		go cl.Listen()
+	}
+
+	if *runtimeInterval > 0 {
+		sampler := newRuntimeSampler(*runtimeInterval, *correlationWindow, udpDrops, logger)
+		go sampler.Run()
+	}
+
 	mux := http.NewServeMux()
-	mux.Handle(*metricsEndpoint, promhttp.Handler())
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	gatherer := statsdGatherer
+	if *omitDefaultHelp {
+		gatherer = registry.OmitHelpGatherer{Gatherer: gatherer, Help: defaultHelp}
+	}
+
+	if *remoteWriteURL != "" {
+		remoteWriteRequests := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "statsd_exporter_remote_write_requests_total",
+			Help: "The number of remote write push attempts, by result.",
+		}, []string{"result"})
+		prometheus.MustRegister(remoteWriteRequests)
+		writer := &remotewrite.Writer{
+			URL:          *remoteWriteURL,
+			Interval:     *remoteWriteInterval,
+			Gatherer:     gatherer,
+			Client:       &http.Client{Timeout: *remoteWriteInterval},
+			Retries:      *remoteWriteRetries,
+			RetryBackoff: time.Second,
+			Logger:       logger,
+			Requests:     remoteWriteRequests,
+		}
+		if *remoteWriteWALDir != "" {
+			wal, err := remotewrite.OpenWAL(*remoteWriteWALDir, *remoteWriteWALBytes)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error opening remote write WAL", "error", err)
+				os.Exit(1)
+			}
+			writer.WAL = wal
+		}
+		go writer.Run()
+	}
+	if *graphiteAddress != "" {
+		graphiteErrors := prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "statsd_exporter_graphite_errors_total",
+			Help: "The number of flushes to Graphite that could not be written.",
+		})
+		prometheus.MustRegister(graphiteErrors)
+		graphiteWriter := &graphite.Writer{
+			Address:  *graphiteAddress,
+			Interval: *graphiteInterval,
+			Prefix:   *graphitePrefix,
+			Gatherer: gatherer,
+			Logger:   logger,
+			Errors:   graphiteErrors,
+		}
+		go graphiteWriter.Run()
+	}
+	handlerOpts := promhttp.HandlerOpts{EnableOpenMetrics: *enableOpenMetrics}
+	metricsHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherer, handlerOpts))
+	// The metrics of a tenant are served on <metrics endpoint>/<tenant>, or
+	// on the metrics endpoint with a tenant parameter.
+	tenantOf := func(r *http.Request) string {
+		if strings.HasPrefix(r.URL.Path, *metricsEndpoint+"/") {
+			return strings.TrimPrefix(r.URL.Path, *metricsEndpoint+"/")
+		}
+		return r.URL.Query().Get("tenant")
+	}
+	metricsEndpointHandler := webConfig.TenantHandler(tenantOf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		group := query.Get("group")
+		names := query["name[]"]
+		selectors := query["label[]"]
+		tenant := tenantOf(r)
+		if group == "" && len(names) == 0 && len(selectors) == 0 && tenant == "" {
+			metricsHandler.ServeHTTP(w, r)
+			return
+		}
+		if tenant != "" && tenants == nil {
+			http.Error(w, "tenancy is not enabled", http.StatusNotFound)
+			return
+		}
+
+		requestGatherer := gatherer
+		if group != "" {
+			requestGatherer = registry.GroupGatherer{
+				Gatherer: requestGatherer,
+				Groups:   exporter.Groups,
+				Group:    group,
+			}
+		}
+		if len(names) > 0 || len(selectors) > 0 {
+			filterGatherer := registry.FilterGatherer{
+				Gatherer: requestGatherer,
+				Names:    names,
+			}
+			for _, selector := range selectors {
+				matcher, err := registry.ParseLabelMatcher(selector)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				filterGatherer.Matchers = append(filterGatherer.Matchers, matcher)
+			}
+			requestGatherer = filterGatherer
+		}
+		if tenant != "" {
+			requestGatherer = registry.FilterGatherer{
+				Gatherer: requestGatherer,
+				Matchers: []*registry.LabelMatcher{{Name: tenants.Label, Op: "=", Value: tenant}},
+			}
+		}
+		promhttp.HandlerFor(requestGatherer, handlerOpts).ServeHTTP(w, r)
+	}))
+	mux.Handle(*metricsEndpoint, metricsEndpointHandler)
+	if *selfMetricsAddress != "" {
+		selfMux := http.NewServeMux()
+		selfMux.Handle(*selfMetricsPath, webConfig.Handler(web.GroupMetrics, promhttp.HandlerFor(prometheus.DefaultGatherer, handlerOpts)))
+		go serveHTTP(selfMux, listenHTTP(inherited, "self-metrics", *selfMetricsAddress, &handoffSockets, logger), webConfig, logger)
+	}
+	if tenants != nil {
+		mux.Handle(*metricsEndpoint+"/", metricsEndpointHandler)
+	}
+	mux.Handle("/", webConfig.Handler(web.GroupMetrics, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>StatsD Exporter</title></head>
 			<body>
@@ -476,59 +1558,189 @@ func main() {
 			<p><a href="` + *metricsEndpoint + `">Metrics</a></p>
 			</body>
 			</html>`))
-	})
+	})))
+
+	if *enableDebugAPI {
+		mux.Handle("/debug/fsm", webConfig.Handler(web.GroupDebug, fsmHandler(mapper)))
+		mux.Handle("/debug/cardinality", webConfig.Handler(web.GroupDebug, cardinalityHandler(statsdGatherer)))
+		mux.Handle("/debug/series", webConfig.Handler(web.GroupDebug, seriesHandler(exporter)))
+		mux.Handle("/api/v1/mappings", webConfig.Handler(web.GroupDebug, activeMappingsHandler(mapper)))
+	}
+	if *enablePprof {
+		mux.Handle("/debug/pprof/", webConfig.Handler(web.GroupDebug, pprofHandler()))
+	}
+	if *pprofAddress != "" {
+		go serveHTTP(pprofHandler(), listenHTTP(inherited, "pprof", *pprofAddress, &handoffSockets, logger), nil, logger)
+	}
+
+	if *enableEventStream {
+		eventStream := stream.NewBroadcaster(logger)
+		exporter.EventStream = eventStream
+		mux.Handle("/debug/events/stream", webConfig.Handler(web.GroupDebug, eventStream))
+	}
+
+	if *enableAdminAPI {
+		mux.Handle("/api/v1/series", webConfig.Handler(web.GroupAdmin, deleteSeriesHandler(exporter)))
+	}
 
 	quitChan := make(chan struct{}, 1)
+	upgradeChan := make(chan struct{}, 1)
 
 	if *enableLifecycle {
-		mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		mux.Handle("/-/reload", webConfig.Handler(web.GroupLifecycle, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.Method == http.MethodPut || r.Method == http.MethodPost {
 				fmt.Fprintf(w, "Requesting reload")
-				if *mappingConfig == "" {
+				if source.fileName == "" {
 					level.Warn(logger).Log("msg", "Received lifecycle api reload but no mapping config to reload")
 					return
 				}
 				level.Info(logger).Log("msg", "Received lifecycle api reload, attempting reload")
-				reloadConfig(*mappingConfig, mapper, *cacheSize, logger, cacheOption)
+				reloadConfig(source, mapper, *cacheSize, logger, cacheOptions...)
 			}
-		})
-		mux.HandleFunc("/-/quit", func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == http.MethodPut || r.Method == http.MethodPost {
-				fmt.Fprintf(w, "Requesting termination... Goodbye!")
-				quitChan <- struct{}{}
+		})))
+		exporter.Tracer = tracer
+		mux.Handle("/-/trace", webConfig.Handler(web.GroupLifecycle, tracer))
+		mux.Handle("/-/mappings", webConfig.Handler(web.GroupLifecycle, temporaryMappingsHandler(mapper, logger)))
+		mux.Handle("/-/candidate", webConfig.Handler(web.GroupLifecycle, candidate))
+		mux.Handle("/-/candidate/promote", webConfig.Handler(web.GroupLifecycle, candidate.PromoteHandler()))
+		mux.Handle("/-/quit", webConfig.Handler(web.GroupLifecycle, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPut && r.Method != http.MethodPost {
+				w.Header().Set("Allow", "PUT, POST")
+				http.Error(w, "Only PUT and POST requests quit the exporter", http.StatusMethodNotAllowed)
+				return
 			}
-		})
+			fmt.Fprintf(w, "Requesting termination... Goodbye!")
+			// Requests while shutting down don't wait for the first one.
+			select {
+			case quitChan <- struct{}{}:
+			default:
+			}
+		})))
+		mux.Handle("/-/upgrade", webConfig.Handler(web.GroupLifecycle, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPut && r.Method != http.MethodPost {
+				w.Header().Set("Allow", "PUT, POST")
+				http.Error(w, "Only PUT and POST requests upgrade the exporter", http.StatusMethodNotAllowed)
+				return
+			}
+			fmt.Fprintf(w, "Requesting upgrade")
+			select {
+			case upgradeChan <- struct{}{}:
+			default:
+			}
+		})))
 	}
 
-	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/-/healthy", webConfig.Handler(web.GroupHealth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			level.Debug(logger).Log("msg", "Received health check")
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, "Statsd Exporter is Healthy.\n")
 		}
-	})
+	})))
 
-	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/-/ready", webConfig.Handler(web.GroupHealth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			level.Debug(logger).Log("msg", "Received ready check")
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, "Statsd Exporter is Ready.\n")
 		}
-	})
+	})))
 
-	go serveHTTP(mux, *listenAddress, logger)
+	if *stateFile != "" {
+		restoreState(exporter, *stateFile, logger)
+	}
 
-	go sighupConfigReloader(*mappingConfig, mapper, *cacheSize, logger, cacheOption)
-	go exporter.Listen(events)
+	go serveHTTP(mux, listenHTTP(inherited, "web", *listenAddress, &handoffSockets, logger), webConfig, logger)
+
+	go sighupConfigReloader(source, mapper, *cacheSize, logger, cacheOptions...)
+	listenDone := make(chan struct{})
+	go func() {
+		exporter.Listen(events)
+		close(listenDone)
+	}()
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	if len(upgradeSignals) > 0 {
+		upgradeSignalChan := make(chan os.Signal, 1)
+		signal.Notify(upgradeSignalChan, upgradeSignals...)
+		go func() {
+			for sig := range upgradeSignalChan {
+				level.Info(logger).Log("msg", "Received signal, attempting upgrade", "signal", sig)
+				select {
+				case upgradeChan <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	if inherited != nil {
+		if err := inherited.Ready(); err != nil {
+			level.Error(logger).Log("msg", "unable to notify the upgraded process", "error", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Took over the sockets of the upgraded process")
+	}
+
+	// quit if we get a message on either channel, or upgrade
+	var upgrade *handoff.Handoff
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			level.Info(logger).Log("msg", "Received os signal, exiting", "signal", sig.String())
+			break wait
+		case <-quitChan:
+			level.Info(logger).Log("msg", "Received lifecycle api quit, exiting")
+			break wait
+		case <-upgradeChan:
+			upgrade, err = prepareUpgrade(handoffSockets, *upgradeTimeout)
+			if err != nil {
+				level.Error(logger).Log("msg", "Not upgrading", "error", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Upgrading, handing off the sockets after draining")
+			break wait
+		}
+	}
 
-	// quit if we get a message on either channel
-	select {
-	case sig := <-signals:
-		level.Info(logger).Log("msg", "Received os signal, exiting", "signal", sig.String())
-	case <-quitChan:
-		level.Info(logger).Log("msg", "Received lifecycle api quit, exiting")
+	drain, grace := *drainTimeout, *gracePeriod
+	if upgrade != nil {
+		// Queued events are handled before the state is saved for the new
+		// process, which serves the scrapes from then on.
+		if drain == 0 {
+			drain = *upgradeTimeout
+		}
+		grace = 0
+	}
+	shutdown(listeners, eventQueue, listenDone, drain, grace, signals, logger)
+
+	if *cachePersistPath != "" {
+		saveCache(mapper, *cachePersistPath, logger)
+	}
+	if *stateFile != "" {
+		saveState(exporter, listenDone, *stateFile, logger)
+	}
+	stopHA()
+
+	report := exporter.Report()
+	report.QueuedEvents = eventQueue.Len()
+	report.QueuedBatches = len(events)
+	level.Info(logger).Log(append([]interface{}{"msg", "Shutdown report"}, report.KeyVals()...)...)
+	if *shutdownReport != "" {
+		if err := writeShutdownReport(*shutdownReport, report); err != nil {
+			level.Error(logger).Log("msg", "Error writing shutdown report", "file", *shutdownReport, "error", err)
+		}
+	}
+
+	if upgrade != nil {
+		process, err := upgrade.Start(os.Args[0], os.Args[1:], *upgradeTimeout)
+		if err != nil {
+			level.Error(logger).Log("msg", "Upgrade failed", "error", err)
+			os.Exit(1)
+		}
+		handedOff = true
+		level.Info(logger).Log("msg", "Handed off the sockets to the new process", "pid", process.Pid)
 	}
 }
@@ -0,0 +1,127 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Rough per-event memory overhead, on top of the metric name and labels.
+const (
+	eventOverhead  = 64
+	labelOverhead  = 16
+	bucketOverhead = 16
+)
+
+// ShedPolicy decides what happens to events that don't fit into the byte
+// budget of the event queue.
+type ShedPolicy string
+
+const (
+	// ShedDropNewest drops incoming events until there is room again.
+	ShedDropNewest ShedPolicy = "drop-newest"
+	// ShedDropOldest drops the oldest queued events to make room.
+	ShedDropOldest ShedPolicy = "drop-oldest"
+	// ShedBlock makes the listeners wait until there is room, which stops
+	// them from reading and leaves it to the socket buffers to drop packets.
+	ShedBlock ShedPolicy = "block"
+)
+
+// Size estimates the memory an event holds while it is queued.
+func Size(e Event) int64 {
+	size := int64(eventOverhead + len(e.MetricName()))
+	for k, v := range e.Labels() {
+		size += int64(labelOverhead + len(k) + len(v))
+	}
+	if h, ok := e.(*HistogramEvent); ok {
+		size += int64(bucketOverhead * len(h.HBuckets))
+	}
+	return size
+}
+
+// ByteBudget bounds the estimated memory of the events between being queued
+// and being handled by the exporter, which releases them.
+type ByteBudget struct {
+	limit  int64
+	policy ShedPolicy
+	shed   prometheus.Counter
+
+	m    sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+// NewByteBudget returns a budget of limit bytes that sheds events according
+// to the policy, counting them in shed.
+func NewByteBudget(limit int64, policy ShedPolicy, shed prometheus.Counter) *ByteBudget {
+	b := &ByteBudget{
+		limit:  limit,
+		policy: policy,
+		shed:   shed,
+	}
+	b.cond = sync.NewCond(&b.m)
+	return b
+}
+
+// Bytes returns the estimated memory of the events currently queued.
+func (b *ByteBudget) Bytes() int64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.used
+}
+
+// Release returns the memory of handled or shed events to the budget.
+func (b *ByteBudget) Release(events Events) {
+	if b == nil {
+		return
+	}
+	var size int64
+	for _, e := range events {
+		size += Size(e)
+	}
+
+	b.m.Lock()
+	b.used -= size
+	b.m.Unlock()
+	b.cond.Broadcast()
+}
+
+// reserve takes size bytes from the budget if they fit. An event always fits
+// into an empty budget, so that events larger than the limit can't block the
+// queue forever.
+func (b *ByteBudget) reserve(size int64) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.reserveLocked(size)
+}
+
+func (b *ByteBudget) reserveLocked(size int64) bool {
+	if b.used > 0 && b.used+size > b.limit {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+// wait takes size bytes from the budget, waiting for them to be released if
+// necessary.
+func (b *ByteBudget) wait(size int64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for !b.reserveLocked(size) {
+		b.cond.Wait()
+	}
+}
@@ -29,7 +29,23 @@ type Event interface {
 	MetricType() mapper.MetricType
 }
 
+// Timestamp records when an event was received. It is embedded in the event
+// types and set when events are queued.
+type Timestamp struct {
+	receivedAt time.Time
+}
+
+func (t *Timestamp) ReceivedAt() time.Time        { return t.receivedAt }
+func (t *Timestamp) SetReceivedAt(when time.Time) { t.receivedAt = when }
+
+// Timestamped is implemented by events that record when they were received.
+type Timestamped interface {
+	ReceivedAt() time.Time
+	SetReceivedAt(when time.Time)
+}
+
 type CounterEvent struct {
+	Timestamp
 	CMetricName string
 	CValue      float64
 	CLabels     map[string]string
@@ -41,6 +57,7 @@ func (c *CounterEvent) Labels() map[string]string     { return c.CLabels }
 func (c *CounterEvent) MetricType() mapper.MetricType { return mapper.MetricTypeCounter }
 
 type GaugeEvent struct {
+	Timestamp
 	GMetricName string
 	GValue      float64
 	GRelative   bool
@@ -53,16 +70,66 @@ func (g *GaugeEvent) Labels() map[string]string     { return g.GLabels }
 func (g *GaugeEvent) MetricType() mapper.MetricType { return mapper.MetricTypeGauge }
 
 type ObserverEvent struct {
+	Timestamp
 	OMetricName string
 	OValue      float64
 	OLabels     map[string]string
+	// OMilliseconds marks a StatsD timer, whose OValue is in milliseconds.
+	// Value converts it to seconds, which Prometheus presumes.
+	OMilliseconds bool
 }
 
-func (o *ObserverEvent) MetricName() string            { return o.OMetricName }
-func (o *ObserverEvent) Value() float64                { return o.OValue }
+func (o *ObserverEvent) MetricName() string { return o.OMetricName }
+func (o *ObserverEvent) Value() float64 {
+	if o.OMilliseconds {
+		return o.OValue / 1000
+	}
+	return o.OValue
+}
 func (o *ObserverEvent) Labels() map[string]string     { return o.OLabels }
 func (o *ObserverEvent) MetricType() mapper.MetricType { return mapper.MetricTypeObserver }
 
+// HistogramEvent carries observations that the client already aggregated
+// into buckets, each holding a value and the number of times it was observed.
+type HistogramEvent struct {
+	Timestamp
+	HMetricName string
+	HBuckets    []HistogramBucket
+	HLabels     map[string]string
+	// HMilliseconds marks buckets of timer values in milliseconds.
+	HMilliseconds bool
+}
+
+type HistogramBucket struct {
+	Value float64
+	Count uint64
+}
+
+func (h *HistogramEvent) MetricName() string            { return h.HMetricName }
+func (h *HistogramEvent) Labels() map[string]string     { return h.HLabels }
+func (h *HistogramEvent) MetricType() mapper.MetricType { return mapper.MetricTypeObserver }
+
+// Value returns the sum of all observations, in seconds for timers.
+func (h *HistogramEvent) Value() float64 {
+	var sum float64
+	for _, b := range h.HBuckets {
+		sum += b.Value * float64(b.Count)
+	}
+	if h.HMilliseconds {
+		return sum / 1000
+	}
+	return sum
+}
+
+// Count returns the number of observations.
+func (h *HistogramEvent) Count() uint64 {
+	var count uint64
+	for _, b := range h.HBuckets {
+		count += b.Count
+	}
+	return count
+}
+
 type Events []Event
 
 type EventQueue struct {
@@ -73,6 +140,18 @@ type EventQueue struct {
 	flushThreshold int
 	flushInterval  time.Duration
 	eventsFlushed  prometheus.Counter
+	// Budget, if set, bounds the memory of queued events. The consumer of
+	// the channel has to release the events it handles.
+	Budget *ByteBudget
+	// Overflow decides what happens to a batch of events when the channel
+	// is full. The default blocks until the consumer receives a batch.
+	Overflow ShedPolicy
+	// Dropped, if set, counts the events dropped by the Overflow policy.
+	Dropped prometheus.Counter
+	// Blocked, if set, counts the seconds spent waiting for room in the
+	// channel.
+	Blocked prometheus.Counter
+	closed  bool
 }
 
 type EventHandler interface {
@@ -99,10 +178,21 @@ func NewEventQueue(c chan Events, flushThreshold int, flushInterval time.Duratio
 }
 
 func (eq *EventQueue) Queue(events Events) {
+	now := clock.Now()
+
 	eq.m.Lock()
 	defer eq.m.Unlock()
 
+	if eq.closed {
+		return
+	}
 	for _, e := range events {
+		if !eq.admit(e) {
+			continue
+		}
+		if t, ok := e.(Timestamped); ok {
+			t.SetReceivedAt(now)
+		}
 		eq.q = append(eq.q, e)
 		if len(eq.q) >= eq.flushThreshold {
 			eq.FlushUnlocked()
@@ -110,6 +200,64 @@ func (eq *EventQueue) Queue(events Events) {
 	}
 }
 
+// admit reserves room for an event in the budget, shedding events according
+// to its policy if there is none. It reports whether the event can be queued.
+func (eq *EventQueue) admit(e Event) bool {
+	if eq.Budget == nil {
+		return true
+	}
+	size := Size(e)
+
+	switch eq.Budget.policy {
+	case ShedBlock:
+		if !eq.Budget.reserve(size) {
+			// Queued events can only be released once the exporter has
+			// received them.
+			if len(eq.q) > 0 {
+				eq.FlushUnlocked()
+			}
+			eq.Budget.wait(size)
+		}
+		return true
+
+	case ShedDropOldest:
+		for !eq.Budget.reserve(size) {
+			if !eq.shedOldest() {
+				eq.Budget.shed.Inc()
+				return false
+			}
+		}
+		return true
+
+	default:
+		if eq.Budget.reserve(size) {
+			return true
+		}
+		eq.Budget.shed.Inc()
+		return false
+	}
+}
+
+// shedOldest drops the oldest batch waiting for the exporter, or else the
+// oldest event not flushed yet. It reports whether there was anything to drop.
+func (eq *EventQueue) shedOldest() bool {
+	select {
+	case batch := <-eq.C:
+		eq.Budget.Release(batch)
+		eq.Budget.shed.Add(float64(len(batch)))
+		return true
+	default:
+	}
+
+	if len(eq.q) == 0 {
+		return false
+	}
+	eq.Budget.Release(eq.q[:1])
+	eq.Budget.shed.Inc()
+	eq.q = append(eq.q[:0], eq.q[1:]...)
+	return true
+}
+
 func (eq *EventQueue) Flush() {
 	eq.m.Lock()
 	defer eq.m.Unlock()
@@ -117,11 +265,75 @@ func (eq *EventQueue) Flush() {
 }
 
 func (eq *EventQueue) FlushUnlocked() {
-	eq.C <- eq.q
+	if eq.closed {
+		return
+	}
+	eq.send(eq.q)
 	eq.q = make([]Event, 0, cap(eq.q))
 	eq.eventsFlushed.Inc()
 }
 
+// send sends a batch of events to the channel. If the channel is full, it
+// drops the batch, or the oldest batch in the channel, according to the
+// Overflow policy.
+func (eq *EventQueue) send(batch Events) {
+	switch eq.Overflow {
+	case ShedDropNewest:
+		select {
+		case eq.C <- batch:
+		default:
+			eq.drop(batch)
+		}
+
+	case ShedDropOldest:
+		for {
+			select {
+			case eq.C <- batch:
+				return
+			default:
+			}
+			select {
+			case oldest := <-eq.C:
+				eq.drop(oldest)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case eq.C <- batch:
+		default:
+			start := clock.Now()
+			eq.C <- batch
+			if eq.Blocked != nil {
+				eq.Blocked.Add(clock.Now().Sub(start).Seconds())
+			}
+		}
+	}
+}
+
+func (eq *EventQueue) drop(batch Events) {
+	eq.Budget.Release(batch)
+	if eq.Dropped != nil {
+		eq.Dropped.Add(float64(len(batch)))
+	}
+}
+
+// Close flushes the queued events and closes the channel, so that its
+// consumer stops once it has handled them. Events queued afterwards are
+// discarded.
+func (eq *EventQueue) Close() {
+	eq.m.Lock()
+	defer eq.m.Unlock()
+
+	if eq.closed {
+		return
+	}
+	eq.FlushUnlocked()
+	eq.closed = true
+	close(eq.C)
+}
+
 func (eq *EventQueue) Len() int {
 	eq.m.Lock()
 	defer eq.m.Unlock()
@@ -14,10 +14,12 @@
 package event
 
 import (
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/statsd_exporter/pkg/clock"
 )
 
@@ -86,3 +88,199 @@ func TestEventIntervalFlush(t *testing.T) {
 	}
 
 }
+
+func TestEventQueueTimestamps(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(42, 0)}
+	defer func() { clock.ClockInstance = nil }()
+
+	c := make(chan Events, 100)
+	eq := NewEventQueue(c, 1, time.Second, eventsFlushed)
+	eq.Queue(Events{&CounterEvent{CMetricName: "foo", CValue: 1}})
+
+	batch := <-c
+	ts, ok := batch[0].(Timestamped)
+	if !ok {
+		t.Fatal("Expected counter events to be timestamped")
+	}
+	if !ts.ReceivedAt().Equal(time.Unix(42, 0)) {
+		t.Fatalf("Expected receive time %v, got %v", time.Unix(42, 0), ts.ReceivedAt())
+	}
+}
+
+func TestEventQueueByteBudget(t *testing.T) {
+	// Only flush explicitly.
+	clock.ClockInstance = &clock.Clock{TickerCh: make(chan time.Time)}
+	defer func() { clock.ClockInstance = nil }()
+
+	size := Size(&CounterEvent{CMetricName: "a", CLabels: map[string]string{}})
+	newEvents := func(names ...string) Events {
+		events := Events{}
+		for _, name := range names {
+			events = append(events, &CounterEvent{CMetricName: name, CValue: 1, CLabels: map[string]string{}})
+		}
+		return events
+	}
+	names := func(events Events) []string {
+		n := []string{}
+		for _, e := range events {
+			n = append(n, e.MetricName())
+		}
+		return n
+	}
+
+	t.Run("drop-newest", func(t *testing.T) {
+		shed := prometheus.NewCounter(prometheus.CounterOpts{Name: "shed"})
+		c := make(chan Events, 100)
+		eq := NewEventQueue(c, 100, time.Second, eventsFlushed)
+		eq.Budget = NewByteBudget(2*size, ShedDropNewest, shed)
+
+		eq.Queue(newEvents("a", "b", "c"))
+		eq.Flush()
+		if got := names(<-c); !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Fatalf("Expected events a and b to be queued, got %v", got)
+		}
+		if got := testCounterValue(shed); got != 1 {
+			t.Fatalf("Expected 1 shed event, got %v", got)
+		}
+		if got := eq.Budget.Bytes(); got != 2*size {
+			t.Fatalf("Expected %d bytes in use, got %d", 2*size, got)
+		}
+	})
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		shed := prometheus.NewCounter(prometheus.CounterOpts{Name: "shed"})
+		c := make(chan Events, 100)
+		eq := NewEventQueue(c, 100, time.Second, eventsFlushed)
+		eq.Budget = NewByteBudget(2*size, ShedDropOldest, shed)
+
+		eq.Queue(newEvents("a"))
+		eq.Flush()
+		eq.Queue(newEvents("b", "c", "d"))
+		eq.Flush()
+		if got := names(<-c); !reflect.DeepEqual(got, []string{"c", "d"}) {
+			t.Fatalf("Expected events c and d to be queued, got %v", got)
+		}
+		if got := testCounterValue(shed); got != 2 {
+			t.Fatalf("Expected 2 shed events, got %v", got)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		shed := prometheus.NewCounter(prometheus.CounterOpts{Name: "shed"})
+		c := make(chan Events, 100)
+		eq := NewEventQueue(c, 100, time.Second, eventsFlushed)
+		eq.Budget = NewByteBudget(2*size, ShedBlock, shed)
+
+		done := make(chan struct{})
+		go func() {
+			eq.Queue(newEvents("a", "b", "c"))
+			close(done)
+		}()
+
+		batch := <-c
+		if got := names(batch); !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Fatalf("Expected events a and b to be flushed, got %v", got)
+		}
+		eq.Budget.Release(batch)
+		<-done
+		eq.Flush()
+		if got := names(<-c); !reflect.DeepEqual(got, []string{"c"}) {
+			t.Fatalf("Expected event c to be queued, got %v", got)
+		}
+		if got := testCounterValue(shed); got != 0 {
+			t.Fatalf("Expected no shed events, got %v", got)
+		}
+	})
+}
+
+func testCounterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestEventQueueClose(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{TickerCh: make(chan time.Time)}
+	defer func() { clock.ClockInstance = nil }()
+
+	c := make(chan Events, 100)
+	eq := NewEventQueue(c, 100, time.Second, eventsFlushed)
+	eq.Queue(Events{&CounterEvent{CMetricName: "a", CValue: 1}})
+	eq.Close()
+	eq.Queue(Events{&CounterEvent{CMetricName: "b", CValue: 1}})
+	eq.Flush()
+	eq.Close()
+
+	batches := []Events{}
+	for batch := range c {
+		batches = append(batches, batch)
+	}
+	if len(batches) != 1 || len(batches[0]) != 1 || batches[0][0].MetricName() != "a" {
+		t.Fatalf("Expected only the event queued before closing to be flushed, got %v", batches)
+	}
+}
+
+func TestEventQueueOverflow(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{TickerCh: make(chan time.Time)}
+	defer func() { clock.ClockInstance = nil }()
+
+	for _, policy := range []ShedPolicy{ShedDropNewest, ShedDropOldest} {
+		dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+		c := make(chan Events, 1)
+		eq := NewEventQueue(c, 1, time.Second, eventsFlushed)
+		eq.Overflow = policy
+		eq.Dropped = dropped
+
+		// Each event is flushed as a batch, and only one fits into the
+		// channel.
+		for _, name := range []string{"a", "b", "c"} {
+			eq.Queue(Events{&CounterEvent{CMetricName: name, CValue: 1}})
+		}
+
+		expected := map[ShedPolicy]string{ShedDropNewest: "a", ShedDropOldest: "c"}[policy]
+		if batch := <-c; batch[0].MetricName() != expected {
+			t.Errorf("%s: expected %s to be queued, got %s", policy, expected, batch[0].MetricName())
+		}
+		if v := testCounterValue(dropped); v != 2 {
+			t.Errorf("%s: expected 2 dropped events, got %v", policy, v)
+		}
+	}
+}
+
+func TestEventQueueBlocked(t *testing.T) {
+	blocked := prometheus.NewCounter(prometheus.CounterOpts{Name: "blocked"})
+	c := make(chan Events, 1)
+	eq := NewEventQueue(c, 1, time.Minute, eventsFlushed)
+	eq.Blocked = blocked
+
+	done := make(chan struct{})
+	go func() {
+		// The second batch waits for the first to be received.
+		eq.Queue(Events{&CounterEvent{CMetricName: "a"}, &CounterEvent{CMetricName: "b"}})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	<-c
+	<-done
+
+	if v := testCounterValue(blocked); v < 0.04 {
+		t.Errorf("expected at least 0.04 seconds blocked, got %v", v)
+	}
+}
+
+func TestRecycle(t *testing.T) {
+	e := NewCounterEvent("foo", 1, map[string]string{"la": "bar"})
+	e.SetReceivedAt(time.Unix(1, 0))
+	Recycle(Events{e})
+
+	// Events from the pools have no fields left over from their last use.
+	for i := 0; i < 10; i++ {
+		c := NewCounterEvent("bar", 2, nil)
+		expected := &CounterEvent{CMetricName: "bar", CValue: 2}
+		if !reflect.DeepEqual(c, expected) {
+			t.Fatalf("expected %#v, got %#v", expected, c)
+		}
+	}
+}
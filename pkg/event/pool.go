@@ -0,0 +1,66 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import "sync"
+
+// The pools reuse the events of the most common types, which are created
+// for every sample received.
+var (
+	counterEvents  = sync.Pool{New: func() interface{} { return &CounterEvent{} }}
+	gaugeEvents    = sync.Pool{New: func() interface{} { return &GaugeEvent{} }}
+	observerEvents = sync.Pool{New: func() interface{} { return &ObserverEvent{} }}
+)
+
+// NewCounterEvent returns a counter event, reusing one passed to Recycle if
+// possible.
+func NewCounterEvent(metricName string, value float64, labels map[string]string) *CounterEvent {
+	e := counterEvents.Get().(*CounterEvent)
+	*e = CounterEvent{CMetricName: metricName, CValue: value, CLabels: labels}
+	return e
+}
+
+// NewGaugeEvent returns a gauge event, reusing one passed to Recycle if
+// possible.
+func NewGaugeEvent(metricName string, value float64, relative bool, labels map[string]string) *GaugeEvent {
+	e := gaugeEvents.Get().(*GaugeEvent)
+	*e = GaugeEvent{GMetricName: metricName, GValue: value, GRelative: relative, GLabels: labels}
+	return e
+}
+
+// NewObserverEvent returns an observer event, reusing one passed to Recycle
+// if possible.
+func NewObserverEvent(metricName string, value float64, labels map[string]string) *ObserverEvent {
+	e := observerEvents.Get().(*ObserverEvent)
+	*e = ObserverEvent{OMetricName: metricName, OValue: value, OLabels: labels}
+	return e
+}
+
+// Recycle returns handled events to the pools. The events must not be used
+// afterwards.
+func Recycle(events Events) {
+	for _, e := range events {
+		switch e := e.(type) {
+		case *CounterEvent:
+			*e = CounterEvent{}
+			counterEvents.Put(e)
+		case *GaugeEvent:
+			*e = GaugeEvent{}
+			gaugeEvents.Put(e)
+		case *ObserverEvent:
+			*e = ObserverEvent{}
+			observerEvents.Put(e)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+)
+
+// aggregator accumulates the events received during an aggregation interval,
+// like a StatsD server does, so that every metric is updated once per
+// interval: counters are summed, gauges keep the last value set plus the
+// changes after it, and observations are counted by value.
+type aggregator struct {
+	counters     map[string]*event.CounterEvent
+	gauges       map[string]*event.GaugeEvent
+	observations map[string]*observations
+}
+
+type observations struct {
+	metricName   string
+	labels       map[string]string
+	milliseconds bool
+	counts       map[float64]uint64
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{
+		counters:     map[string]*event.CounterEvent{},
+		gauges:       map[string]*event.GaugeEvent{},
+		observations: map[string]*observations{},
+	}
+}
+
+// aggregationKey identifies the events that are aggregated together: those
+// with the same StatsD name and labels. Timer values in milliseconds are kept
+// apart from other observations.
+func aggregationKey(e event.Event) string {
+	labels := e.Labels()
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(e.MetricName())
+	switch ev := e.(type) {
+	case *event.ObserverEvent:
+		if ev.OMilliseconds {
+			b.WriteString("|ms")
+		}
+	case *event.HistogramEvent:
+		if ev.HMilliseconds {
+			b.WriteString("|ms")
+		}
+	}
+	for _, name := range names {
+		b.WriteByte(model.SeparatorByte)
+		b.WriteString(name)
+		b.WriteByte(model.SeparatorByte)
+		b.WriteString(labels[name])
+	}
+	return b.String()
+}
+
+// copyLabels copies the labels of an event, as handling events changes them.
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
+
+// add accumulates an event. It reports whether the event type can be
+// aggregated.
+func (a *aggregator) add(e event.Event) bool {
+	key := aggregationKey(e)
+	switch ev := e.(type) {
+	case *event.CounterEvent:
+		if c, ok := a.counters[key]; ok {
+			c.CValue += ev.CValue
+			return true
+		}
+		a.counters[key] = &event.CounterEvent{
+			CMetricName: ev.CMetricName,
+			CValue:      ev.CValue,
+			CLabels:     copyLabels(ev.CLabels),
+		}
+
+	case *event.GaugeEvent:
+		g, ok := a.gauges[key]
+		if !ok {
+			a.gauges[key] = &event.GaugeEvent{
+				GMetricName: ev.GMetricName,
+				GValue:      ev.GValue,
+				GRelative:   ev.GRelative,
+				GLabels:     copyLabels(ev.GLabels),
+			}
+			return true
+		}
+		if ev.GRelative {
+			g.GValue += ev.GValue
+		} else {
+			// A set overrides the changes before it.
+			g.GValue = ev.GValue
+			g.GRelative = false
+		}
+
+	case *event.ObserverEvent:
+		a.observe(key, ev, ev.OMilliseconds, ev.OValue, 1)
+
+	case *event.HistogramEvent:
+		for _, bucket := range ev.HBuckets {
+			a.observe(key, ev, ev.HMilliseconds, bucket.Value, bucket.Count)
+		}
+
+	default:
+		return false
+	}
+	return true
+}
+
+func (a *aggregator) observe(key string, e event.Event, milliseconds bool, value float64, count uint64) {
+	o, ok := a.observations[key]
+	if !ok {
+		o = &observations{
+			metricName:   e.MetricName(),
+			labels:       copyLabels(e.Labels()),
+			milliseconds: milliseconds,
+			counts:       map[float64]uint64{},
+		}
+		a.observations[key] = o
+	}
+	o.counts[value] += count
+}
+
+// flush returns the aggregated events and starts a new interval. The
+// observations of a metric are returned as one histogram event.
+func (a *aggregator) flush() event.Events {
+	events := make(event.Events, 0, len(a.counters)+len(a.gauges)+len(a.observations))
+	for _, c := range a.counters {
+		events = append(events, c)
+	}
+	for _, g := range a.gauges {
+		events = append(events, g)
+	}
+	for _, o := range a.observations {
+		buckets := make([]event.HistogramBucket, 0, len(o.counts))
+		for value, count := range o.counts {
+			buckets = append(buckets, event.HistogramBucket{Value: value, Count: count})
+		}
+		events = append(events, &event.HistogramEvent{
+			HMetricName:   o.metricName,
+			HBuckets:      buckets,
+			HLabels:       o.labels,
+			HMilliseconds: o.milliseconds,
+		})
+	}
+
+	a.counters = map[string]*event.CounterEvent{}
+	a.gauges = map[string]*event.GaugeEvent{}
+	a.observations = map[string]*observations{}
+	return events
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// Reasons for which the candidate mapping of an event diverges from the
+// active one, in the order they are checked.
+const (
+	DivergenceMatch        = "match"
+	DivergenceAction       = "action"
+	DivergenceName         = "name"
+	DivergenceLabels       = "labels"
+	DivergenceObserverType = "observer_type"
+	DivergenceTargets      = "targets"
+)
+
+// Candidate evaluates a candidate mapping config in the shadow of the active
+// one. Events are looked up in both, but only the active mapping is applied;
+// events that the candidate would map differently are counted by the first
+// divergence found. Once the candidate is validated, it can be promoted to
+// replace the active config.
+type Candidate struct {
+	// Active is the mapper the candidate is compared with and promoted into.
+	Active       *mapper.MetricMapper
+	CacheSize    int
+	CacheOptions []mapper.CacheOption
+	Events       prometheus.Counter
+	Divergences  *prometheus.CounterVec
+
+	mutex  sync.RWMutex
+	mapper *mapper.MetricMapper
+	config string
+}
+
+// Load replaces the candidate with the given config.
+func (c *Candidate) Load(config string) error {
+	m := &mapper.MetricMapper{}
+	if err := m.InitFromYAMLString(config, c.CacheSize, c.CacheOptions...); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.mapper = m
+	c.config = config
+	return nil
+}
+
+// LoadFile starts evaluating the mapping config in a YAML or JSON file.
+func (c *Candidate) LoadFile(fileName string) error {
+	config, err := mapper.ReadConfigFile(fileName)
+	if err != nil {
+		return err
+	}
+	return c.Load(config)
+}
+
+// Clear stops evaluating the candidate.
+func (c *Candidate) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.mapper = nil
+	c.config = ""
+}
+
+// Config returns the candidate config, or "" if there is none.
+func (c *Candidate) Config() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.config
+}
+
+// Promote loads the candidate config into the active mapper and clears the
+// candidate. The active config is replaced at once, like on a reload.
+func (c *Candidate) Promote() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.mapper == nil {
+		return fmt.Errorf("no candidate mapping config loaded")
+	}
+	if err := c.Active.InitFromYAMLString(c.config, c.CacheSize, c.CacheOptions...); err != nil {
+		return err
+	}
+	c.mapper = nil
+	c.config = ""
+	return nil
+}
+
+// Evaluate looks up an event in the candidate and counts how its mapping
+// diverges from the active mapping, if at all.
+func (c *Candidate) Evaluate(e event.Event, mapping *mapper.MetricMapping, labels prometheus.Labels, present bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.mapper == nil {
+		return
+	}
+
+	c.Events.Inc()
+	candidate, candidateLabels, candidatePresent := c.mapper.GetMapping(e.MetricName(), e.MetricType())
+	var reason string
+	switch {
+	case present != candidatePresent:
+		reason = DivergenceMatch
+	case !present:
+		if c.Active.Defaults.Action != c.mapper.Defaults.Action {
+			reason = DivergenceAction
+		}
+	default:
+		reason = mappingDivergence(mapping, candidate, labels, candidateLabels)
+	}
+	if reason != "" {
+		c.Divergences.WithLabelValues(reason).Inc()
+	}
+}
+
+// mappingDivergence returns the first way in which two mappings of the same
+// event differ, or "" if they are handled alike.
+func mappingDivergence(active, candidate *mapper.MetricMapping, activeLabels, candidateLabels prometheus.Labels) string {
+	switch {
+	case active.Action != candidate.Action:
+		return DivergenceAction
+	case active.Action == mapper.ActionTypeDrop:
+		return ""
+	case active.Name != candidate.Name:
+		return DivergenceName
+	case !reflect.DeepEqual(activeLabels, candidateLabels):
+		return DivergenceLabels
+	case active.ObserverType != candidate.ObserverType:
+		return DivergenceObserverType
+	case len(active.Targets) != len(candidate.Targets):
+		return DivergenceTargets
+	}
+	for i, target := range active.Targets {
+		if target.Name != candidate.Targets[i].Name || !reflect.DeepEqual(target.Labels, candidate.Targets[i].Labels) {
+			return DivergenceTargets
+		}
+	}
+	return ""
+}
+
+// ServeHTTP loads the candidate config from the request body on POST or PUT,
+// returns it on GET, and clears it on DELETE.
+func (c *Candidate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read candidate: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := c.Load(string(body)); err != nil {
+			http.Error(w, fmt.Sprintf("invalid candidate: %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "Evaluating candidate mapping config\n")
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/yaml")
+		fmt.Fprint(w, c.Config())
+	case http.MethodDelete:
+		c.Clear()
+		fmt.Fprintf(w, "Candidate mapping config cleared\n")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PromoteHandler promotes the candidate on POST or PUT.
+func (c *Candidate) PromoteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := c.Promote(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to promote candidate: %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "Candidate mapping config promoted\n")
+	})
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CardinalityLimiter suppresses labels that take more distinct values for a
+// metric than the limit. It is not safe for concurrent use.
+type CardinalityLimiter struct {
+	limit int
+	hash  bool
+	// suppressedLabels is set to 1 for every suppressed label of a metric.
+	suppressedLabels *prometheus.GaugeVec
+	labels           map[string]map[string]*labelValues
+}
+
+// labelValues tracks the distinct values of one label of a metric, until the
+// label is suppressed.
+type labelValues struct {
+	values     map[string]struct{}
+	suppressed bool
+}
+
+// NewCardinalityLimiter returns a limiter that suppresses labels with more
+// than limit distinct values per metric. Suppressed labels are dropped, or
+// with hash set, their values are replaced by one of limit hash buckets.
+func NewCardinalityLimiter(limit int, hash bool, suppressedLabels *prometheus.GaugeVec) *CardinalityLimiter {
+	return &CardinalityLimiter{
+		limit:            limit,
+		hash:             hash,
+		suppressedLabels: suppressedLabels,
+		labels:           make(map[string]map[string]*labelValues),
+	}
+}
+
+// Apply records the label values of a metric and suppresses the labels over
+// the limit in place. A nil limiter leaves the labels unchanged.
+func (c *CardinalityLimiter) Apply(metricName string, labels map[string]string) {
+	if c == nil || c.limit <= 0 {
+		return
+	}
+
+	metric, ok := c.labels[metricName]
+	if !ok {
+		metric = make(map[string]*labelValues)
+		c.labels[metricName] = metric
+	}
+
+	for label, value := range labels {
+		l, ok := metric[label]
+		if !ok {
+			l = &labelValues{values: make(map[string]struct{})}
+			metric[label] = l
+		}
+
+		if !l.suppressed {
+			if _, seen := l.values[value]; seen {
+				continue
+			}
+			if len(l.values) < c.limit {
+				l.values[value] = struct{}{}
+				continue
+			}
+			// The values are not needed anymore once the label is suppressed.
+			l.suppressed = true
+			l.values = nil
+			c.suppressedLabels.WithLabelValues(metricName, label).Set(1)
+		}
+
+		if c.hash {
+			labels[label] = hashBucket(value, c.limit)
+		} else {
+			delete(labels, label)
+		}
+	}
+}
+
+// hashBucket maps a label value to one of n buckets.
+func hashBucket(value string, n int) string {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return strconv.FormatUint(uint64(h.Sum32()%uint32(n)), 10)
+}
+
+// DefaultCardinalityReportLimit is the number of metrics and labels in a
+// cardinality report if no limit is given.
+const DefaultCardinalityReportLimit = 10
+
+// CardinalityReport lists the metrics with the most series, and the labels
+// with the most distinct values, to find the sources of series explosions.
+type CardinalityReport struct {
+	Series  int                 `json:"series"`
+	Metrics []MetricCardinality `json:"metrics"`
+	Labels  []LabelCardinality  `json:"labels"`
+}
+
+// MetricCardinality is the number of series of a metric.
+type MetricCardinality struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+}
+
+// LabelCardinality is the number of distinct values of a label of a metric.
+type LabelCardinality struct {
+	Metric string `json:"metric"`
+	Label  string `json:"label"`
+	Values int    `json:"values"`
+}
+
+// ReportCardinality reports the limit metrics with the most series and the
+// limit labels with the most distinct values among the gathered metrics.
+// Histograms and summaries count as one series per label set.
+func ReportCardinality(g prometheus.Gatherer, limit int) (*CardinalityReport, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CardinalityReport{Metrics: []MetricCardinality{}, Labels: []LabelCardinality{}}
+	for _, family := range families {
+		series := len(family.GetMetric())
+		report.Series += series
+		report.Metrics = append(report.Metrics, MetricCardinality{Name: family.GetName(), Series: series})
+
+		values := map[string]map[string]struct{}{}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				v, ok := values[pair.GetName()]
+				if !ok {
+					v = map[string]struct{}{}
+					values[pair.GetName()] = v
+				}
+				v[pair.GetValue()] = struct{}{}
+			}
+		}
+		for label, v := range values {
+			report.Labels = append(report.Labels, LabelCardinality{Metric: family.GetName(), Label: label, Values: len(v)})
+		}
+	}
+
+	sort.Slice(report.Metrics, func(i, j int) bool {
+		a, b := report.Metrics[i], report.Metrics[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		return a.Name < b.Name
+	})
+	sort.Slice(report.Labels, func(i, j int) bool {
+		a, b := report.Labels[i], report.Labels[j]
+		if a.Values != b.Values {
+			return a.Values > b.Values
+		}
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		return a.Label < b.Label
+	})
+	if limit > 0 && len(report.Metrics) > limit {
+		report.Metrics = report.Metrics[:limit]
+	}
+	if limit > 0 && len(report.Labels) > limit {
+		report.Labels = report.Labels[:limit]
+	}
+	return report, nil
+}
@@ -14,8 +14,12 @@
 package exporter
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -23,8 +27,10 @@ import (
 
 	"github.com/prometheus/statsd_exporter/pkg/clock"
 	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/filter"
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
 	"github.com/prometheus/statsd_exporter/pkg/registry"
+	"github.com/prometheus/statsd_exporter/pkg/stream"
 )
 
 const (
@@ -38,6 +44,12 @@ type Registry interface {
 	GetHistogram(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Observer, error)
 	GetSummary(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Observer, error)
 	RemoveStaleMetrics()
+	RemoveOrphanedMetrics(exists func(origin string) bool) int
+	SeriesCount() int64
+	Series(metricName string) []registry.Series
+	DeleteSeries(metricName string, labels prometheus.Labels) int
+	Snapshot() registry.State
+	RestoreSeries(s registry.SeriesState, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) error
 }
 
 type Exporter struct {
@@ -50,6 +62,64 @@ type Exporter struct {
 	EventStats            *prometheus.CounterVec
 	ConflictingEventStats *prometheus.CounterVec
 	MetricsCount          *prometheus.GaugeVec
+	EventStream           *stream.Broadcaster
+	Groups                *registry.MetricGroups
+	// MaxEventAge, if set, drops events that were received longer ago than
+	// this by the time they are handled.
+	MaxEventAge time.Duration
+	// Tracer, if set, selects events whose handling is logged verbosely.
+	Tracer *EventTracer
+	// DropUnmapped drops events that do not match any mapping, regardless of
+	// the default action of the mapping config.
+	DropUnmapped bool
+	// Cardinality, if set, suppresses labels with too many distinct values.
+	Cardinality *CardinalityLimiter
+	// Budget, if set, is the byte budget of the event queue, which handled
+	// events are released from.
+	Budget *event.ByteBudget
+	// Candidate, if set, evaluates a candidate mapping config in shadow.
+	Candidate *Candidate
+	// LocalCache, if set, is looked up before the shared cache of the
+	// Mapper. It must only be used by the goroutine that handles events.
+	LocalCache *mapper.LocalCache
+	// RecycleEvents returns handled events to the event pools. It must only
+	// be set if the events are not used after being sent to Listen.
+	RecycleEvents bool
+	// AggregationInterval, if set, accumulates the events of each metric
+	// and handles them once per interval.
+	AggregationInterval time.Duration
+	// Exemplars moves the trace_id and span_id labels of observer events to
+	// exemplars of the histogram observations.
+	Exemplars bool
+	// StaticLabels are added to every series that does not have a label of
+	// the same name, for example the pod and namespace of a sidecar.
+	StaticLabels prometheus.Labels
+	// Tenancy, if set, counts the events of each tenant. It is usually
+	// shared with the registry, which limits the series of each tenant.
+	Tenancy *registry.Tenancy
+	// NameEscaping is how invalid characters in metric names are handled.
+	// The zero value replaces them with underscores.
+	NameEscaping mapper.EscapingScheme
+	// MaxLabelValueLength, if set, truncates longer label values, ending
+	// them with a hash of the whole value to keep them distinct. It should
+	// be at least MinLabelValueLength.
+	MaxLabelValueLength int
+	// LabelValuesTruncated, if set, counts the truncated label values.
+	LabelValuesTruncated prometheus.Counter
+	// EventsClamped, if set, counts the events whose values were clamped to
+	// the bounds of their mapping.
+	EventsClamped prometheus.Counter
+	// Filter, if set, may modify or drop every event before it is mapped
+	// and aggregated.
+	Filter filter.Filter
+	// EventsFiltered, if set, counts the events the Filter dropped.
+	EventsFiltered prometheus.Counter
+	// RateWindow is the window the rates of the counters of mappings with
+	// emit_rate are computed over. DefaultRateWindow is used if unset.
+	RateWindow time.Duration
+	rates      *rates
+	// calls are run by Listen, see Run.
+	calls chan func()
 }
 
 // Listen handles all events sent to the given channel sequentially. It
@@ -57,37 +127,183 @@ type Exporter struct {
 func (b *Exporter) Listen(e <-chan event.Events) {
 
 	removeStaleMetricsTicker := clock.NewTicker(time.Second)
+	generation := b.Mapper.Generation()
+
+	var (
+		aggregator     *aggregator
+		aggregateTicks <-chan time.Time
+	)
+	if b.AggregationInterval > 0 {
+		aggregator = newAggregator()
+		aggregateTicker := clock.NewTicker(b.AggregationInterval)
+		defer aggregateTicker.Stop()
+		aggregateTicks = aggregateTicker.C
+	}
+
+	rateWindow := b.RateWindow
+	if rateWindow <= 0 {
+		rateWindow = DefaultRateWindow
+	}
+	// The clock is only read if rates are emitted, as tests change it while
+	// the exporter listens. If a reload enables rates, their first window
+	// starts with the next tick.
+	var ratesFlushed time.Time
+	if b.Mapper.EmitsRates() {
+		ratesFlushed = clock.Now()
+	}
 
 	for {
 		select {
+		case call := <-b.calls:
+			call()
+		case <-aggregateTicks:
+			for _, event := range aggregator.flush() {
+				b.handleEvent(event)
+			}
 		case <-removeStaleMetricsTicker.C:
 			b.Registry.RemoveStaleMetrics()
+			if !ratesFlushed.IsZero() || b.rates != nil {
+				switch now := clock.Now(); {
+				case ratesFlushed.IsZero():
+					ratesFlushed = now
+				case now.Sub(ratesFlushed) >= rateWindow:
+					if b.rates != nil {
+						b.rates.flush(now.Sub(ratesFlushed))
+					}
+					ratesFlushed = now
+				}
+			}
+			// After a reload, remove the series of mappings that were
+			// deleted or renamed.
+			if g := b.Mapper.Generation(); g != generation {
+				generation = g
+				if n := b.Registry.RemoveOrphanedMetrics(b.Mapper.HasOrigin); n > 0 {
+					level.Info(b.Logger).Log("msg", "Removed series of mappings no longer in the config", "series", n)
+				}
+			}
 		case events, ok := <-e:
 			if !ok {
 				level.Debug(b.Logger).Log("msg", "Channel is closed. Break out of Exporter.Listener.")
+				if aggregator != nil {
+					for _, event := range aggregator.flush() {
+						b.handleEvent(event)
+					}
+				}
 				removeStaleMetricsTicker.Stop()
 				return
 			}
+			var now time.Time
+			if b.MaxEventAge > 0 {
+				now = clock.Now()
+			}
 			for _, event := range events {
+				if b.MaxEventAge > 0 && b.tooOld(event, now) {
+					continue
+				}
+				if b.Filter != nil {
+					var ok bool
+					if event, ok = b.filter(event); !ok {
+						continue
+					}
+				}
+				if aggregator != nil && aggregator.add(event) {
+					continue
+				}
 				b.handleEvent(event)
 			}
+			b.Budget.Release(events)
+			if b.RecycleEvents {
+				event.Recycle(events)
+			}
+		}
+	}
+}
+
+// Run calls f on the goroutine that handles events, where it may use the
+// registry, and waits for it to return. It returns the error of ctx if the
+// call could not be made before ctx is done, for example because the exporter
+// is not listening.
+func (b *Exporter) Run(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	call := func() {
+		defer close(done)
+		f()
+	}
+	select {
+	case b.calls <- call:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// tooOld reports, and counts, events that were received more than
+// MaxEventAge before now.
+func (b *Exporter) tooOld(thisEvent event.Event, now time.Time) bool {
+	t, ok := thisEvent.(event.Timestamped)
+	if !ok || t.ReceivedAt().IsZero() {
+		return false
+	}
+	if now.Sub(t.ReceivedAt()) <= b.MaxEventAge {
+		return false
+	}
+	level.Debug(b.Logger).Log("msg", "Dropping event older than the maximum event age", "metric", thisEvent.MetricName(), "received_at", t.ReceivedAt())
+	b.ErrorEventStats.WithLabelValues("too_old").Inc()
+	return true
+}
+
+// filter passes an event through the Filter, and counts the events it drops.
+// Events that make the Filter panic are dropped too, so that a faulty plugin
+// doesn't take down the exporter.
+func (b *Exporter) filter(thisEvent event.Event) (filtered event.Event, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			level.Error(b.Logger).Log("msg", "Filter failed", "metric", thisEvent.MetricName(), "error", r)
+			b.ErrorEventStats.WithLabelValues("filter_failed").Inc()
+			filtered, ok = thisEvent, false
+		}
+	}()
+	filtered, ok = b.Filter.Filter(thisEvent)
+	if !ok || filtered == nil {
+		if b.EventsFiltered != nil {
+			b.EventsFiltered.Inc()
 		}
+		return thisEvent, false
 	}
+	return filtered, true
 }
 
 // handleEvent processes a single Event according to the configured mapping.
 func (b *Exporter) handleEvent(thisEvent event.Event) {
+	// Traced events are logged at info level, so that they show up without
+	// enabling debug logging for all events.
+	debug := level.Debug(b.Logger)
+	traced := b.Tracer.Matches(thisEvent.MetricName())
+	if traced {
+		debug = level.Info(log.With(b.Logger, "trace", thisEvent.MetricName()))
+	}
 
-	mapping, labels, present := b.Mapper.GetMapping(thisEvent.MetricName(), thisEvent.MetricType())
+	getMapping := b.Mapper.GetMapping
+	if b.LocalCache != nil {
+		getMapping = b.LocalCache.GetMapping
+	}
+	mapping, labels, present := getMapping(thisEvent.MetricName(), thisEvent.MetricType())
+	b.Candidate.Evaluate(thisEvent, mapping, labels, present)
 	if mapping == nil {
-		mapping = &mapper.MetricMapping{}
-		if b.Mapper.Defaults.Ttl != 0 {
-			mapping.Ttl = b.Mapper.Defaults.Ttl
-		}
+		mapping = b.unmappedMapping()
+	}
+
+	if traced {
+		debug.Log("msg", "Received event", "type", thisEvent.MetricType(), "value", thisEvent.Value(), "labels", fmt.Sprint(thisEvent.Labels()), "mapped", present, "match", mapping.Match)
 	}
 
 	if mapping.Action == mapper.ActionTypeDrop {
+		if traced {
+			debug.Log("msg", "Dropping event by mapping action")
+		}
 		b.EventsActions.WithLabelValues("drop").Inc()
+		b.publishEvent(thisEvent, mapping, "drop", "", nil)
 		return
 	}
 
@@ -98,58 +314,357 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 		help = mapping.HelpText
 	}
 
+	// The events parsed from one line share their labels, so an event whose
+	// labels change below gets a copy.
 	prometheusLabels := thisEvent.Labels()
+	if b.changesLabels(thisEvent, mapping, labels, present) {
+		prometheusLabels = copyLabels(prometheusLabels)
+	}
+	if b.Tenancy != nil {
+		if tenant := prometheusLabels[b.Tenancy.Label]; tenant != "" {
+			b.Tenancy.Events.WithLabelValues(tenant).Inc()
+		}
+	}
+	var exemplar prometheus.Labels
+	if b.Exemplars && thisEvent.MetricType() == mapper.MetricTypeObserver {
+		exemplar = takeExemplar(prometheusLabels)
+	}
+	// Targets get the labels of the event, not those of the mapping, so they
+	// need a copy before the mapping labels are added.
+	var eventLabels map[string]string
+	if len(mapping.Targets) > 0 {
+		eventLabels = copyLabels(prometheusLabels)
+	}
 	if present {
 		if mapping.Name == "" {
-			level.Debug(b.Logger).Log("msg", "The mapping generates an empty metric name", "metric_name", thisEvent.MetricName(), "match", mapping.Match)
+			debug.Log("msg", "The mapping generates an empty metric name", "metric_name", thisEvent.MetricName(), "match", mapping.Match)
 			b.ErrorEventStats.WithLabelValues("empty_metric_name").Inc()
 			return
 		}
-		metricName = mapper.EscapeMetricName(mapping.Name)
+		var ok bool
+		if metricName, ok = b.escapeName(mapping.Name, debug); !ok {
+			return
+		}
 		for label, value := range labels {
 			prometheusLabels[label] = value
 		}
+		if mapping.DropsLabels(prometheusLabels) {
+			if traced {
+				debug.Log("msg", "Dropping event by label value", "labels", fmt.Sprint(prometheusLabels))
+			}
+			b.EventsActions.WithLabelValues("drop").Inc()
+			b.publishEvent(thisEvent, mapping, "drop", metricName, prometheusLabels)
+			return
+		}
+		if thisEvent, ok = b.transform(thisEvent, mapping, prometheusLabels, debug); !ok {
+			return
+		}
+		if thisEvent, ok = b.bound(thisEvent, mapping, debug); !ok {
+			return
+		}
 		b.EventsActions.WithLabelValues(string(mapping.Action)).Inc()
+		b.publishEvent(thisEvent, mapping, string(mapping.Action), metricName, prometheusLabels)
 	} else {
 		b.EventsUnmapped.Inc()
-		metricName = mapper.EscapeMetricName(thisEvent.MetricName())
+		var ok bool
+		if metricName, ok = b.escapeName(thisEvent.MetricName(), debug); !ok {
+			return
+		}
+		b.publishEvent(thisEvent, mapping, "unmapped", metricName, prometheusLabels)
+	}
+
+	if traced {
+		debug.Log("msg", "Mapped event", "metric", metricName, "labels", fmt.Sprint(prometheusLabels), "help", help)
+	}
+
+	if stat := b.record(thisEvent, metricName, prometheusLabels, exemplar, help, mapping, debug); stat != "" {
+		b.EventStats.WithLabelValues(stat).Inc()
+	}
+
+	for _, target := range mapping.Targets {
+		b.recordTarget(thisEvent, eventLabels, exemplar, target, debug)
+	}
+}
+
+// changesLabels reports whether handling an event changes its labels: when
+// the mapping adds labels or transforms them, or exemplars or any of the
+// limits are enabled.
+func (b *Exporter) changesLabels(thisEvent event.Event, mapping *mapper.MetricMapping, labels map[string]string, present bool) bool {
+	switch {
+	case present && (len(labels) > 0 || mapping.HasTransform()):
+		return true
+	case b.Exemplars && thisEvent.MetricType() == mapper.MetricTypeObserver:
+		return true
+	}
+	return len(mapping.AggregateLabels) > 0 || b.MaxLabelValueLength > 0 || b.Cardinality != nil || len(b.StaticLabels) > 0
+}
+
+// unmappedMapping returns the mapping for events that match no mapping, from
+// the defaults of the mapping config.
+func (b *Exporter) unmappedMapping() *mapper.MetricMapping {
+	mapping := &mapper.MetricMapping{}
+	if b.Mapper.Defaults.Ttl != 0 {
+		mapping.Ttl = b.Mapper.Defaults.Ttl
+	}
+	mapping.TtlJitter = b.Mapper.Defaults.TtlJitter
+	mapping.MaxSeries = b.Mapper.Defaults.MaxSeries
+	if b.DropUnmapped || b.Mapper.Defaults.Action == mapper.ActionTypeDrop {
+		mapping.Action = mapper.ActionTypeDrop
+	}
+	return mapping
+}
+
+// escapeName escapes a metric name according to the escaping scheme, and
+// counts the event as an error if the scheme drops it.
+func (b *Exporter) escapeName(name string, debug log.Logger) (string, bool) {
+	escaped, ok := b.NameEscaping.Escape(name)
+	if !ok {
+		debug.Log("msg", "Dropping event with invalid metric name", "metric_name", name)
+		b.ErrorEventStats.WithLabelValues("invalid_metric_name").Inc()
+	}
+	return escaped, ok
+}
+
+// recordRate records a counter increment for the rate gauge of the counter.
+func (b *Exporter) recordRate(metricName string, prometheusLabels prometheus.Labels, help string, mapping *mapper.MetricMapping, value float64, debug log.Logger) {
+	rateName := metricName + RateSuffix
+	gauge, err := b.Registry.GetGauge(rateName, prometheusLabels, rateHelp, mapping, b.MetricsCount)
+	if err != nil {
+		b.registryError(err, rateName, "gauge", debug)
+		return
+	}
+	if b.rates == nil {
+		b.rates = newRates()
+	}
+	b.rates.add(metricName, prometheusLabels, gauge, value)
+}
+
+// bound applies the bounds of the mapping to the values of an event. It
+// returns the event, or a copy with clamped values, and false if the event is
+// dropped because its values are out of bounds.
+func (b *Exporter) bound(thisEvent event.Event, mapping *mapper.MetricMapping, debug log.Logger) (event.Event, bool) {
+	if !mapping.HasBounds() {
+		return thisEvent, true
+	}
+
+	var bounded event.Event
+	clamped := false
+	switch ev := thisEvent.(type) {
+	case *event.CounterEvent:
+		value, ok := mapping.Bound(ev.CValue)
+		if !ok {
+			break
+		}
+		c := *ev
+		c.CValue, clamped = value, value != ev.CValue
+		bounded = &c
+	case *event.GaugeEvent:
+		value, ok := mapping.Bound(ev.GValue)
+		if !ok {
+			break
+		}
+		g := *ev
+		g.GValue, clamped = value, value != ev.GValue
+		bounded = &g
+	case *event.ObserverEvent:
+		value, ok := mapping.Bound(ev.OValue)
+		if !ok {
+			break
+		}
+		o := *ev
+		o.OValue, clamped = value, value != ev.OValue
+		bounded = &o
+	case *event.HistogramEvent:
+		// Buckets out of bounds are dropped from pre-aggregated histograms,
+		// the event only if none is left.
+		buckets := make([]event.HistogramBucket, 0, len(ev.HBuckets))
+		for _, bucket := range ev.HBuckets {
+			value, ok := mapping.Bound(bucket.Value)
+			if !ok {
+				continue
+			}
+			clamped = clamped || value != bucket.Value
+			buckets = append(buckets, event.HistogramBucket{Value: value, Count: bucket.Count})
+		}
+		if len(buckets) == 0 {
+			break
+		}
+		h := *ev
+		h.HBuckets = buckets
+		bounded = &h
+	default:
+		return thisEvent, true
+	}
+
+	if bounded == nil {
+		debug.Log("msg", "Dropping event with value out of bounds", "metric_name", thisEvent.MetricName(), "match", mapping.Match)
+		b.ErrorEventStats.WithLabelValues("value_out_of_bounds").Inc()
+		return thisEvent, false
+	}
+	if clamped && b.EventsClamped != nil {
+		b.EventsClamped.Inc()
+	}
+	return bounded, true
+}
+
+// transform applies the transform of the mapping to an event and its labels.
+// It returns the event, or a copy with the new values, and false if the event
+// is dropped because an expression failed.
+func (b *Exporter) transform(thisEvent event.Event, mapping *mapper.MetricMapping, labels map[string]string, debug log.Logger) (event.Event, bool) {
+	if !mapping.HasTransform() {
+		return thisEvent, true
+	}
+
+	name, metricType := thisEvent.MetricName(), thisEvent.MetricType()
+	value := func(v float64) (float64, bool) {
+		v, err := mapping.TransformValue(name, metricType, v, labels)
+		if err != nil {
+			debug.Log("msg", "Dropping event that failed its transform", "metric_name", name, "match", mapping.Match, "error", err)
+			b.ErrorEventStats.WithLabelValues("transform_failed").Inc()
+			return 0, false
+		}
+		return v, true
+	}
+
+	var transformed event.Event
+	ok := true
+	switch ev := thisEvent.(type) {
+	case *event.CounterEvent:
+		c := *ev
+		c.CValue, ok = value(ev.CValue)
+		transformed = &c
+	case *event.GaugeEvent:
+		g := *ev
+		g.GValue, ok = value(ev.GValue)
+		transformed = &g
+	case *event.ObserverEvent:
+		o := *ev
+		o.OValue, ok = value(ev.OValue)
+		transformed = &o
+	case *event.HistogramEvent:
+		h := *ev
+		h.HBuckets = make([]event.HistogramBucket, len(ev.HBuckets))
+		for i, bucket := range ev.HBuckets {
+			h.HBuckets[i] = bucket
+			if h.HBuckets[i].Value, ok = value(bucket.Value); !ok {
+				break
+			}
+		}
+		transformed = &h
+	default:
+		transformed = thisEvent
+	}
+	if !ok {
+		return thisEvent, false
+	}
+
+	// The labels are transformed last, so that the value expression sees the
+	// labels as mapped too.
+	if err := mapping.TransformLabels(name, metricType, thisEvent.Value(), labels); err != nil {
+		debug.Log("msg", "Dropping event that failed its transform", "metric_name", name, "match", mapping.Match, "error", err)
+		b.ErrorEventStats.WithLabelValues("transform_failed").Inc()
+		return thisEvent, false
+	}
+	return transformed, true
+}
+
+// recordTarget records an event in an additional target of its mapping.
+// Events recorded in targets are not counted again in the event stats.
+func (b *Exporter) recordTarget(thisEvent event.Event, eventLabels map[string]string, exemplar prometheus.Labels, target *mapper.MetricMapping, debug log.Logger) {
+	metricName, ok := b.escapeName(target.Name, debug)
+	if !ok {
+		return
+	}
+	labels := make(prometheus.Labels, len(eventLabels)+len(target.Labels))
+	for label, value := range eventLabels {
+		labels[label] = value
+	}
+	for label, value := range target.Labels {
+		labels[label] = value
+	}
+
+	help := defaultHelp
+	if target.HelpText != "" {
+		help = target.HelpText
+	}
+
+	if target.Type == mapper.MetricTypeCounter {
+		count := 1.0
+		if h, ok := thisEvent.(*event.HistogramEvent); ok {
+			count = float64(h.Count())
+		}
+		if _, ok := thisEvent.(*event.CounterEvent); !ok {
+			thisEvent = &event.CounterEvent{
+				CMetricName: thisEvent.MetricName(),
+				CValue:      count,
+				CLabels:     labels,
+			}
+		}
+	}
+
+	b.record(thisEvent, metricName, labels, exemplar, help, target, debug)
+}
+
+// record records the value of an event in the named metric and returns the
+// event stats type to count it as, or "" if it could not be recorded.
+// Histogram observations get the exemplar, if not nil. The limits change
+// prometheusLabels, so they must not be shared with other events.
+func (b *Exporter) record(thisEvent event.Event, metricName string, prometheusLabels, exemplar prometheus.Labels, help string, mapping *mapper.MetricMapping, debug log.Logger) string {
+	mapping.AggregateAway(prometheusLabels)
+	if truncated := truncateLabelValues(prometheusLabels, b.MaxLabelValueLength); truncated > 0 {
+		debug.Log("msg", "Truncated label values", "metric", metricName, "count", truncated)
+		if b.LabelValuesTruncated != nil {
+			b.LabelValuesTruncated.Add(float64(truncated))
+		}
+	}
+	b.Cardinality.Apply(metricName, prometheusLabels)
+	for label, value := range b.StaticLabels {
+		if _, ok := prometheusLabels[label]; !ok {
+			prometheusLabels[label] = value
+		}
 	}
 
 	switch ev := thisEvent.(type) {
 	case *event.CounterEvent:
+		value := mapping.ScaleDelta(thisEvent.Value())
 		// We don't accept negative values for counters. Incrementing the counter with a negative number
 		// will cause the exporter to panic. Instead we will warn and continue to the next event.
-		if thisEvent.Value() < 0.0 {
-			level.Debug(b.Logger).Log("msg", "counter must be non-negative value", "metric", metricName, "event_value", thisEvent.Value())
+		if value < 0.0 {
+			debug.Log("msg", "counter must be non-negative value", "metric", metricName, "event_value", value)
 			b.ErrorEventStats.WithLabelValues("illegal_negative_counter").Inc()
-			return
+			return ""
 		}
 
 		counter, err := b.Registry.GetCounter(metricName, prometheusLabels, help, mapping, b.MetricsCount)
-		if err == nil {
-			counter.Add(thisEvent.Value())
-			b.EventStats.WithLabelValues("counter").Inc()
-		} else {
-			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-			b.ConflictingEventStats.WithLabelValues("counter").Inc()
+		if err != nil {
+			b.registryError(err, metricName, "counter", debug)
+			return ""
+		}
+		counter.Add(value)
+		if mapping != nil && mapping.EmitRate {
+			b.recordRate(metricName, prometheusLabels, help, mapping, value, debug)
 		}
+		return "counter"
 
 	case *event.GaugeEvent:
+		if len(mapping.EnumStates) > 0 {
+			return b.recordEnum(ev, metricName, prometheusLabels, help, mapping, debug)
+		}
+
 		gauge, err := b.Registry.GetGauge(metricName, prometheusLabels, help, mapping, b.MetricsCount)
 
-		if err == nil {
-			if ev.GRelative {
-				gauge.Add(thisEvent.Value())
-			} else {
-				gauge.Set(thisEvent.Value())
-			}
-			b.EventStats.WithLabelValues("gauge").Inc()
+		if err != nil {
+			b.registryError(err, metricName, "gauge", debug)
+			return ""
+		}
+		if ev.GRelative {
+			gauge.Add(mapping.ScaleDelta(thisEvent.Value()))
 		} else {
-			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-			b.ConflictingEventStats.WithLabelValues("gauge").Inc()
+			gauge.Set(mapping.ScaleValue(thisEvent.Value()))
 		}
+		return "gauge"
 
-	case *event.ObserverEvent:
+	case *event.ObserverEvent, *event.HistogramEvent:
 		t := mapper.ObserverTypeDefault
 		if mapping != nil {
 			t = mapping.ObserverType
@@ -161,23 +676,21 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 		switch t {
 		case mapper.ObserverTypeHistogram:
 			histogram, err := b.Registry.GetHistogram(metricName, prometheusLabels, help, mapping, b.MetricsCount)
-			if err == nil {
-				histogram.Observe(thisEvent.Value())
-				b.EventStats.WithLabelValues("observer").Inc()
-			} else {
-				level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-				b.ConflictingEventStats.WithLabelValues("observer").Inc()
+			if err != nil {
+				b.registryError(err, metricName, "observer", debug)
+				return ""
 			}
+			observe(histogram, thisEvent, mapping, exemplar)
+			return "observer"
 
 		case mapper.ObserverTypeDefault, mapper.ObserverTypeSummary:
 			summary, err := b.Registry.GetSummary(metricName, prometheusLabels, help, mapping, b.MetricsCount)
-			if err == nil {
-				summary.Observe(thisEvent.Value())
-				b.EventStats.WithLabelValues("observer").Inc()
-			} else {
-				level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-				b.ConflictingEventStats.WithLabelValues("observer").Inc()
+			if err != nil {
+				b.registryError(err, metricName, "observer", debug)
+				return ""
 			}
+			observe(summary, thisEvent, mapping, nil)
+			return "observer"
 
 		default:
 			level.Error(b.Logger).Log("msg", "unknown observer type", "type", t)
@@ -185,15 +698,185 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 		}
 
 	default:
-		level.Debug(b.Logger).Log("msg", "Unsupported event type")
-		b.EventStats.WithLabelValues("illegal").Inc()
+		debug.Log("msg", "Unsupported event type")
+		return "illegal"
+	}
+	return ""
+}
+
+// recordEnum sets one series per state of an enum mapping, with the state
+// selected by the gauge value set to 1 and all others to 0.
+func (b *Exporter) recordEnum(ev *event.GaugeEvent, metricName string, prometheusLabels prometheus.Labels, help string, mapping *mapper.MetricMapping, debug log.Logger) string {
+	current, ok := mapping.EnumState(ev.Value())
+	if ev.GRelative || !ok {
+		debug.Log("msg", "gauge value is not the index of an enum state", "metric", metricName, "event_value", ev.Value(), "relative", ev.GRelative)
+		b.ErrorEventStats.WithLabelValues("invalid_enum_state").Inc()
+		return ""
+	}
+
+	for _, state := range mapping.EnumStates {
+		labels := make(prometheus.Labels, len(prometheusLabels)+1)
+		for k, v := range prometheusLabels {
+			labels[k] = v
+		}
+		labels[mapper.EnumStateLabel] = state
+
+		gauge, err := b.Registry.GetGauge(metricName, labels, help, mapping, b.MetricsCount)
+		if err != nil {
+			b.registryError(err, metricName, "gauge", debug)
+			return ""
+		}
+		if state == current {
+			gauge.Set(1)
+		} else {
+			gauge.Set(0)
+		}
+	}
+	return "gauge"
+}
+
+// registryError logs and counts an event that could not be recorded in the
+// registry.
+func (b *Exporter) registryError(err error, metricName string, eventType string, debug log.Logger) {
+	debug.Log("msg", regErrF, "metric", metricName, "error", err)
+	if errors.Is(err, registry.ErrSeriesLimit) {
+		b.ErrorEventStats.WithLabelValues("series_limit").Inc()
+		return
+	}
+	if errors.Is(err, registry.ErrTenantSeriesLimit) {
+		b.ErrorEventStats.WithLabelValues("tenant_series_limit").Inc()
+		return
+	}
+	b.ConflictingEventStats.WithLabelValues(eventType).Inc()
+}
+
+// observe records an observer event, or every observation of a
+// pre-aggregated histogram event, in the observer. The observations get the
+// exemplar if it is not nil and the observer supports exemplars.
+func observe(observer prometheus.Observer, thisEvent event.Event, mapping *mapper.MetricMapping, exemplar prometheus.Labels) {
+	observeValue := observer.Observe
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		observeValue = func(value float64) { eo.ObserveWithExemplar(value, exemplar) }
+	}
+
+	h, ok := thisEvent.(*event.HistogramEvent)
+	if !ok {
+		value := thisEvent.Value()
+		if o, ok := thisEvent.(*event.ObserverEvent); ok {
+			value = timerValue(o.OValue, o.OMilliseconds, mapping)
+		}
+		observeValue(mapping.ScaleValue(value))
+		return
+	}
+	for _, bucket := range h.HBuckets {
+		value := mapping.ScaleValue(timerValue(bucket.Value, h.HMilliseconds, mapping))
+		for i := uint64(0); i < bucket.Count; i++ {
+			observeValue(value)
+		}
 	}
 }
 
+// exemplarLabels are the tags that become exemplars instead of labels when
+// exemplars are enabled.
+var exemplarLabels = []string{"trace_id", "span_id"}
+
+// takeExemplar removes the exemplar labels from labels and returns them, or
+// nil if there are none or they exceed the size limit of exemplars.
+func takeExemplar(labels map[string]string) prometheus.Labels {
+	var exemplar prometheus.Labels
+	runes := 0
+	for _, name := range exemplarLabels {
+		value, ok := labels[name]
+		if !ok {
+			continue
+		}
+		delete(labels, name)
+		if exemplar == nil {
+			exemplar = prometheus.Labels{}
+		}
+		exemplar[name] = value
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	if runes > prometheus.ExemplarMaxRunes {
+		return nil
+	}
+	return exemplar
+}
+
+// timerValue converts a timer value from milliseconds to seconds, unless the
+// mapping records timers as received.
+func timerValue(value float64, milliseconds bool, mapping *mapper.MetricMapping) float64 {
+	if milliseconds && !mapping.NoUnitConversion {
+		return value / 1000
+	}
+	return value
+}
+
+// recordedValue returns the value of an event as record records it, after
+// the scale and offset of the mapping and the unit conversion of timers. For
+// a pre-aggregated histogram, it is the sum of the observations.
+func recordedValue(thisEvent event.Event, mapping *mapper.MetricMapping) float64 {
+	switch ev := thisEvent.(type) {
+	case *event.CounterEvent:
+		return mapping.ScaleDelta(ev.CValue)
+	case *event.GaugeEvent:
+		switch {
+		case len(mapping.EnumStates) > 0:
+			return ev.GValue
+		case ev.GRelative:
+			return mapping.ScaleDelta(ev.GValue)
+		}
+		return mapping.ScaleValue(ev.GValue)
+	case *event.ObserverEvent:
+		return mapping.ScaleValue(timerValue(ev.OValue, ev.OMilliseconds, mapping))
+	case *event.HistogramEvent:
+		var sum float64
+		for _, bucket := range ev.HBuckets {
+			sum += mapping.ScaleValue(timerValue(bucket.Value, ev.HMilliseconds, mapping)) * float64(bucket.Count)
+		}
+		return sum
+	}
+	return thisEvent.Value()
+}
+
+// publishEvent sends the outcome of mapping an event to the event stream, if
+// anyone is listening. Events that are recorded are published with the value
+// recorded, dropped events with the value received.
+func (b *Exporter) publishEvent(thisEvent event.Event, mapping *mapper.MetricMapping, action string, metricName string, labels prometheus.Labels) {
+	if !b.EventStream.Active() {
+		return
+	}
+
+	// The labels map is shared with other events and modified while
+	// handling them, so the stream gets its own copy.
+	streamLabels := make(map[string]string, len(labels))
+	for k, v := range labels {
+		streamLabels[k] = v
+	}
+
+	value := thisEvent.Value()
+	if action != "drop" {
+		value = recordedValue(thisEvent, mapping)
+	}
+
+	b.EventStream.Publish(stream.HandledEvent{
+		Time:       clock.Now(),
+		StatsdName: thisEvent.MetricName(),
+		Type:       string(thisEvent.MetricType()),
+		Value:      value,
+		Action:     action,
+		Match:      mapping.Match,
+		MetricName: metricName,
+		Labels:     streamLabels,
+	})
+}
+
 func NewExporter(reg prometheus.Registerer, mapper *mapper.MetricMapper, logger log.Logger, eventsActions *prometheus.CounterVec, eventsUnmapped prometheus.Counter, errorEventStats *prometheus.CounterVec, eventStats *prometheus.CounterVec, conflictingEventStats *prometheus.CounterVec, metricsCount *prometheus.GaugeVec) *Exporter {
+	r := registry.NewRegistry(reg, mapper)
 	return &Exporter{
 		Mapper:                mapper,
-		Registry:              registry.NewRegistry(reg, mapper),
+		Registry:              r,
+		Groups:                r.Groups,
 		Logger:                logger,
 		EventsActions:         eventsActions,
 		EventsUnmapped:        eventsUnmapped,
@@ -201,5 +884,6 @@ func NewExporter(reg prometheus.Registerer, mapper *mapper.MetricMapper, logger
 		EventStats:            eventStats,
 		ConflictingEventStats: conflictingEventStats,
 		MetricsCount:          metricsCount,
+		calls:                 make(chan func()),
 	}
 }
@@ -14,20 +14,32 @@
 package exporter
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 
 	"github.com/prometheus/statsd_exporter/pkg/clock"
 	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/filter"
 	"github.com/prometheus/statsd_exporter/pkg/line"
 	"github.com/prometheus/statsd_exporter/pkg/listener"
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
 	"github.com/prometheus/statsd_exporter/pkg/registry"
 )
 
@@ -796,329 +808,3219 @@ func TestCounterIncrement(t *testing.T) {
 	}
 }
 
-type statsDPacketHandler interface {
-	HandlePacket(packet []byte)
-	SetEventHandler(eh event.EventHandler)
-}
-
-type mockStatsDTCPListener struct {
-	listener.StatsDTCPListener
-	log.Logger
-}
-
-func (ml *mockStatsDTCPListener) HandlePacket(packet []byte) {
-	// Forcing IPv4 because the TravisCI build environment does not have IPv6
-	// addresses.
-	lc, err := net.ListenTCP("tcp4", nil)
+// TestScaleAndOffset validates that mapped values are scaled and offset
+// before they are recorded, and that counter increments are only scaled.
+func TestScaleAndOffset(t *testing.T) {
+	config := `
+mappings:
+- match: scale.bytes
+  name: "scale_megabytes"
+  scale: 0.000001
+- match: scale.celsius
+  name: "scale_fahrenheit"
+  scale: 1.8
+  offset: 32
+- match: scale.cents
+  name: "scale_dollars_total"
+  scale: 0.01
+  offset: 100
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
 	if err != nil {
-		panic(fmt.Sprintf("mockStatsDTCPListener: listen failed: %v", err))
+		t.Fatalf("Config load error: %s %s", config, err)
 	}
 
-	defer lc.Close()
-
+	events := make(chan event.Events)
 	go func() {
-		cc, err := net.DialTCP("tcp", nil, lc.Addr().(*net.TCPAddr))
-		if err != nil {
-			panic(fmt.Sprintf("mockStatsDTCPListener: dial failed: %v", err))
-		}
-
-		defer cc.Close()
-
-		n, err := cc.Write(packet)
-		if err != nil || n != len(packet) {
-			panic(fmt.Sprintf("mockStatsDTCPListener: write failed: %v,%d", err, n))
-		}
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
 	}()
 
-	sc, err := lc.AcceptTCP()
+	events <- event.Events{
+		&event.GaugeEvent{
+			GMetricName: "scale.bytes",
+			GValue:      5000000,
+		},
+		&event.GaugeEvent{
+			GMetricName: "scale.celsius",
+			GValue:      100,
+		},
+		&event.CounterEvent{
+			CMetricName: "scale.cents",
+			CValue:      250,
+		},
+		&event.CounterEvent{
+			CMetricName: "scale.cents",
+			CValue:      150,
+		},
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
 	if err != nil {
-		panic(fmt.Sprintf("mockStatsDTCPListener: accept failed: %v", err))
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
 	}
-	ml.HandleConn(sc)
-}
 
-// TestTtlExpiration validates expiration of time series.
-// foobar metric without mapping should expire with default ttl of 1s
-// bazqux metric should expire with ttl of 2s
-func TestTtlExpiration(t *testing.T) {
-	// Mock a time.NewTicker
-	tickerCh := make(chan time.Time)
-	clock.ClockInstance = &clock.Clock{
-		TickerCh: tickerCh,
+	expected := map[string]float64{
+		"scale_megabytes":     5,
+		"scale_fahrenheit":    212,
+		"scale_dollars_total": 4,
+	}
+	for name, want := range expected {
+		value := getFloat64(metrics, name, prometheus.Labels{})
+		if value == nil {
+			t.Fatalf("Metric %s should be gathered", name)
+		}
+		if *value != want {
+			t.Fatalf("Metric %s has value %v, expected %v", name, *value, want)
+		}
 	}
+}
 
+// TestNoUnitConversion validates that timers of mappings with
+// no_unit_conversion are recorded as received, and others in seconds.
+func TestNoUnitConversion(t *testing.T) {
 	config := `
 defaults:
-  ttl: 1s
+  observer_type: histogram
 mappings:
-- match: bazqux.*
-  name: bazqux
-  ttl: 2s
+- match: raw.payload
+  name: "raw_payload_bytes"
+  no_unit_conversion: true
+- match: raw.latency
+  name: "raw_latency_seconds"
 `
-	// Create mapper from config and start an Exporter with a synchronous channel
 	testMapper := &mapper.MetricMapper{}
 	err := testMapper.InitFromYAMLString(config, 0)
 	if err != nil {
 		t.Fatalf("Config load error: %s %s", config, err)
 	}
+
 	events := make(chan event.Events)
-	defer close(events)
 	go func() {
 		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 		ex.Listen(events)
 	}()
 
-	ev := event.Events{
-		// event with default ttl = 1s
-		&event.GaugeEvent{
-			GMetricName: "foobar",
-			GValue:      200,
+	events <- event.Events{
+		&event.ObserverEvent{
+			OMetricName:   "raw.payload",
+			OValue:        1234,
+			OMilliseconds: true,
 		},
-		// event with ttl = 2s from a mapping
 		&event.ObserverEvent{
-			OMetricName: "bazqux.main",
-			OValue:      42,
+			OMetricName:   "raw.latency",
+			OValue:        250,
+			OMilliseconds: true,
 		},
 	}
-
-	var metrics []*dto.MetricFamily
-	var foobarValue *float64
-	var bazquxValue *float64
-
-	// Step 1. Send events with statsd metrics.
-	// Send empty Events to wait for events are handled.
-	// saveLabelValues will use fake instant as a lastRegisteredAt time.
-	clock.ClockInstance.Instant = time.Unix(0, 0)
-	events <- ev
 	events <- event.Events{}
+	close(events)
 
-	// Check values
-	metrics, err = prometheus.DefaultGatherer.Gather()
+	metrics, err := prometheus.DefaultGatherer.Gather()
 	if err != nil {
-		t.Fatal("Gather should not fail")
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
 	}
-	foobarValue = getFloat64(metrics, "foobar", prometheus.Labels{})
-	bazquxValue = getFloat64(metrics, "bazqux", prometheus.Labels{})
-	if foobarValue == nil || bazquxValue == nil {
-		t.Fatalf("Gauge `foobar` and Summary `bazqux` should be gathered")
+
+	expected := map[string]float64{
+		"raw_payload_bytes":   1234,
+		"raw_latency_seconds": .25,
 	}
-	if *foobarValue != 200 {
-		t.Fatalf("Gauge `foobar` observation %f is not expected. Should be 200", *foobarValue)
+	for name, want := range expected {
+		value := getFloat64(metrics, name, prometheus.Labels{})
+		if value == nil {
+			t.Fatalf("Metric %s should be gathered", name)
+		}
+		if *value != want {
+			t.Fatalf("Metric %s has value %v, expected %v", name, *value, want)
+		}
 	}
-	if *bazquxValue != 42 {
-		t.Fatalf("Summary `bazqux` observation %f is not expected. Should be 42", *bazquxValue)
+}
+
+// TestNoQuantiles validates that summaries with no_quantiles export only
+// their count and sum.
+func TestNoQuantiles(t *testing.T) {
+	config := `
+mappings:
+- match: summary.count_sum
+  name: "summary_count_sum_seconds"
+  summary_options:
+    no_quantiles: true
+- match: summary.quantiles
+  name: "summary_quantiles_seconds"
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
 	}
 
-	// Step 2. Increase Instant to emulate metrics expiration after 1s
-	clock.ClockInstance.Instant = time.Unix(1, 10)
-	clock.ClockInstance.TickerCh <- time.Unix(0, 0)
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	events <- event.Events{
+		&event.ObserverEvent{OMetricName: "summary.count_sum", OValue: 2},
+		&event.ObserverEvent{OMetricName: "summary.count_sum", OValue: 3},
+		&event.ObserverEvent{OMetricName: "summary.quantiles", OValue: 2},
+	}
 	events <- event.Events{}
+	close(events)
 
-	// Check values
-	metrics, err = prometheus.DefaultGatherer.Gather()
+	metrics, err := prometheus.DefaultGatherer.Gather()
 	if err != nil {
-		t.Fatal("Gather should not fail")
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
 	}
-	foobarValue = getFloat64(metrics, "foobar", prometheus.Labels{})
-	bazquxValue = getFloat64(metrics, "bazqux", prometheus.Labels{})
-	if foobarValue != nil {
-		t.Fatalf("Gauge `foobar` should be expired")
+
+	expected := map[string]int{
+		"summary_count_sum_seconds": 0,
+		"summary_quantiles_seconds": 3,
 	}
-	if bazquxValue == nil {
-		t.Fatalf("Summary `bazqux` should be gathered")
+	for name, want := range expected {
+		var summary *dto.Summary
+		for _, mf := range metrics {
+			if mf.GetName() == name {
+				summary = mf.GetMetric()[0].GetSummary()
+			}
+		}
+		if summary == nil {
+			t.Fatalf("Metric %s should be gathered", name)
+		}
+		if got := len(summary.GetQuantile()); got != want {
+			t.Errorf("Metric %s has %d quantiles, expected %d", name, got, want)
+		}
 	}
-	if *bazquxValue != 42 {
-		t.Fatalf("Summary `bazqux` observation %f is not expected. Should be 42", *bazquxValue)
+	if value := getFloat64(metrics, "summary_count_sum_seconds", prometheus.Labels{}); value == nil || *value != 5 {
+		t.Errorf("Metric summary_count_sum_seconds should have a sum of 5, got %v", value)
 	}
+}
 
-	// Step 3. Increase Instant to emulate metrics expiration after 2s
-	clock.ClockInstance.Instant = time.Unix(2, 200)
-	clock.ClockInstance.TickerCh <- time.Unix(0, 0)
-	events <- event.Events{}
+// TestExemplars validates that trace labels of observer events become
+// exemplars of histogram observations.
+func TestExemplars(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("defaults:\n  observer_type: histogram\n", 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Exemplars = true
 
-	// Check values
-	metrics, err = prometheus.DefaultGatherer.Gather()
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.ObserverEvent{
+			OMetricName: "exemplar_timer",
+			OValue:      0.3,
+			OLabels: map[string]string{
+				"la":       "foo",
+				"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+				"span_id":  "00f067aa0ba902b7",
+			},
+		},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
 	if err != nil {
-		t.Fatal("Gather should not fail")
+		t.Fatal(err)
 	}
-	foobarValue = getFloat64(metrics, "foobar", prometheus.Labels{})
-	bazquxValue = getFloat64(metrics, "bazqux", prometheus.Labels{})
-	if bazquxValue != nil {
-		t.Fatalf("Summary `bazqux` should be expired")
+	if value := getFloat64(metrics, "exemplar_timer", prometheus.Labels{"la": "foo"}); value == nil || *value != 0.3 {
+		t.Fatalf("expected exemplar_timer{la=\"foo\"} to be 0.3, got %v", value)
 	}
-	if foobarValue != nil {
-		t.Fatalf("Gauge `foobar` should not be gathered after expiration")
+	var exemplar *dto.Exemplar
+	for _, mf := range metrics {
+		if mf.GetName() != "exemplar_timer" {
+			continue
+		}
+		for _, bucket := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			if bucket.GetExemplar() != nil {
+				exemplar = bucket.GetExemplar()
+			}
+		}
+	}
+	if exemplar == nil {
+		t.Fatal("expected an exemplar")
+	}
+	labels := labelPairsAsLabels(exemplar.GetLabel())
+	if labels["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || labels["span_id"] != "00f067aa0ba902b7" {
+		t.Errorf("unexpected exemplar labels %v", labels)
 	}
 }
 
-func TestHashLabelNames(t *testing.T) {
-	r := registry.NewRegistry(prometheus.DefaultRegisterer, nil)
-	// Validate value hash changes and name has doesn't when just the value changes.
-	hash1, _ := r.HashLabels(map[string]string{
-		"label": "value1",
-	})
-	hash2, _ := r.HashLabels(map[string]string{
-		"label": "value2",
-	})
-	if hash1.Names != hash2.Names {
-		t.Fatal("Hash of label names should match, but doesn't")
+// TestExemplarsSharedLabels validates that every event parsed from one line
+// gets the exemplar, not only the first one.
+func TestExemplarsSharedLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("defaults:\n  observer_type: histogram\n", 0); err != nil {
+		t.Fatal(err)
 	}
-	if hash1.Values == hash2.Values {
-		t.Fatal("Hash of label names shouldn't match, but do")
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Exemplars = true
+
+	parser := line.NewParser()
+	parser.EnableDogstatsdParsing()
+	parser.EnableInfluxdbParsing()
+	var events event.Events
+	for _, l := range []string{"exemplar.sampled:1|ms|@0.5|#trace_id:abc", "exemplar.multi,trace_id=abc:1|ms:2000|ms"} {
+		events = append(events, parser.LineToEvents(l, *sampleErrors, samplesReceived, tagErrors, tagsReceived, log.NewNopLogger())...)
 	}
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(events))
+	}
+	ch := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(ch)
+		close(done)
+	}()
+	ch <- events
+	close(ch)
+	<-done
 
-	// Validate value and name hashes change when the name changes.
-	hash1, _ = r.HashLabels(map[string]string{
-		"label1": "value",
-	})
-	hash2, _ = r.HashLabels(map[string]string{
-		"label2": "value",
-	})
-	if hash1.Names == hash2.Names {
-		t.Fatal("Hash of label names shouldn't match, but do")
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if hash1.Values == hash2.Values {
-		t.Fatal("Hash of label names shouldn't match, but do")
+	exemplars := map[string]int{}
+	for _, mf := range metrics {
+		switch mf.GetName() {
+		case "exemplar_sampled", "exemplar_multi":
+		default:
+			continue
+		}
+		if n := len(mf.GetMetric()); n != 1 {
+			t.Fatalf("expected 1 series of %s, got %d", mf.GetName(), n)
+		}
+		m := mf.GetMetric()[0]
+		if len(m.GetLabel()) != 0 {
+			t.Errorf("expected no labels on %s, got %v", mf.GetName(), m.GetLabel())
+		}
+		if count := m.GetHistogram().GetSampleCount(); count != 2 {
+			t.Errorf("expected 2 observations of %s, got %d", mf.GetName(), count)
+		}
+		for _, bucket := range m.GetHistogram().GetBucket() {
+			if labels := labelPairsAsLabels(bucket.GetExemplar().GetLabel()); labels["trace_id"] == "abc" {
+				exemplars[mf.GetName()]++
+			}
+		}
+	}
+	// The observations of exemplar_multi fall into two different buckets,
+	// which both have the exemplar.
+	if exemplars["exemplar_sampled"] != 1 || exemplars["exemplar_multi"] != 2 {
+		t.Errorf("expected exemplars in 1 bucket of exemplar_sampled and 2 of exemplar_multi, got %v", exemplars)
 	}
 }
 
-// getFloat64 search for metric by name in array of MetricFamily and then search a value by labels.
-// Method returns a value or nil if metric is not found.
-func getFloat64(metrics []*dto.MetricFamily, name string, labels prometheus.Labels) *float64 {
-	var metricFamily *dto.MetricFamily
-	for _, m := range metrics {
-		if *m.Name == name {
-			metricFamily = m
-			break
-		}
+// TestCreatedTimestamps validates that the creation time of counter and
+// histogram series is exported.
+func TestCreatedTimestamps(t *testing.T) {
+	previousClock := clock.ClockInstance
+	defer func() { clock.ClockInstance = previousClock }()
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(100, 0)}
+
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("defaults:\n  observer_type: histogram\n", 0); err != nil {
+		t.Fatal(err)
 	}
-	if metricFamily == nil {
-		return nil
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Registry.(*registry.Registry).CreatedTimestamps = true
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "created_requests_total", CValue: 1, CLabels: map[string]string{"la": "foo"}},
+		&event.ObserverEvent{OMetricName: "created_latency", OValue: 1},
+		&event.GaugeEvent{GMetricName: "created_gauge", GValue: 1},
+	}
+	// Wait for the events to be handled before advancing the clock.
+	events <- event.Events{}
+	clock.ClockInstance.Instant = time.Unix(200, 0)
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "created_requests_total", CValue: 1, CLabels: map[string]string{"la": "foo"}},
 	}
+	close(events)
+	<-done
 
-	var metric *dto.Metric
-	labelStr := fmt.Sprintf("%v", labels)
-	for _, m := range metricFamily.Metric {
-		l := labelPairsAsLabels(m.GetLabel())
-		ls := fmt.Sprintf("%v", l)
-		if labelStr == ls {
-			metric = m
-			break
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		labels prometheus.Labels
+	}{
+		{"created_requests_created", prometheus.Labels{"la": "foo"}},
+		{"created_latency_created", prometheus.Labels{}},
+	} {
+		value := getFloat64(metrics, c.name, c.labels)
+		if value == nil {
+			t.Errorf("expected %s%v to be exported", c.name, c.labels)
+		} else if *value != 100 {
+			t.Errorf("expected %s%v to be 100, got %v", c.name, c.labels, *value)
 		}
 	}
-	if metric == nil {
-		return nil
+	if value := getFloat64(metrics, "created_gauge_created", prometheus.Labels{}); value != nil {
+		t.Errorf("expected no created gauge for gauges, got %v", *value)
 	}
+}
+
+// TestCreatedTimestampsClash validates that created gauges are dropped or
+// skipped when their name is used by another metric after they were created.
+func TestCreatedTimestampsClash(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("", 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Registry.(*registry.Registry).CreatedTimestamps = true
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "clash_total", CValue: 1, CLabels: map[string]string{"la": "foo"}},
+		&event.CounterEvent{CMetricName: "shared_total", CValue: 1, CLabels: map[string]string{"la": "foo"}},
+	}
+	events <- event.Events{
+		&event.GaugeEvent{GMetricName: "clash_created", GValue: 5},
+		&event.CounterEvent{CMetricName: "shared", CValue: 1, CLabels: map[string]string{"lb": "bar"}},
+		&event.CounterEvent{CMetricName: "clash_total", CValue: 1, CLabels: map[string]string{"la": "bar"}},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "clash_created", prometheus.Labels{}); value == nil || *value != 5 {
+		t.Errorf("expected the clash_created gauge to be 5, got %v", value)
+	}
+	for _, labels := range []prometheus.Labels{{"la": "foo"}, {"la": "bar"}} {
+		if value := getFloat64(metrics, "clash_created", labels); value != nil {
+			t.Errorf("expected no created gauge of clash_total%v, got %v", labels, *value)
+		}
+	}
+	if value := getFloat64(metrics, "shared_created", prometheus.Labels{"la": "foo"}); value == nil {
+		t.Errorf("expected the created gauge of shared_total to be kept")
+	}
+	if value := getFloat64(metrics, "shared_created", prometheus.Labels{"lb": "bar"}); value != nil {
+		t.Errorf("expected no created gauge of shared, got %v", *value)
+	}
+}
+
+// TestMappingTargets validates that events are also recorded in the
+// targets of their mapping, with the labels of the event and the target.
+func TestMappingTargets(t *testing.T) {
+	config := `
+mappings:
+- match: targets.*.*
+  name: "targets_duration_seconds"
+  observer_type: histogram
+  labels:
+    service: "$1"
+    endpoint: "$2"
+  targets:
+  - name: "targets_requests_total"
+    type: counter
+    labels:
+      service: "$1"
+  - name: "targets_endpoint_duration_seconds"
+    labels:
+      endpoint: "$2"
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	events <- event.Events{
+		&event.ObserverEvent{
+			OMetricName: "targets.api.login",
+			OValue:      0.5,
+			OLabels:     map[string]string{"region": "eu"},
+		},
+		&event.ObserverEvent{
+			OMetricName: "targets.api.logout",
+			OValue:      0.25,
+			OLabels:     map[string]string{"region": "eu"},
+		},
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+	}
+
+	for _, expected := range []struct {
+		name   string
+		labels prometheus.Labels
+		value  float64
+	}{
+		{"targets_duration_seconds", prometheus.Labels{"service": "api", "endpoint": "login", "region": "eu"}, 0.5},
+		{"targets_requests_total", prometheus.Labels{"service": "api", "region": "eu"}, 2},
+		{"targets_endpoint_duration_seconds", prometheus.Labels{"endpoint": "logout", "region": "eu"}, 0.25},
+	} {
+		value := getFloat64(metrics, expected.name, expected.labels)
+		if value == nil {
+			t.Fatalf("Metric %s with labels %v should be gathered", expected.name, expected.labels)
+		}
+		if *value != expected.value {
+			t.Fatalf("Metric %s has value %v, expected %v", expected.name, *value, expected.value)
+		}
+	}
+}
+
+// TestHistogramEvents validates that all observations of a pre-aggregated
+// histogram are recorded.
+func TestHistogramEvents(t *testing.T) {
+	config := `
+mappings:
+- match: preaggregated.*
+  name: "preaggregated_seconds"
+  observer_type: histogram
+  histogram_options:
+    buckets: [0.2, 1]
+  labels:
+    name: "$1"
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	events <- event.Events{
+		&event.HistogramEvent{
+			HMetricName: "preaggregated.a",
+			HBuckets:    []event.HistogramBucket{{Value: 0.1, Count: 3}, {Value: 0.5, Count: 2}},
+			HLabels:     map[string]string{},
+		},
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+	}
+
+	for _, mf := range metrics {
+		if mf.GetName() != "preaggregated_seconds" {
+			continue
+		}
+		h := mf.GetMetric()[0].GetHistogram()
+		if h.GetSampleCount() != 5 {
+			t.Errorf("expected 5 observations, got %d", h.GetSampleCount())
+		}
+		if sum := h.GetSampleSum(); sum < 1.29 || sum > 1.31 {
+			t.Errorf("expected a sum of 1.3, got %v", sum)
+		}
+		if c := h.GetBucket()[0].GetCumulativeCount(); c != 3 {
+			t.Errorf("expected 3 observations up to 0.2, got %d", c)
+		}
+		return
+	}
+	t.Fatalf("Metric preaggregated_seconds should be gathered")
+}
+
+// TestDropUnmapped validates that unmapped events are dropped by the default
+// action of the config or the exporter option.
+func TestDropUnmapped(t *testing.T) {
+	for name, scenario := range map[string]struct {
+		config       string
+		dropUnmapped bool
+		metricName   string
+	}{
+		"default action": {
+			config: `
+defaults:
+  action: drop
+mappings:
+- match: dropunmapped.*
+  name: "dropunmapped_default_action_total"
+`,
+			metricName: "dropunmapped_default_action_total",
+		},
+		"exporter option": {
+			config: `
+mappings:
+- match: dropunmapped.*
+  name: "dropunmapped_exporter_option_total"
+`,
+			dropUnmapped: true,
+			metricName:   "dropunmapped_exporter_option_total",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testMapper := &mapper.MetricMapper{}
+			err := testMapper.InitFromYAMLString(scenario.config, 0)
+			if err != nil {
+				t.Fatalf("Config load error: %s %s", scenario.config, err)
+			}
+
+			ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+			ex.DropUnmapped = scenario.dropUnmapped
+			events := make(chan event.Events)
+			go ex.Listen(events)
+
+			dropped := getTelemetryCounterValue(eventsActions.WithLabelValues("drop"))
+			events <- event.Events{
+				&event.CounterEvent{
+					CMetricName: "dropunmapped.a",
+					CValue:      1,
+					CLabels:     map[string]string{},
+				},
+				&event.CounterEvent{
+					CMetricName: "dropunmapped_other",
+					CValue:      1,
+					CLabels:     map[string]string{},
+				},
+			}
+			events <- event.Events{}
+			close(events)
+
+			metrics, err := prometheus.DefaultGatherer.Gather()
+			if err != nil {
+				t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+			}
+			if getFloat64(metrics, "dropunmapped_other", prometheus.Labels{}) != nil {
+				t.Errorf("Unmapped metric dropunmapped_other should not be exported")
+			}
+			if getFloat64(metrics, scenario.metricName, prometheus.Labels{}) == nil {
+				t.Errorf("Mapped metric %s should be exported", scenario.metricName)
+			}
+			if got := getTelemetryCounterValue(eventsActions.WithLabelValues("drop")) - dropped; got != 1 {
+				t.Errorf("Expected 1 dropped event, got %v", got)
+			}
+		})
+	}
+}
+
+// TestMaxSeries validates that series beyond the limit of a mapping are
+// dropped, while other mappings are unaffected.
+func TestMaxSeries(t *testing.T) {
+	config := `
+defaults:
+  max_series: 1
+mappings:
+- match: maxseries.limited.*
+  name: "maxseries_limited_total"
+  max_series: 2
+  labels:
+    id: "$1"
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	limited := getTelemetryCounterValue(errorEventStats.WithLabelValues("series_limit"))
+	ev := event.Events{}
+	for _, id := range []string{"a", "b", "c", "a"} {
+		ev = append(ev, &event.CounterEvent{
+			CMetricName: "maxseries.limited." + id,
+			CValue:      1,
+			CLabels:     map[string]string{},
+		})
+	}
+	// Unmapped events are limited by the default.
+	for _, name := range []string{"maxseries_unmapped_a", "maxseries_unmapped_b"} {
+		ev = append(ev, &event.CounterEvent{
+			CMetricName: name,
+			CValue:      1,
+			CLabels:     map[string]string{},
+		})
+	}
+	events <- ev
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+	}
+	for id, want := range map[string]float64{"a": 2, "b": 1} {
+		value := getFloat64(metrics, "maxseries_limited_total", prometheus.Labels{"id": id})
+		if value == nil || *value != want {
+			t.Errorf("Series with id %s should have value %v, got %v", id, want, value)
+		}
+	}
+	if getFloat64(metrics, "maxseries_limited_total", prometheus.Labels{"id": "c"}) != nil {
+		t.Errorf("Series with id c should have been dropped")
+	}
+	if getFloat64(metrics, "maxseries_unmapped_a", prometheus.Labels{}) == nil {
+		t.Errorf("Unmapped series maxseries_unmapped_a should be gathered")
+	}
+	if getFloat64(metrics, "maxseries_unmapped_b", prometheus.Labels{}) != nil {
+		t.Errorf("Unmapped series maxseries_unmapped_b should have been dropped")
+	}
+	if got := getTelemetryCounterValue(errorEventStats.WithLabelValues("series_limit")) - limited; got != 2 {
+		t.Errorf("Expected 2 events dropped by the series limit, got %v", got)
+	}
+}
+
+// TestDropLabelValues validates that events are dropped when one of their
+// labels, whether captured by the mapping or from tags, matches a pattern.
+func TestDropLabelValues(t *testing.T) {
+	config := `
+mappings:
+- match: droplabels.*.requests
+  name: "droplabels_requests_total"
+  labels:
+    service: "$1"
+  drop_label_values:
+    env: "dev|test"
+    service: "internal"
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	events <- event.Events{
+		&event.CounterEvent{
+			CMetricName: "droplabels.api.requests",
+			CValue:      1,
+			CLabels:     map[string]string{"env": "prod"},
+		},
+		&event.CounterEvent{
+			CMetricName: "droplabels.api.requests",
+			CValue:      1,
+			CLabels:     map[string]string{"env": "dev"},
+		},
+		&event.CounterEvent{
+			CMetricName: "droplabels.api.requests",
+			CValue:      1,
+			CLabels:     map[string]string{"env": "development"},
+		},
+		&event.CounterEvent{
+			CMetricName: "droplabels.internal.requests",
+			CValue:      1,
+			CLabels:     map[string]string{"env": "prod"},
+		},
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+	}
+
+	scenarios := []struct {
+		labels  prometheus.Labels
+		present bool
+	}{
+		{labels: prometheus.Labels{"service": "api", "env": "prod"}, present: true},
+		{labels: prometheus.Labels{"service": "api", "env": "dev"}, present: false},
+		{labels: prometheus.Labels{"service": "api", "env": "development"}, present: true},
+		{labels: prometheus.Labels{"service": "internal", "env": "prod"}, present: false},
+	}
+	for _, s := range scenarios {
+		value := getFloat64(metrics, "droplabels_requests_total", s.labels)
+		if s.present && value == nil {
+			t.Fatalf("Series with labels %v should be present", s.labels)
+		}
+		if !s.present && value != nil {
+			t.Fatalf("Series with labels %v should have been dropped", s.labels)
+		}
+	}
+}
+
+// TestMetricGroups validates that only the metrics of the requested group
+// are gathered when filtering by group.
+func TestMetricGroups(t *testing.T) {
+	config := `
+mappings:
+- match: groups.fast.*
+  name: "groups_fast"
+  group: fast
+  labels:
+    type: "$1"
+- match: groups.slow.*
+  name: "groups_slow"
+  group: slow
+  labels:
+    type: "$1"
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	events := make(chan event.Events)
+	go ex.Listen(events)
+
+	events <- event.Events{
+		&event.GaugeEvent{
+			GMetricName: "groups.fast.a",
+			GValue:      1,
+			GLabels:     map[string]string{},
+		},
+		&event.GaugeEvent{
+			GMetricName: "groups.slow.a",
+			GValue:      2,
+			GLabels:     map[string]string{},
+		},
+		&event.GaugeEvent{
+			GMetricName: "groups.none",
+			GValue:      3,
+			GLabels:     map[string]string{},
+		},
+	}
+	events <- event.Events{}
+	close(events)
+
+	gatherer := registry.GroupGatherer{
+		Gatherer: prometheus.DefaultGatherer,
+		Groups:   ex.Groups,
+		Group:    "fast",
+	}
+	metrics, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from GroupGatherer: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetName() != "groups_fast" {
+		names := []string{}
+		for _, m := range metrics {
+			names = append(names, m.GetName())
+		}
+		t.Fatalf("Expected only groups_fast to be gathered, got %v", names)
+	}
+}
+
+// TestFilterGatherer validates that gathered metrics can be filtered by name
+// and label matchers.
+func TestFilterGatherer(t *testing.T) {
+	events := make(chan event.Events)
+	go func() {
+		events <- event.Events{
+			&event.CounterEvent{
+				CMetricName: "filter_requests",
+				CValue:      1,
+				CLabels:     map[string]string{"code": "200"},
+			},
+			&event.CounterEvent{
+				CMetricName: "filter_requests",
+				CValue:      1,
+				CLabels:     map[string]string{"code": "503"},
+			},
+			&event.CounterEvent{
+				CMetricName: "filter_other",
+				CValue:      1,
+				CLabels:     map[string]string{"code": "500"},
+			},
+		}
+		close(events)
+	}()
+
+	testMapper := &mapper.MetricMapper{}
+	testMapper.InitCache(0)
+	ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Listen(events)
+
+	matcher, err := registry.ParseLabelMatcher("code=~5..")
+	if err != nil {
+		t.Fatalf("Cannot parse label matcher: %v", err)
+	}
+	gatherer := registry.FilterGatherer{
+		Gatherer: prometheus.DefaultGatherer,
+		Names:    []string{"filter_requests"},
+		Matchers: []*registry.LabelMatcher{matcher},
+	}
+	metrics, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from FilterGatherer: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetName() != "filter_requests" {
+		t.Fatalf("Expected only filter_requests to be gathered, got %d families", len(metrics))
+	}
+	if len(metrics[0].Metric) != 1 || metrics[0].Metric[0].GetLabel()[0].GetValue() != "503" {
+		t.Fatalf("Expected only the series with code 503, got %v", metrics[0].Metric)
+	}
+
+	for _, bad := range []string{"code", "=5..", "code=~("} {
+		if _, err := registry.ParseLabelMatcher(bad); err == nil {
+			t.Errorf("Expected an error parsing label matcher %q", bad)
+		}
+	}
+}
+
+// TestEnumStates validates that gauges of enum mappings set one series per
+// state, and that values that don't select a state are rejected.
+func TestEnumStates(t *testing.T) {
+	config := `
+mappings:
+- match: enum.*.status
+  name: "enum_status"
+  labels:
+    service: "$1"
+  enum_states: [starting, running, stopped]
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	errorCounter := errorEventStats.WithLabelValues("invalid_enum_state")
+	prev := getTelemetryCounterValue(errorCounter)
+
+	events := make(chan event.Events)
+	go func() {
+		events <- event.Events{
+			&event.GaugeEvent{
+				GMetricName: "enum.api.status",
+				GValue:      0,
+				GLabels:     map[string]string{},
+			},
+			&event.GaugeEvent{
+				GMetricName: "enum.api.status",
+				GValue:      1,
+				GLabels:     map[string]string{},
+			},
+			&event.GaugeEvent{
+				GMetricName: "enum.api.status",
+				GValue:      3,
+				GLabels:     map[string]string{},
+			},
+			&event.GaugeEvent{
+				GMetricName: "enum.api.status",
+				GValue:      1,
+				GRelative:   true,
+				GLabels:     map[string]string{},
+			},
+		}
+		close(events)
+	}()
+
+	ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Listen(events)
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+	}
+	expected := map[string]float64{"starting": 0, "running": 1, "stopped": 0}
+	for state, value := range expected {
+		labels := map[string]string{"service": "api", "state": state}
+		got := getFloat64(metrics, "enum_status", labels)
+		if got == nil || *got != value {
+			t.Errorf("Expected enum_status%v to be %v, got %v", labels, value, got)
+		}
+	}
+
+	if got := getTelemetryCounterValue(errorCounter) - prev; got != 2 {
+		t.Errorf("Expected 2 invalid enum state errors, got %v", got)
+	}
+}
+
+// TestMaxEventAge validates that events received longer ago than the maximum
+// event age are dropped and counted.
+func TestMaxEventAge(t *testing.T) {
+	previousClock := clock.ClockInstance
+	defer func() { clock.ClockInstance = previousClock }()
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(100, 0)}
+
+	fresh := &event.GaugeEvent{
+		GMetricName: "maxage_fresh",
+		GValue:      1,
+		GLabels:     map[string]string{},
+	}
+	fresh.SetReceivedAt(time.Unix(99, 0))
+	stale := &event.GaugeEvent{
+		GMetricName: "maxage_stale",
+		GValue:      1,
+		GLabels:     map[string]string{},
+	}
+	stale.SetReceivedAt(time.Unix(50, 0))
+	untimed := &event.GaugeEvent{
+		GMetricName: "maxage_untimed",
+		GValue:      1,
+		GLabels:     map[string]string{},
+	}
+
+	errorCounter := errorEventStats.WithLabelValues("too_old")
+	prev := getTelemetryCounterValue(errorCounter)
+
+	testMapper := &mapper.MetricMapper{}
+	testMapper.InitCache(0)
+	ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.MaxEventAge = 10 * time.Second
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{fresh, stale, untimed}
+	close(events)
+	// Listen must return before the deferred restore of the clock.
+	<-done
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+	}
+	if getFloat64(metrics, "maxage_fresh", prometheus.Labels{}) == nil {
+		t.Fatal("Fresh event should have been handled")
+	}
+	if getFloat64(metrics, "maxage_untimed", prometheus.Labels{}) == nil {
+		t.Fatal("Event without receive time should have been handled")
+	}
+	if getFloat64(metrics, "maxage_stale", prometheus.Labels{}) != nil {
+		t.Fatal("Stale event should have been dropped")
+	}
+	if updated := getTelemetryCounterValue(errorCounter); updated-prev != 1 {
+		t.Fatalf("Expected 1 stale event to be counted, got %v", updated-prev)
+	}
+}
+
+// TestEventTracer validates that the handling of traced events is logged at
+// info level, and that tracing expires.
+func TestEventTracer(t *testing.T) {
+	previousClock := clock.ClockInstance
+	defer func() { clock.ClockInstance = previousClock }()
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(100, 0)}
+
+	var buf bytes.Buffer
+	logger := level.NewFilter(log.NewLogfmtLogger(&buf), level.AllowInfo())
+
+	testMapper := &mapper.MetricMapper{}
+	testMapper.InitCache(0)
+	ex := NewExporter(prometheus.DefaultRegisterer, testMapper, logger, eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Tracer = &EventTracer{}
+	if err := ex.Tracer.Trace(`trace\.foo\..*`, time.Minute); err != nil {
+		t.Fatalf("Failed to start tracing: %v", err)
+	}
+
+	ex.handleEvent(&event.CounterEvent{CMetricName: "trace.bar.a", CValue: 1, CLabels: map[string]string{}})
+	if buf.Len() != 0 {
+		t.Fatalf("Untraced event should not be logged, got %q", buf.String())
+	}
+
+	ex.handleEvent(&event.CounterEvent{CMetricName: "trace.foo.a", CValue: 1, CLabels: map[string]string{}})
+	if !strings.Contains(buf.String(), "trace=trace.foo.a") {
+		t.Fatalf("Traced event should be logged, got %q", buf.String())
+	}
+
+	buf.Reset()
+	clock.ClockInstance.Instant = time.Unix(200, 0)
+	ex.handleEvent(&event.CounterEvent{CMetricName: "trace.foo.a", CValue: 1, CLabels: map[string]string{}})
+	if buf.Len() != 0 {
+		t.Fatalf("Tracing should have expired, got %q", buf.String())
+	}
+}
+
+// TestCandidate validates that a candidate mapping config is only evaluated
+// until it is promoted, and that its divergences are counted.
+func TestCandidate(t *testing.T) {
+	active := `
+mappings:
+- match: candidate.*.a
+  name: "candidate_a"
+- match: candidate.*.b
+  name: "candidate_b"
+  labels:
+    host: "$1"
+`
+	candidate := `
+mappings:
+- match: candidate.*.a
+  name: "candidate_a"
+- match: candidate.*.b
+  name: "candidate_b"
+  labels:
+    instance: "$1"
+- match: candidate.*.c
+  name: "candidate_c"
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(active, 0); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Candidate = &Candidate{
+		Active:      testMapper,
+		Events:      prometheus.NewCounter(prometheus.CounterOpts{Name: "candidate_events"}),
+		Divergences: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "candidate_divergences"}, []string{"reason"}),
+	}
+	if err := ex.Candidate.Load(candidate); err != nil {
+		t.Fatalf("Candidate load error: %s", err)
+	}
+
+	for _, name := range []string{"candidate.x.a", "candidate.x.b", "candidate.x.c"} {
+		ex.handleEvent(&event.CounterEvent{CMetricName: name, CValue: 1, CLabels: map[string]string{}})
+	}
+	if got := getTelemetryCounterValue(ex.Candidate.Events); got != 3 {
+		t.Errorf("Expected 3 evaluated events, got %v", got)
+	}
+	for reason, expected := range map[string]float64{DivergenceLabels: 1, DivergenceMatch: 1, DivergenceName: 0} {
+		if got := getTelemetryCounterValue(ex.Candidate.Divergences.WithLabelValues(reason)); got != expected {
+			t.Errorf("Expected %v divergences by %s, got %v", expected, reason, got)
+		}
+	}
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+	}
+	if getFloat64(metrics, "candidate_c", prometheus.Labels{}) != nil {
+		t.Errorf("The candidate should not change the exported metrics")
+	}
+
+	if err := ex.Candidate.Promote(); err != nil {
+		t.Fatalf("Promote error: %s", err)
+	}
+	if ex.Candidate.Config() != "" {
+		t.Errorf("Expected the candidate to be cleared after promotion")
+	}
+	if mapping, labels, present := testMapper.GetMapping("candidate.x.b", mapper.MetricTypeCounter); !present || labels["instance"] != "x" {
+		t.Errorf("Expected the promoted config to be active, got %v %v", mapping, labels)
+	}
+	if err := ex.Candidate.Promote(); err == nil {
+		t.Errorf("Expected promoting without a candidate to fail")
+	}
+}
+
+// TestTtlJitter validates that series sharing a TTL with jitter expire
+// spread out between the TTL and the TTL extended by the jitter.
+func TestTtlJitter(t *testing.T) {
+	config := `
+defaults:
+  ttl: 10s
+  ttl_jitter: 50
+mappings:
+- match: jitter.*
+  name: jitter
+  labels:
+    series: "$1"
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	mapping, _, _ := testMapper.GetMapping("jitter.a", mapper.MetricTypeGauge)
+	if mapping.TtlJitter != 50 {
+		t.Fatalf("Expected the mapping to inherit the default jitter, got %v", mapping.TtlJitter)
+	}
+
+	r := registry.NewRegistry(prometheus.NewRegistry(), testMapper)
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+	const series = 100
+	for i := 0; i < series; i++ {
+		if _, err := r.GetGauge("jitter", prometheus.Labels{"series": fmt.Sprint(i)}, "", mapping, metricsCount); err != nil {
+			t.Fatalf("Failed to create gauge: %v", err)
+		}
+	}
+
+	for _, step := range []struct {
+		at       time.Duration
+		min, max int64
+	}{
+		{at: 10 * time.Second, min: series, max: series},
+		{at: 12500 * time.Millisecond, min: 1, max: series - 1},
+		{at: 15 * time.Second, min: 0, max: 0},
+	} {
+		clock.ClockInstance.Instant = time.Unix(0, 0).Add(step.at)
+		r.RemoveStaleMetrics()
+		if n := r.SeriesCount(); n < step.min || n > step.max {
+			t.Errorf("After %v, expected between %d and %d series, got %d", step.at, step.min, step.max, n)
+		}
+	}
+
+	if err := testMapper.InitFromYAMLString("defaults:\n  ttl_jitter: 101\n", 0); err == nil {
+		t.Error("Expected an error for a jitter over 100")
+	}
+}
+
+// TestExpiryRemovesMetric validates that a metric whose last series expired
+// is no longer collected, and that its name can be used with another type.
+func TestExpiryRemovesMetric(t *testing.T) {
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("defaults:\n  ttl: 1s\n", 0); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	reg := prometheus.NewRegistry()
+	r := registry.NewRegistry(reg, testMapper)
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+
+	mapping := &mapper.MetricMapping{Ttl: time.Second}
+	if _, err := r.GetCounter("expiring", prometheus.Labels{"a": "1"}, "", mapping, metricsCount); err != nil {
+		t.Fatalf("Failed to create counter: %v", err)
+	}
+	if _, err := r.GetGauge("expiring", prometheus.Labels{}, "", mapping, metricsCount); err == nil {
+		t.Fatalf("Expected a conflict while the counter exists")
+	}
+
+	clock.ClockInstance.Instant = time.Unix(2, 0)
+	r.RemoveStaleMetrics()
+	if _, ok := r.Metrics["expiring"]; ok {
+		t.Fatalf("Expected the metric to be removed with its last series")
+	}
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	if len(metrics) != 0 {
+		t.Fatalf("Expected no metrics to be collected, got %v", metrics)
+	}
+
+	if _, err := r.GetGauge("expiring", prometheus.Labels{}, "", mapping, metricsCount); err != nil {
+		t.Fatalf("Expected the name to be free for a gauge: %v", err)
+	}
+	metrics, err = reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetType() != dto.MetricType_GAUGE {
+		t.Fatalf("Expected only the gauge to be collected, got %v", metrics)
+	}
+}
+
+// TestReloadRemovesOrphanedMetrics validates that the series of mappings
+// that are removed or renamed on reload are deleted, and others are kept.
+func TestReloadRemovesOrphanedMetrics(t *testing.T) {
+	tickerCh := make(chan time.Time)
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+
+	config := `
+mappings:
+- match: orphan.kept.*
+  name: orphan_kept
+  labels:
+    name: "$1"
+- match: orphan.removed.*
+  name: orphan_removed
+- match: orphan.renamed.*
+  name: orphan_renamed
+`
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "orphan.kept.a", CValue: 1, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "orphan.removed.a", CValue: 1, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "orphan.renamed.a", CValue: 1, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "orphan_unmapped", CValue: 1, CLabels: map[string]string{}},
+	}
+	events <- event.Events{}
+
+	// Changing the help text keeps the origin of the mapping.
+	config = `
+mappings:
+- match: orphan.kept.*
+  name: orphan_kept
+  help: "Kept."
+  labels:
+    name: "$1"
+- match: orphan.renamed.*
+  name: orphan_renamed_total
+`
+	if err := testMapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	clock.ClockInstance.TickerCh <- time.Unix(0, 0)
+	events <- event.Events{}
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	for name, expected := range map[string]bool{
+		"orphan_kept":     true,
+		"orphan_unmapped": true,
+		"orphan_removed":  false,
+		"orphan_renamed":  false,
+	} {
+		found := false
+		for _, mf := range metrics {
+			if mf.GetName() == name {
+				found = true
+			}
+		}
+		if found != expected {
+			t.Errorf("Expected %s to be exported: %v, got %v", name, expected, found)
+		}
+	}
+}
+
+// TestConflictPolicy validates the handling of a metric name that is used
+// with another type than it is registered with.
+func TestConflictPolicy(t *testing.T) {
+	testMapper := &mapper.MetricMapper{}
+	testMapper.InitCache(0)
+	mapping := &mapper.MetricMapping{}
+
+	for _, policy := range []registry.ConflictPolicy{registry.ConflictReject, registry.ConflictReplace, registry.ConflictSuffix} {
+		t.Run(string(policy), func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			r := registry.NewRegistry(reg, testMapper)
+			r.ConflictPolicy = policy
+
+			if _, err := r.GetCounter("conflict", prometheus.Labels{}, "", mapping, metricsCount); err != nil {
+				t.Fatalf("Failed to create counter: %v", err)
+			}
+			_, err := r.GetGauge("conflict", prometheus.Labels{}, "", mapping, metricsCount)
+			if policy == registry.ConflictReject {
+				if err == nil {
+					t.Fatal("Expected the gauge to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to create gauge: %v", err)
+			}
+
+			metrics, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("Cannot gather: %v", err)
+			}
+			types := map[string]dto.MetricType{}
+			for _, mf := range metrics {
+				types[mf.GetName()] = mf.GetType()
+			}
+			expected := map[string]dto.MetricType{"conflict": dto.MetricType_GAUGE}
+			if policy == registry.ConflictSuffix {
+				expected = map[string]dto.MetricType{"conflict": dto.MetricType_COUNTER, "conflict_gauge": dto.MetricType_GAUGE}
+			}
+			if !reflect.DeepEqual(types, expected) {
+				t.Fatalf("Expected metrics %v, got %v", expected, types)
+			}
+		})
+	}
+}
+
+// TestMetricHelpConflict validates that vectors of one metric with different
+// label names share the help text the metric was registered with.
+func TestMetricHelpConflict(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	testMapper.InitCache(0)
+	r := registry.NewRegistry(reg, testMapper)
+
+	mapping := &mapper.MetricMapping{}
+	if _, err := r.GetCounter("help_conflict", prometheus.Labels{"a": "1"}, "First help.", mapping, metricsCount); err != nil {
+		t.Fatalf("Failed to create counter: %v", err)
+	}
+	if _, err := r.GetCounter("help_conflict", prometheus.Labels{"b": "1"}, "Second help.", mapping, metricsCount); err != nil {
+		t.Fatalf("Failed to create counter: %v", err)
+	}
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].GetHelp() != "First help." || len(metrics[0].GetMetric()) != 2 {
+		t.Fatalf("Expected both series with the first help, got %v", metrics)
+	}
+}
+
+// TestOmitHelpGatherer validates that only the HELP text of metrics with the
+// given help text is removed.
+func TestOmitHelpGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	testMapper.InitCache(0)
+	r := registry.NewRegistry(reg, testMapper)
+
+	mapping := &mapper.MetricMapping{}
+	if _, err := r.GetGauge("omit_help_default", prometheus.Labels{}, defaultHelp, mapping, metricsCount); err != nil {
+		t.Fatalf("Failed to create gauge: %v", err)
+	}
+	if _, err := r.GetGauge("omit_help_custom", prometheus.Labels{}, "Custom help.", mapping, metricsCount); err != nil {
+		t.Fatalf("Failed to create gauge: %v", err)
+	}
+
+	gatherer := registry.OmitHelpGatherer{Gatherer: reg, Help: defaultHelp}
+	metrics, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	for _, mf := range metrics {
+		switch mf.GetName() {
+		case "omit_help_default":
+			if mf.Help != nil {
+				t.Fatalf("Expected no help for %s, got %q", mf.GetName(), mf.GetHelp())
+			}
+		case "omit_help_custom":
+			if mf.GetHelp() != "Custom help." {
+				t.Fatalf("Expected custom help for %s, got %q", mf.GetName(), mf.GetHelp())
+			}
+		}
+	}
+}
+
+type statsDPacketHandler interface {
+	HandlePacket(packet []byte)
+	SetEventHandler(eh event.EventHandler)
+}
+
+type mockStatsDTCPListener struct {
+	listener.StatsDTCPListener
+	log.Logger
+}
+
+func (ml *mockStatsDTCPListener) HandlePacket(packet []byte) {
+	// Forcing IPv4 because the TravisCI build environment does not have IPv6
+	// addresses.
+	lc, err := net.ListenTCP("tcp4", nil)
+	if err != nil {
+		panic(fmt.Sprintf("mockStatsDTCPListener: listen failed: %v", err))
+	}
+
+	defer lc.Close()
+
+	go func() {
+		cc, err := net.DialTCP("tcp", nil, lc.Addr().(*net.TCPAddr))
+		if err != nil {
+			panic(fmt.Sprintf("mockStatsDTCPListener: dial failed: %v", err))
+		}
+
+		defer cc.Close()
+
+		n, err := cc.Write(packet)
+		if err != nil || n != len(packet) {
+			panic(fmt.Sprintf("mockStatsDTCPListener: write failed: %v,%d", err, n))
+		}
+	}()
+
+	sc, err := lc.AcceptTCP()
+	if err != nil {
+		panic(fmt.Sprintf("mockStatsDTCPListener: accept failed: %v", err))
+	}
+	ml.HandleConn(sc)
+}
+
+// TestTtlExpiration validates expiration of time series.
+// foobar metric without mapping should expire with default ttl of 1s
+// bazqux metric should expire with ttl of 2s
+func TestTtlExpiration(t *testing.T) {
+	// Mock a time.NewTicker
+	tickerCh := make(chan time.Time)
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+
+	config := `
+defaults:
+  ttl: 1s
+mappings:
+- match: bazqux.*
+  name: bazqux
+  ttl: 2s
+`
+	// Create mapper from config and start an Exporter with a synchronous channel
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	ev := event.Events{
+		// event with default ttl = 1s
+		&event.GaugeEvent{
+			GMetricName: "foobar",
+			GValue:      200,
+		},
+		// event with ttl = 2s from a mapping
+		&event.ObserverEvent{
+			OMetricName: "bazqux.main",
+			OValue:      42,
+		},
+		// labeled event with default ttl = 1s
+		&event.GaugeEvent{
+			GMetricName: "foobar_labeled",
+			GValue:      1,
+			GLabels:     map[string]string{"label": "value"},
+		},
+	}
+
+	var metrics []*dto.MetricFamily
+	var foobarValue *float64
+	var bazquxValue *float64
+
+	// Step 1. Send events with statsd metrics.
+	// Send empty Events to wait for events are handled.
+	// saveLabelValues will use fake instant as a lastRegisteredAt time.
+	clock.ClockInstance.Instant = time.Unix(0, 0)
+	events <- ev
+	events <- event.Events{}
+
+	// Check values
+	metrics, err = prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("Gather should not fail")
+	}
+	foobarValue = getFloat64(metrics, "foobar", prometheus.Labels{})
+	bazquxValue = getFloat64(metrics, "bazqux", prometheus.Labels{})
+	if foobarValue == nil || bazquxValue == nil {
+		t.Fatalf("Gauge `foobar` and Summary `bazqux` should be gathered")
+	}
+	if *foobarValue != 200 {
+		t.Fatalf("Gauge `foobar` observation %f is not expected. Should be 200", *foobarValue)
+	}
+	if *bazquxValue != 42 {
+		t.Fatalf("Summary `bazqux` observation %f is not expected. Should be 42", *bazquxValue)
+	}
+	if getFloat64(metrics, "foobar_labeled", prometheus.Labels{"label": "value"}) == nil {
+		t.Fatalf("Gauge `foobar_labeled` should be gathered")
+	}
+
+	// Step 2. Increase Instant to emulate metrics expiration after 1s
+	clock.ClockInstance.Instant = time.Unix(1, 10)
+	clock.ClockInstance.TickerCh <- time.Unix(0, 0)
+	events <- event.Events{}
+
+	// Check values
+	metrics, err = prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("Gather should not fail")
+	}
+	foobarValue = getFloat64(metrics, "foobar", prometheus.Labels{})
+	bazquxValue = getFloat64(metrics, "bazqux", prometheus.Labels{})
+	if foobarValue != nil {
+		t.Fatalf("Gauge `foobar` should be expired")
+	}
+	if getFloat64(metrics, "foobar_labeled", prometheus.Labels{"label": "value"}) != nil {
+		t.Fatalf("Gauge `foobar_labeled` should be expired")
+	}
+	if bazquxValue == nil {
+		t.Fatalf("Summary `bazqux` should be gathered")
+	}
+	if *bazquxValue != 42 {
+		t.Fatalf("Summary `bazqux` observation %f is not expected. Should be 42", *bazquxValue)
+	}
+
+	// Step 3. Increase Instant to emulate metrics expiration after 2s
+	clock.ClockInstance.Instant = time.Unix(2, 200)
+	clock.ClockInstance.TickerCh <- time.Unix(0, 0)
+	events <- event.Events{}
+
+	// Check values
+	metrics, err = prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("Gather should not fail")
+	}
+	foobarValue = getFloat64(metrics, "foobar", prometheus.Labels{})
+	bazquxValue = getFloat64(metrics, "bazqux", prometheus.Labels{})
+	if bazquxValue != nil {
+		t.Fatalf("Summary `bazqux` should be expired")
+	}
+	if foobarValue != nil {
+		t.Fatalf("Gauge `foobar` should not be gathered after expiration")
+	}
+}
+
+// TestEmitRate validates that counters of mappings with emit_rate get a gauge
+// of their rate over the rate window.
+func TestEmitRate(t *testing.T) {
+	tickerCh := make(chan time.Time)
+	clock.ClockInstance = &clock.Clock{
+		Instant:  time.Unix(0, 0),
+		TickerCh: tickerCh,
+	}
+	defer func() { clock.ClockInstance = nil }()
+
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: rated.*
+  name: rated_requests_total
+  emit_rate: true
+  labels:
+    code: $1
+`, 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.RateWindow = 10 * time.Second
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "rated.200", CValue: 30, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "rated.200", CValue: 20, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "unrated", CValue: 5, CLabels: map[string]string{}},
+	}
+
+	rate := func() *float64 {
+		events <- event.Events{}
+		metrics, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := getFloat64(metrics, "unrated_rate", prometheus.Labels{}); value != nil {
+			t.Errorf("expected no rate for unrated, got %v", *value)
+		}
+		return getFloat64(metrics, "rated_requests_total_rate", prometheus.Labels{"code": "200"})
+	}
+
+	// Wait for the events to be handled before advancing the clock.
+	events <- event.Events{}
+
+	// Before the window has passed, the rate is not known yet.
+	clock.ClockInstance.Instant = time.Unix(5, 0)
+	tickerCh <- time.Unix(5, 0)
+	if value := rate(); value == nil || *value != 0 {
+		t.Errorf("expected the rate to be 0 before the first window, got %v", value)
+	}
+
+	clock.ClockInstance.Instant = time.Unix(10, 0)
+	tickerCh <- time.Unix(10, 0)
+	if value := rate(); value == nil || *value != 5 {
+		t.Errorf("expected a rate of 5, got %v", value)
+	}
+
+	clock.ClockInstance.Instant = time.Unix(20, 0)
+	tickerCh <- time.Unix(20, 0)
+	if value := rate(); value == nil || *value != 0 {
+		t.Errorf("expected a rate of 0 without increments, got %v", value)
+	}
+
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range metrics {
+		if mf.GetName() == "rated_requests_total_rate" && mf.GetHelp() != rateHelp {
+			t.Errorf("expected the help text of rate gauges, got %q", mf.GetHelp())
+		}
+	}
+}
+
+// TestZeroOnExpiry validates that gauges of mappings with on_expiry: zero are
+// set to 0 instead of being deleted when they expire.
+func TestZeroOnExpiry(t *testing.T) {
+	tickerCh := make(chan time.Time)
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+	defer func() { clock.ClockInstance = nil }()
+
+	config := `
+mappings:
+- match: worker.*.up
+  name: worker_up
+  ttl: 1s
+  on_expiry: zero
+  labels:
+    worker: "$1"
+- match: worker.*.duration
+  name: worker_duration
+  ttl: 1s
+  on_expiry: zero
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	ev := event.Events{
+		&event.GaugeEvent{
+			GMetricName: "worker.a.up",
+			GValue:      1,
+			GLabels:     map[string]string{},
+		},
+		&event.ObserverEvent{
+			OMetricName: "worker.a.duration",
+			OValue:      3,
+			OLabels:     map[string]string{},
+		},
+	}
+	labels := prometheus.Labels{"worker": "a"}
+
+	expect := func(up float64, durationPresent bool) {
+		t.Helper()
+		metrics, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal("Gather should not fail")
+		}
+		value := getFloat64(metrics, "worker_up", labels)
+		if value == nil || *value != up {
+			t.Fatalf("Expected gauge `worker_up` to be %v, got %v", up, value)
+		}
+		if present := getFloat64(metrics, "worker_duration", prometheus.Labels{}) != nil; present != durationPresent {
+			t.Fatalf("Expected summary `worker_duration` present to be %v, got %v", durationPresent, present)
+		}
+	}
+
+	clock.ClockInstance.Instant = time.Unix(0, 0)
+	events <- ev
+	events <- event.Events{}
+	expect(1, true)
+
+	// The gauge is kept at 0, while other types are still deleted.
+	clock.ClockInstance.Instant = time.Unix(1, 10)
+	clock.ClockInstance.TickerCh <- time.Unix(0, 0)
+	events <- event.Events{}
+	expect(0, false)
+
+	// Updates bring the gauge back, and it expires again.
+	events <- ev[:1]
+	events <- event.Events{}
+	expect(1, false)
+
+	clock.ClockInstance.Instant = time.Unix(2, 20)
+	clock.ClockInstance.TickerCh <- time.Unix(0, 0)
+	events <- event.Events{}
+	expect(0, false)
+}
+
+// TestExpiryPolicies validates that series of metric types whose expiry
+// policy is never are kept when their TTL expires.
+func TestExpiryPolicies(t *testing.T) {
+	tickerCh := make(chan time.Time)
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+	defer func() { clock.ClockInstance = nil }()
+
+	config := `
+defaults:
+  ttl: 1s
+  expiry_policies:
+    counter: never
+mappings:
+- match: policy.*
+  name: policy_${1}
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		ex := NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	clock.ClockInstance.Instant = time.Unix(0, 0)
+	events <- event.Events{
+		&event.CounterEvent{
+			CMetricName: "policy.counter",
+			CValue:      1,
+			CLabels:     map[string]string{},
+		},
+		&event.GaugeEvent{
+			GMetricName: "policy.gauge",
+			GValue:      1,
+			GLabels:     map[string]string{},
+		},
+	}
+	events <- event.Events{}
+
+	clock.ClockInstance.Instant = time.Unix(1, 10)
+	clock.ClockInstance.TickerCh <- time.Unix(0, 0)
+	events <- event.Events{}
+
+	metrics, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal("Gather should not fail")
+	}
+	if getFloat64(metrics, "policy_counter", prometheus.Labels{}) == nil {
+		t.Fatalf("Counter `policy_counter` should not expire")
+	}
+	if getFloat64(metrics, "policy_gauge", prometheus.Labels{}) != nil {
+		t.Fatalf("Gauge `policy_gauge` should be expired")
+	}
+}
+
+func TestHashLabelNames(t *testing.T) {
+	r := registry.NewRegistry(prometheus.DefaultRegisterer, nil)
+	// Validate value hash changes and name has doesn't when just the value changes.
+	hash1, _ := r.HashLabels(map[string]string{
+		"label": "value1",
+	})
+	hash2, _ := r.HashLabels(map[string]string{
+		"label": "value2",
+	})
+	if hash1.Names != hash2.Names {
+		t.Fatal("Hash of label names should match, but doesn't")
+	}
+	if hash1.Values == hash2.Values {
+		t.Fatal("Hash of label names shouldn't match, but do")
+	}
+
+	// Validate value and name hashes change when the name changes.
+	hash1, _ = r.HashLabels(map[string]string{
+		"label1": "value",
+	})
+	hash2, _ = r.HashLabels(map[string]string{
+		"label2": "value",
+	})
+	if hash1.Names == hash2.Names {
+		t.Fatal("Hash of label names shouldn't match, but do")
+	}
+	if hash1.Values == hash2.Values {
+		t.Fatal("Hash of label names shouldn't match, but do")
+	}
+}
+
+func TestHashLabelsConcurrent(t *testing.T) {
+	r := registry.NewRegistry(prometheus.DefaultRegisterer, nil)
+	labels := []map[string]string{
+		{},
+		{"label": "value"},
+		{"label1": "value1", "label2": "value2"},
+	}
+
+	// The hashes are FNV-1a over the label names, and then the values.
+	for _, l := range labels {
+		expected, _ := r.HashLabels(l)
+		names := make([]string, 0, len(l))
+		for name := range l {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		h := fnv.New64a()
+		for _, name := range names {
+			h.Write(append([]byte(name), model.SeparatorByte))
+		}
+		if metrics.NameHash(h.Sum64()) != expected.Names {
+			t.Errorf("unexpected name hash for %v", l)
+		}
+		h.Write([]byte{model.SeparatorByte})
+		for _, name := range names {
+			h.Write(append([]byte(l[name]), model.SeparatorByte))
+		}
+		if metrics.ValueHash(h.Sum64()) != expected.Values {
+			t.Errorf("unexpected value hash for %v", l)
+		}
+	}
+
+	// Hashing has no shared state, which the race detector checks.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				l := labels[j%len(labels)]
+				got, _ := r.HashLabels(l)
+				expected, _ := r.HashLabels(l)
+				if got != expected {
+					t.Errorf("expected hash %v for %v, got %v", expected, l, got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServer(t *testing.T) {
+	// Reserve a free port for the UDP listener.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	reg := prometheus.NewRegistry()
+	s, err := New(WithRegisterer(reg), WithUDPAddress(addr), WithTCPAddress(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(WithRegisterer(reg)); err == nil {
+		t.Error("expected an error registering the metrics of a second server")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(ctx) }()
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var value *float64
+	for deadline := time.Now().Add(5 * time.Second); value == nil && time.Now().Before(deadline); {
+		// Writes fail until the server listens.
+		client.Write([]byte("server_test:1|c"))
+		time.Sleep(50 * time.Millisecond)
+		metrics, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		value = getFloat64(metrics, "server_test", prometheus.Labels{})
+	}
+	if value == nil {
+		t.Fatal("expected server_test to be exported")
+	}
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getFloat64(metrics, "statsd_exporter_lines_total", prometheus.Labels{"listener": "udp://" + addr}) == nil {
+		t.Error("expected the lines to be counted for the UDP listener")
+	}
+
+	cancel()
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return after the context is done")
+	}
+}
+
+// testEventSource queues the events sent to it until it is closed.
+type testEventSource struct {
+	handler event.EventHandler
+	events  chan event.Events
+}
+
+func (s *testEventSource) SetEventHandler(eh event.EventHandler) { s.handler = eh }
+
+func (s *testEventSource) Listen() {
+	for events := range s.events {
+		s.handler.Queue(events)
+	}
+}
+
+func (s *testEventSource) Close() error {
+	close(s.events)
+	return nil
+}
+
+func TestServerEventSource(t *testing.T) {
+	source := &testEventSource{events: make(chan event.Events)}
+	reg := prometheus.NewRegistry()
+	s, err := New(WithRegisterer(reg), WithUDPAddress(""), WithTCPAddress(""), WithEventSource(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- s.Run(ctx) }()
+
+	source.events <- event.Events{&event.CounterEvent{CMetricName: "source_test", CValue: 2, CLabels: map[string]string{}}}
+	cancel()
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+
+	// Run handles the queued events before it returns.
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "source_test", prometheus.Labels{}); value == nil || *value != 2 {
+		t.Errorf("expected source_test to be 2, got %v", value)
+	}
+}
+
+// TestServerAddressInUse validates that Run returns an error if a listener
+// cannot be started, and releases what it already started.
+func TestServerAddressInUse(t *testing.T) {
+	// Reserve a free port for the UDP listener.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := conn.LocalAddr().String()
+	conn.Close()
+	// Keep the TCP address in use.
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	source := &testEventSource{events: make(chan event.Events)}
+	s, err := New(WithRegisterer(prometheus.NewRegistry()), WithUDPAddress(udpAddr), WithTCPAddress(busy.Addr().String()), WithEventSource(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("expected an error listening on an address in use")
+	}
+
+	select {
+	case <-source.events:
+	case <-time.After(time.Second):
+		t.Error("expected the event source to be closed")
+	}
+	conn, err = net.ListenPacket("udp", udpAddr)
+	if err != nil {
+		t.Errorf("expected the UDP listener to be closed: %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("", 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	// The interval doesn't pass during the test, so the events are
+	// applied when the channel is closed.
+	ex.AggregationInterval = time.Hour
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+
+	labels := func() map[string]string { return map[string]string{"la": "foo"} }
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "agg_counter", CValue: 1, CLabels: labels()},
+		&event.CounterEvent{CMetricName: "agg_counter", CValue: 2, CLabels: labels()},
+		&event.CounterEvent{CMetricName: "agg_counter", CValue: 4, CLabels: map[string]string{"la": "bar"}},
+		&event.GaugeEvent{GMetricName: "agg_gauge", GValue: 1, GRelative: true, GLabels: labels()},
+		&event.GaugeEvent{GMetricName: "agg_gauge", GValue: 5, GLabels: labels()},
+		&event.GaugeEvent{GMetricName: "agg_gauge", GValue: 2, GRelative: true, GLabels: labels()},
+		&event.ObserverEvent{OMetricName: "agg_timer", OValue: 0.5, OLabels: labels()},
+		&event.ObserverEvent{OMetricName: "agg_timer", OValue: 0.5, OLabels: labels()},
+		&event.HistogramEvent{HMetricName: "agg_timer", HBuckets: []event.HistogramBucket{{Value: 1, Count: 2}}, HLabels: labels()},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name     string
+		labels   prometheus.Labels
+		expected float64
+	}{
+		{"agg_counter", prometheus.Labels{"la": "foo"}, 3},
+		{"agg_counter", prometheus.Labels{"la": "bar"}, 4},
+		{"agg_gauge", prometheus.Labels{"la": "foo"}, 7},
+		{"agg_timer", prometheus.Labels{"la": "foo"}, 3},
+	} {
+		if value := getFloat64(metrics, c.name, c.labels); value == nil || *value != c.expected {
+			t.Errorf("expected %s%v to be %v, got %v", c.name, c.labels, c.expected, value)
+		}
+	}
+	for _, mf := range metrics {
+		if mf.GetName() == "agg_timer" {
+			if count := mf.GetMetric()[0].GetSummary().GetSampleCount(); count != 4 {
+				t.Errorf("expected 4 observations, got %d", count)
+			}
+		}
+	}
+}
+
+// getFloat64 search for metric by name in array of MetricFamily and then search a value by labels.
+// Method returns a value or nil if metric is not found.
+func getFloat64(metrics []*dto.MetricFamily, name string, labels prometheus.Labels) *float64 {
+	var metricFamily *dto.MetricFamily
+	for _, m := range metrics {
+		if *m.Name == name {
+			metricFamily = m
+			break
+		}
+	}
+	if metricFamily == nil {
+		return nil
+	}
+
+	var metric *dto.Metric
+	labelStr := fmt.Sprintf("%v", labels)
+	for _, m := range metricFamily.Metric {
+		l := labelPairsAsLabels(m.GetLabel())
+		ls := fmt.Sprintf("%v", l)
+		if labelStr == ls {
+			metric = m
+			break
+		}
+	}
+	if metric == nil {
+		return nil
+	}
+
+	var value float64
+	if metric.Gauge != nil {
+		value = metric.Gauge.GetValue()
+		return &value
+	}
+	if metric.Counter != nil {
+		value = metric.Counter.GetValue()
+		return &value
+	}
+	if metric.Histogram != nil {
+		value = metric.Histogram.GetSampleSum()
+		return &value
+	}
+	if metric.Summary != nil {
+		value = metric.Summary.GetSampleSum()
+		return &value
+	}
+	if metric.Untyped != nil {
+		value = metric.Untyped.GetValue()
+		return &value
+	}
+	panic(fmt.Errorf("collected a non-gauge/counter/histogram/summary/untyped metric: %s", metric))
+}
+
+func labelPairsAsLabels(pairs []*dto.LabelPair) (labels prometheus.Labels) {
+	labels = prometheus.Labels{}
+	for _, pair := range pairs {
+		if pair.Name == nil {
+			continue
+		}
+		value := ""
+		if pair.Value != nil {
+			value = *pair.Value
+		}
+		labels[*pair.Name] = value
+	}
+	return
+}
+
+func getTelemetryCounterValue(counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	err := counter.Write(&metric)
+	if err != nil {
+		return 0.0
+	}
+	return metric.Counter.GetValue()
+}
+
+func getTelemetryGaugeValue(gauge prometheus.Gauge) float64 {
+	var metric dto.Metric
+	err := gauge.Write(&metric)
+	if err != nil {
+		return 0.0
+	}
+	return metric.Gauge.GetValue()
+}
+
+func BenchmarkParseDogStatsDTags(b *testing.B) {
+	scenarios := map[string]string{
+		"1 tag w/hash":         "#test:tag",
+		"1 tag w/o hash":       "test:tag",
+		"2 tags, mixed hashes": "tag1:test,#tag2:test",
+		"3 long tags":          "tag1:reallylongtagthisisreallylong,tag2:anotherreallylongtag,tag3:thisisyetanotherextraordinarilylongtag",
+		"a-z tags":             "a:0,b:1,c:2,d:3,e:4,f:5,g:6,h:7,i:8,j:9,k:0,l:1,m:2,n:3,o:4,p:5,q:6,r:7,s:8,t:9,u:0,v:1,w:2,x:3,y:4,z:5",
+	}
+
+	parser := line.NewParser()
+	parser.EnableDogstatsdParsing()
+
+	b.ResetTimer()
+
+	for name, tags := range scenarios {
+		b.Run(name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				labels := map[string]string{}
+				parser.ParseDogStatsDTags(tags, labels, tagErrors, log.NewNopLogger())
+			}
+		})
+	}
+}
+
+func BenchmarkHashNameAndLabels(b *testing.B) {
+	scenarios := []struct {
+		name   string
+		metric string
+		labels map[string]string
+	}{
+		{
+			name:   "no labels",
+			labels: map[string]string{},
+		}, {
+			name: "one label",
+			labels: map[string]string{
+				"label": "value",
+			},
+		}, {
+			name: "many labels",
+			labels: map[string]string{
+				"label0": "value",
+				"label1": "value",
+				"label2": "value",
+				"label3": "value",
+				"label4": "value",
+				"label5": "value",
+				"label6": "value",
+				"label7": "value",
+				"label8": "value",
+				"label9": "value",
+			},
+		},
+	}
+
+	r := registry.NewRegistry(prometheus.DefaultRegisterer, nil)
+	for _, s := range scenarios {
+		b.Run(s.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				r.HashLabels(s.labels)
+			}
+		})
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	config := `
+mappings:
+- match: report.dropped.*
+  name: "dropped"
+  action: drop
+- match: report.*
+  name: "report_${1}"
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	ex := NewExporter(prometheus.NewRegistry(), testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	before := ex.Report()
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "report.a", CValue: 1, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "report.a", CValue: 1, CLabels: map[string]string{"x": "y"}},
+		&event.GaugeEvent{GMetricName: "report.b", GValue: 1, GLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "report.dropped.a", CValue: 1, CLabels: map[string]string{}},
+	}
+	close(events)
+	<-done
+
+	after := ex.Report()
+	// Dropped events are not counted as processed.
+	if got := after.EventsProcessed - before.EventsProcessed; got != 3 {
+		t.Errorf("expected 3 processed events, got %v", got)
+	}
+	if got := after.EventsDropped - before.EventsDropped; got != 1 {
+		t.Errorf("expected 1 dropped event, got %v", got)
+	}
+	if after.SeriesExported != 3 {
+		t.Errorf("expected 3 exported series, got %d", after.SeriesExported)
+	}
+}
+
+func TestCardinalityLimiter(t *testing.T) {
+	for _, hash := range []bool{false, true} {
+		suppressed := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "suppressed"}, []string{"metric", "label"})
+		c := NewCardinalityLimiter(2, hash, suppressed)
+
+		for i, value := range []string{"a", "b", "a", "c", "d"} {
+			labels := map[string]string{"user": value, "code": "200"}
+			c.Apply("requests_total", labels)
+
+			if labels["code"] != "200" {
+				t.Errorf("Label code should not be suppressed, got %v", labels)
+			}
+			userValue, hasUser := labels["user"]
+			switch {
+			case i < 3:
+				if userValue != value {
+					t.Errorf("Label user should be kept for value %s, got %v", value, labels)
+				}
+			case hash:
+				if userValue != hashBucket(value, 2) {
+					t.Errorf("Label user should be hashed for value %s, got %v", value, labels)
+				}
+			case hasUser:
+				t.Errorf("Label user should be dropped for value %s, got %v", value, labels)
+			}
+		}
+
+		// Other metrics have their own count of values.
+		labels := map[string]string{"user": "e"}
+		c.Apply("other_total", labels)
+		if labels["user"] != "e" {
+			t.Errorf("Label user of other_total should not be suppressed, got %v", labels)
+		}
+
+		var metric dto.Metric
+		if err := suppressed.WithLabelValues("requests_total", "user").Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		if metric.GetGauge().GetValue() != 1 {
+			t.Errorf("Suppressed label user of requests_total should be reported")
+		}
+	}
+}
+
+// TestCardinalitySharedLabels validates that the events of a line with
+// several samples are hashed into the same bucket of a suppressed label.
+func TestCardinalitySharedLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("", 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	suppressed := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "suppressed"}, []string{"metric", "label"})
+	ex.Cardinality = NewCardinalityLimiter(2, true, suppressed)
+
+	parser := line.NewParser()
+	parser.EnableInfluxdbParsing()
+	var events event.Events
+	for _, l := range []string{"card.foo,host=a:1|c", "card.foo,host=b:1|c", "card.foo,host=c:1|c:1|c:1|c"} {
+		events = append(events, parser.LineToEvents(l, *sampleErrors, samplesReceived, tagErrors, tagsReceived, log.NewNopLogger())...)
+	}
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got %d", len(events))
+	}
+	ch := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(ch)
+		close(done)
+	}()
+	ch <- events
+	close(ch)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := hashBucket("c", 2)
+	if value := getFloat64(metrics, "card_foo", prometheus.Labels{"host": bucket}); value == nil || *value != 3 {
+		t.Errorf("expected card_foo of bucket %s to be 3, got %v", bucket, value)
+	}
+	var metric dto.Metric
+	if err := suppressed.WithLabelValues("card_foo", "host").Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if metric.GetGauge().GetValue() != 1 {
+		t.Errorf("Suppressed label host of card_foo should be reported")
+	}
+}
+
+func TestTruncateLabelValue(t *testing.T) {
+	long := strings.Repeat("a", 20)
+	scenarios := []struct {
+		value string
+		max   int
+		want  int
+	}{
+		{value: "short", max: 16, want: 5},
+		{value: long, max: 20, want: 20},
+		{value: long, max: 16, want: 16},
+		{value: long + "ü", max: 21, want: 21},
+		{value: strings.Repeat("ü", 20), max: 16, want: 15},
+	}
+	for _, s := range scenarios {
+		labels := map[string]string{"value": s.value}
+		truncated := truncateLabelValues(labels, s.max)
+		got := labels["value"]
+		if len(got) != s.want {
+			t.Errorf("%q truncated to %d: expected %d bytes, got %q", s.value, s.max, s.want, got)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%q truncated to %d: invalid UTF-8 %q", s.value, s.max, got)
+		}
+		if (truncated == 1) != (got != s.value) {
+			t.Errorf("%q truncated to %d: counted %d truncated values", s.value, s.max, truncated)
+		}
+	}
+
+	// Values that only differ after the cut stay distinct.
+	a := truncateLabelValue(long+"a", 16)
+	b := truncateLabelValue(long+"b", 16)
+	if a == b || a[:7] != b[:7] {
+		t.Errorf("expected distinct values with a common prefix, got %q and %q", a, b)
+	}
+}
+
+// TestRecordedValue validates that the event stream gets the values of
+// events as they are recorded, after scale, offset and timer conversion.
+func TestRecordedValue(t *testing.T) {
+	scaled := &mapper.MetricMapping{Scale: 2, Offset: 1}
+	scenarios := []struct {
+		name    string
+		event   event.Event
+		mapping *mapper.MetricMapping
+		want    float64
+	}{
+		{name: "counter", event: &event.CounterEvent{CValue: 3}, mapping: scaled, want: 6},
+		{name: "gauge", event: &event.GaugeEvent{GValue: 3}, mapping: scaled, want: 7},
+		{name: "relative gauge", event: &event.GaugeEvent{GValue: 3, GRelative: true}, mapping: scaled, want: 6},
+		{name: "enum gauge", event: &event.GaugeEvent{GValue: 1}, mapping: &mapper.MetricMapping{Scale: 2, EnumStates: []string{"a", "b"}}, want: 1},
+		{name: "timer", event: &event.ObserverEvent{OValue: 3000, OMilliseconds: true}, mapping: scaled, want: 7},
+		{name: "timer without conversion", event: &event.ObserverEvent{OValue: 3, OMilliseconds: true}, mapping: &mapper.MetricMapping{NoUnitConversion: true}, want: 3},
+		{name: "histogram", event: &event.HistogramEvent{HBuckets: []event.HistogramBucket{{Value: 1, Count: 2}, {Value: 3, Count: 1}}}, mapping: scaled, want: 13},
+		{name: "unmapped", event: &event.CounterEvent{CValue: 3}, mapping: &mapper.MetricMapping{}, want: 3},
+	}
+	for _, s := range scenarios {
+		if got := recordedValue(s.event, s.mapping); got != s.want {
+			t.Errorf("%s: expected %v, got %v", s.name, s.want, got)
+		}
+	}
+}
+
+// TestValueBounds validates that events out of the bounds of their mapping
+// are dropped or clamped, and counted.
+func TestValueBounds(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: bounded.latency
+  name: bounded_latency
+  observer_type: histogram
+  histogram_options:
+    buckets: [1, 10, 100]
+  max: 60000
+- match: bounded.depth
+  name: bounded_depth
+  min: 0
+  max: 10
+  out_of_bounds: clamp
+`, 0); err != nil {
+		t.Fatal(err)
+	}
+	errorEventStats := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "events_error_total"}, []string{"reason"})
+	eventsClamped := prometheus.NewCounter(prometheus.CounterOpts{Name: "events_clamped_total"})
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.EventsClamped = eventsClamped
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.ObserverEvent{OMetricName: "bounded.latency", OValue: 500, OMilliseconds: true, OLabels: map[string]string{}},
+		&event.ObserverEvent{OMetricName: "bounded.latency", OValue: 5e8, OMilliseconds: true, OLabels: map[string]string{}},
+		&event.HistogramEvent{HMetricName: "bounded.latency", HBuckets: []event.HistogramBucket{{Value: 2, Count: 2}, {Value: 1e9, Count: 3}}, HLabels: map[string]string{}},
+		&event.GaugeEvent{GMetricName: "bounded.depth", GValue: 25, GLabels: map[string]string{}},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count uint64
+	for _, metric := range metrics {
+		if metric.GetName() == "bounded_latency" {
+			count = metric.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	if count != 3 {
+		t.Errorf("expected 3 observations of bounded_latency, got %d", count)
+	}
+	if value := getFloat64(metrics, "bounded_depth", prometheus.Labels{}); value == nil || *value != 10 {
+		t.Errorf("expected bounded_depth to be clamped to 10, got %v", value)
+	}
+	if value := getTelemetryCounterValue(errorEventStats.WithLabelValues("value_out_of_bounds")); value != 1 {
+		t.Errorf("expected 1 event out of bounds, got %v", value)
+	}
+	if value := getTelemetryCounterValue(eventsClamped); value != 1 {
+		t.Errorf("expected 1 clamped event, got %v", value)
+	}
+}
+
+// TestTransform validates that the transform expressions of a mapping rewrite
+// the values and labels of its events, and that events whose expressions
+// fail are dropped.
+func TestTransform(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: transformed.*.bytes
+  name: transformed_bytes
+  labels:
+    host: "$1"
+  transform:
+    value: cond(labels.unit == "kb", value * 1024, value)
+    labels:
+      host: lower(host_name(labels.host))
+      unit: '""'
+`, 0); err == nil {
+		t.Fatal("expected an unknown function to fail")
+	}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: transformed.*.bytes
+  name: transformed_bytes
+  labels:
+    host: "$1"
+  transform:
+    value: cond(labels.unit == "kb", value * 1024, value)
+    labels:
+      host: lower(split(labels.host, "-", 0))
+      unit: '""'
+- match: transformed.number
+  name: transformed_number
+  transform:
+    value: number(labels.value)
+`, 0); err != nil {
+		t.Fatal(err)
+	}
+	errorEventStats := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "events_error_total"}, []string{"reason"})
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.GaugeEvent{GMetricName: "transformed.Web-1.bytes", GValue: 2, GLabels: map[string]string{"unit": "kb"}},
+		&event.GaugeEvent{GMetricName: "transformed.db-1.bytes", GValue: 3, GLabels: map[string]string{}},
+		&event.GaugeEvent{GMetricName: "transformed.number", GValue: 1, GLabels: map[string]string{"value": "not a number"}},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "transformed_bytes", prometheus.Labels{"host": "web"}); value == nil || *value != 2048 {
+		t.Errorf("expected transformed_bytes of web to be 2048, got %v", value)
+	}
+	if value := getFloat64(metrics, "transformed_bytes", prometheus.Labels{"host": "db"}); value == nil || *value != 3 {
+		t.Errorf("expected transformed_bytes of db to be 3, got %v", value)
+	}
+	if value := getTelemetryCounterValue(errorEventStats.WithLabelValues("transform_failed")); value != 1 {
+		t.Errorf("expected 1 failed transform, got %v", value)
+	}
+}
+
+// TestTransformSharedLabels validates that label expressions apply once to
+// each of the events parsed from one line, which share their labels.
+func TestTransformSharedLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: shared.*
+  name: shared_$1
+  observer_type: histogram
+  transform:
+    labels:
+      host: labels.host + "x"
+`, 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+
+	parser := line.NewParser()
+	parser.EnableDogstatsdParsing()
+	parser.EnableInfluxdbParsing()
+	var events event.Events
+	for _, l := range []string{"shared.timer:1|ms|@0.25|#host:a", "shared.count,host=a:1|c:2|c:3|c"} {
+		events = append(events, parser.LineToEvents(l, *sampleErrors, samplesReceived, tagErrors, tagsReceived, log.NewNopLogger())...)
+	}
+	if len(events) != 7 {
+		t.Fatalf("expected 7 events, got %d", len(events))
+	}
+	ch := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(ch)
+		close(done)
+	}()
+	ch <- events
+	close(ch)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range metrics {
+		switch metric.GetName() {
+		case "shared_timer", "shared_count":
+			if n := len(metric.GetMetric()); n != 1 {
+				t.Errorf("expected 1 series of %s, got %d", metric.GetName(), n)
+			}
+		}
+	}
+	if value := getFloat64(metrics, "shared_count", prometheus.Labels{"host": "ax"}); value == nil || *value != 6 {
+		t.Errorf("expected shared_count of ax to be 6, got %v", value)
+	}
+	var count uint64
+	for _, metric := range metrics {
+		if metric.GetName() == "shared_timer" {
+			m := metric.GetMetric()[0]
+			if m.GetLabel()[0].GetValue() == "ax" {
+				count = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	if count != 4 {
+		t.Errorf("expected 4 observations of shared_timer with host ax, got %d", count)
+	}
+}
+
+// TestMappingSharedLabels validates that the labels a mapping adds to one
+// event of a line are not added to the other events of the line.
+func TestMappingSharedLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: typed.*
+  match_metric_type: counter
+  name: typed_${1}_total
+  labels:
+    kind: counter
+- match: typed.*
+  match_metric_type: gauge
+  name: typed_$1
+`, 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 
-	var value float64
-	if metric.Gauge != nil {
-		value = metric.Gauge.GetValue()
-		return &value
+	parser := line.NewParser()
+	parser.EnableInfluxdbParsing()
+	events := parser.LineToEvents("typed.foo,host=a:1|c:2|g", *sampleErrors, samplesReceived, tagErrors, tagsReceived, log.NewNopLogger())
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
 	}
-	if metric.Counter != nil {
-		value = metric.Counter.GetValue()
-		return &value
+	ch := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(ch)
+		close(done)
+	}()
+	ch <- events
+	close(ch)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if metric.Histogram != nil {
-		value = metric.Histogram.GetSampleSum()
-		return &value
+	if value := getFloat64(metrics, "typed_foo_total", prometheus.Labels{"host": "a", "kind": "counter"}); value == nil || *value != 1 {
+		t.Errorf("expected typed_foo_total of kind counter to be 1, got %v", value)
 	}
-	if metric.Summary != nil {
-		value = metric.Summary.GetSampleSum()
-		return &value
+	if value := getFloat64(metrics, "typed_foo", prometheus.Labels{"host": "a"}); value == nil || *value != 2 {
+		t.Errorf("expected typed_foo without the kind label to be 2, got %v", value)
 	}
-	if metric.Untyped != nil {
-		value = metric.Untyped.GetValue()
-		return &value
+}
+
+// TestFilter validates that the filter modifies and drops events before they
+// are mapped, and that events that make it panic are dropped.
+func TestFilter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("", 0); err != nil {
+		t.Fatal(err)
+	}
+	errorEventStats := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "events_error_total"}, []string{"reason"})
+	eventsFiltered := prometheus.NewCounter(prometheus.CounterOpts{Name: "events_filtered_total"})
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.EventsFiltered = eventsFiltered
+	ex.Filter = filter.Func(func(e event.Event) (event.Event, bool) {
+		switch e.MetricName() {
+		case "panics":
+			panic("faulty filter")
+		case "renamed":
+			return &event.GaugeEvent{GMetricName: "filtered_name", GValue: e.Value(), GLabels: e.Labels()}, true
+		}
+		delete(e.Labels(), "email")
+		return e, e.MetricName() != "secret"
+	})
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "filtered_logins", CValue: 1, CLabels: map[string]string{"email": "a@example.com"}},
+		&event.CounterEvent{CMetricName: "secret", CValue: 1, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "panics", CValue: 1, CLabels: map[string]string{}},
+		&event.GaugeEvent{GMetricName: "renamed", GValue: 3, GLabels: map[string]string{}},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "filtered_logins", prometheus.Labels{}); value == nil || *value != 1 {
+		t.Errorf("expected filtered_logins without the email label, got %v", value)
+	}
+	if value := getFloat64(metrics, "filtered_name", prometheus.Labels{}); value == nil || *value != 3 {
+		t.Errorf("expected the event replaced by the filter, got %v", value)
+	}
+	for _, metric := range metrics {
+		if name := metric.GetName(); name == "secret" || name == "panics" {
+			t.Errorf("expected %s to be dropped", name)
+		}
+	}
+	if value := getTelemetryCounterValue(eventsFiltered); value != 1 {
+		t.Errorf("expected 1 filtered event, got %v", value)
+	}
+	if value := getTelemetryCounterValue(errorEventStats.WithLabelValues("filter_failed")); value != 1 {
+		t.Errorf("expected 1 failed filter, got %v", value)
 	}
-	panic(fmt.Errorf("collected a non-gauge/counter/histogram/summary/untyped metric: %s", metric))
 }
 
-func labelPairsAsLabels(pairs []*dto.LabelPair) (labels prometheus.Labels) {
-	labels = prometheus.Labels{}
-	for _, pair := range pairs {
-		if pair.Name == nil {
+// TestAggregateLabels validates that the labels a mapping aggregates over are
+// collapsed into one series.
+func TestAggregateLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: collapsed.requests
+  name: collapsed_requests_total
+  aggregate_labels: [host, pod]
+- match: collapsed.latency
+  name: collapsed_latency_seconds
+  observer_type: histogram
+  aggregate_labels: [host]
+`, 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "collapsed.requests", CValue: 1, CLabels: map[string]string{"host": "a", "pod": "a-1", "code": "200"}},
+		&event.CounterEvent{CMetricName: "collapsed.requests", CValue: 2, CLabels: map[string]string{"host": "b", "pod": "b-1", "code": "200"}},
+		&event.CounterEvent{CMetricName: "collapsed.requests", CValue: 4, CLabels: map[string]string{"host": "b", "code": "500"}},
+		&event.ObserverEvent{OMetricName: "collapsed.latency", OValue: 1, OLabels: map[string]string{"host": "a"}},
+		&event.ObserverEvent{OMetricName: "collapsed.latency", OValue: 2, OLabels: map[string]string{"host": "b"}},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "collapsed_requests_total", prometheus.Labels{"code": "200"}); value == nil || *value != 3 {
+		t.Errorf("expected collapsed_requests_total{code=\"200\"} to be 3, got %v", value)
+	}
+	if value := getFloat64(metrics, "collapsed_requests_total", prometheus.Labels{"code": "500"}); value == nil || *value != 4 {
+		t.Errorf("expected collapsed_requests_total{code=\"500\"} to be 4, got %v", value)
+	}
+	for _, metric := range metrics {
+		if metric.GetName() != "collapsed_latency_seconds" {
 			continue
 		}
-		value := ""
-		if pair.Value != nil {
-			value = *pair.Value
+		if len(metric.GetMetric()) != 1 {
+			t.Fatalf("expected 1 series of collapsed_latency_seconds, got %d", len(metric.GetMetric()))
+		}
+		if count := metric.GetMetric()[0].GetHistogram().GetSampleCount(); count != 2 {
+			t.Errorf("expected 2 observations of collapsed_latency_seconds, got %d", count)
 		}
-		labels[*pair.Name] = value
 	}
-	return
 }
 
-func getTelemetryCounterValue(counter prometheus.Counter) float64 {
-	var metric dto.Metric
-	err := counter.Write(&metric)
+func TestReportCardinality(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total"}, []string{"host", "code"})
+	reg.MustRegister(requests)
+	for _, host := range []string{"a", "b", "c"} {
+		requests.WithLabelValues(host, "200").Inc()
+	}
+	requests.WithLabelValues("a", "500").Inc()
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "up"})
+	reg.MustRegister(up)
+
+	report, err := ReportCardinality(reg, 2)
 	if err != nil {
-		return 0.0
+		t.Fatal(err)
+	}
+	if report.Series != 5 {
+		t.Errorf("expected 5 series, got %d", report.Series)
+	}
+	wantMetrics := []MetricCardinality{{Name: "requests_total", Series: 4}, {Name: "up", Series: 1}}
+	if !reflect.DeepEqual(report.Metrics, wantMetrics) {
+		t.Errorf("expected metrics %v, got %v", wantMetrics, report.Metrics)
+	}
+	wantLabels := []LabelCardinality{{Metric: "requests_total", Label: "host", Values: 3}, {Metric: "requests_total", Label: "code", Values: 2}}
+	if !reflect.DeepEqual(report.Labels, wantLabels) {
+		t.Errorf("expected labels %v, got %v", wantLabels, report.Labels)
 	}
-	return metric.Counter.GetValue()
 }
 
-func BenchmarkParseDogStatsDTags(b *testing.B) {
-	scenarios := map[string]string{
-		"1 tag w/hash":         "#test:tag",
-		"1 tag w/o hash":       "test:tag",
-		"2 tags, mixed hashes": "tag1:test,#tag2:test",
-		"3 long tags":          "tag1:reallylongtagthisisreallylong,tag2:anotherreallylongtag,tag3:thisisyetanotherextraordinarilylongtag",
-		"a-z tags":             "a:0,b:1,c:2,d:3,e:4,f:5,g:6,h:7,i:8,j:9,k:0,l:1,m:2,n:3,o:4,p:5,q:6,r:7,s:8,t:9,u:0,v:1,w:2,x:3,y:4,z:5",
+// TestSeriesInventory validates that the series of the registry can be
+// listed and deleted from another goroutine while the exporter is listening.
+func TestSeriesInventory(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(100, 0)}
+	defer func() { clock.ClockInstance = nil }()
+
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: inventory.*
+  name: inventory_total
+  ttl: 1m
+  labels:
+    host: $1
+`, 0); err != nil {
+		t.Fatal(err)
 	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 
-	parser := line.NewParser()
-	parser.EnableDogstatsdParsing()
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "inventory.b", CValue: 1, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "inventory.a", CValue: 1, CLabels: map[string]string{}},
+		&event.GaugeEvent{GMetricName: "inventory_gauge", GValue: 1, GLabels: map[string]string{}},
+	}
 
-	b.ResetTimer()
+	var series []registry.Series
+	if err := ex.Run(context.Background(), func() { series = ex.Registry.Series("inventory_total") }); err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series of inventory_total, got %v", series)
+	}
+	expiresAt := time.Unix(160, 0)
+	for i, host := range []string{"a", "b"} {
+		s := series[i]
+		if s.Metric != "inventory_total" || s.Type != "counter" || s.Labels["host"] != host {
+			t.Errorf("expected counter inventory_total{host=%q}, got %+v", host, s)
+		}
+		if s.TTL != "1m0s" || s.ExpiresAt == nil || !s.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("expected inventory_total{host=%q} to expire at %v, got %+v", host, expiresAt, s)
+		}
+	}
 
-	for name, tags := range scenarios {
-		b.Run(name, func(b *testing.B) {
-			for n := 0; n < b.N; n++ {
-				labels := map[string]string{}
-				parser.ParseDogStatsDTags(tags, labels, tagErrors, log.NewNopLogger())
-			}
-		})
+	if err := ex.Run(context.Background(), func() { series = ex.Registry.Series("") }); err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 3 || series[2].Metric != "inventory_total" || series[0].TTL != "" || series[0].ExpiresAt != nil {
+		t.Errorf("expected all 3 series, the gauge without TTL first, got %+v", series)
+	}
+
+	var deleted int
+	if err := ex.Run(context.Background(), func() {
+		deleted = ex.Registry.DeleteSeries("inventory_total", prometheus.Labels{"host": "a"})
+		series = ex.Registry.Series("inventory_total")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 || len(series) != 1 || series[0].Labels["host"] != "b" {
+		t.Errorf("expected only inventory_total{host=\"a\"} to be deleted, deleted %d and kept %+v", deleted, series)
+	}
+	if err := ex.Run(context.Background(), func() {
+		deleted = ex.Registry.DeleteSeries("inventory_gauge", nil)
+		series = ex.Registry.Series("")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 || len(series) != 1 {
+		t.Errorf("expected inventory_gauge to be deleted, deleted %d and kept %+v", deleted, series)
+	}
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "inventory_total", prometheus.Labels{"host": "a"}); value != nil {
+		t.Errorf("expected inventory_total{host=\"a\"} not to be exported, got %v", *value)
+	}
+
+	close(events)
+	<-done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ex.Run(ctx, func() {}); err == nil {
+		t.Errorf("expected an error running on an exporter that stopped listening")
 	}
 }
 
-func BenchmarkHashNameAndLabels(b *testing.B) {
-	scenarios := []struct {
+// TestStaticLabels validates that static labels are added to every series
+// without overriding the labels of events and mappings.
+func TestStaticLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: static.*
+  name: static_total
+  labels:
+    namespace: $1
+`, 0); err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.StaticLabels = prometheus.Labels{"pod": "web-1", "namespace": "shop"}
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "static.checkout", CValue: 1, CLabels: map[string]string{}},
+		&event.GaugeEvent{GMetricName: "static_gauge", GValue: 2, GLabels: map[string]string{"pod": "other"}},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "static_total", prometheus.Labels{"pod": "web-1", "namespace": "checkout"}); value == nil || *value != 1 {
+		t.Errorf("expected static_total{namespace=\"checkout\",pod=\"web-1\"} to be 1, got %v", value)
+	}
+	if value := getFloat64(metrics, "static_gauge", prometheus.Labels{"pod": "other", "namespace": "shop"}); value == nil || *value != 2 {
+		t.Errorf("expected static_gauge{namespace=\"shop\",pod=\"other\"} to be 2, got %v", value)
+	}
+}
+
+// TestNameEscaping validates that metric names are escaped with the
+// configured scheme, and that dropped events are counted.
+func TestNameEscaping(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString(`mappings:
+- match: escaped.*
+  name: escaped_$1
+`, 0); err != nil {
+		t.Fatal(err)
+	}
+	errorEventStats := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "events_error_total"}, []string{"reason"})
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.NameEscaping = mapper.EscapeValues
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "escaped.web-server", CValue: 1, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "http.requests", CValue: 2, CLabels: map[string]string{}},
+	}
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "U__escaped__web_2d_server", prometheus.Labels{}); value == nil || *value != 1 {
+		t.Errorf("expected U__escaped__web_2d_server to be 1, got %v", value)
+	}
+	if value := getFloat64(metrics, "U__http_2e_requests", prometheus.Labels{}); value == nil || *value != 2 {
+		t.Errorf("expected U__http_2e_requests to be 2, got %v", value)
+	}
+
+	ex.NameEscaping = mapper.EscapeDrop
+	events = make(chan event.Events)
+	done = make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "http.dropped", CValue: 1, CLabels: map[string]string{}},
+		&event.CounterEvent{CMetricName: "kept_total", CValue: 1, CLabels: map[string]string{}},
+	}
+	close(events)
+	<-done
+
+	metrics, err = reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "http.dropped", prometheus.Labels{}); value != nil {
+		t.Errorf("expected http.dropped to be dropped, got %v", *value)
+	}
+	if value := getFloat64(metrics, "kept_total", prometheus.Labels{}); value == nil || *value != 1 {
+		t.Errorf("expected kept_total to be 1, got %v", value)
+	}
+	if value := getTelemetryCounterValue(errorEventStats.WithLabelValues("invalid_metric_name")); value != 1 {
+		t.Errorf("expected 1 event dropped for its name, got %v", value)
+	}
+}
+
+// TestTenancy validates that the series of each tenant are limited and that
+// the activity of each tenant is exported.
+func TestTenancy(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	if err := testMapper.InitFromYAMLString("", 0); err != nil {
+		t.Fatal(err)
+	}
+	tenancy := &registry.Tenancy{
+		Label:     "tenant",
+		MaxSeries: 2,
+		Events:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tenant_events_total"}, []string{"tenant"}),
+		Series:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tenant_series"}, []string{"tenant"}),
+		Limited:   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tenant_limited_total"}, []string{"tenant"}),
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Tenancy = tenancy
+	ex.Registry.(*registry.Registry).Tenancy = tenancy
+
+	events := make(chan event.Events)
+	done := make(chan struct{})
+	go func() {
+		ex.Listen(events)
+		close(done)
+	}()
+	ev := event.Events{}
+	for _, s := range []struct{ tenant, name string }{
+		{"payments", "tenancy_a"},
+		{"payments", "tenancy_b"},
+		{"payments", "tenancy_c"},
+		{"payments", "tenancy_a"},
+		{"search", "tenancy_c"},
+		{"", "tenancy_d"},
+	} {
+		labels := map[string]string{}
+		if s.tenant != "" {
+			labels["tenant"] = s.tenant
+		}
+		ev = append(ev, &event.CounterEvent{CMetricName: s.name, CValue: 1, CLabels: labels})
+	}
+	events <- ev
+	close(events)
+	<-done
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "tenancy_a", prometheus.Labels{"tenant": "payments"}); value == nil || *value != 2 {
+		t.Errorf("expected tenancy_a{tenant=\"payments\"} to be 2, got %v", value)
+	}
+	if getFloat64(metrics, "tenancy_c", prometheus.Labels{"tenant": "payments"}) != nil {
+		t.Errorf("expected tenancy_c{tenant=\"payments\"} to be dropped by the series limit")
+	}
+	if getFloat64(metrics, "tenancy_c", prometheus.Labels{"tenant": "search"}) == nil {
+		t.Errorf("expected tenancy_c{tenant=\"search\"} to be exported")
+	}
+	if getFloat64(metrics, "tenancy_d", prometheus.Labels{}) == nil {
+		t.Errorf("expected tenancy_d without tenant not to be limited")
+	}
+
+	for tenant, expected := range map[string]float64{"payments": 4, "search": 1} {
+		if got := getTelemetryCounterValue(tenancy.Events.WithLabelValues(tenant)); got != expected {
+			t.Errorf("expected %v events of %s, got %v", expected, tenant, got)
+		}
+	}
+	if got := getTelemetryCounterValue(tenancy.Limited.WithLabelValues("payments")); got != 1 {
+		t.Errorf("expected 1 limited event of payments, got %v", got)
+	}
+	for tenant, expected := range map[string]float64{"payments": 2, "search": 1} {
+		if got := getTelemetryGaugeValue(tenancy.Series.WithLabelValues(tenant)); got != expected {
+			t.Errorf("expected %v series of %s, got %v", expected, tenant, got)
+		}
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(100, 0)}
+	defer func() { clock.ClockInstance = nil }()
+
+	config := `mappings:
+- match: state.*
+  name: state_total
+  ttl: 1m
+  labels:
+    host: $1
+`
+	newExporter := func(reg prometheus.Registerer, config string) *Exporter {
+		testMapper := &mapper.MetricMapper{}
+		if err := testMapper.InitFromYAMLString(config, 0); err != nil {
+			t.Fatal(err)
+		}
+		return NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	}
+
+	ex := newExporter(prometheus.NewRegistry(), config)
+	ex.handleEvent(&event.CounterEvent{CMetricName: "state.a", CValue: 5, CLabels: map[string]string{}})
+	clock.ClockInstance.Instant = time.Unix(130, 0)
+	ex.handleEvent(&event.CounterEvent{CMetricName: "state.b", CValue: 2, CLabels: map[string]string{}})
+	ex.handleEvent(&event.GaugeEvent{GMetricName: "state_gauge", GValue: 3, GLabels: map[string]string{}})
+	ex.handleEvent(&event.ObserverEvent{OMetricName: "state_timer", OValue: 1, OLabels: map[string]string{}})
+	state := ex.Registry.Snapshot()
+	if len(state.Series) != 3 {
+		t.Fatalf("expected the 2 counters and the gauge to be saved, got %+v", state.Series)
+	}
+
+	clock.ClockInstance.Instant = time.Unix(150, 0)
+	reg := prometheus.NewRegistry()
+	ex = newExporter(reg, config)
+	if restored := ex.RestoreState(state); restored != 3 {
+		t.Errorf("expected 3 restored series, got %d", restored)
+	}
+	clock.ClockInstance.Instant = time.Unix(170, 0)
+	ex.handleEvent(&event.CounterEvent{CMetricName: "state.a", CValue: 1, CLabels: map[string]string{}})
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
 		name   string
-		metric string
-		labels map[string]string
+		labels prometheus.Labels
+		value  float64
 	}{
-		{
-			name:   "no labels",
-			labels: map[string]string{},
-		}, {
-			name: "one label",
-			labels: map[string]string{
-				"label": "value",
-			},
-		}, {
-			name: "many labels",
-			labels: map[string]string{
-				"label0": "value",
-				"label1": "value",
-				"label2": "value",
-				"label3": "value",
-				"label4": "value",
-				"label5": "value",
-				"label6": "value",
-				"label7": "value",
-				"label8": "value",
-				"label9": "value",
-			},
-		},
+		{"state_total", prometheus.Labels{"host": "a"}, 6},
+		{"state_total", prometheus.Labels{"host": "b"}, 2},
+		{"state_gauge", prometheus.Labels{}, 3},
+	} {
+		if value := getFloat64(metrics, c.name, c.labels); value == nil || *value != c.value {
+			t.Errorf("expected %s%v to be restored as %v, got %v", c.name, c.labels, c.value, value)
+		}
 	}
 
-	r := registry.NewRegistry(prometheus.DefaultRegisterer, nil)
-	for _, s := range scenarios {
-		b.Run(s.name, func(b *testing.B) {
-			for n := 0; n < b.N; n++ {
-				r.HashLabels(s.labels)
-			}
-		})
+	// The series that was not updated since the snapshot expires on time.
+	clock.ClockInstance.Instant = time.Unix(191, 0)
+	ex.Registry.RemoveStaleMetrics()
+	series := ex.Registry.Series("state_total")
+	if len(series) != 1 || series[0].Labels["host"] != "a" {
+		t.Errorf("expected only state_total{host=\"a\"} to remain, got %+v", series)
+	}
+
+	// Series of mappings that were removed from the config are not restored.
+	ex = newExporter(prometheus.NewRegistry(), `mappings:
+- match: state.*
+  name: state_total
+  labels:
+    server: $1
+`)
+	if restored := ex.RestoreState(state); restored != 1 {
+		t.Errorf("expected only the unmapped gauge to be restored, got %d series", restored)
+	}
+}
+
+func TestHiddenRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{}
+	testMapper.InitCache(0)
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Registry.(*registry.Registry).CreatedTimestamps = true
+
+	ex.Registry.(*registry.Registry).SetHidden(true)
+	ex.handleEvent(&event.CounterEvent{CMetricName: "standby_total", CValue: 2, CLabels: map[string]string{}})
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 0 {
+		t.Errorf("expected no metrics while hidden, got %v", metrics)
+	}
+
+	// Hidden series are still updated.
+	ex.Registry.(*registry.Registry).SetHidden(false)
+	metrics, err = reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getFloat64(metrics, "standby_total", prometheus.Labels{}); value == nil || *value != 2 {
+		t.Errorf("expected standby_total to be 2, got %v", value)
+	}
+	if value := getFloat64(metrics, "standby_created", prometheus.Labels{}); value == nil {
+		t.Errorf("expected standby_created to be exported")
 	}
 }
@@ -0,0 +1,96 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+)
+
+// TagFormats selects the tag formats a parser parses.
+type TagFormats struct {
+	DogStatsD bool
+	InfluxDB  bool
+	Librato   bool
+	SignalFX  bool
+}
+
+// AllTagFormats parses every supported tag format, like the statsd_exporter
+// command does by default.
+var AllTagFormats = TagFormats{DogStatsD: true, InfluxDB: true, Librato: true, SignalFX: true}
+
+// NewParser returns a line parser for the given tag formats.
+func NewParser(formats TagFormats) *line.Parser {
+	p := line.NewParser()
+	if formats.DogStatsD {
+		p.EnableDogstatsdParsing()
+	}
+	if formats.InfluxDB {
+		p.EnableInfluxdbParsing()
+	}
+	if formats.Librato {
+		p.EnableLibratoParsing()
+	}
+	if formats.SignalFX {
+		p.EnableSignalFXParsing()
+	}
+	return p
+}
+
+// UDPListener returns a listener that reads lines from conn and counts them
+// in the metrics, labeled with the listen address.
+func (m *Metrics) UDPListener(conn *net.UDPConn, address string, handler event.EventHandler, parser listener.Parser, logger log.Logger) *listener.StatsDUDPListener {
+	labels := prometheus.Labels{"listener": "udp://" + address}
+	return &listener.StatsDUDPListener{
+		Conn:            conn,
+		EventHandler:    handler,
+		Logger:          logger,
+		LineParser:      parser,
+		UDPPackets:      m.UDPPackets.With(labels),
+		LinesReceived:   m.LinesReceived.With(labels),
+		EventsFlushed:   m.EventsFlushed,
+		SampleErrors:    *m.SampleErrors.MustCurryWith(labels),
+		SamplesReceived: m.SamplesReceived.With(labels),
+		TagErrors:       m.TagErrors.With(labels),
+		TagsReceived:    m.TagsReceived.With(labels),
+	}
+}
+
+// TCPListener returns a listener that reads lines from the connections
+// accepted by conn and counts them in the metrics, labeled with the listen
+// address.
+func (m *Metrics) TCPListener(conn *net.TCPListener, address string, handler event.EventHandler, parser listener.Parser, logger log.Logger) *listener.StatsDTCPListener {
+	labels := prometheus.Labels{"listener": "tcp://" + address}
+	return &listener.StatsDTCPListener{
+		Conn:            conn,
+		EventHandler:    handler,
+		Logger:          logger,
+		LineParser:      parser,
+		LinesReceived:   m.LinesReceived.With(labels),
+		EventsFlushed:   m.EventsFlushed,
+		SampleErrors:    *m.SampleErrors.MustCurryWith(labels),
+		SamplesReceived: m.SamplesReceived.With(labels),
+		TagErrors:       m.TagErrors.With(labels),
+		TagsReceived:    m.TagsReceived.With(labels),
+		TCPConnections:  m.TCPConnections.With(labels),
+		TCPErrors:       m.TCPErrors.With(labels),
+		TCPLineTooLong:  m.TCPLineTooLong.With(labels),
+	}
+}
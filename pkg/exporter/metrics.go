@@ -0,0 +1,176 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// Metrics are the metrics of the exporter itself that the statsd_exporter
+// command and Server have in common: those of the UDP and TCP listeners, the
+// event queue and the Exporter.
+type Metrics struct {
+	// The listener metrics are labeled with the listener.
+	UDPPackets      *prometheus.CounterVec
+	TCPConnections  *prometheus.CounterVec
+	TCPErrors       *prometheus.CounterVec
+	TCPLineTooLong  *prometheus.CounterVec
+	LinesReceived   *prometheus.CounterVec
+	SamplesReceived *prometheus.CounterVec
+	SampleErrors    *prometheus.CounterVec
+	TagsReceived    *prometheus.CounterVec
+	TagErrors       *prometheus.CounterVec
+	EventsFlushed   prometheus.Counter
+
+	EventsActions         *prometheus.CounterVec
+	EventsUnmapped        prometheus.Counter
+	ErrorEventStats       *prometheus.CounterVec
+	EventStats            *prometheus.CounterVec
+	ConflictingEventStats *prometheus.CounterVec
+	MetricsCount          *prometheus.GaugeVec
+}
+
+// NewMetrics returns the metrics of the exporter, unregistered.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		UDPPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_udp_packets_total",
+				Help: "The total number of StatsD packets received over UDP.",
+			},
+			[]string{"listener"},
+		),
+		TCPConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_connections_total",
+				Help: "The total number of TCP connections handled.",
+			},
+			[]string{"listener"},
+		),
+		TCPErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_connection_errors_total",
+				Help: "The number of errors encountered reading from TCP.",
+			},
+			[]string{"listener"},
+		),
+		TCPLineTooLong: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_too_long_lines_total",
+				Help: "The number of lines discarded due to being too long.",
+			},
+			[]string{"listener"},
+		),
+		LinesReceived: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_lines_total",
+				Help: "The total number of StatsD lines received.",
+			},
+			[]string{"listener"},
+		),
+		SamplesReceived: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_samples_total",
+				Help: "The total number of StatsD samples received.",
+			},
+			[]string{"listener"},
+		),
+		SampleErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_sample_errors_total",
+				Help: "The total number of errors parsing StatsD samples.",
+			},
+			[]string{"reason", "listener"},
+		),
+		TagsReceived: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tags_total",
+				Help: "The total number of DogStatsD tags processed.",
+			},
+			[]string{"listener"},
+		),
+		TagErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tag_errors_total",
+				Help: "The number of errors parsing DogStatsD tags.",
+			},
+			[]string{"listener"},
+		),
+		EventsFlushed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_event_queue_flushed_total",
+				Help: "Number of times events were flushed to exporter",
+			},
+		),
+		EventsActions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_actions_total",
+				Help: "The total number of StatsD events by action.",
+			},
+			[]string{"action"},
+		),
+		EventsUnmapped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_unmapped_total",
+				Help: "The total number of StatsD events no mapping was found for.",
+			},
+		),
+		ErrorEventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_error_total",
+				Help: "The total number of StatsD events discarded due to errors.",
+			},
+			[]string{"reason"},
+		),
+		EventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_total",
+				Help: "The total number of StatsD events seen.",
+			},
+			[]string{"type"},
+		),
+		ConflictingEventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_conflict_total",
+				Help: "The total number of StatsD events with conflicting names.",
+			},
+			[]string{"type"},
+		),
+		MetricsCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_metrics_total",
+				Help: "The total number of metrics.",
+			},
+			[]string{"type"},
+		),
+	}
+}
+
+// Collectors returns the metrics, for registering them.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.UDPPackets, m.TCPConnections, m.TCPErrors, m.TCPLineTooLong,
+		m.LinesReceived, m.SamplesReceived, m.SampleErrors, m.TagsReceived,
+		m.TagErrors, m.EventsFlushed, m.EventsActions, m.EventsUnmapped,
+		m.ErrorEventStats, m.EventStats, m.ConflictingEventStats, m.MetricsCount,
+	}
+}
+
+// NewExporter returns an Exporter that counts events in the metrics.
+func (m *Metrics) NewExporter(reg prometheus.Registerer, mapper *mapper.MetricMapper, logger log.Logger) *Exporter {
+	return NewExporter(reg, mapper, logger, m.EventsActions, m.EventsUnmapped, m.ErrorEventStats, m.EventStats, m.ConflictingEventStats, m.MetricsCount)
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// DefaultRateWindow is the window counter rates are computed over if the
+// exporter does not set one.
+const DefaultRateWindow = 10 * time.Second
+
+// RateSuffix is appended to the names of counters for their rate gauges.
+const RateSuffix = "_rate"
+
+// rateHelp is the help text of all rate gauges. It does not name the counter,
+// as the registry keeps every help text it has seen.
+const rateHelp = "Per-second rate of the counter of the same name without the _rate suffix, over the last rate window."
+
+// rates accumulates the increments of the counters of mappings with
+// emit_rate, and sets their rate gauges once per window. It is not safe for
+// concurrent use.
+type rates struct {
+	series map[string]*rateSeries
+}
+
+type rateSeries struct {
+	gauge prometheus.Gauge
+	sum   float64
+	// idle is set if there was no increment in the last window.
+	idle bool
+}
+
+func newRates() *rates {
+	return &rates{series: map[string]*rateSeries{}}
+}
+
+// add records an increment of the counter series the rate gauge belongs to.
+func (r *rates) add(metricName string, labels prometheus.Labels, gauge prometheus.Gauge, value float64) {
+	key := seriesKey(metricName, labels)
+	s, ok := r.series[key]
+	if !ok {
+		s = &rateSeries{}
+		r.series[key] = s
+	}
+	s.gauge = gauge
+	s.sum += value
+}
+
+// flush sets the rate gauges to the per-second rate of the increments in the
+// elapsed window. Series without increments for two windows are forgotten, and
+// their gauges left at 0 until they expire.
+func (r *rates) flush(elapsed time.Duration) {
+	for key, s := range r.series {
+		if s.sum == 0 && s.idle {
+			delete(r.series, key)
+			continue
+		}
+		s.gauge.Set(s.sum / elapsed.Seconds())
+		s.idle = s.sum == 0
+		s.sum = 0
+	}
+}
+
+// seriesKey identifies a series by its metric name and labels.
+func seriesKey(metricName string, labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(metricName)
+	for _, name := range names {
+		b.WriteByte(model.SeparatorByte)
+		b.WriteString(name)
+		b.WriteByte(model.SeparatorByte)
+		b.WriteString(labels[name])
+	}
+	return b.String()
+}
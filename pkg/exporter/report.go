@@ -0,0 +1,83 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+// ShutdownReport summarizes what the exporter did over its lifetime, and
+// what it leaves unprocessed, for postmortems of restarts.
+type ShutdownReport struct {
+	Time              time.Time `json:"time"`
+	EventsProcessed   float64   `json:"events_processed"`
+	EventsUnmapped    float64   `json:"events_unmapped"`
+	EventsDropped     float64   `json:"events_dropped"`
+	EventsErrored     float64   `json:"events_errored"`
+	EventsConflicting float64   `json:"events_conflicting"`
+	SeriesExported    int64     `json:"series_exported"`
+	// The queue residues are filled in by the owner of the queue.
+	QueuedEvents  int `json:"queued_events"`
+	QueuedBatches int `json:"queued_batches"`
+}
+
+// Report returns the exporter's part of the shutdown report.
+func (b *Exporter) Report() ShutdownReport {
+	return ShutdownReport{
+		Time:              clock.Now(),
+		EventsProcessed:   sumCounters(b.EventStats),
+		EventsUnmapped:    sumCounters(b.EventsUnmapped),
+		EventsDropped:     sumCounters(b.EventsActions.WithLabelValues("drop")),
+		EventsErrored:     sumCounters(b.ErrorEventStats),
+		EventsConflicting: sumCounters(b.ConflictingEventStats),
+		SeriesExported:    b.Registry.SeriesCount(),
+	}
+}
+
+// KeyVals returns the report as key/value pairs for logging.
+func (r ShutdownReport) KeyVals() []interface{} {
+	return []interface{}{
+		"events_processed", r.EventsProcessed,
+		"events_unmapped", r.EventsUnmapped,
+		"events_dropped", r.EventsDropped,
+		"events_errored", r.EventsErrored,
+		"events_conflicting", r.EventsConflicting,
+		"series_exported", r.SeriesExported,
+		"queued_events", r.QueuedEvents,
+		"queued_batches", r.QueuedBatches,
+	}
+}
+
+// sumCounters adds up the values of all counters a collector returns.
+func sumCounters(c prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var sum float64
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err == nil {
+			sum += metric.GetCounter().GetValue()
+		}
+	}
+	return sum
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/address"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// Server embeds a StatsD endpoint in an application: it listens for StatsD
+// lines over UDP and TCP and exports the resulting metrics through a
+// Prometheus registerer. Create it with New and start it with Run.
+type Server struct {
+	// Exporter handles the received events. Its settings may be changed
+	// between New and Run.
+	Exporter *Exporter
+
+	registerer     prometheus.Registerer
+	logger         log.Logger
+	mapper         *mapper.MetricMapper
+	parser         listener.Parser
+	udpAddress     string
+	tcpAddress     string
+	queueSize      int
+	flushThreshold int
+	flushInterval  time.Duration
+	sources        []listener.EventSource
+	metrics        *Metrics
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithRegisterer registers the exported metrics, and the metrics of the
+// server itself, with reg instead of prometheus.DefaultRegisterer.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(s *Server) { s.registerer = reg }
+}
+
+// WithLogger logs to logger instead of discarding log messages.
+func WithLogger(logger log.Logger) Option {
+	return func(s *Server) { s.logger = logger }
+}
+
+// WithMapper maps the received metrics with m. By default metrics are
+// exported under their StatsD names.
+func WithMapper(m *mapper.MetricMapper) Option {
+	return func(s *Server) { s.mapper = m }
+}
+
+// WithParser parses the received lines with p. By default all supported tag
+// formats are parsed.
+func WithParser(p listener.Parser) Option {
+	return func(s *Server) { s.parser = p }
+}
+
+// WithUDPAddress listens for UDP packets on addr, ":9125" by default. An
+// empty address disables the UDP listener.
+func WithUDPAddress(addr string) Option {
+	return func(s *Server) { s.udpAddress = addr }
+}
+
+// WithTCPAddress listens for TCP connections on addr, ":9125" by default. An
+// empty address disables the TCP listener.
+func WithTCPAddress(addr string) Option {
+	return func(s *Server) { s.tcpAddress = addr }
+}
+
+// WithEventSource adds a custom transport, which receives events in addition
+// to the UDP and TCP listeners. Run starts it and closes it when done.
+func WithEventSource(source listener.EventSource) Option {
+	return func(s *Server) { s.sources = append(s.sources, source) }
+}
+
+// WithEventQueue sets the number of batches of events buffered between the
+// listeners and the exporter, and the number of events and the interval after
+// which queued events are flushed.
+func WithEventQueue(size, flushThreshold int, flushInterval time.Duration) Option {
+	return func(s *Server) {
+		s.queueSize = size
+		s.flushThreshold = flushThreshold
+		s.flushInterval = flushInterval
+	}
+}
+
+// New returns a Server configured by opts, with the defaults of the
+// statsd_exporter command. It registers the metrics of the server, which
+// fails if they are already registered.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		registerer:     prometheus.DefaultRegisterer,
+		logger:         log.NewNopLogger(),
+		udpAddress:     ":9125",
+		tcpAddress:     ":9125",
+		queueSize:      10000,
+		flushThreshold: 1000,
+		flushInterval:  200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.mapper == nil {
+		s.mapper = &mapper.MetricMapper{Registerer: s.registerer, Logger: s.logger}
+		s.mapper.InitCache(1000)
+	}
+	if s.parser == nil {
+		s.parser = NewParser(AllTagFormats)
+	}
+
+	s.metrics = NewMetrics()
+	for _, c := range s.metrics.Collectors() {
+		if err := s.registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	s.Exporter = s.metrics.NewExporter(s.registerer, s.mapper, s.logger)
+	s.Exporter.RecycleEvents = true
+	return s, nil
+}
+
+// Run listens for StatsD lines and starts the event sources, then handles
+// their events until ctx is done. It then stops the listeners and sources,
+// handles the events already received and returns.
+// Run returns an error if a listener cannot be started.
+func (s *Server) Run(ctx context.Context) error {
+	sources := append([]listener.EventSource(nil), s.sources...)
+	closed := false
+	closeSources := func() {
+		if closed {
+			return
+		}
+		closed = true
+		for _, source := range sources {
+			source.Close()
+		}
+	}
+	// The sources are closed also if a listener cannot be started.
+	defer closeSources()
+
+	// The listeners are opened before the event queue is created, so that
+	// there is nothing else to clean up if one of them fails.
+	if s.udpAddress != "" {
+		addr, err := address.UDPAddrFromString(s.udpAddress)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, s.metrics.UDPListener(conn, s.udpAddress, nil, s.parser, s.logger))
+	}
+
+	if s.tcpAddress != "" {
+		addr, err := address.TCPAddrFromString(s.tcpAddress)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, s.metrics.TCPListener(conn, s.tcpAddress, nil, s.parser, s.logger))
+	}
+
+	events := make(chan event.Events, s.queueSize)
+	eventQueue := event.NewEventQueue(events, s.flushThreshold, s.flushInterval, s.metrics.EventsFlushed)
+
+	var sourcesDone sync.WaitGroup
+	for _, source := range sources {
+		source.SetEventHandler(eventQueue)
+		sourcesDone.Add(1)
+		go func(source listener.EventSource) {
+			defer sourcesDone.Done()
+			source.Listen()
+		}(source)
+	}
+
+	listenDone := make(chan struct{})
+	go func() {
+		s.Exporter.Listen(events)
+		close(listenDone)
+	}()
+
+	<-ctx.Done()
+	closeSources()
+	// Events queued by a source before it stops are still handled.
+	sourcesDone.Wait()
+	eventQueue.Close()
+	<-listenDone
+	return nil
+}
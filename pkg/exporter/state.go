@@ -0,0 +1,48 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/registry"
+)
+
+// RestoreState re-creates the series of a state saved by
+// Registry.Snapshot, and returns how many were restored. Series whose mapping
+// is no longer in the config, or that the config now drops, are skipped. It
+// must be called before Listen.
+func (b *Exporter) RestoreState(state registry.State) int {
+	restored := 0
+	for _, s := range state.Series {
+		var mapping *mapper.MetricMapping
+		if s.Origin == "" {
+			mapping = b.unmappedMapping()
+		} else {
+			mapping = b.Mapper.MappingForOrigin(s.Origin)
+		}
+		if mapping == nil || mapping.Action == mapper.ActionTypeDrop {
+			continue
+		}
+		if err := b.Registry.RestoreSeries(s, mapping, b.MetricsCount); err != nil {
+			level.Debug(b.Logger).Log("msg", "Unable to restore series", "metric", s.Metric, "labels", fmt.Sprint(s.Labels), "error", err)
+			continue
+		}
+		restored++
+	}
+	return restored
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+const (
+	defaultTraceDuration = 5 * time.Minute
+	maxTraceDuration     = time.Hour
+)
+
+// EventTracer enables verbose logging of the handling of events whose StatsD
+// metric name matches a pattern, for a limited time. This avoids turning on
+// debug logging for all events.
+type EventTracer struct {
+	mutex   sync.RWMutex
+	pattern *regexp.Regexp
+	until   time.Time
+}
+
+// Trace starts tracing events matching the regular expression for the given
+// duration, replacing any previous pattern.
+func (t *EventTracer) Trace(pattern string, d time.Duration) error {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pattern = re
+	t.until = clock.Now().Add(d)
+	return nil
+}
+
+// Stop ends tracing.
+func (t *EventTracer) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pattern = nil
+}
+
+// Matches reports whether events with this StatsD metric name are currently
+// traced.
+func (t *EventTracer) Matches(metricName string) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.pattern == nil || clock.Now().After(t.until) {
+		return false
+	}
+	return t.pattern.MatchString(metricName)
+}
+
+// ServeHTTP starts tracing on POST or PUT, with the "pattern" and optional
+// "duration" parameters, and stops it on DELETE.
+func (t *EventTracer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		pattern := r.FormValue("pattern")
+		if pattern == "" {
+			http.Error(w, "missing pattern", http.StatusBadRequest)
+			return
+		}
+		d := defaultTraceDuration
+		if v := r.FormValue("duration"); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		if d > maxTraceDuration {
+			d = maxTraceDuration
+		}
+		if err := t.Trace(pattern, d); err != nil {
+			http.Error(w, fmt.Sprintf("invalid pattern: %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "Tracing events matching %q for %s\n", pattern, d)
+	case http.MethodDelete:
+		t.Stop()
+		fmt.Fprintf(w, "Tracing stopped\n")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"unicode/utf8"
+)
+
+// MinLabelValueLength is the smallest maximum label value length, which
+// leaves room for some of the value besides the hash suffix.
+const MinLabelValueLength = 16
+
+// truncatedSuffixLength is the length of the suffix of truncated values, a
+// "~" followed by 8 hex digits.
+const truncatedSuffixLength = 9
+
+// truncateLabelValues truncates the label values longer than max bytes in
+// place and returns how many were truncated.
+func truncateLabelValues(labels map[string]string, max int) int {
+	if max <= 0 {
+		return 0
+	}
+	truncated := 0
+	for label, value := range labels {
+		if len(value) > max {
+			labels[label] = truncateLabelValue(value, max)
+			truncated++
+		}
+	}
+	return truncated
+}
+
+// truncateLabelValue shortens a value to max bytes. The end of the value is
+// replaced by a hash of the whole value, so that values sharing a long
+// prefix stay distinct.
+func truncateLabelValue(value string, max int) string {
+	n := max - truncatedSuffixLength
+	if n < 0 {
+		n = 0
+	}
+	// Do not cut a multi-byte character in half.
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("%s~%08x", value[:n], h.Sum32())
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filter defines the filter stage, which enforces site-specific
+// policies, such as scrubbing personal data from labels or naming
+// conventions, on every event before it is mapped. Filters can be built into
+// a program that uses the exporter as a library, or loaded from Go plugins.
+package filter
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+)
+
+// Symbol is the function a filter plugin exports. It has the type
+// func(log.Logger) (Filter, error), and is called once when the plugin is
+// loaded. Plugins read their own configuration, for example from environment
+// variables.
+const Symbol = "NewFilter"
+
+// Filter inspects, modifies or drops events. Filter is called for every event
+// from the goroutine that handles events, so it must be fast, and must not
+// keep the events after it returns, as they are reused.
+type Filter interface {
+	// Filter returns the event, modified in place or replaced, and false if
+	// the event is dropped.
+	Filter(e event.Event) (event.Event, bool)
+}
+
+// Func adapts a function to a Filter.
+type Func func(e event.Event) (event.Event, bool)
+
+// Filter calls f.
+func (f Func) Filter(e event.Event) (event.Event, bool) {
+	return f(e)
+}
+
+// Chain applies filters in order, until one drops the event.
+type Chain []Filter
+
+// Filter passes the event through the filters of the chain.
+func (c Chain) Filter(e event.Event) (event.Event, bool) {
+	for _, f := range c {
+		var ok bool
+		if e, ok = f.Filter(e); !ok {
+			return e, false
+		}
+	}
+	return e, true
+}
+
+// Load opens a Go plugin and returns the filter its Symbol creates. The
+// plugin must be built with the same Go version and versions of the packages
+// it shares with the exporter, including this one, and Go plugins are only
+// supported on Linux, FreeBSD and macOS with cgo enabled.
+func Load(path string, logger log.Logger) (Filter, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := p.Lookup(Symbol)
+	if err != nil {
+		return nil, err
+	}
+	newFilter, ok := symbol.(func(log.Logger) (Filter, error))
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %s is a %T, not a func(log.Logger) (filter.Filter, error)", path, Symbol, symbol)
+	}
+	f, err := newFilter(log.With(logger, "filter", path))
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+)
+
+func TestChain(t *testing.T) {
+	scrub := Func(func(e event.Event) (event.Event, bool) {
+		delete(e.Labels(), "email")
+		return e, true
+	})
+	dropSecrets := Func(func(e event.Event) (event.Event, bool) {
+		return e, e.MetricName() != "secret"
+	})
+	chain := Chain{scrub, dropSecrets}
+
+	e, ok := chain.Filter(&event.CounterEvent{CMetricName: "logins", CValue: 1, CLabels: map[string]string{"email": "a@example.com", "team": "x"}})
+	if !ok {
+		t.Fatal("expected the event to pass")
+	}
+	if labels := e.Labels(); len(labels) != 1 || labels["team"] != "x" {
+		t.Errorf("expected the email label to be scrubbed, got %v", labels)
+	}
+	if _, ok := chain.Filter(&event.CounterEvent{CMetricName: "secret", CValue: 1, CLabels: map[string]string{}}); ok {
+		t.Error("expected the event to be dropped")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if _, err := Load("/nonexistent/filter.so", log.NewNopLogger()); err == nil {
+		t.Error("expected an error for a missing plugin")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package graphite writes the exported metrics to a Graphite/Carbon server,
+// for dashboards that are still fed from Graphite.
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+// Writer gathers the metrics every Interval and writes them to the Carbon
+// plaintext listener at Address. Labels become Graphite tags, and every
+// metric name is preceded by Prefix.
+type Writer struct {
+	Address  string
+	Interval time.Duration
+	Prefix   string
+	Gatherer prometheus.Gatherer
+	Logger   log.Logger
+	// Errors counts the flushes that could not be written.
+	Errors prometheus.Counter
+}
+
+// Run writes the metrics every Interval until the process exits.
+func (w *Writer) Run() {
+	ticker := clock.NewTicker(w.Interval)
+	for range ticker.C {
+		w.Flush()
+	}
+}
+
+// Flush gathers the metrics and writes them over a new connection.
+func (w *Writer) Flush() {
+	mfs, err := w.Gatherer.Gather()
+	if err != nil {
+		level.Warn(w.Logger).Log("msg", "Error gathering metrics for Graphite", "error", err)
+	}
+	var buf bytes.Buffer
+	writeMetrics(&buf, mfs, w.Prefix, clock.Now().Unix())
+
+	if err := w.write(buf.Bytes()); err != nil {
+		level.Warn(w.Logger).Log("msg", "Error writing metrics to Graphite", "address", w.Address, "error", err)
+		if w.Errors != nil {
+			w.Errors.Inc()
+		}
+	}
+}
+
+func (w *Writer) write(b []byte) error {
+	conn, err := net.DialTimeout("tcp", w.Address, w.Interval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(w.Interval))
+	bw := bufio.NewWriter(conn)
+	if _, err := bw.Write(b); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeMetrics writes metric families in the Carbon plaintext format, one
+// "name;tag=value value timestamp" line per sample. Histograms and summaries
+// are flattened like in the Prometheus text format.
+func writeMetrics(buf *bytes.Buffer, mfs []*dto.MetricFamily, prefix string, now int64) {
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs() / 1000
+			}
+			line := func(suffix string, value float64, extra ...*dto.LabelPair) {
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					return
+				}
+				buf.WriteString(sanitize(prefix + name + suffix))
+				tags := append(append([]*dto.LabelPair{}, m.GetLabel()...), extra...)
+				sort.Slice(tags, func(i, j int) bool { return tags[i].GetName() < tags[j].GetName() })
+				for _, tag := range tags {
+					if tag.GetValue() == "" {
+						continue
+					}
+					buf.WriteByte(';')
+					buf.WriteString(sanitize(tag.GetName()))
+					buf.WriteByte('=')
+					buf.WriteString(sanitize(tag.GetValue()))
+				}
+				buf.WriteByte(' ')
+				buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+				buf.WriteByte(' ')
+				buf.WriteString(strconv.FormatInt(ts, 10))
+				buf.WriteByte('\n')
+			}
+			pair := func(name, value string) *dto.LabelPair {
+				return &dto.LabelPair{Name: &name, Value: &value}
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				line("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				line("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				line("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					line("", q.GetValue(), pair(model.QuantileLabel, strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)))
+				}
+				line("_sum", s.GetSampleSum())
+				line("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					line("_bucket", float64(b.GetCumulativeCount()), pair(model.BucketLabel, strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)))
+				}
+				line("_bucket", float64(h.GetSampleCount()), pair(model.BucketLabel, "+Inf"))
+				line("_sum", h.GetSampleSum())
+				line("_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+}
+
+// sanitizer replaces the characters that separate the fields and tags of a
+// plaintext line.
+var sanitizer = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "\n", "_", "\t", "_", "=", "_")
+
+func sanitize(s string) string {
+	return sanitizer.Replace(s)
+}
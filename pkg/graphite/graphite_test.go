@@ -0,0 +1,107 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+func TestFlush(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(1600000000, 0)}
+	defer func() { clock.ClockInstance = nil }()
+
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}, []string{"la", "empty"})
+	c.WithLabelValues("foo bar;baz", "").Add(3)
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "Latency.", Buckets: []float64{0.5}})
+	h.Observe(0.25)
+	reg.MustRegister(c, h)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	w := &Writer{
+		Address:  l.Addr().String(),
+		Interval: time.Second,
+		Prefix:   "statsd.",
+		Gatherer: reg,
+		Logger:   log.NewNopLogger(),
+	}
+	w.Flush()
+
+	expected := `statsd.latency_seconds_bucket;le=0.5 1 1600000000
+statsd.latency_seconds_bucket;le=+Inf 1 1600000000
+statsd.latency_seconds_sum 0.25 1600000000
+statsd.latency_seconds_count 1 1600000000
+statsd.requests_total;la=foo_bar_baz 3 1600000000
+`
+	select {
+	case got := <-received:
+		if got != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics received")
+	}
+}
+
+func TestFlushError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	errors := prometheus.NewCounter(prometheus.CounterOpts{Name: "errors_total"})
+	w := &Writer{
+		Address:  address,
+		Interval: time.Second,
+		Gatherer: prometheus.NewRegistry(),
+		Logger:   log.NewNopLogger(),
+		Errors:   errors,
+	}
+	w.Flush()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(errors)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mfs[0].GetMetric()[0].GetCounter().GetValue(); got != 1 {
+		t.Errorf("expected 1 error, got %v", got)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ha elects the active exporter among exporters that receive the same
+// mirrored traffic for redundancy, so that only one of them exports it.
+package ha
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// inClusterDir holds the credentials of the service account of a pod.
+const inClusterDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// microTimeFormat is the format of the times of a Lease.
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// lease is a coordination.k8s.io/v1 Lease. The metadata is kept as is, so
+// that updates do not drop fields such as labels.
+type lease struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   json.RawMessage `json:"metadata"`
+	Spec       leaseSpec       `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string     `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int        `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *microTime `json:"acquireTime,omitempty"`
+	RenewTime            *microTime `json:"renewTime,omitempty"`
+	LeaseTransitions     int        `json:"leaseTransitions,omitempty"`
+}
+
+type microTime struct {
+	time.Time
+}
+
+func (t microTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(microTimeFormat))
+}
+
+func (t *microTime) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.Parse(microTimeFormat, s)
+	if err != nil {
+		// Leases written by other clients may use plain RFC 3339.
+		if parsed, err = time.Parse(time.RFC3339, s); err != nil {
+			return err
+		}
+	}
+	t.Time = parsed
+	return nil
+}
+
+// expired reports whether the holder of the lease failed to renew it in time.
+func (s *leaseSpec) expired(now time.Time) bool {
+	if s.HolderIdentity == "" || s.RenewTime == nil {
+		return true
+	}
+	return s.RenewTime.Add(time.Duration(s.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+// errConflict is returned when another exporter updated the lease first.
+var errConflict = errors.New("the lease was updated concurrently")
+
+// LeaseElector elects the active exporter with a Kubernetes Lease. The
+// exporter that holds the lease is active, and renews it every third of the
+// lease duration. The others are on standby, and take it over when it is not
+// renewed for the lease duration.
+type LeaseElector struct {
+	// URL is the URL of the Lease in the Kubernetes API.
+	URL string
+	// TokenFile holds the bearer token of the requests. It is read for every
+	// request, as service account tokens are rotated.
+	TokenFile string
+	Client    *http.Client
+	// Identity tells the exporters apart, for example the name of the pod.
+	Identity      string
+	LeaseDuration time.Duration
+	Logger        log.Logger
+	// OnChange, if set, is called when the exporter becomes active or goes
+	// on standby.
+	OnChange func(active bool)
+
+	active  uint32
+	renewed time.Time
+	now     func() time.Time
+}
+
+// NewInClusterElector returns an elector for the named Lease in the namespace
+// of the pod it runs in, using the service account of the pod.
+func NewInClusterElector(name, identity string, leaseDuration time.Duration, logger log.Logger) (*LeaseElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	namespace, err := ioutil.ReadFile(inClusterDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(inClusterDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s/ca.crt", inClusterDir)
+	}
+	return &LeaseElector{
+		URL:       fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", net.JoinHostPort(host, port), strings.TrimSpace(string(namespace)), name),
+		TokenFile: inClusterDir + "/token",
+		Client: &http.Client{
+			Timeout:   leaseDuration / 3,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		Identity:      identity,
+		LeaseDuration: leaseDuration,
+		Logger:        logger,
+	}, nil
+}
+
+// Active reports whether this exporter holds the lease. It may be called
+// from any goroutine.
+func (e *LeaseElector) Active() bool {
+	return atomic.LoadUint32(&e.active) != 0
+}
+
+// Run tries to acquire or renew the lease every third of the lease duration
+// until ctx is done, then releases it if it is held, so that another exporter
+// takes over without waiting for it to expire.
+func (e *LeaseElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		e.update(ctx)
+		select {
+		case <-ctx.Done():
+			if e.Active() {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), e.LeaseDuration/3)
+				if err := e.release(releaseCtx); err != nil {
+					level.Warn(e.Logger).Log("msg", "Unable to release the HA lease", "error", err)
+				}
+				cancel()
+				e.setActive(false)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *LeaseElector) update(ctx context.Context) {
+	now := e.clock()
+	held, err := e.acquire(ctx, now)
+	if err != nil {
+		level.Warn(e.Logger).Log("msg", "Unable to update the HA lease", "error", err)
+		// Stay active only while the last renewal is certainly still valid
+		// for the other exporters.
+		held = e.Active() && now.Before(e.renewed.Add(e.LeaseDuration*2/3))
+	} else if held {
+		e.renewed = now
+	}
+	e.setActive(held)
+}
+
+func (e *LeaseElector) setActive(active bool) {
+	var v uint32
+	if active {
+		v = 1
+	}
+	if atomic.SwapUint32(&e.active, v) == v {
+		return
+	}
+	if active {
+		level.Info(e.Logger).Log("msg", "Acquired the HA lease, exporting metrics", "identity", e.Identity)
+	} else {
+		level.Info(e.Logger).Log("msg", "Lost the HA lease, on standby", "identity", e.Identity)
+	}
+	if e.OnChange != nil {
+		e.OnChange(active)
+	}
+}
+
+func (e *LeaseElector) clock() time.Time {
+	if e.now != nil {
+		return e.now()
+	}
+	return time.Now()
+}
+
+// acquire creates, takes over or renews the lease, and reports whether this
+// exporter holds it.
+func (e *LeaseElector) acquire(ctx context.Context, now time.Time) (bool, error) {
+	l, err := e.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	method, url := http.MethodPut, e.URL
+	if l == nil {
+		name := e.URL[strings.LastIndex(e.URL, "/")+1:]
+		metadata, err := json.Marshal(map[string]string{"name": name})
+		if err != nil {
+			return false, err
+		}
+		l = &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease", Metadata: metadata}
+		method, url = http.MethodPost, e.URL[:strings.LastIndex(e.URL, "/")]
+	}
+
+	spec := &l.Spec
+	if spec.HolderIdentity != e.Identity {
+		if !spec.expired(now) {
+			return false, nil
+		}
+		spec.HolderIdentity = e.Identity
+		spec.AcquireTime = &microTime{now}
+		spec.LeaseTransitions++
+	}
+	spec.RenewTime = &microTime{now}
+	spec.LeaseDurationSeconds = int(e.LeaseDuration / time.Second)
+	err = e.send(ctx, method, url, l)
+	if err == errConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release gives up the lease.
+func (e *LeaseElector) release(ctx context.Context) error {
+	l, err := e.get(ctx)
+	if err != nil || l == nil || l.Spec.HolderIdentity != e.Identity {
+		return err
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.AcquireTime = nil
+	l.Spec.RenewTime = nil
+	return e.send(ctx, http.MethodPut, e.URL, l)
+}
+
+// get returns the lease, or nil if it does not exist.
+func (e *LeaseElector) get(ctx context.Context) (*lease, error) {
+	resp, err := e.do(ctx, http.MethodGet, e.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s getting the lease", resp.Status)
+	}
+	var l lease
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// send creates or updates the lease. The resource version in its metadata
+// makes updates fail with errConflict if another exporter updated it first.
+func (e *LeaseElector) send(ctx context.Context, method, url string, l *lease) error {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	resp, err := e.do(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return errConflict
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("unexpected status %s updating the lease", resp.Status)
+	}
+	return nil
+}
+
+func (e *LeaseElector) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if e.TokenFile != "" {
+		token, err := ioutil.ReadFile(e.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
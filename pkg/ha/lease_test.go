@@ -0,0 +1,160 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeAPI serves a single Lease with optimistic concurrency, like the
+// Kubernetes API.
+type fakeAPI struct {
+	mutex   sync.Mutex
+	lease   map[string]interface{}
+	version int
+	down    bool
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	const path = "/apis/coordination.k8s.io/v1/namespaces/default/leases"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == path+"/exporter":
+		if a.lease == nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(a.lease)
+	case r.Method == http.MethodPost && r.URL.Path == path:
+		if a.lease != nil {
+			http.Error(w, "exists", http.StatusConflict)
+			return
+		}
+		a.store(w, r)
+	case r.Method == http.MethodPut && r.URL.Path == path+"/exporter":
+		a.store(w, r)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (a *fakeAPI) store(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var l map[string]interface{}
+	if err := json.Unmarshal(body, &l); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metadata := l["metadata"].(map[string]interface{})
+	if a.lease != nil && metadata["resourceVersion"] != strconv.Itoa(a.version) {
+		http.Error(w, "conflict", http.StatusConflict)
+		return
+	}
+	a.version++
+	metadata["resourceVersion"] = strconv.Itoa(a.version)
+	a.lease = l
+	json.NewEncoder(w).Encode(l)
+}
+
+func (a *fakeAPI) holder() interface{} {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.lease["spec"].(map[string]interface{})["holderIdentity"]
+}
+
+func TestLeaseElector(t *testing.T) {
+	api := &fakeAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	now := time.Unix(1000, 0)
+	newElector := func(identity string, changes *[]bool) *LeaseElector {
+		return &LeaseElector{
+			URL:           server.URL + "/apis/coordination.k8s.io/v1/namespaces/default/leases/exporter",
+			Identity:      identity,
+			LeaseDuration: 15 * time.Second,
+			Logger:        log.NewNopLogger(),
+			OnChange:      func(active bool) { *changes = append(*changes, active) },
+			now:           func() time.Time { return now },
+		}
+	}
+	var aChanges, bChanges []bool
+	a, b := newElector("a", &aChanges), newElector("b", &bChanges)
+	ctx := context.Background()
+
+	a.update(ctx)
+	b.update(ctx)
+	if !a.Active() || b.Active() || api.holder() != "a" {
+		t.Fatalf("expected a to create and hold the lease, holder is %v", api.holder())
+	}
+
+	// a renews the lease, so b stays on standby.
+	now = now.Add(10 * time.Second)
+	a.update(ctx)
+	now = now.Add(10 * time.Second)
+	b.update(ctx)
+	if !a.Active() || b.Active() {
+		t.Errorf("expected a to keep the lease it renewed")
+	}
+
+	// a cannot reach the API, so its lease expires and b takes over.
+	api.mutex.Lock()
+	api.down = true
+	api.mutex.Unlock()
+	now = now.Add(5 * time.Second)
+	a.update(ctx)
+	if a.Active() {
+		t.Errorf("expected a to go on standby before its lease expires")
+	}
+	api.mutex.Lock()
+	api.down = false
+	api.mutex.Unlock()
+	now = now.Add(5 * time.Second)
+	b.update(ctx)
+	a.update(ctx)
+	if a.Active() || !b.Active() || api.holder() != "b" {
+		t.Errorf("expected b to take over the expired lease, holder is %v", api.holder())
+	}
+
+	// b releases the lease on shutdown, and a takes it over right away.
+	runCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	b.Run(runCtx)
+	a.update(ctx)
+	if !a.Active() || b.Active() || api.holder() != "a" {
+		t.Errorf("expected a to take over the released lease, holder is %v", api.holder())
+	}
+
+	if len(aChanges) != 3 || !aChanges[0] || aChanges[1] || !aChanges[2] {
+		t.Errorf("unexpected changes of a %v", aChanges)
+	}
+	if len(bChanges) != 2 || !bChanges[0] || bChanges[1] {
+		t.Errorf("unexpected changes of b %v", bChanges)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package handoff passes the listening sockets of a process to the process
+// that replaces it, so that an upgrade never closes them. Packets and
+// connections that arrive in between wait in the socket buffers and backlogs
+// of the kernel instead of being refused.
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvVar tells a process started by Handoff.Start which file descriptors it
+// inherited, as a comma-separated list of name:fd pairs.
+const EnvVar = "STATSD_EXPORTER_HANDOFF"
+
+// readyName is the name of the pipe the new process signals readiness on.
+const readyName = "ready"
+
+// Socket is implemented by the listeners and connections that can be handed
+// off, such as *net.UDPConn, *net.TCPListener and *net.UnixConn.
+type Socket interface {
+	File() (*os.File, error)
+}
+
+// Handoff collects the sockets to pass to a new process.
+type Handoff struct {
+	names []string
+	files []*os.File
+}
+
+// Add duplicates the file descriptor of a socket under the given name. The
+// socket stays open in the kernel as long as the duplicate does, even if the
+// socket itself is closed.
+func (h *Handoff) Add(name string, socket Socket) error {
+	if name == readyName || strings.ContainsAny(name, ",:") {
+		return fmt.Errorf("invalid socket name %q", name)
+	}
+	f, err := socket.File()
+	if err != nil {
+		return err
+	}
+	h.names = append(h.names, name)
+	h.files = append(h.files, f)
+	return nil
+}
+
+// Close closes the duplicated file descriptors of the sockets.
+func (h *Handoff) Close() {
+	for _, f := range h.files {
+		f.Close()
+	}
+	h.names, h.files = nil, nil
+}
+
+// Start starts the named program with the sockets, and waits up to timeout
+// for it to call Inherited.Ready. A program that does not become ready is
+// killed. The sockets are closed in this process either way.
+func (h *Handoff) Start(name string, args []string, timeout time.Duration) (*os.Process, error) {
+	defer h.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	fds := make([]string, 0, len(h.names)+1)
+	for i, name := range append(h.names, readyName) {
+		// The extra files of a command start after stdin, stdout and stderr.
+		fds = append(fds, name+":"+strconv.Itoa(3+i))
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), EnvVar+"="+strings.Join(fds, ","))
+	cmd.ExtraFiles = append(h.files, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	// The pipe is closed without a write if the process exits before it is
+	// ready.
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("the new process did not become ready: %v", err)
+	}
+	return cmd.Process, nil
+}
+
+// Inherited holds the sockets a process was started with by Handoff.Start.
+// The zero value and nil hold none.
+type Inherited struct {
+	files map[string]*os.File
+	ready *os.File
+}
+
+// Inherit returns the sockets this process was started with, or nil if it
+// was not started by Handoff.Start. It unsets EnvVar, so that processes this
+// one starts do not inherit it.
+func Inherit() (*Inherited, error) {
+	spec, ok := os.LookupEnv(EnvVar)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(EnvVar)
+	fds, err := parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	i := &Inherited{files: make(map[string]*os.File, len(fds))}
+	for name, fd := range fds {
+		f := os.NewFile(fd, name)
+		if name == readyName {
+			i.ready = f
+		} else {
+			i.files[name] = f
+		}
+	}
+	return i, nil
+}
+
+// parse reads the file descriptors of the inherited sockets from EnvVar.
+func parse(spec string) (map[string]uintptr, error) {
+	fds := make(map[string]uintptr)
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid inherited socket %q", pair)
+		}
+		fd, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("invalid file descriptor of inherited socket %q", pair)
+		}
+		fds[parts[0]] = uintptr(fd)
+	}
+	if _, ok := fds[readyName]; !ok {
+		return nil, errors.New("no readiness pipe among the inherited sockets")
+	}
+	return fds, nil
+}
+
+// take removes the file of the named socket.
+func (i *Inherited) take(name string) *os.File {
+	if i == nil {
+		return nil
+	}
+	f := i.files[name]
+	delete(i.files, name)
+	return f
+}
+
+// PacketConn returns the named inherited datagram socket, or nil if there is
+// none.
+func (i *Inherited) PacketConn(name string) (net.PacketConn, error) {
+	f := i.take(name)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// Listener returns the named inherited listening socket, or nil if there is
+// none.
+func (i *Inherited) Listener(name string) (net.Listener, error) {
+	f := i.take(name)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Ready tells the process that started this one that it took over the
+// sockets, and closes the inherited sockets that were not used.
+func (i *Inherited) Ready() error {
+	if i == nil {
+		return nil
+	}
+	for name, f := range i.files {
+		f.Close()
+		delete(i.files, name)
+	}
+	_, err := i.ready.Write([]byte{1})
+	if closeErr := i.ready.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handoff
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"udp:3", "ready:x", "udp", "ready:1"} {
+		if _, err := parse(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+	fds, err := parse("udp:3,web:4,ready:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fds) != 3 || fds["udp"] != 3 || fds["web"] != 4 || fds["ready"] != 5 {
+		t.Errorf("unexpected inherited sockets %v", fds)
+	}
+
+	var none *Inherited
+	if conn, err := none.PacketConn("udp"); conn != nil || err != nil {
+		t.Errorf("expected no socket, got %v, %v", conn, err)
+	}
+	if err := none.Ready(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestHelperProcess is the process started by TestStart.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv(EnvVar) == "" {
+		return
+	}
+	inherited, err := Inherit()
+	if err != nil {
+		os.Exit(2)
+	}
+	conn, err := inherited.PacketConn("udp")
+	if err != nil || conn == nil {
+		os.Exit(3)
+	}
+	if err := inherited.Ready(); err != nil {
+		os.Exit(4)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "foo:1|c" {
+		os.Exit(5)
+	}
+	os.Exit(0)
+}
+
+func TestStart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("passing files to processes is not supported on Windows")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h Handoff
+	if err := h.Add("udp", conn); err != nil {
+		t.Fatal(err)
+	}
+	// The packet waits in the socket after this process stopped reading it.
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("foo:1|c")); err != nil {
+		t.Fatal(err)
+	}
+
+	process, err := h.Start(os.Args[0], []string{"-test.run=TestHelperProcess"}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := process.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Success() {
+		t.Errorf("expected the new process to read the packet, got %v", state)
+	}
+
+	// Without the UDP socket, the helper process exits before it is ready.
+	var failing Handoff
+	if _, err := failing.Start(os.Args[0], []string{"-test.run=TestHelperProcess"}, 10*time.Second); err == nil {
+		t.Error("expected an error for a process that does not become ready")
+	}
+}
@@ -14,6 +14,7 @@
 package line
 
 import (
+	"encoding/base64"
 	"fmt"
 	"strconv"
 	"strings"
@@ -33,8 +34,25 @@ type Parser struct {
 	InfluxdbTagsEnabled  bool
 	LibratoTagsEnabled   bool
 	SignalFXTagsEnabled  bool
+	// TagKeys is how tag keys that are not valid label names are handled.
+	// The zero value is TagKeysPrefix.
+	TagKeys TagKeyPolicy
 }
 
+// TagKeyPolicy is the way tag keys that are not valid label names are
+// handled.
+type TagKeyPolicy string
+
+const (
+	// TagKeysPrefix replaces invalid characters with "_" and prefixes keys
+	// that start with a digit with "_", and keys that start with the
+	// reserved "__" with "tag".
+	TagKeysPrefix TagKeyPolicy = "prefix"
+	// TagKeysDrop drops the tags whose keys are not valid label names and
+	// counts them as tag errors.
+	TagKeysDrop TagKeyPolicy = "drop"
+)
+
 // NewParser returns a new line parser
 func NewParser() *Parser {
 	p := Parser{}
@@ -61,33 +79,116 @@ func (p *Parser) EnableSignalFXParsing() {
 	p.SignalFXTagsEnabled = true
 }
 
+// labelName returns the label name of a tag key, and false if the tag is
+// dropped.
+func (p *Parser) labelName(key string) (string, bool) {
+	if p.TagKeys == TagKeysDrop {
+		return key, isValidLabelName(key)
+	}
+	name := mapper.EscapeMetricName(key)
+	if strings.HasPrefix(name, "__") {
+		name = "tag" + name
+	}
+	return name, true
+}
+
+// isValidLabelName reports whether the name is a valid label name that is not
+// reserved for internal use.
+func isValidLabelName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for i, c := range name {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || (c >= '0' && c <= '9' && i > 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxHistogramObservations limits the number of observations in one
+// pre-aggregated histogram sample, as each of them is recorded separately.
+const maxHistogramObservations = 1 << 20
+
+// parseHistogram decodes the payload of a pre-aggregated histogram sample: a
+// base64-encoded, comma-separated list of value:count pairs.
+func parseHistogram(payload string) ([]event.HistogramBucket, error) {
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		decoded, err = base64.RawStdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pairs := string(decoded)
+	buckets := make([]event.HistogramBucket, 0, strings.Count(pairs, ",")+1)
+	var total uint64
+	for more := true; more; {
+		var pair string
+		pair, pairs, more = cut(pairs, ',')
+		valueStr, countStr, found := cut(pair, ':')
+		if !found {
+			return nil, fmt.Errorf("malformed histogram bucket %q", pair)
+		}
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.ParseUint(countStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		// Checked before adding, as the sum of the counts can overflow.
+		if count > maxHistogramObservations-total {
+			return nil, fmt.Errorf("histogram has more than %d observations", maxHistogramObservations)
+		}
+		total += count
+		buckets = append(buckets, event.HistogramBucket{Value: value, Count: count})
+	}
+	return buckets, nil
+}
+
+// cut slices s around the first instance of sep, returning the text before
+// and after it. If sep does not appear in s, cut returns s, "", false.
+func cut(s string, sep byte) (before, after string, found bool) {
+	if i := strings.IndexByte(s, sep); i >= 0 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+// maxComponents is the maximum number of |-separated components of a sample:
+// the value, the type, a sampling factor and tags.
+const maxComponents = 4
+
+// splitComponents slices sample into its components without allocating. It
+// returns the number of components, or maxComponents+1 if there are more.
+func splitComponents(sample string, components *[maxComponents]string) int {
+	n := 0
+	for more := true; more; n++ {
+		if n == maxComponents {
+			return n + 1
+		}
+		components[n], sample, more = cut(sample, '|')
+	}
+	return n
+}
+
 func buildEvent(statType, metric string, value float64, relative bool, labels map[string]string) (event.Event, error) {
 	switch statType {
 	case "c":
-		return &event.CounterEvent{
-			CMetricName: metric,
-			CValue:      float64(value),
-			CLabels:     labels,
-		}, nil
+		return event.NewCounterEvent(metric, value, labels), nil
 	case "g":
-		return &event.GaugeEvent{
-			GMetricName: metric,
-			GValue:      float64(value),
-			GRelative:   relative,
-			GLabels:     labels,
-		}, nil
+		return event.NewGaugeEvent(metric, value, relative, labels), nil
 	case "ms":
-		return &event.ObserverEvent{
-			OMetricName: metric,
-			OValue:      float64(value) / 1000, // prometheus presumes seconds, statsd millisecond
-			OLabels:     labels,
-		}, nil
+		// prometheus presumes seconds, statsd millisecond; the event
+		// converts unless the mapping keeps the unit.
+		e := event.NewObserverEvent(metric, value, labels)
+		e.OMilliseconds = true
+		return e, nil
 	case "h", "d":
-		return &event.ObserverEvent{
-			OMetricName: metric,
-			OValue:      float64(value),
-			OLabels:     labels,
-		}, nil
+		return event.NewObserverEvent(metric, value, labels), nil
 	case "s":
 		return nil, fmt.Errorf("no support for StatsD sets")
 	default:
@@ -95,7 +196,7 @@ func buildEvent(statType, metric string, value float64, relative bool, labels ma
 	}
 }
 
-func parseTag(component, tag string, separator rune, labels map[string]string, tagErrors prometheus.Counter, logger log.Logger) {
+func (p *Parser) parseTag(component, tag string, separator rune, labels map[string]string, tagErrors prometheus.Counter, logger log.Logger) {
 	// Entirely empty tag is an error
 	if len(tag) == 0 {
 		tagErrors.Inc()
@@ -112,8 +213,11 @@ func parseTag(component, tag string, separator rune, labels map[string]string, t
 				// Empty key or value is an error
 				tagErrors.Inc()
 				level.Debug(logger).Log("msg", "Malformed name tag", "k", k, "v", v, "component", component)
+			} else if name, ok := p.labelName(k); ok {
+				labels[name] = v
 			} else {
-				labels[mapper.EscapeMetricName(k)] = v
+				tagErrors.Inc()
+				level.Debug(logger).Log("msg", "Invalid tag key", "k", k, "component", component)
 			}
 			return
 		}
@@ -124,20 +228,20 @@ func parseTag(component, tag string, separator rune, labels map[string]string, t
 	level.Debug(logger).Log("msg", "Malformed name tag", "tag", tag, "component", component)
 }
 
-func parseNameTags(component string, labels map[string]string, tagErrors prometheus.Counter, logger log.Logger) {
+func (p *Parser) parseNameTags(component string, labels map[string]string, tagErrors prometheus.Counter, logger log.Logger) {
 	lastTagEndIndex := 0
 	for i, c := range component {
 		if c == ',' {
 			tag := component[lastTagEndIndex:i]
 			lastTagEndIndex = i + 1
-			parseTag(component, tag, '=', labels, tagErrors, logger)
+			p.parseTag(component, tag, '=', labels, tagErrors, logger)
 		}
 	}
 
 	// If we're not off the end of the string, add the last tag
 	if lastTagEndIndex < len(component) {
 		tag := component[lastTagEndIndex:]
-		parseTag(component, tag, '=', labels, tagErrors, logger)
+		p.parseTag(component, tag, '=', labels, tagErrors, logger)
 	}
 }
 
@@ -155,14 +259,14 @@ func (p *Parser) ParseDogStatsDTags(component string, labels map[string]string,
 			if c == ',' {
 				tag := component[lastTagEndIndex:i]
 				lastTagEndIndex = i + 1
-				parseTag(component, trimLeftHash(tag), ':', labels, tagErrors, logger)
+				p.parseTag(component, trimLeftHash(tag), ':', labels, tagErrors, logger)
 			}
 		}
 
 		// If we're not off the end of the string, add the last tag
 		if lastTagEndIndex < len(component) {
 			tag := component[lastTagEndIndex:]
-			parseTag(component, trimLeftHash(tag), ':', labels, tagErrors, logger)
+			p.parseTag(component, trimLeftHash(tag), ':', labels, tagErrors, logger)
 		}
 	}
 }
@@ -179,7 +283,7 @@ func (p *Parser) parseNameAndTags(name string, labels map[string]string, tagErro
 		switch {
 		case startIdx != -1 && endIdx != -1:
 			// good signalfx tags
-			parseNameTags(name[startIdx+1:endIdx], labels, tagErrors, logger)
+			p.parseNameTags(name[startIdx+1:endIdx], labels, tagErrors, logger)
 			return name[:startIdx] + name[endIdx+1:]
 		case (startIdx != -1) != (endIdx != -1):
 			// only one bracket, return unparsed
@@ -195,73 +299,87 @@ func (p *Parser) parseNameAndTags(name string, labels map[string]string, tagErro
 		// `,` delimits start of tags by InfluxDB
 		// https://www.influxdata.com/blog/getting-started-with-sending-statsd-metrics-to-telegraf-influxdb/#introducing-influx-statsd
 		if (c == '#' && p.LibratoTagsEnabled) || (c == ',' && p.InfluxdbTagsEnabled) {
-			parseNameTags(name[i+1:], labels, tagErrors, logger)
+			p.parseNameTags(name[i+1:], labels, tagErrors, logger)
 			return name[:i]
 		}
 	}
 	return name
 }
 
+// LineToEvents parses a StatsD line into events. It slices the line instead
+// of splitting it, so that parsing only allocates the events and their
+// labels.
 func (p *Parser) LineToEvents(line string, sampleErrors prometheus.CounterVec, samplesReceived prometheus.Counter, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) event.Events {
 	events := event.Events{}
 	if line == "" {
 		return events
 	}
 
-	elements := strings.SplitN(line, ":", 2)
-	if len(elements) < 2 || len(elements[0]) == 0 || !utf8.ValidString(line) {
+	name, rest, found := cut(line, ':')
+	if !found || len(name) == 0 || !utf8.ValidString(line) {
 		sampleErrors.WithLabelValues("malformed_line").Inc()
 		level.Debug(logger).Log("msg", "Bad line from StatsD", "line", line)
 		return events
 	}
 
 	labels := map[string]string{}
-	metric := p.parseNameAndTags(elements[0], labels, tagErrors, logger)
-
-	var samples []string
-	if strings.Contains(elements[1], "|#") {
-		// using DogStatsD tags
+	metric := p.parseNameAndTags(name, labels, tagErrors, logger)
 
+	// using DogStatsD tags disables multi-metrics
+	dogStatsD := strings.Contains(rest, "|#")
+	if dogStatsD && len(labels) > 0 {
 		// don't allow mixed tagging styles
-		if len(labels) > 0 {
-			sampleErrors.WithLabelValues("mixed_tagging_styles").Inc()
-			level.Debug(logger).Log("msg", "Bad line (multiple tagging styles) from StatsD", "line", line)
-			return events
-		}
-
-		// disable multi-metrics
-		samples = elements[1:]
-	} else {
-		samples = strings.Split(elements[1], ":")
+		sampleErrors.WithLabelValues("mixed_tagging_styles").Inc()
+		level.Debug(logger).Log("msg", "Bad line (multiple tagging styles) from StatsD", "line", line)
+		return events
 	}
 
+	var components [maxComponents]string
 samples:
-	for _, sample := range samples {
+	for more := true; more; {
+		sample := rest
+		if dogStatsD {
+			more = false
+		} else {
+			sample, rest, more = cut(rest, ':')
+		}
+
 		samplesReceived.Inc()
-		components := strings.Split(sample, "|")
+		n := splitComponents(sample, &components)
 		samplingFactor := 1.0
-		if len(components) < 2 || len(components) > 4 {
+		if n < 2 || n > maxComponents {
 			sampleErrors.WithLabelValues("malformed_component").Inc()
 			level.Debug(logger).Log("msg", "Bad component", "line", line)
 			continue
 		}
 		valueStr, statType := components[0], components[1]
 
-		var relative = false
-		if strings.Index(valueStr, "+") == 0 || strings.Index(valueStr, "-") == 0 {
-			relative = true
-		}
+		relative := valueStr != "" && (valueStr[0] == '+' || valueStr[0] == '-')
 
-		value, err := strconv.ParseFloat(valueStr, 64)
-		if err != nil {
-			level.Debug(logger).Log("msg", "Bad value", "value", valueStr, "line", line)
-			sampleErrors.WithLabelValues("malformed_value").Inc()
-			continue
+		var (
+			value   float64
+			buckets []event.HistogramBucket
+			err     error
+		)
+		if statType == "H" {
+			buckets, err = parseHistogram(valueStr)
+			if err != nil {
+				level.Debug(logger).Log("msg", "Bad histogram", "value", valueStr, "line", line, "error", err)
+				sampleErrors.WithLabelValues("malformed_histogram").Inc()
+				continue
+			}
+		} else {
+			value, err = strconv.ParseFloat(valueStr, 64)
+			if err != nil {
+				level.Debug(logger).Log("msg", "Bad value", "value", valueStr, "line", line)
+				sampleErrors.WithLabelValues("malformed_value").Inc()
+				continue
+			}
 		}
 
 		multiplyEvents := 1
-		if len(components) >= 3 {
-			for _, component := range components[2:] {
+		if n >= 3 {
+			for _, component := range components[2:n] {
 				if len(component) == 0 {
 					level.Debug(logger).Log("msg", "Empty component", "line", line)
 					sampleErrors.WithLabelValues("malformed_component").Inc()
@@ -269,7 +387,7 @@ samples:
 				}
 			}
 
-			for _, component := range components[2:] {
+			for _, component := range components[2:n] {
 				switch component[0] {
 				case '@':
 
@@ -286,7 +404,7 @@ samples:
 						continue
 					} else if statType == "c" {
 						value /= samplingFactor
-					} else if statType == "ms" || statType == "h" || statType == "d" {
+					} else if statType == "ms" || statType == "h" || statType == "d" || statType == "H" {
 						multiplyEvents = int(1 / samplingFactor)
 					}
 				case '#':
@@ -304,6 +422,14 @@ samples:
 		}
 
 		for i := 0; i < multiplyEvents; i++ {
+			if statType == "H" {
+				events = append(events, &event.HistogramEvent{
+					HMetricName: metric,
+					HBuckets:    buckets,
+					HLabels:     labels,
+				})
+				continue
+			}
 			event, err := buildEvent(statType, metric, value, relative, labels)
 			if err != nil {
 				level.Debug(logger).Log("msg", "Error building event", "line", line, "error", err)
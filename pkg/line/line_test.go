@@ -19,6 +19,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 
 	"github.com/prometheus/statsd_exporter/pkg/event"
 )
@@ -105,9 +106,10 @@ func TestLineToEvents(t *testing.T) {
 			in: "foo:200|ms",
 			out: event.Events{
 				&event.ObserverEvent{
-					OMetricName: "foo",
-					OValue:      0.2,
-					OLabels:     map[string]string{},
+					OMetricName:   "foo",
+					OValue:        200,
+					OLabels:       map[string]string{},
+					OMilliseconds: true,
 				},
 			},
 		},
@@ -406,18 +408,62 @@ func TestLineToEvents(t *testing.T) {
 		"timings with sampling factor": {
 			in: "foo.timing:0.5|ms|@0.1",
 			out: event.Events{
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
-				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.0005, OLabels: map[string]string{}},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+				&event.ObserverEvent{OMetricName: "foo.timing", OValue: 0.5, OLabels: map[string]string{}, OMilliseconds: true},
+			},
+		},
+		"pre-aggregated histogram": {
+			in: "foo.histogram:MC4xOjMsMC41OjI=|H|#tag:value",
+			out: event.Events{
+				&event.HistogramEvent{
+					HMetricName: "foo.histogram",
+					HBuckets:    []event.HistogramBucket{{Value: 0.1, Count: 3}, {Value: 0.5, Count: 2}},
+					HLabels:     map[string]string{"tag": "value"},
+				},
+			},
+		},
+		"pre-aggregated histogram without padding": {
+			in: "foo.histogram:MC4yNTo0|H",
+			out: event.Events{
+				&event.HistogramEvent{
+					HMetricName: "foo.histogram",
+					HBuckets:    []event.HistogramBucket{{Value: 0.25, Count: 4}},
+					HLabels:     map[string]string{},
+				},
 			},
 		},
+		"pre-aggregated histogram with sampling factor": {
+			in: "foo.histogram:MC4yNTo0|H|@0.5",
+			out: event.Events{
+				&event.HistogramEvent{
+					HMetricName: "foo.histogram",
+					HBuckets:    []event.HistogramBucket{{Value: 0.25, Count: 4}},
+					HLabels:     map[string]string{},
+				},
+				&event.HistogramEvent{
+					HMetricName: "foo.histogram",
+					HBuckets:    []event.HistogramBucket{{Value: 0.25, Count: 4}},
+					HLabels:     map[string]string{},
+				},
+			},
+		},
+		"malformed pre-aggregated histogram": {
+			in: "foo.histogram:MC4xOjMsMC41|H",
+		},
+		"pre-aggregated histogram with invalid base64": {
+			in: "foo.histogram:not*base64|H",
+		},
+		"pre-aggregated histogram with too many observations": {
+			in: "foo.histogram:MC4xOjMwMDAwMDA=|H",
+		},
 		"bad line": {
 			in: "foo",
 		},
@@ -463,9 +509,10 @@ func TestLineToEvents(t *testing.T) {
 			in: "foo:200|ms",
 			out: event.Events{
 				&event.ObserverEvent{
-					OMetricName: "foo",
-					OValue:      0.2,
-					OLabels:     map[string]string{},
+					OMetricName:   "foo",
+					OValue:        200,
+					OLabels:       map[string]string{},
+					OMilliseconds: true,
 				},
 			},
 		},
@@ -1701,3 +1748,85 @@ func TestDisableParsingLibratoLineToEvents(t *testing.T) {
 		})
 	}
 }
+
+func TestTagKeyPolicy(t *testing.T) {
+	line := "foo:100|c|#0.region:eu,__name__:bar,valid_key:1,web-host:a,😱:b"
+	testCases := map[TagKeyPolicy]struct {
+		labels map[string]string
+		errors float64
+	}{
+		"": {
+			labels: map[string]string{"_0_region": "eu", "tag__name__": "bar", "valid_key": "1", "web_host": "a", "_": "b"},
+		},
+		TagKeysPrefix: {
+			labels: map[string]string{"_0_region": "eu", "tag__name__": "bar", "valid_key": "1", "web_host": "a", "_": "b"},
+		},
+		TagKeysDrop: {
+			labels: map[string]string{"valid_key": "1"},
+			errors: 4,
+		},
+	}
+
+	for policy, testCase := range testCases {
+		t.Run(string(policy), func(t *testing.T) {
+			parser := NewParser()
+			parser.EnableDogstatsdParsing()
+			parser.TagKeys = policy
+			tagErrors := prometheus.NewCounter(prometheus.CounterOpts{Name: "tag_errors_total"})
+
+			events := parser.LineToEvents(line, *nopSampleErrors, nopSamplesReceived, tagErrors, nopTagsReceived, nopLogger)
+			if len(events) != 1 {
+				t.Fatalf("Expected 1 event, got %d", len(events))
+			}
+			if labels := events[0].Labels(); !reflect.DeepEqual(labels, testCase.labels) {
+				t.Errorf("Expected labels %v, got %v", testCase.labels, labels)
+			}
+			m := &dto.Metric{}
+			if err := tagErrors.Write(m); err != nil {
+				t.Fatal(err)
+			}
+			if errors := m.GetCounter().GetValue(); errors != testCase.errors {
+				t.Errorf("Expected %v tag errors, got %v", testCase.errors, errors)
+			}
+		})
+	}
+}
+
+func BenchmarkLineToEvents(b *testing.B) {
+	lines := []string{
+		"foo:100|c",
+		"foo:100|c|@0.1",
+		"foo:100|ms:200|ms:300|g",
+		"foo:100|c|#tag1:bar,tag2:baz",
+		"foo,tag1=bar,tag2=baz:100|g",
+	}
+
+	parser := NewParser()
+	parser.EnableDogstatsdParsing()
+	parser.EnableInfluxdbParsing()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, l := range lines {
+			event.Recycle(parser.LineToEvents(l, *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger))
+		}
+	}
+}
+
+func TestParseHistogramLimit(t *testing.T) {
+	for _, payload := range []string{
+		// 0.1:3000000
+		"MC4xOjMwMDAwMDA=",
+		// 1:1048576,1:18446744073708503041, whose counts sum to 1 modulo 2^64.
+		"MToxMDQ4NTc2LDE6MTg0NDY3NDQwNzM3MDg1MDMwNDE=",
+	} {
+		if buckets, err := parseHistogram(payload); err == nil {
+			t.Errorf("expected an error for payload %s, got %v", payload, buckets)
+		}
+	}
+	// 1:1048576
+	if _, err := parseHistogram("MToxMDQ4NTc2"); err != nil {
+		t.Errorf("expected %d observations to be accepted, got %v", maxHistogramObservations, err)
+	}
+}
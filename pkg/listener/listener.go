@@ -25,12 +25,30 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/relay"
+	"github.com/prometheus/statsd_exporter/pkg/sender"
+	"github.com/prometheus/statsd_exporter/pkg/tenant"
 )
 
 type Parser interface {
 	LineToEvents(line string, sampleErrors prometheus.CounterVec, samplesReceived prometheus.Counter, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) event.Events
 }
 
+// EventSource is a transport that receives StatsD events. Listen receives
+// events and queues them to the event handler until the source is closed.
+// Custom transports implement it to feed events into the exporter.
+type EventSource interface {
+	SetEventHandler(eh event.EventHandler)
+	Listen()
+	io.Closer
+}
+
+var (
+	_ EventSource = &StatsDUDPListener{}
+	_ EventSource = &StatsDTCPListener{}
+	_ EventSource = &StatsDUnixgramListener{}
+)
+
 type StatsDUDPListener struct {
 	Conn            *net.UDPConn
 	EventHandler    event.EventHandler
@@ -43,16 +61,30 @@ type StatsDUDPListener struct {
 	SamplesReceived prometheus.Counter
 	TagErrors       prometheus.Counter
 	TagsReceived    prometheus.Counter
+	// Relay, if set, forwards the received lines.
+	Relay *relay.Relay
+	// Cluster, if set, forwards the lines of the metrics other exporters of
+	// the cluster are responsible for to them, instead of handling them.
+	Cluster *relay.Relay
+	// Tenants, if set, labels the events with their tenant.
+	Tenants *tenant.Resolver
+	// Sources, if set, labels the events with the host that sent them.
+	Sources *sender.Labeler
 }
 
 func (l *StatsDUDPListener) SetEventHandler(eh event.EventHandler) {
 	l.EventHandler = eh
 }
 
+// Close stops the listener.
+func (l *StatsDUDPListener) Close() error {
+	return l.Conn.Close()
+}
+
 func (l *StatsDUDPListener) Listen() {
 	buf := make([]byte, 65535)
 	for {
-		n, _, err := l.Conn.ReadFromUDP(buf)
+		n, addr, err := l.Conn.ReadFromUDP(buf)
 		if err != nil {
 			// https://github.com/golang/go/issues/4373
 			// ignore net: errClosing error as it will occur during shutdown
@@ -62,17 +94,45 @@ func (l *StatsDUDPListener) Listen() {
 			level.Error(l.Logger).Log("error", err)
 			return
 		}
-		l.HandlePacket(buf[0:n])
+		l.handlePacket(buf[0:n], addr)
 	}
 }
 
 func (l *StatsDUDPListener) HandlePacket(packet []byte) {
+	l.handlePacket(packet, nil)
+}
+
+func (l *StatsDUDPListener) handlePacket(packet []byte, addr *net.UDPAddr) {
 	l.UDPPackets.Inc()
-	lines := strings.Split(string(packet), "\n")
-	for _, line := range lines {
+	source := ""
+	if l.Tenants != nil && addr != nil {
+		source = l.Tenants.Source(addr.IP, l.Conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	host := ""
+	if l.Sources != nil && addr != nil {
+		host = l.Sources.Source(addr.IP)
+	}
+	// The lines are sliced from a single copy of the packet.
+	lines := string(packet)
+	for more := true; more; {
+		line := lines
+		if i := strings.IndexByte(lines, '\n'); i >= 0 {
+			line, lines = lines[:i], lines[i+1:]
+		} else {
+			more = false
+		}
 		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "udp", "line", line)
 		l.LinesReceived.Inc()
-		l.EventHandler.Queue(l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+		if l.Relay != nil {
+			l.Relay.RelayLine(line)
+		}
+		if l.Cluster != nil && l.Cluster.Forward(line) {
+			continue
+		}
+		events := l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)
+		setTenant(l.Tenants, events, source)
+		setSource(l.Sources, events, host)
+		l.EventHandler.Queue(events)
 	}
 }
 
@@ -90,12 +150,26 @@ type StatsDTCPListener struct {
 	TCPConnections  prometheus.Counter
 	TCPErrors       prometheus.Counter
 	TCPLineTooLong  prometheus.Counter
+	// Relay, if set, forwards the received lines.
+	Relay *relay.Relay
+	// Cluster, if set, forwards the lines of the metrics other exporters of
+	// the cluster are responsible for to them, instead of handling them.
+	Cluster *relay.Relay
+	// Tenants, if set, labels the events with their tenant.
+	Tenants *tenant.Resolver
+	// Sources, if set, labels the events with the host that sent them.
+	Sources *sender.Labeler
 }
 
 func (l *StatsDTCPListener) SetEventHandler(eh event.EventHandler) {
 	l.EventHandler = eh
 }
 
+// Close stops the listener.
+func (l *StatsDTCPListener) Close() error {
+	return l.Conn.Close()
+}
+
 func (l *StatsDTCPListener) Listen() {
 	for {
 		c, err := l.Conn.AcceptTCP()
@@ -116,6 +190,17 @@ func (l *StatsDTCPListener) HandleConn(c *net.TCPConn) {
 	defer c.Close()
 
 	l.TCPConnections.Inc()
+	source, host := "", ""
+	remote, _ := c.RemoteAddr().(*net.TCPAddr)
+	if l.Tenants != nil {
+		local, _ := c.LocalAddr().(*net.TCPAddr)
+		if remote != nil && local != nil {
+			source = l.Tenants.Source(remote.IP, local.Port)
+		}
+	}
+	if l.Sources != nil && remote != nil {
+		host = l.Sources.Source(remote.IP)
+	}
 
 	r := bufio.NewReader(c)
 	for {
@@ -134,7 +219,16 @@ func (l *StatsDTCPListener) HandleConn(c *net.TCPConn) {
 			break
 		}
 		l.LinesReceived.Inc()
-		l.EventHandler.Queue(l.LineParser.LineToEvents(string(line), l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+		if l.Relay != nil {
+			l.Relay.RelayLine(string(line))
+		}
+		if l.Cluster != nil && l.Cluster.Forward(string(line)) {
+			continue
+		}
+		events := l.LineParser.LineToEvents(string(line), l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)
+		setTenant(l.Tenants, events, source)
+		setSource(l.Sources, events, host)
+		l.EventHandler.Queue(events)
 	}
 }
 
@@ -150,16 +244,43 @@ type StatsDUnixgramListener struct {
 	SamplesReceived prometheus.Counter
 	TagErrors       prometheus.Counter
 	TagsReceived    prometheus.Counter
+	// Relay, if set, forwards the received lines.
+	Relay *relay.Relay
+	// Cluster, if set, forwards the lines of the metrics other exporters of
+	// the cluster are responsible for to them, instead of handling them.
+	Cluster *relay.Relay
+	// Tenants, if set, labels the events with their tenant.
+	Tenants *tenant.Resolver
+	// Origins, if set, labels the events with the client that sent them.
+	Origins *Origins
 }
 
 func (l *StatsDUnixgramListener) SetEventHandler(eh event.EventHandler) {
 	l.EventHandler = eh
 }
 
+// Close stops the listener.
+func (l *StatsDUnixgramListener) Close() error {
+	return l.Conn.Close()
+}
+
 func (l *StatsDUnixgramListener) Listen() {
 	buf := make([]byte, 65535)
+	var oob []byte
+	if l.Origins != nil {
+		oob = make([]byte, oobSize)
+	}
 	for {
-		n, _, err := l.Conn.ReadFromUnix(buf)
+		var (
+			n      int
+			client string
+			err    error
+		)
+		if l.Origins != nil {
+			n, client, err = l.Origins.read(l.Conn, buf, oob)
+		} else {
+			n, _, err = l.Conn.ReadFromUnix(buf)
+		}
 		if err != nil {
 			// https://github.com/golang/go/issues/4373
 			// ignore net: errClosing error as it will occur during shutdown
@@ -169,16 +290,71 @@ func (l *StatsDUnixgramListener) Listen() {
 			level.Error(l.Logger).Log(err)
 			os.Exit(1)
 		}
-		l.HandlePacket(buf[:n])
+		l.handlePacket(buf[:n], client)
 	}
 }
 
 func (l *StatsDUnixgramListener) HandlePacket(packet []byte) {
+	l.handlePacket(packet, "")
+}
+
+func (l *StatsDUnixgramListener) handlePacket(packet []byte, client string) {
 	l.UnixgramPackets.Inc()
-	lines := strings.Split(string(packet), "\n")
-	for _, line := range lines {
+	// The lines are sliced from a single copy of the packet.
+	lines := string(packet)
+	for more := true; more; {
+		line := lines
+		if i := strings.IndexByte(lines, '\n'); i >= 0 {
+			line, lines = lines[:i], lines[i+1:]
+		} else {
+			more = false
+		}
 		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "unixgram", "line", line)
 		l.LinesReceived.Inc()
-		l.EventHandler.Queue(l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+		if l.Relay != nil {
+			l.Relay.RelayLine(line)
+		}
+		if l.Cluster != nil && l.Cluster.Forward(line) {
+			continue
+		}
+		events := l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)
+		setTenant(l.Tenants, events, "")
+		if client != "" {
+			setClient(l.Origins.Label, events, client)
+		}
+		l.EventHandler.Queue(events)
+	}
+}
+
+// setSource labels the events parsed from one line with the host that sent
+// them.
+func setSource(sources *sender.Labeler, events event.Events, host string) {
+	if sources == nil || host == "" {
+		return
+	}
+	for _, e := range events {
+		sources.Set(e.Labels(), host)
+	}
+}
+
+// setClient labels the events parsed from one line with the client that sent
+// them, unless they have a tag of the same name.
+func setClient(label string, events event.Events, client string) {
+	for _, e := range events {
+		if labels := e.Labels(); labels[label] == "" {
+			labels[label] = client
+		}
+	}
+}
+
+// setTenant labels the events parsed from one line with their tenant. The
+// events of a line share their tags, so the tenant is derived from the first.
+func setTenant(tenants *tenant.Resolver, events event.Events, source string) {
+	if tenants == nil || len(events) == 0 {
+		return
+	}
+	t := tenants.Tenant(events[0].Labels(), source)
+	for _, e := range events {
+		tenants.Set(e.Labels(), t)
 	}
 }
@@ -0,0 +1,82 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// originTTL is how long the client of a process ID is cached for, so that
+	// reused process IDs are eventually resolved again.
+	originTTL = time.Minute
+	// maxOrigins bounds the number of cached process IDs.
+	maxOrigins = 4096
+)
+
+// Origins identifies the clients that send to a Unixgram listener from the
+// credentials the kernel attaches to every datagram, like the origin
+// detection of the Datadog agent. The client is the ID of the container the
+// sending process runs in, or the name of the process outside of containers.
+type Origins struct {
+	// Label is the label the client is added as to the received events.
+	// Tags of the same name take precedence.
+	Label string
+
+	mutex   sync.Mutex
+	clients map[int32]origin
+	// resolve looks up the client of a process ID.
+	resolve func(pid int32) string
+	now     func() time.Time
+}
+
+type origin struct {
+	client  string
+	expires time.Time
+}
+
+// NewOrigins enables origin detection on the socket of conn. It is only
+// supported on Linux.
+func NewOrigins(conn *net.UnixConn, label string) (*Origins, error) {
+	if err := enableCredentials(conn); err != nil {
+		return nil, err
+	}
+	return &Origins{
+		Label:   label,
+		clients: make(map[int32]origin),
+		resolve: resolveClient,
+		now:     time.Now,
+	}, nil
+}
+
+// client returns the cached client of a process ID, resolving it if needed.
+func (o *Origins) client(pid int32) string {
+	if pid <= 0 {
+		return ""
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	now := o.now()
+	if c, ok := o.clients[pid]; ok && now.Before(c.expires) {
+		return c.client
+	}
+	if len(o.clients) >= maxOrigins {
+		o.clients = make(map[int32]origin)
+	}
+	c := origin{client: o.resolve(pid), expires: now.Add(originTTL)}
+	o.clients[pid] = c
+	return c.client
+}
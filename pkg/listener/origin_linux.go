@@ -0,0 +1,98 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// containerID matches the ID of a container in the cgroup paths of Docker,
+// containerd, CRI-O and Kubernetes, such as
+// /kubepods/burstable/pod.../<id> or /system.slice/docker-<id>.scope.
+var containerID = regexp.MustCompile(`(?:^|[/-])([0-9a-f]{64})(?:\.scope)?$`)
+
+// enableCredentials makes the kernel attach the credentials of the sender to
+// every datagram received on the socket of conn.
+func enableCredentials(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// read reads a datagram from conn and returns the client that sent it, or ""
+// if it is unknown.
+func (o *Origins) read(conn *net.UnixConn, buf, oob []byte) (int, string, error) {
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return n, "", err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, "", nil
+	}
+	for _, msg := range msgs {
+		if cred, err := syscall.ParseUnixCredentials(&msg); err == nil {
+			return n, o.client(cred.Pid), nil
+		}
+	}
+	return n, "", nil
+}
+
+// oobSize is the size of the buffer for the credentials of a datagram.
+var oobSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// resolveClient returns the ID of the container a process runs in, or the
+// name of the process if it does not run in one.
+func resolveClient(pid int32) string {
+	proc := "/proc/" + strconv.Itoa(int(pid))
+	if cgroup, err := ioutil.ReadFile(proc + "/cgroup"); err == nil {
+		if id := parseContainerID(string(cgroup)); id != "" {
+			return id
+		}
+	}
+	comm, err := ioutil.ReadFile(proc + "/comm")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// parseContainerID finds the container ID in the contents of a
+// /proc/<pid>/cgroup file, which has a hierarchy-ID:controllers:path line per
+// cgroup hierarchy.
+func parseContainerID(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if m := containerID.FindStringSubmatch(parts[2]); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
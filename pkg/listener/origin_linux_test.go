@@ -0,0 +1,88 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseContainerID(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for cgroup, expected := range map[string]string{
+		"12:pids:/docker/" + id + "\n0::/\n":                                        id,
+		"0::/system.slice/docker-" + id + ".scope\n":                                id,
+		"11:memory:/kubepods/burstable/pod1234/" + id + "\n":                        id,
+		"0::/kubepods.slice/kubepods-pod1234.slice/cri-containerd-" + id + ".scope": id,
+		"0::/user.slice/user-1000.slice/session-2.scope\n":                          "",
+		"": "",
+	} {
+		if got := parseContainerID(cgroup); got != expected {
+			t.Errorf("unexpected container ID %q for %q", got, cgroup)
+		}
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "origins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := &net.UnixAddr{Net: "unixgram", Name: filepath.Join(dir, "statsd.sock")}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	origins, err := NewOrigins(conn, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := 0
+	origins.resolve = func(pid int32) string {
+		resolved++
+		if int(pid) != os.Getpid() {
+			t.Errorf("unexpected sender %d", pid)
+		}
+		return "tester"
+	}
+
+	client, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	buf, oob := make([]byte, 64), make([]byte, oobSize)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; i < 2; i++ {
+		if _, err := client.Write([]byte("foo:1|c")); err != nil {
+			t.Fatal(err)
+		}
+		n, sender, err := origins.read(conn, buf, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "foo:1|c" || sender != "tester" {
+			t.Errorf("unexpected datagram %q from %q", buf[:n], sender)
+		}
+	}
+	if resolved != 1 {
+		t.Errorf("expected the client to be resolved once, got %d", resolved)
+	}
+}
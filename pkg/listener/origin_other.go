@@ -0,0 +1,38 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+// oobSize is the size of the buffer for the credentials of a datagram.
+const oobSize = 0
+
+func enableCredentials(conn *net.UnixConn) error {
+	return errors.New("origin detection is only available on Linux")
+}
+
+func (o *Origins) read(conn *net.UnixConn, buf, oob []byte) (int, string, error) {
+	n, _, err := conn.ReadFromUnix(buf)
+	return n, "", err
+}
+
+func resolveClient(pid int32) string {
+	return ""
+}
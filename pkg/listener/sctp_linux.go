@@ -0,0 +1,69 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ListenSCTP listens for SCTP associations on the address. It uses a
+// one-to-one style socket, which behaves like a TCP socket, so that the
+// associations can be handled by the StatsDTCPListener. An address without
+// an IP listens on all IPv4 addresses.
+func ListenSCTP(addr *net.TCPAddr) (*net.TCPListener, error) {
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := addr.IP.To4(); addr.IP == nil || ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return nil, fmt.Errorf("creating SCTP socket: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "sctp")
+	defer f.Close()
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, fmt.Errorf("binding SCTP socket: %v", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, fmt.Errorf("listening on SCTP socket: %v", err)
+	}
+
+	// The file descriptor is duplicated into the listener.
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("unexpected listener type %T for SCTP socket", l)
+	}
+	return tl, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// UDPDrops returns a function that reads how many datagrams the kernel
+// dropped on the socket of conn, usually because its receive buffer was full.
+// The count is read from /proc/net/udp and /proc/net/udp6.
+func UDPDrops(conn *net.UDPConn) (func() (uint64, error), error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		st      syscall.Stat_t
+		statErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		statErr = syscall.Fstat(int(fd), &st)
+	}); err != nil {
+		return nil, err
+	}
+	if statErr != nil {
+		return nil, statErr
+	}
+	inode := strconv.FormatUint(uint64(st.Ino), 10)
+
+	return func() (uint64, error) {
+		for _, file := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+			drops, found, err := readUDPDrops(file, inode)
+			if err != nil {
+				return 0, err
+			}
+			if found {
+				return drops, nil
+			}
+		}
+		return 0, fmt.Errorf("socket with inode %s not found", inode)
+	}, nil
+}
+
+// readUDPDrops looks up the drops column of the socket with the inode in a
+// /proc/net/udp style file.
+func readUDPDrops(file, inode string) (uint64, bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip the header.
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || fields[9] != inode {
+			continue
+		}
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		return drops, true, err
+	}
+	return 0, false, scanner.Err()
+}
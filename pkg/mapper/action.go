@@ -15,6 +15,7 @@ package mapper
 
 import "fmt"
 
+// ActionType is what happens to the events a mapping matches.
 type ActionType string
 
 const (
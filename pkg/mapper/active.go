@@ -0,0 +1,113 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// mappingHits are the hit counters of the mappings of a config, by mapping
+// key. The map is replaced, not modified, when a config is loaded.
+type mappingHits map[string]*uint64
+
+// newMappingHits returns the hit counters of the mappings, keeping the
+// counts of the mappings that did not change from the previous counters.
+func newMappingHits(mappings []MetricMapping, previous mappingHits) mappingHits {
+	hits := make(mappingHits, len(mappings))
+	for _, mapping := range mappings {
+		if c, ok := previous[mapping.key]; ok {
+			hits[mapping.key] = c
+			continue
+		}
+		hits[mapping.key] = new(uint64)
+	}
+	return hits
+}
+
+// trackHit counts a lookup that returned the mapping.
+func (m *MetricMapper) trackHit(mapping *MetricMapping) {
+	hits, _ := m.hits.Load().(mappingHits)
+	if c, ok := hits[mapping.key]; ok {
+		atomic.AddUint64(c, 1)
+	}
+}
+
+// ActiveConfig returns the loaded mapping config, including the temporary
+// mappings, with the defaults and environment variables applied. Every
+// mapping has an additional "hits" key with the number of lookups that
+// returned it since it was loaded. The result marshals to JSON with the keys
+// of the config file.
+func (m *MetricMapper) ActiveConfig() (map[string]interface{}, error) {
+	m.mutex.RLock()
+	config := struct {
+		Version       int                  `yaml:"version"`
+		ConfigVersion string               `yaml:"config_version,omitempty"`
+		Defaults      MapperConfigDefaults `yaml:"defaults"`
+		Mappings      []MetricMapping      `yaml:"mappings"`
+		RelayRules    []RelayRule          `yaml:"relay_rules,omitempty"`
+	}{m.Version, m.ConfigVersion, m.Defaults, m.Mappings, m.RelayRules}
+	b, err := yaml.Marshal(config)
+	m.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	active, ok := toJSON(v).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected mapping config %T", v)
+	}
+
+	hits, _ := m.hits.Load().(mappingHits)
+	mappings, _ := active["mappings"].([]interface{})
+	for i, mapping := range mappings {
+		if i >= len(config.Mappings) {
+			break
+		}
+		if mm, ok := mapping.(map[string]interface{}); ok {
+			var n uint64
+			if c, ok := hits[config.Mappings[i].key]; ok {
+				n = atomic.LoadUint64(c)
+			}
+			mm["hits"] = n
+		}
+	}
+	return active, nil
+}
+
+// toJSON replaces the maps in a value decoded from YAML with maps with
+// string keys, which JSON can marshal.
+func toJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = toJSON(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = toJSON(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
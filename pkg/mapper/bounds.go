@@ -0,0 +1,84 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"math"
+)
+
+// BoundsAction is what happens to the values of events outside the min and
+// max bounds of their mapping.
+type BoundsAction string
+
+const (
+	// BoundsActionDrop drops the events.
+	BoundsActionDrop BoundsAction = "drop"
+	// BoundsActionClamp records the closest bound instead of the value.
+	BoundsActionClamp   BoundsAction = "clamp"
+	BoundsActionDefault BoundsAction = ""
+)
+
+func (a *BoundsAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch BoundsAction(v) {
+	case BoundsActionClamp:
+		*a = BoundsActionClamp
+	case BoundsActionDrop, BoundsActionDefault:
+		*a = BoundsActionDrop
+	default:
+		return fmt.Errorf("invalid out_of_bounds action %q", v)
+	}
+	return nil
+}
+
+// HasBounds reports whether the mapping bounds the values of its events.
+func (m *MetricMapping) HasBounds() bool {
+	return m != nil && (m.Min != nil || m.Max != nil)
+}
+
+// Bound returns a value as received, before scaling and unit conversion,
+// limited to the bounds of the mapping, and false if the event with the value
+// is dropped. NaN values are always out of bounds.
+func (m *MetricMapping) Bound(value float64) (float64, bool) {
+	if !m.HasBounds() {
+		return value, true
+	}
+	if math.IsNaN(value) {
+		return value, false
+	}
+	bounded := value
+	if m.Min != nil && value < *m.Min {
+		bounded = *m.Min
+	}
+	if m.Max != nil && value > *m.Max {
+		bounded = *m.Max
+	}
+	if bounded != value && m.OutOfBounds != BoundsActionClamp {
+		return value, false
+	}
+	return bounded, true
+}
+
+// initBounds validates the bounds of a mapping.
+func initBounds(mapping *MetricMapping) error {
+	if mapping.Min != nil && mapping.Max != nil && *mapping.Min > *mapping.Max {
+		return fmt.Errorf("min must not be greater than max in %s", mapping.Match)
+	}
+	return nil
+}
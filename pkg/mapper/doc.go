@@ -0,0 +1,40 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mapper implements the mapping language of the statsd_exporter,
+// which translates dot-separated StatsD metric names into Prometheus metric
+// names and labels. It can be used on its own by other exporters and bridges
+// that want to accept the same mapping configs.
+//
+// A MetricMapper is set up from a YAML config, and then looked up with the
+// name and type of each metric:
+//
+//	m := &mapper.MetricMapper{}
+//	if err := m.InitFromYAMLString(config, 1000); err != nil {
+//		return err
+//	}
+//	mapping, labels, matched := m.GetMapping("app.api.requests", mapper.MetricTypeCounter)
+//	if matched && mapping.Action != mapper.ActionTypeDrop {
+//		// Record the value in the metric named by mapping.Name, with labels.
+//	}
+//
+// The mapping returned for a match has its name expanded, and carries the
+// settings of the mapping, such as the observer type, TTL and scale, that
+// apply to the metric. The settings of the defaults section of the config are
+// available in MetricMapper.Defaults. Lookups are cached; the cache can be
+// configured with CacheOption values.
+//
+// Setting MetricMapper.Registerer before initialization registers metrics of
+// the mapper and its cache. The FSM field and package fsm are implementation
+// details of glob matching.
+package mapper
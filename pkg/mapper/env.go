@@ -0,0 +1,69 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// envRefRE matches the ${ENV_VAR} references expanded at load time. Numeric
+// references such as ${1} are captures and never match.
+var envRefRE = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// expandEnv expands the environment variables referenced in the name, label
+// values and help text of a mapping and its targets. References to the
+// named capture groups of a regex mapping are kept for the match. A
+// reference to an unset variable is an error.
+func expandEnv(mapping *MetricMapping, matchType MatchType) error {
+	captures := map[string]bool{}
+	if matchType == MatchTypeRegex {
+		// An invalid regex is reported when the mapping is compiled.
+		if re, err := regexp.Compile(mapping.Match); err == nil {
+			for _, name := range re.SubexpNames() {
+				captures[name] = true
+			}
+		}
+	}
+
+	var err error
+	expand := func(s string) string {
+		return envRefRE.ReplaceAllStringFunc(s, func(ref string) string {
+			name := envRefRE.FindStringSubmatch(ref)[1]
+			if captures[name] {
+				return ref
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s referenced in mapping %s is not set", name, mapping.Match)
+			}
+			return value
+		})
+	}
+
+	var expandMapping func(m *MetricMapping)
+	expandMapping = func(m *MetricMapping) {
+		m.Name = expand(m.Name)
+		m.HelpText = expand(m.HelpText)
+		for k, v := range m.Labels {
+			m.Labels[k] = expand(v)
+		}
+		for _, target := range m.Targets {
+			expandMapping(target)
+		}
+	}
+	expandMapping(mapping)
+	return err
+}
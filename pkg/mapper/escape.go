@@ -14,6 +14,7 @@
 package mapper
 
 import (
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -72,3 +73,88 @@ func EscapeMetricName(metricName string) string {
 
 	return sb.String()
 }
+
+// EscapingScheme is the way invalid characters in metric names are handled.
+type EscapingScheme string
+
+const (
+	// EscapeUnderscores replaces invalid characters with "_", see
+	// EscapeMetricName. It is the default.
+	EscapeUnderscores EscapingScheme = "underscores"
+	// EscapeDots replaces "." with "_dot_", "_" with "__" and other invalid
+	// characters with "__", like the dots escaping of Prometheus.
+	EscapeDots EscapingScheme = "dots"
+	// EscapeValues prefixes names with invalid characters with "U__" and
+	// replaces the characters with their code point as "_<hex>_", and "_"
+	// with "__", like the values escaping of Prometheus. It can be reversed.
+	EscapeValues EscapingScheme = "values"
+	// EscapeDrop drops the events whose metric names have invalid
+	// characters.
+	EscapeDrop EscapingScheme = "drop"
+)
+
+// Escape returns the metric name escaped according to the scheme, and false
+// if events with the name are dropped.
+func (s EscapingScheme) Escape(metricName string) (string, bool) {
+	switch s {
+	case EscapeDots:
+		var sb strings.Builder
+		for i, c := range metricName {
+			switch {
+			case c == '_':
+				sb.WriteString("__")
+			case c == '.':
+				sb.WriteString("_dot_")
+			case isValidNameRune(c, i):
+				sb.WriteRune(c)
+			default:
+				sb.WriteString("__")
+			}
+		}
+		return sb.String(), true
+	case EscapeValues:
+		if isValidName(metricName) {
+			return metricName, true
+		}
+		var sb strings.Builder
+		sb.WriteString("U__")
+		for i, c := range metricName {
+			switch {
+			case c == '_':
+				sb.WriteString("__")
+			case isValidNameRune(c, i):
+				sb.WriteRune(c)
+			case !utf8.ValidRune(c):
+				sb.WriteString("_FFFD_")
+			default:
+				sb.WriteByte('_')
+				sb.WriteString(strconv.FormatInt(int64(c), 16))
+				sb.WriteByte('_')
+			}
+		}
+		return sb.String(), true
+	case EscapeDrop:
+		return metricName, isValidName(metricName)
+	default:
+		return EscapeMetricName(metricName), true
+	}
+}
+
+func isValidName(metricName string) bool {
+	if metricName == "" {
+		return false
+	}
+	for i, c := range metricName {
+		if !isValidNameRune(c, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidNameRune reports whether the character is valid at the byte offset
+// i of a metric name.
+func isValidNameRune(c rune, i int) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' ||
+		(c >= '0' && c <= '9' && i > 0)
+}
@@ -34,6 +34,37 @@ func TestEscapeMetricName(t *testing.T) {
 	}
 }
 
+func TestEscapingScheme(t *testing.T) {
+	scenarios := []struct {
+		scheme EscapingScheme
+		in     string
+		want   string
+		ok     bool
+	}{
+		{scheme: "", in: "with.dot", want: "with_dot", ok: true},
+		{scheme: EscapeUnderscores, in: "test.web-server", want: "test_web_server", ok: true},
+		{scheme: EscapeDots, in: "clean", want: "clean", ok: true},
+		{scheme: EscapeDots, in: "with_underscore.dot", want: "with__underscore_dot_dot", ok: true},
+		{scheme: EscapeDots, in: "0web-server", want: "__web__server", ok: true},
+		{scheme: EscapeValues, in: "with_underscore", want: "with_underscore", ok: true},
+		{scheme: EscapeValues, in: "http.request-count", want: "U__http_2e_request_2d_count", ok: true},
+		{scheme: EscapeValues, in: "with_under.dot", want: "U__with__under_2e_dot", ok: true},
+		{scheme: EscapeValues, in: "0starts", want: "U___30_starts", ok: true},
+		{scheme: EscapeValues, in: "with😱emoji", want: "U__with_1f631_emoji", ok: true},
+		{scheme: EscapeDrop, in: "with_underscore", want: "with_underscore", ok: true},
+		{scheme: EscapeDrop, in: "with.dot", want: "with.dot", ok: false},
+		{scheme: EscapeDrop, in: "0starts", want: "0starts", ok: false},
+		{scheme: EscapeDrop, in: "", want: "", ok: false},
+	}
+
+	for _, s := range scenarios {
+		got, ok := s.scheme.Escape(s.in)
+		if got != s.want || ok != s.ok {
+			t.Errorf("%s: expected `%s` to be escaped to `%s`, %t, got `%s`, %t", s.scheme, s.in, s.want, s.ok, got, ok)
+		}
+	}
+}
+
 func BenchmarkEscapeMetricName(b *testing.B) {
 	scenarios := []string{
 		"clean",
@@ -0,0 +1,94 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import "fmt"
+
+// ExpiryAction is what happens to a gauge series when its TTL expires.
+type ExpiryAction string
+
+const (
+	// ExpiryActionDelete removes the series.
+	ExpiryActionDelete ExpiryAction = "delete"
+	// ExpiryActionZero sets the series to 0 and keeps it, for gauges that
+	// represent presence.
+	ExpiryActionZero    ExpiryAction = "zero"
+	ExpiryActionDefault ExpiryAction = ""
+)
+
+func (t *ExpiryAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch ExpiryAction(v) {
+	case ExpiryActionZero:
+		*t = ExpiryActionZero
+	case ExpiryActionDelete, ExpiryActionDefault:
+		*t = ExpiryActionDelete
+	default:
+		return fmt.Errorf("invalid on_expiry action %q", v)
+	}
+	return nil
+}
+
+// ExpiryPolicy decides whether series of a metric type expire by their TTL.
+type ExpiryPolicy string
+
+const (
+	// ExpiryPolicyExpire expires series by their TTL.
+	ExpiryPolicyExpire ExpiryPolicy = "expire"
+	// ExpiryPolicyNever keeps series regardless of their TTL, for example so
+	// that counters don't reset when they reappear.
+	ExpiryPolicyNever   ExpiryPolicy = "never"
+	ExpiryPolicyDefault ExpiryPolicy = ""
+)
+
+func (p *ExpiryPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch ExpiryPolicy(v) {
+	case ExpiryPolicyNever:
+		*p = ExpiryPolicyNever
+	case ExpiryPolicyExpire, ExpiryPolicyDefault:
+		*p = ExpiryPolicyExpire
+	default:
+		return fmt.Errorf("invalid expiry policy %q", v)
+	}
+	return nil
+}
+
+// ExpiryPolicies are the expiry policies of each metric type, set in the
+// defaults of the mapping config.
+type ExpiryPolicies struct {
+	Counter  ExpiryPolicy `yaml:"counter"`
+	Gauge    ExpiryPolicy `yaml:"gauge"`
+	Observer ExpiryPolicy `yaml:"observer"`
+}
+
+// Expires reports whether series of the metric type expire by their TTL.
+func (p ExpiryPolicies) Expires(t MetricType) bool {
+	switch t {
+	case MetricTypeCounter:
+		return p.Counter != ExpiryPolicyNever
+	case MetricTypeGauge:
+		return p.Gauge != ExpiryPolicyNever
+	default:
+		return p.Observer != ExpiryPolicyNever
+	}
+}
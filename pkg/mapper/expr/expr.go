@@ -0,0 +1,447 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package expr implements the expressions of mapping transforms. Expressions
+// use the syntax of Go expressions, are checked when they are compiled and
+// can only read the event they are evaluated for, so that configs can't run
+// arbitrary code. It is used by package mapper, and its interface may change
+// along with the mapper's needs.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Env is the event an expression is evaluated for.
+type Env struct {
+	// Name is the StatsD metric name, and Type the StatsD metric type.
+	Name  string
+	Type  string
+	Value float64
+	// Labels are the labels of the event. Missing labels read as "".
+	Labels map[string]string
+}
+
+// Expr is a compiled expression. Its value is a float64, a string or a bool.
+type Expr struct {
+	source string
+	root   ast.Expr
+}
+
+// function is a function expressions can call. Arguments are evaluated
+// before the call, except for lazy functions.
+type function struct {
+	args int
+	call func(args []interface{}) (interface{}, error)
+	lazy bool
+}
+
+var functions = map[string]function{
+	"lower":      {args: 1, call: stringFunc(strings.ToLower)},
+	"upper":      {args: 1, call: stringFunc(strings.ToUpper)},
+	"trim":       {args: 1, call: stringFunc(strings.TrimSpace)},
+	"replace":    {args: 3, call: replaceFunc},
+	"has_prefix": {args: 2, call: stringPredicate(strings.HasPrefix)},
+	"has_suffix": {args: 2, call: stringPredicate(strings.HasSuffix)},
+	"contains":   {args: 2, call: stringPredicate(strings.Contains)},
+	"split":      {args: 3, call: splitFunc},
+	"number":     {args: 1, call: numberFunc},
+	"string":     {args: 1, call: stringOf},
+	"abs":        {args: 1, call: mathFunc(math.Abs)},
+	"floor":      {args: 1, call: mathFunc(math.Floor)},
+	"ceil":       {args: 1, call: mathFunc(math.Ceil)},
+	"round":      {args: 1, call: mathFunc(math.Round)},
+	"min":        {args: 2, call: mathFunc2(math.Min)},
+	"max":        {args: 2, call: mathFunc2(math.Max)},
+	// cond evaluates only the argument it returns.
+	"cond": {args: 3, lazy: true},
+}
+
+// Compile parses an expression and checks that it only uses the supported
+// operators, variables and functions.
+func Compile(source string) (*Expr, error) {
+	root, err := parser.ParseExpr(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	if err := check(root); err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.source
+}
+
+func check(node ast.Expr) error {
+	switch n := node.(type) {
+	case *ast.BasicLit:
+		switch n.Kind {
+		case token.STRING:
+			return nil
+		case token.INT, token.FLOAT:
+			// Only decimal numbers, which is what eval parses.
+			if _, err := strconv.ParseFloat(n.Value, 64); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("unsupported literal %s", n.Value)
+	case *ast.Ident:
+		switch n.Name {
+		case "value", "name", "metric_type", "true", "false":
+			return nil
+		case "labels":
+			return errors.New("labels must be indexed, as labels[\"name\"] or labels.name")
+		}
+		return fmt.Errorf("unknown variable %s", n.Name)
+	case *ast.ParenExpr:
+		return check(n.X)
+	case *ast.UnaryExpr:
+		switch n.Op {
+		case token.SUB, token.ADD, token.NOT:
+			return check(n.X)
+		}
+		return fmt.Errorf("unsupported operator %s", n.Op)
+	case *ast.BinaryExpr:
+		switch n.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM,
+			token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ,
+			token.LAND, token.LOR:
+		default:
+			return fmt.Errorf("unsupported operator %s", n.Op)
+		}
+		if err := check(n.X); err != nil {
+			return err
+		}
+		return check(n.Y)
+	case *ast.IndexExpr:
+		if !isLabels(n.X) {
+			return errors.New("only labels can be indexed")
+		}
+		return check(n.Index)
+	case *ast.SelectorExpr:
+		if !isLabels(n.X) {
+			return fmt.Errorf("unsupported selector .%s", n.Sel.Name)
+		}
+		return nil
+	case *ast.CallExpr:
+		ident, ok := n.Fun.(*ast.Ident)
+		if !ok {
+			return errors.New("only functions can be called")
+		}
+		fn, ok := functions[ident.Name]
+		if !ok {
+			return fmt.Errorf("unknown function %s", ident.Name)
+		}
+		if len(n.Args) != fn.args || n.Ellipsis.IsValid() {
+			return fmt.Errorf("%s takes %d arguments, got %d", ident.Name, fn.args, len(n.Args))
+		}
+		for _, arg := range n.Args {
+			if err := check(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported expression %T", node)
+}
+
+func isLabels(node ast.Expr) bool {
+	ident, ok := node.(*ast.Ident)
+	return ok && ident.Name == "labels"
+}
+
+// Eval evaluates the expression for an event.
+func (e *Expr) Eval(env *Env) (interface{}, error) {
+	v, err := eval(e.root, env)
+	if err != nil {
+		return nil, fmt.Errorf("evaluating %q: %v", e.source, err)
+	}
+	return v, nil
+}
+
+func eval(node ast.Expr, env *Env) (interface{}, error) {
+	switch n := node.(type) {
+	case *ast.BasicLit:
+		if n.Kind == token.STRING {
+			return strconv.Unquote(n.Value)
+		}
+		return strconv.ParseFloat(n.Value, 64)
+	case *ast.Ident:
+		switch n.Name {
+		case "value":
+			return env.Value, nil
+		case "name":
+			return env.Name, nil
+		case "metric_type":
+			return env.Type, nil
+		}
+		return n.Name == "true", nil
+	case *ast.ParenExpr:
+		return eval(n.X, env)
+	case *ast.IndexExpr:
+		label, err := eval(n.Index, env)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := label.(string)
+		if !ok {
+			return nil, fmt.Errorf("label name %v is not a string", label)
+		}
+		return env.Labels[s], nil
+	case *ast.SelectorExpr:
+		return env.Labels[n.Sel.Name], nil
+	case *ast.UnaryExpr:
+		x, err := eval(n.X, env)
+		if err != nil {
+			return nil, err
+		}
+		if n.Op == token.NOT {
+			b, ok := x.(bool)
+			if !ok {
+				return nil, fmt.Errorf("! of non-bool %v", x)
+			}
+			return !b, nil
+		}
+		f, ok := x.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s of non-number %v", n.Op, x)
+		}
+		if n.Op == token.SUB {
+			return -f, nil
+		}
+		return f, nil
+	case *ast.BinaryExpr:
+		return evalBinary(n, env)
+	case *ast.CallExpr:
+		fn := functions[n.Fun.(*ast.Ident).Name]
+		if fn.lazy {
+			return evalCond(n.Args, env)
+		}
+		args := make([]interface{}, len(n.Args))
+		for i, arg := range n.Args {
+			v, err := eval(arg, env)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		return fn.call(args)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", node)
+}
+
+func evalBinary(n *ast.BinaryExpr, env *Env) (interface{}, error) {
+	x, err := eval(n.X, env)
+	if err != nil {
+		return nil, err
+	}
+	if n.Op == token.LAND || n.Op == token.LOR {
+		b, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s of non-bool %v", n.Op, x)
+		}
+		// Short-circuit like Go.
+		if b == (n.Op == token.LOR) {
+			return b, nil
+		}
+		y, err := eval(n.Y, env)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := y.(bool); !ok {
+			return nil, fmt.Errorf("%s of non-bool %v", n.Op, y)
+		}
+		return y, nil
+	}
+
+	y, err := eval(n.Y, env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Op {
+	case token.EQL:
+		return x == y, nil
+	case token.NEQ:
+		return x != y, nil
+	}
+
+	switch x := x.(type) {
+	case float64:
+		y, ok := y.(float64)
+		if !ok {
+			break
+		}
+		switch n.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO:
+			return x / y, nil
+		case token.REM:
+			return math.Mod(x, y), nil
+		case token.LSS:
+			return x < y, nil
+		case token.LEQ:
+			return x <= y, nil
+		case token.GTR:
+			return x > y, nil
+		case token.GEQ:
+			return x >= y, nil
+		}
+	case string:
+		y, ok := y.(string)
+		if !ok {
+			break
+		}
+		switch n.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.LSS:
+			return x < y, nil
+		case token.LEQ:
+			return x <= y, nil
+		case token.GTR:
+			return x > y, nil
+		case token.GEQ:
+			return x >= y, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported operands %#v %s %#v", x, n.Op, y)
+}
+
+func evalCond(args []ast.Expr, env *Env) (interface{}, error) {
+	c, err := eval(args[0], env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := c.(bool)
+	if !ok {
+		return nil, fmt.Errorf("cond of non-bool %v", c)
+	}
+	if b {
+		return eval(args[1], env)
+	}
+	return eval(args[2], env)
+}
+
+func stringArgs(args []interface{}) ([]string, error) {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		var ok bool
+		if s[i], ok = arg.(string); !ok {
+			return nil, fmt.Errorf("expected a string, got %v", arg)
+		}
+	}
+	return s, nil
+}
+
+func stringFunc(f func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return f(s[0]), nil
+	}
+}
+
+func stringPredicate(f func(string, string) bool) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return f(s[0], s[1]), nil
+	}
+}
+
+func replaceFunc(args []interface{}) (interface{}, error) {
+	s, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Replace(s[0], s[1], s[2], -1), nil
+}
+
+// splitFunc returns the field of a string with the index, or "" if there are
+// fewer fields.
+func splitFunc(args []interface{}) (interface{}, error) {
+	s, err := stringArgs(args[:2])
+	if err != nil {
+		return nil, err
+	}
+	index, ok := args[2].(float64)
+	if !ok || index < 0 || index != math.Trunc(index) {
+		return nil, fmt.Errorf("invalid field index %v", args[2])
+	}
+	fields := strings.Split(s[0], s[1])
+	// Compared before converting, as converting a large index overflows.
+	if index >= float64(len(fields)) {
+		return "", nil
+	}
+	return fields[int(index)], nil
+}
+
+func numberFunc(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return nil, fmt.Errorf("cannot convert %v to a number", args[0])
+}
+
+func stringOf(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case string:
+		return v, nil
+	}
+	return strconv.FormatBool(args[0].(bool)), nil
+}
+
+func mathFunc(f func(float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		x, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("expected a number, got %v", args[0])
+		}
+		return f(x), nil
+	}
+}
+
+func mathFunc2(f func(float64, float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		x, ok := args[0].(float64)
+		y, ok2 := args[1].(float64)
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("expected numbers, got %v and %v", args[0], args[1])
+		}
+		return f(x, y), nil
+	}
+}
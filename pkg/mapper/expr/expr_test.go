@@ -0,0 +1,98 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expr
+
+import (
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	env := &Env{
+		Name:   "api.requests",
+		Type:   "counter",
+		Value:  1.5,
+		Labels: map[string]string{"host": "Web-1.example.com", "code": "503"},
+	}
+	for source, expected := range map[string]interface{}{
+		`value * 1000`:                             1500.0,
+		`-value + 2 % 3`:                           0.5,
+		`(value + 0.5) / 4`:                        0.5,
+		`name + "/" + metric_type`:                 "api.requests/counter",
+		`lower(split(labels.host, ".", 0))`:        "web-1",
+		`split(labels.host, ".", 2)`:               "com",
+		`split(labels.host, ".", 1e19)`:            "",
+		`labels["code"] >= "500"`:                  true,
+		`number(labels.code) / 100`:                5.03,
+		`floor(number(labels.code) / 100)`:         5.0,
+		`string(value)`:                            "1.5",
+		`labels.missing == ""`:                     true,
+		`cond(has_prefix(name, "api."), "api", 1)`: "api",
+		`false && number("x") > 0`:                 false,
+		`replace(labels.host, ".example.com", "")`: "Web-1",
+		`max(value, 2)`:                            2.0,
+		`!contains(labels.host, "db")`:             true,
+	} {
+		e, err := Compile(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		got, err := e.Eval(env)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("%s: expected %#v, got %#v", source, expected, got)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, source := range []string{
+		`value +`,
+		`os.Exit(1)`,
+		`labels`,
+		`unknown * 2`,
+		`lower(name, 1)`,
+		`name[0]`,
+		`func() {}`,
+		`value << 2`,
+		`0x10`,
+	} {
+		if _, err := Compile(source); err == nil {
+			t.Errorf("expected an error for %s", source)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	env := &Env{Labels: map[string]string{"code": "x"}}
+	for _, source := range []string{
+		`number(labels.code)`,
+		`name + 1`,
+		`value && true`,
+		`cond(name, 1, 2)`,
+		`split(name, ".", -1)`,
+		`split(name, ".", 0.5)`,
+	} {
+		e, err := Compile(source)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if _, err := e.Eval(env); err == nil {
+			t.Errorf("expected an error evaluating %s", source)
+		}
+	}
+}
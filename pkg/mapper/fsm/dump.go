@@ -14,35 +14,139 @@
 package fsm
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 )
 
+// transition is an edge of the FSM between two states, which are numbered
+// breadth-first from the root, 0.
+type transition struct {
+	from, to int
+	label    string
+	state    *MappingState
+}
+
+// transitions returns all transitions of the FSM, in the order the states are
+// numbered in. The transitions of a state are sorted by label, so that dumps
+// of the same FSM are identical.
+func (f *FSM) transitions() []transition {
+	var transitions []transition
+	states := []*MappingState{f.root}
+	for idx := 0; idx < len(states); idx++ {
+		fields := make([]string, 0, len(states[idx].transitions))
+		for field := range states[idx].transitions {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			state := states[idx].transitions[field]
+			states = append(states, state)
+			transitions = append(transitions, transition{from: idx, to: len(states) - 1, label: field, state: state})
+		}
+	}
+	return transitions
+}
+
 // DumpFSM accepts a io.writer and write the current FSM into dot file format.
 func (f *FSM) DumpFSM(w io.Writer) {
-	idx := 0
-	states := make(map[int]*mappingState)
-	states[idx] = f.root
-
 	w.Write([]byte("digraph g {\n"))
 	w.Write([]byte("rankdir=LR\n"))                                                    // make it vertical
 	w.Write([]byte("node [ label=\"\",style=filled,fillcolor=white,shape=circle ]\n")) // remove label of node
 
-	for idx < len(states) {
-		for field, transition := range states[idx].transitions {
-			states[len(states)] = transition
-			w.Write([]byte(fmt.Sprintf("%d -> %d  [label = \"%s\"];\n", idx, len(states)-1, field)))
-			if idx == 0 {
-				// color for metric types
-				w.Write([]byte(fmt.Sprintf("%d [color=\"#D6B656\",fillcolor=\"#FFF2CC\"];\n", len(states)-1)))
-			} else if transition.transitions == nil || len(transition.transitions) == 0 {
-				// color for end state
-				w.Write([]byte(fmt.Sprintf("%d [color=\"#82B366\",fillcolor=\"#D5E8D4\"];\n", len(states)-1)))
-			}
+	for _, t := range f.transitions() {
+		w.Write([]byte(fmt.Sprintf("%d -> %d  [label = \"%s\"];\n", t.from, t.to, t.label)))
+		if t.from == 0 {
+			// color for metric types
+			w.Write([]byte(fmt.Sprintf("%d [color=\"#D6B656\",fillcolor=\"#FFF2CC\"];\n", t.to)))
+		} else if len(t.state.transitions) == 0 {
+			// color for end state
+			w.Write([]byte(fmt.Sprintf("%d [color=\"#82B366\",fillcolor=\"#D5E8D4\"];\n", t.to)))
 		}
-		idx++
 	}
 	// color for start state
 	w.Write([]byte(fmt.Sprintf("0 [color=\"#a94442\",fillcolor=\"#f2dede\"];\n")))
 	w.Write([]byte("}"))
 }
+
+// Kinds of states in JSON dumps.
+const (
+	StateKindStart      = "start"
+	StateKindMetricType = "metric_type"
+	StateKindField      = "field"
+)
+
+// JSONState is a state of the FSM in JSON dumps. Result describes the result
+// of states that a metric can end in.
+type JSONState struct {
+	ID     int    `json:"id"`
+	Kind   string `json:"kind"`
+	Result string `json:"result,omitempty"`
+}
+
+// JSONTransition is a transition of the FSM in JSON dumps, on the metric type
+// or a field of the StatsD metric name. "*" matches any field.
+type JSONTransition struct {
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+	Label string `json:"label"`
+}
+
+// JSONFSM is the JSON dump of an FSM.
+type JSONFSM struct {
+	States             []JSONState      `json:"states"`
+	Transitions        []JSONTransition `json:"transitions"`
+	BacktrackingNeeded bool             `json:"backtracking_needed"`
+	OrderingDisabled   bool             `json:"ordering_disabled"`
+}
+
+// DumpJSON writes the FSM as JSON. describe, if set, describes the results of
+// states.
+func (f *FSM) DumpJSON(w io.Writer, describe func(result interface{}) string) error {
+	dump := JSONFSM{
+		States:             []JSONState{{ID: 0, Kind: StateKindStart}},
+		Transitions:        []JSONTransition{},
+		BacktrackingNeeded: f.BacktrackingNeeded,
+		OrderingDisabled:   f.OrderingDisabled,
+	}
+	for _, t := range f.transitions() {
+		state := JSONState{ID: t.to, Kind: StateKindField}
+		if t.from == 0 {
+			state.Kind = StateKindMetricType
+		}
+		if t.state.Result != nil && describe != nil {
+			state.Result = describe(t.state.Result)
+		}
+		dump.States = append(dump.States, state)
+		dump.Transitions = append(dump.Transitions, JSONTransition{From: t.from, To: t.to, Label: t.label})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+// DumpMermaid writes the FSM as a Mermaid flowchart. describe, if set,
+// describes the results of states, which are shown as their labels.
+func (f *FSM) DumpMermaid(w io.Writer, describe func(result interface{}) string) error {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	b.WriteString("  0((start))\n")
+	for _, t := range f.transitions() {
+		fmt.Fprintf(&b, "  %d -->|\"%s\"| %d\n", t.from, mermaidEscape(t.label), t.to)
+		switch {
+		case t.state.Result != nil && describe != nil:
+			fmt.Fprintf(&b, "  %d[\"%s\"]\n", t.to, mermaidEscape(describe(t.state.Result)))
+		case t.from == 0:
+			fmt.Fprintf(&b, "  %d([\"%s\"])\n", t.to, mermaidEscape(t.label))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidEscape replaces the characters that end a quoted Mermaid label.
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s)
+}
@@ -11,17 +11,23 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package fsm implements the finite state machine that matches StatsD metric
+// names against glob mappings. It is used by package mapper, and its
+// interface may change along with the mapper's needs.
 package fsm
 
 import (
 	"regexp"
 	"strings"
 
-	"github.com/prometheus/common/log"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
-type mappingState struct {
-	transitions        map[string]*mappingState
+// MappingState is a state of the FSM. States that a mapping ends in hold its
+// result.
+type MappingState struct {
+	transitions        map[string]*MappingState
 	minRemainingLength int
 	maxRemainingLength int
 	// result* members are nil unless there's a metric ends with this state
@@ -33,13 +39,13 @@ type fsmBacktrackStackCursor struct {
 	fieldIndex     int
 	captureIndex   int
 	currentCapture string
-	state          *mappingState
+	state          *MappingState
 	prev           *fsmBacktrackStackCursor
 	next           *fsmBacktrackStackCursor
 }
 
 type FSM struct {
-	root               *mappingState
+	root               *MappingState
 	metricTypes        []string
 	statesCount        int
 	BacktrackingNeeded bool
@@ -49,12 +55,12 @@ type FSM struct {
 // NewFSM creates a new FSM instance
 func NewFSM(metricTypes []string, maxPossibleTransitions int, orderingDisabled bool) *FSM {
 	fsm := FSM{}
-	root := &mappingState{}
-	root.transitions = make(map[string]*mappingState, len(metricTypes))
+	root := &MappingState{}
+	root.transitions = make(map[string]*MappingState, len(metricTypes))
 
 	for _, field := range metricTypes {
-		state := &mappingState{}
-		(*state).transitions = make(map[string]*mappingState, maxPossibleTransitions)
+		state := &MappingState{}
+		(*state).transitions = make(map[string]*MappingState, maxPossibleTransitions)
 		root.transitions[string(field)] = state
 	}
 	fsm.OrderingDisabled = orderingDisabled
@@ -71,7 +77,7 @@ func (f *FSM) AddState(match string, matchMetricType string, maxPossibleTransiti
 	// first split by "."
 	matchFields := strings.Split(match, ".")
 	// fill into our FSM
-	roots := []*mappingState{}
+	roots := []*MappingState{}
 	// first state is the metric type
 	if matchMetricType == "" {
 		// if metricType not specified, connect the start state from all three types
@@ -82,7 +88,7 @@ func (f *FSM) AddState(match string, matchMetricType string, maxPossibleTransiti
 		roots = append(roots, f.root.transitions[matchMetricType])
 	}
 	var captureCount int
-	var finalStates []*mappingState
+	var finalStates []*MappingState
 	// iterating over different start state (different metric types)
 	for _, root := range roots {
 		captureCount = 0
@@ -91,8 +97,8 @@ func (f *FSM) AddState(match string, matchMetricType string, maxPossibleTransiti
 			state, prs := root.transitions[field]
 			if !prs {
 				// create a state if it's not exist in the fsm
-				state = &mappingState{}
-				(*state).transitions = make(map[string]*mappingState, maxPossibleTransitions)
+				state = &MappingState{}
+				(*state).transitions = make(map[string]*MappingState, maxPossibleTransitions)
 				(*state).maxRemainingLength = len(matchFields) - i - 1
 				(*state).minRemainingLength = len(matchFields) - i - 1
 				root.transitions[field] = state
@@ -126,7 +132,7 @@ func (f *FSM) AddState(match string, matchMetricType string, maxPossibleTransiti
 // GetMapping using the fsm to find matching rules according to given statsdMetric and statsdMetricType.
 // If it finds a match, the final state and the captured strings are returned;
 // if there's no match found, nil and a empty list will be returned.
-func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mappingState, []string) {
+func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*MappingState, []string) {
 	matchFields := strings.Split(statsdMetric, ".")
 	currentState := f.root.transitions[statsdMetricType]
 
@@ -135,7 +141,7 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 	resumeFromBacktrack := false
 
 	// the return variable
-	var finalState *mappingState
+	var finalState *MappingState
 
 	captures := make([]string, len(matchFields))
 	finalCaptures := make([]string, len(matchFields))
@@ -143,7 +149,7 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 	captureIdx := 0
 	filedsCount := len(matchFields)
 	i := 0
-	var state *mappingState
+	var state *MappingState
 	for { // the loop for backtracking
 		for { // the loop for a single "depth only" search
 			var present bool
@@ -231,8 +237,9 @@ func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mapping
 }
 
 // TestIfNeedBacktracking tests if backtrack is needed for given list of mappings
-// and whether ordering is disabled.
-func TestIfNeedBacktracking(mappings []string, orderingDisabled bool) bool {
+// and whether ordering is disabled. Problems with the mappings are logged to
+// the logger.
+func TestIfNeedBacktracking(mappings []string, orderingDisabled bool, logger log.Logger) bool {
 	backtrackingNeeded := false
 	// A has * in rules, but there's other transisitions at the same state,
 	// this makes A the cause of backtracking
@@ -248,7 +255,7 @@ func TestIfNeedBacktracking(mappings []string, orderingDisabled bool) bool {
 		metricRe = strings.Replace(metricRe, "*", "([^.]*)", -1)
 		regex, err := regexp.Compile("^" + metricRe + "$")
 		if err != nil {
-			log.Warnf("invalid match %s. cannot compile regex in mapping: %v", mapping, err)
+			level.Warn(logger).Log("msg", "invalid match, cannot compile regex in mapping", "match", mapping, "error", err)
 		}
 		// put into array no matter there's error or not, we will skip later if regex is nil
 		ruleREByLength[l] = append(ruleREByLength[l], regex)
@@ -291,8 +298,7 @@ func TestIfNeedBacktracking(mappings []string, orderingDisabled bool) bool {
 				if i2 != i1 && len(re1.FindStringSubmatchIndex(r2)) > 0 {
 					// log if we care about ordering and the superset occurs before
 					if !orderingDisabled && i1 < i2 {
-						log.Warnf("match \"%s\" is a super set of match \"%s\" but in a lower order, "+
-							"the first will never be matched", r1, r2)
+						level.Warn(logger).Log("msg", "match is a super set of a match in a lower order, the latter will never be matched", "match", r1, "subset", r2)
 					}
 					currentRuleNeedBacktrack = false
 				}
@@ -310,8 +316,7 @@ func TestIfNeedBacktracking(mappings []string, orderingDisabled bool) bool {
 			}
 
 			if currentRuleNeedBacktrack {
-				log.Warnf("backtracking required because of match \"%s\", "+
-					"matching performance may be degraded", r1)
+				level.Warn(logger).Log("msg", "backtracking required, matching performance may be degraded", "match", r1)
 				backtrackingNeeded = true
 			}
 		}
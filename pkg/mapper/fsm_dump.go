@@ -0,0 +1,61 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Formats of FSM dumps, see DumpFSM.
+const (
+	FSMFormatDot     = "dot"
+	FSMFormatJSON    = "json"
+	FSMFormatMermaid = "mermaid"
+)
+
+// ErrNoFSM is returned by DumpFSM if the config has no glob mappings.
+var ErrNoFSM = errors.New("the mapping config has no glob mappings")
+
+// DumpFSM writes the FSM that matches the glob mappings of the current config
+// in the given format. In the JSON and Mermaid formats, the states that
+// metrics can end in are described by the mapping they match.
+func (m *MetricMapper) DumpFSM(w io.Writer, format string) error {
+	m.mutex.RLock()
+	f := m.FSM
+	if !m.doFSM {
+		f = nil
+	}
+	m.mutex.RUnlock()
+	if f == nil {
+		return ErrNoFSM
+	}
+
+	describe := func(result interface{}) string {
+		mapping := result.(*MetricMapping)
+		return fmt.Sprintf("%s -> %s", mapping.Match, mapping.Name)
+	}
+	switch format {
+	case FSMFormatDot:
+		f.DumpFSM(w)
+		return nil
+	case FSMFormatJSON:
+		return f.DumpJSON(w, describe)
+	case FSMFormatMermaid:
+		return f.DumpMermaid(w, describe)
+	default:
+		return fmt.Errorf("unsupported FSM dump format %q", format)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"reflect"
+
+	"github.com/go-kit/kit/log"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper/fsm"
+)
+
+// MetricMapperCacheInvalidator is implemented by caches that can drop
+// selected results. The MetricMapper uses it to keep the results of unchanged
+// mappings when a config is loaded again.
+type MetricMapperCacheInvalidator interface {
+	// Invalidate removes the results for which stale returns true.
+	Invalidate(stale func(metricString string, metricType MetricType, result *MetricMapperCacheResult) bool)
+}
+
+// mappingKey identifies a mapping by its settings, to tell which mappings
+// changed between two configs.
+func mappingKey(mapping *MetricMapping) (string, error) {
+	b, err := yaml.Marshal(mapping)
+	return string(b), err
+}
+
+// invalidateCache drops the cached results that the config n would change and
+// reports whether the rest of the cache could be kept. Results of removed or
+// changed mappings are dropped, as well as matches and misses that a new or
+// changed mapping could take over. It must be called with the mutex held,
+// before n is applied.
+func (m *MetricMapper) invalidateCache(n *MetricMapper, cacheSize int, options []CacheOption) bool {
+	invalidator, ok := m.cache.(MetricMapperCacheInvalidator)
+	if !ok || cacheSize != m.cacheSize ||
+		resolveCacheOptions(options) != resolveCacheOptions(m.cacheOptions) ||
+		!reflect.DeepEqual(m.Defaults, n.Defaults) {
+		return false
+	}
+
+	oldKeys := make(map[string]bool, len(m.Mappings))
+	for _, mapping := range m.Mappings {
+		if oldKeys[mapping.key] {
+			return false
+		}
+		oldKeys[mapping.key] = true
+	}
+	newKeys := make(map[string]bool, len(n.Mappings))
+	for _, mapping := range n.Mappings {
+		if newKeys[mapping.key] {
+			return false
+		}
+		newKeys[mapping.key] = true
+	}
+
+	// Mappings that are in both configs have to keep their order, as it
+	// decides which of them matches first.
+	var kept []string
+	for _, mapping := range m.Mappings {
+		if newKeys[mapping.key] {
+			kept = append(kept, mapping.key)
+		}
+	}
+	var added []*MetricMapping
+	i := 0
+	for j := range n.Mappings {
+		mapping := &n.Mappings[j]
+		if !oldKeys[mapping.key] {
+			added = append(added, mapping)
+			continue
+		}
+		if kept[i] != mapping.key {
+			return false
+		}
+		i++
+	}
+
+	if len(added) == 0 && len(kept) == len(m.Mappings) {
+		return true
+	}
+	matchesAdded := newMatcher(added, n.Defaults.GlobDisableOrdering)
+	invalidator.Invalidate(func(metricString string, metricType MetricType, result *MetricMapperCacheResult) bool {
+		if result.Matched && !newKeys[result.Mapping.key] {
+			return true
+		}
+		return matchesAdded(metricString, metricType)
+	})
+	return true
+}
+
+// newMatcher returns a function that reports whether any of the mappings
+// matches a StatsD metric.
+func newMatcher(mappings []*MetricMapping, orderingDisabled bool) func(string, MetricType) bool {
+	var (
+		globs   []string
+		regexes []*MetricMapping
+	)
+	f := fsm.NewFSM([]string{string(MetricTypeCounter), string(MetricTypeGauge), string(MetricTypeObserver)},
+		len(mappings), orderingDisabled)
+	for i, mapping := range mappings {
+		if mapping.MatchType == MatchTypeGlob {
+			f.AddState(mapping.Match, string(mapping.MatchMetricType), len(mappings)-i-1, mapping)
+			globs = append(globs, mapping.Match)
+		} else {
+			regexes = append(regexes, mapping)
+		}
+	}
+	f.BacktrackingNeeded = fsm.TestIfNeedBacktracking(globs, orderingDisabled, log.NewNopLogger())
+
+	return func(metricString string, metricType MetricType) bool {
+		if len(globs) > 0 {
+			if state, _ := f.GetMapping(metricString, string(metricType)); state != nil && state.Result != nil {
+				return true
+			}
+		}
+		for _, mapping := range regexes {
+			if mt := mapping.MatchMetricType; mt != "" && mt != metricType {
+				continue
+			}
+			if mapping.regex.MatchString(metricString) {
+				return true
+			}
+		}
+		return false
+	}
+}
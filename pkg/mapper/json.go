@@ -0,0 +1,82 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReadConfigFile returns the mapping config in a file as YAML. Files with a
+// .json extension hold the config in JSON, with the same schema, and are
+// converted.
+func ReadConfigFile(fileName string) (string, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(filepath.Ext(fileName), ".json") {
+		return string(b), nil
+	}
+	out, err := JSONToYAML(b)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", fileName, err)
+	}
+	return string(out), nil
+}
+
+// JSONToYAML converts a mapping config in JSON to YAML.
+func JSONToYAML(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var config interface{}
+	if err := d.Decode(&config); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("unexpected data after the config")
+	}
+	return yaml.Marshal(fromJSON(config))
+}
+
+// fromJSON replaces the numbers in a decoded JSON value with integers where
+// possible and floats otherwise, which YAML marshals as numbers.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = fromJSON(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromJSON(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
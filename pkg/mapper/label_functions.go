@@ -0,0 +1,271 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper/fsm"
+)
+
+type labelFunction struct {
+	// args is the number of string arguments after the value.
+	args int
+	fn   func(value string, args []string) string
+}
+
+var labelFunctions = map[string]labelFunction{
+	"lowercase": {
+		fn: func(value string, _ []string) string { return strings.ToLower(value) },
+	},
+	"uppercase": {
+		fn: func(value string, _ []string) string { return strings.ToUpper(value) },
+	},
+	"replace": {
+		args: 2,
+		fn:   func(value string, args []string) string { return strings.Replace(value, args[0], args[1], -1) },
+	},
+	"sha1_short": {
+		fn: func(value string, _ []string) string {
+			sum := sha1.Sum([]byte(value))
+			return hex.EncodeToString(sum[:4])
+		},
+	},
+}
+
+// labelTemplate is a label value expression: a sequence of plain templates,
+// which may reference captures, and calls of label functions.
+type labelTemplate struct {
+	parts []labelPart
+}
+
+// labelPart is either a plain template or a call.
+type labelPart struct {
+	template string
+	// formatter expands the template for glob mappings.
+	formatter *fsm.TemplateFormatter
+	call      *labelCall
+}
+
+// labelCall applies a function to its value, which is itself a label
+// expression.
+type labelCall struct {
+	fn    labelFunction
+	value *labelTemplate
+	args  []string
+}
+
+// initFormatters prepares the templates for expansion with the captures of a
+// glob match.
+func (t *labelTemplate) initFormatters(captureCount int) {
+	for i := range t.parts {
+		p := &t.parts[i]
+		if p.call != nil {
+			p.call.value.initFormatters(captureCount)
+		} else {
+			p.formatter = fsm.NewTemplateFormatter(p.template, captureCount)
+		}
+	}
+}
+
+// expandGlob returns the label value for the captures of a glob match.
+func (t *labelTemplate) expandGlob(captures []string) string {
+	if len(t.parts) == 1 {
+		return t.parts[0].expandGlob(captures)
+	}
+	var b strings.Builder
+	for i := range t.parts {
+		b.WriteString(t.parts[i].expandGlob(captures))
+	}
+	return b.String()
+}
+
+func (p *labelPart) expandGlob(captures []string) string {
+	if p.call != nil {
+		return p.call.fn.fn(p.call.value.expandGlob(captures), p.call.args)
+	}
+	return p.formatter.Format(captures)
+}
+
+// expandRegex returns the label value for the submatches of a regex match.
+func (t *labelTemplate) expandRegex(regex *regexp.Regexp, statsdMetric string, matches []int) string {
+	if len(t.parts) == 1 {
+		return t.parts[0].expandRegex(regex, statsdMetric, matches)
+	}
+	var b strings.Builder
+	for i := range t.parts {
+		b.WriteString(t.parts[i].expandRegex(regex, statsdMetric, matches))
+	}
+	return b.String()
+}
+
+func (p *labelPart) expandRegex(regex *regexp.Regexp, statsdMetric string, matches []int) string {
+	if p.call != nil {
+		return p.call.fn.fn(p.call.value.expandRegex(regex, statsdMetric, matches), p.call.args)
+	}
+	return string(regex.ExpandString([]byte{}, p.template, statsdMetric, matches))
+}
+
+// parseLabelTemplate parses expressions like `lowercase(replace($1,"-","_"))`
+// or `lowercase($1)-$2`. Only a known function name, followed by arguments
+// whose value references a capture, is a call. Anything else is a plain
+// template, so existing label values like `count(foo)` keep their meaning.
+func parseLabelTemplate(expr string) (*labelTemplate, error) {
+	t := &labelTemplate{}
+	start := 0
+	for i := 0; i < len(expr); {
+		if !isFunctionNameStart(expr[i]) || (i > 0 && isTemplateNameByte(expr[i-1])) {
+			i++
+			continue
+		}
+		end := i
+		for end < len(expr) && isTemplateNameByte(expr[end]) {
+			end++
+		}
+		name := expr[i:end]
+		fn, ok := labelFunctions[name]
+		if !ok || end == len(expr) || expr[end] != '(' {
+			i = end
+			continue
+		}
+		closing, err := closingParen(expr, end)
+		if err != nil {
+			i = end
+			continue
+		}
+		parts, err := splitLabelFunctionArgs(expr[end+1 : closing])
+		if err != nil || !strings.Contains(parts[0], "$") {
+			i = end
+			continue
+		}
+
+		call, err := parseLabelCall(name, fn, parts, expr)
+		if err != nil {
+			return nil, err
+		}
+		if start < i {
+			t.parts = append(t.parts, labelPart{template: expr[start:i]})
+		}
+		t.parts = append(t.parts, labelPart{call: call})
+		i = closing + 1
+		start = i
+	}
+	if start < len(expr) || len(t.parts) == 0 {
+		t.parts = append(t.parts, labelPart{template: expr[start:]})
+	}
+	return t, nil
+}
+
+// parseLabelCall parses the arguments of a call of the named function in the
+// label value expr.
+func parseLabelCall(name string, fn labelFunction, parts []string, expr string) (*labelCall, error) {
+	if len(parts)-1 != fn.args {
+		return nil, fmt.Errorf("%s takes %d arguments after the value, got %d in label value %q", name, fn.args, len(parts)-1, expr)
+	}
+	value, err := parseLabelTemplate(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, fn.args)
+	for _, p := range parts[1:] {
+		arg, err := strconv.Unquote(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("arguments to %s must be quoted strings in label value %q", name, expr)
+		}
+		args = append(args, arg)
+	}
+	return &labelCall{fn: fn, value: value, args: args}, nil
+}
+
+func isFunctionNameStart(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+// isTemplateNameByte reports whether c can be part of a function name or of
+// a capture reference like $name, so that calls only start at a boundary.
+func isTemplateNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$'
+}
+
+// closingParen returns the index of the parenthesis closing the one at open,
+// skipping over nested calls and quoted strings.
+func closingParen(s string, open int) (int, error) {
+	var (
+		depth   int
+		quoted  bool
+		escaped bool
+	)
+	for i := open + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return i, nil
+			}
+			depth--
+		}
+	}
+	return 0, fmt.Errorf("unterminated call")
+}
+
+// splitLabelFunctionArgs splits the arguments of a call at the top level
+// commas, skipping over nested calls and quoted strings.
+func splitLabelFunctionArgs(s string) ([]string, error) {
+	var (
+		parts   []string
+		depth   int
+		quoted  bool
+		escaped bool
+		start   int
+	)
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses")
+			}
+		case c == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted || depth != 0 {
+		return nil, fmt.Errorf("unterminated string or call")
+	}
+	return append(parts, s[start:]), nil
+}
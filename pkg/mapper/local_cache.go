@@ -0,0 +1,77 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type localCacheKey struct {
+	metricString string
+	metricType   MetricType
+}
+
+// LocalCache holds the most recent matches of a MetricMapper for a single
+// goroutine, in front of the shared mapping cache. Hits take no locks and
+// build no cache keys. It is cleared whenever the mapper loads a config or
+// sets up its cache. Misses are not held, so that they expire as configured
+// in the shared cache.
+//
+// A LocalCache is not safe for concurrent use.
+type LocalCache struct {
+	mapper     *MetricMapper
+	size       int
+	generation uint64
+	items      map[localCacheKey]*MetricMapperCacheResult
+}
+
+// NewLocalCache returns a local cache of at most size matches of m.
+func (m *MetricMapper) NewLocalCache(size int) *LocalCache {
+	return &LocalCache{
+		mapper: m,
+		size:   size,
+		items:  make(map[localCacheKey]*MetricMapperCacheResult, size),
+	}
+}
+
+// GetMapping returns the mapping like MetricMapper.GetMapping.
+func (c *LocalCache) GetMapping(statsdMetric string, statsdMetricType MetricType) (*MetricMapping, prometheus.Labels, bool) {
+	generation := atomic.LoadUint64(&c.mapper.generation)
+	if generation != c.generation {
+		c.items = make(map[localCacheKey]*MetricMapperCacheResult, c.size)
+		c.generation = generation
+	}
+
+	key := localCacheKey{metricString: statsdMetric, metricType: statsdMetricType}
+	if result, ok := c.items[key]; ok {
+		c.mapper.trackLookup("hit", result.Mapping)
+		return result.Mapping, result.Labels, true
+	}
+
+	mapping, labels, present := c.mapper.GetMapping(statsdMetric, statsdMetricType)
+	// The result is only kept if no config was loaded meanwhile, which may
+	// have made it stale.
+	if present && c.size > 0 && atomic.LoadUint64(&c.mapper.generation) == generation {
+		if len(c.items) >= c.size {
+			for k := range c.items {
+				delete(c.items, k)
+				break
+			}
+		}
+		c.items[key] = &MetricMapperCacheResult{Mapping: mapping, Matched: true, Labels: labels}
+	}
+	return mapping, labels, present
+}
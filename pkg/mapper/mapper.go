@@ -15,13 +15,16 @@ package mapper
 
 import (
 	"fmt"
-	"io/ioutil"
+	"os"
 	"regexp"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/prometheus/statsd_exporter/pkg/mapper/fsm"
@@ -36,47 +39,149 @@ var (
 	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]+$`)
 )
 
+// EnumStateLabel is the label that holds the state of enum mappings.
+const EnumStateLabel = "state"
+
+// MetricMapper translates StatsD metric names into Prometheus metric names and
+// labels according to a mapping config. A MetricMapper must be initialized
+// with InitFromYAMLString, InitFromFile or InitCache before it is used, and is
+// safe for concurrent use afterwards. Configs can be loaded again at any time.
 type MetricMapper struct {
+	// generation is incremented atomically whenever cached results may have
+	// become stale, see LocalCache. It is first for 64-bit alignment.
+	generation uint64
+
 	Registerer prometheus.Registerer
-	Defaults   mapperConfigDefaults `yaml:"defaults"`
-	Mappings   []MetricMapping      `yaml:"mappings"`
+	// Logger, if set, receives warnings about the loaded configs.
+	Logger  log.Logger `yaml:"-"`
+	Version int        `yaml:"version"`
+	// ConfigVersion is an optional release identifier of the mapping
+	// config, unrelated to the schema Version.
+	ConfigVersion string               `yaml:"config_version"`
+	Defaults      MapperConfigDefaults `yaml:"defaults"`
+	Mappings      []MetricMapping      `yaml:"mappings"`
+	// RelayRules select the lines the relay forwards, if set.
+	RelayRules []RelayRule `yaml:"relay_rules"`
 	FSM        *fsm.FSM
 	doFSM      bool
 	doRegex    bool
 	cache      MetricMapperCache
+	lookups    *prometheus.CounterVec
 	mutex      sync.RWMutex
 
+	// Templates are Telegraf-style name templates, compiled into glob
+	// mappings that are tried after the Mappings. TemplateSeparator joins
+	// the parts of names and tags, "_" if empty.
+	Templates         []string `yaml:"templates"`
+	TemplateSeparator string   `yaml:"template_separator"`
+
+	// The last loaded config and cache settings, to apply them again when
+	// the temporary mappings change.
+	config       string
+	cacheSize    int
+	cacheOptions []CacheOption
+
+	temporary      []*TemporaryMapping
+	temporaryMutex sync.Mutex
+
+	// origins are the origins of the mappings and targets of the config,
+	// see HasOrigin and MappingForOrigin.
+	origins map[string]*MetricMapping
+	// hits holds the mappingHits of the config.
+	hits atomic.Value
+
 	MappingsCount prometheus.Gauge
+	// ConfigInfo, if set, exposes the ConfigVersion of the loaded config in
+	// a version label.
+	ConfigInfo *prometheus.GaugeVec
 }
 
+// logger returns the Logger, or a logger that discards everything if none is
+// set.
+func (m *MetricMapper) logger() log.Logger {
+	if m.Logger == nil {
+		return log.NewNopLogger()
+	}
+	return m.Logger
+}
+
+// SummaryOptions configure the summaries created for observer events.
 type SummaryOptions struct {
-	Quantiles  []metricObjective `yaml:"quantiles"`
+	Quantiles  []MetricObjective `yaml:"quantiles"`
 	MaxAge     time.Duration     `yaml:"max_age"`
 	AgeBuckets uint32            `yaml:"age_buckets"`
 	BufCap     uint32            `yaml:"buf_cap"`
+	// NoQuantiles exports only the _count and _sum of summaries, which is
+	// cheaper than tracking quantiles.
+	NoQuantiles bool `yaml:"no_quantiles"`
 }
 
+// HistogramOptions configure the histograms created for observer events.
 type HistogramOptions struct {
 	Buckets []float64 `yaml:"buckets"`
 }
 
-type metricObjective struct {
+// MetricObjective is a quantile of a summary with its allowed error.
+type MetricObjective struct {
 	Quantile float64 `yaml:"quantile"`
 	Error    float64 `yaml:"error"`
 }
 
-var defaultQuantiles = []metricObjective{
+var defaultQuantiles = []MetricObjective{
 	{Quantile: 0.5, Error: 0.05},
 	{Quantile: 0.9, Error: 0.01},
 	{Quantile: 0.99, Error: 0.001},
 }
 
+// InitFromYAMLString loads a mapping config and sets up the mapping cache.
+// When a config is loaded again, cached results that it does not change are
+// kept.
+// If the config is invalid, the mapper keeps its previous config.
 func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, options ...CacheOption) error {
+	m.temporaryMutex.Lock()
+	defer m.temporaryMutex.Unlock()
+	return m.initFromYAMLString(fileContents, cacheSize, options...)
+}
+
+// initFromYAMLString loads the config together with the temporary mappings.
+// It must be called with the temporaryMutex held.
+func (m *MetricMapper) initFromYAMLString(fileContents string, cacheSize int, options ...CacheOption) error {
 	var n MetricMapper
 
 	if err := yaml.Unmarshal([]byte(fileContents), &n); err != nil {
 		return err
 	}
+	n.Logger = m.Logger
+
+	temporary, err := m.temporaryMappings()
+	if err != nil {
+		return err
+	}
+	n.Mappings = append(temporary, n.Mappings...)
+
+	separator := n.TemplateSeparator
+	if separator == "" {
+		separator = "_"
+	}
+	templated, err := compileTemplates(n.Templates, separator)
+	if err != nil {
+		return err
+	}
+	n.Mappings = append(n.Mappings, templated...)
+
+	if n.Version < 0 || n.Version > CurrentConfigVersion {
+		return fmt.Errorf("unsupported config version %d, the latest supported version is %d", n.Version, CurrentConfigVersion)
+	}
+
+	if n.Version >= 1 {
+		var doc yaml.MapSlice
+		if err := yaml.Unmarshal([]byte(fileContents), &doc); err != nil {
+			return err
+		}
+		if keys := legacyKeysInConfig(doc); len(keys) > 0 {
+			return fmt.Errorf("deprecated attributes are not supported in config version %d: %v, use migrate-config to upgrade", n.Version, keys)
+		}
+	}
 
 	if len(n.Defaults.HistogramOptions.Buckets) == 0 {
 		n.Defaults.HistogramOptions.Buckets = prometheus.DefBuckets
@@ -86,11 +191,30 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 		n.Defaults.SummaryOptions.Quantiles = defaultQuantiles
 	}
 
+	if n.Defaults.SummaryOptions.MaxAge < 0 {
+		return fmt.Errorf("summary max_age must not be negative in defaults")
+	}
+
+	if n.Defaults.TtlJitter < 0 || n.Defaults.TtlJitter > 100 {
+		return fmt.Errorf("ttl_jitter must be between 0 and 100 in defaults")
+	}
+
+	if n.Defaults.MaxSeries < 0 {
+		return fmt.Errorf("max_series must not be negative in defaults")
+	}
+
 	if n.Defaults.MatchType == MatchTypeDefault {
 		n.Defaults.MatchType = MatchTypeGlob
 	}
 
+	// Mappings with a higher priority are matched first. Mappings with the
+	// same priority keep the order of the file.
+	sort.SliceStable(n.Mappings, func(i, j int) bool {
+		return n.Mappings[i].Priority > n.Mappings[j].Priority
+	})
+
 	remainingMappingsCount := len(n.Mappings)
+	origins := make(map[string]*MetricMapping, len(n.Mappings))
 
 	n.FSM = fsm.NewFSM([]string{string(MetricTypeCounter), string(MetricTypeGauge), string(MetricTypeObserver)},
 		remainingMappingsCount, n.Defaults.GlobDisableOrdering)
@@ -100,17 +224,44 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 
 		currentMapping := &n.Mappings[i]
 
-		// check that label is correct
-		for k := range currentMapping.Labels {
-			if !labelNameRE.MatchString(k) {
-				return fmt.Errorf("invalid label key: %s", k)
-			}
+		matchType := currentMapping.MatchType
+		if matchType == "" {
+			matchType = n.Defaults.MatchType
+		}
+		if err := expandEnv(currentMapping, matchType); err != nil {
+			return err
+		}
+
+		key, err := mappingKey(currentMapping)
+		if err != nil {
+			return err
+		}
+		currentMapping.key = key
+
+		if err := initLabelTemplates(currentMapping); err != nil {
+			return err
 		}
 
 		if currentMapping.Name == "" {
 			return fmt.Errorf("line %d: metric mapping didn't set a metric name", i)
 		}
 
+		if currentMapping.Type != "" {
+			return fmt.Errorf("type can only be set on targets, not in mapping %s", currentMapping.Match)
+		}
+
+		if len(currentMapping.DropLabelValues) > 0 {
+			currentMapping.dropLabelRegexes = make(map[string]*regexp.Regexp, len(currentMapping.DropLabelValues))
+			for label, pattern := range currentMapping.DropLabelValues {
+				// Anchor the pattern so it has to match the whole value.
+				re, err := regexp.Compile("^(?:" + pattern + ")$")
+				if err != nil {
+					return fmt.Errorf("invalid drop_label_values regex %s for label %s in mapping %s: %v", pattern, label, currentMapping.Match, err)
+				}
+				currentMapping.dropLabelRegexes[label] = re
+			}
+		}
+
 		if !metricNameRE.MatchString(currentMapping.Name) {
 			return fmt.Errorf("metric name '%s' doesn't match regex '%s'", currentMapping.Name, metricNameRE)
 		}
@@ -123,27 +274,16 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 			currentMapping.Action = ActionTypeMap
 		}
 
+		captureCount := 0
 		if currentMapping.MatchType == MatchTypeGlob {
 			n.doFSM = true
 			if !metricLineRE.MatchString(currentMapping.Match) {
 				return fmt.Errorf("invalid match: %s", currentMapping.Match)
 			}
 
-			captureCount := n.FSM.AddState(currentMapping.Match, string(currentMapping.MatchMetricType),
+			captureCount = n.FSM.AddState(currentMapping.Match, string(currentMapping.MatchMetricType),
 				remainingMappingsCount, currentMapping)
-
-			currentMapping.nameFormatter = fsm.NewTemplateFormatter(currentMapping.Name, captureCount)
-
-			labelKeys := make([]string, len(currentMapping.Labels))
-			labelFormatters := make([]*fsm.TemplateFormatter, len(currentMapping.Labels))
-			labelIndex := 0
-			for label, valueExpr := range currentMapping.Labels {
-				labelKeys[labelIndex] = label
-				labelFormatters[labelIndex] = fsm.NewTemplateFormatter(valueExpr, captureCount)
-				labelIndex++
-			}
-			currentMapping.labelFormatters = labelFormatters
-			currentMapping.labelKeys = labelKeys
+			initGlobFormatters(currentMapping, captureCount)
 
 		} else {
 			if regex, err := regexp.Compile(currentMapping.Match); err != nil {
@@ -154,83 +294,73 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 			n.doRegex = true
 		}
 
-		if currentMapping.ObserverType == "" {
-			currentMapping.ObserverType = n.Defaults.ObserverType
+		if err := n.initObserverOptions(currentMapping); err != nil {
+			return err
 		}
 
-		if currentMapping.LegacyQuantiles != nil &&
-			(currentMapping.SummaryOptions == nil || currentMapping.SummaryOptions.Quantiles != nil) {
-			log.Warn("using the top level quantiles is deprecated.  Please use quantiles in the summary_options hierarchy")
+		if currentMapping.MaxSeries < 0 {
+			return fmt.Errorf("max_series must not be negative in %s", currentMapping.Match)
+		}
+		if currentMapping.MaxSeries == 0 {
+			currentMapping.MaxSeries = n.Defaults.MaxSeries
 		}
 
-		if currentMapping.LegacyBuckets != nil &&
-			(currentMapping.HistogramOptions == nil || currentMapping.HistogramOptions.Buckets != nil) {
-			log.Warn("using the top level buckets is deprecated.  Please use buckets in the histogram_options hierarchy")
+		if err := initEnumStates(currentMapping); err != nil {
+			return err
 		}
 
-		if currentMapping.SummaryOptions != nil &&
-			currentMapping.LegacyQuantiles != nil &&
-			currentMapping.SummaryOptions.Quantiles != nil {
-			return fmt.Errorf("cannot use quantiles in both the top level and summary options at the same time in %s", currentMapping.Match)
+		if err := initBounds(currentMapping); err != nil {
+			return err
 		}
 
-		if currentMapping.HistogramOptions != nil &&
-			currentMapping.LegacyBuckets != nil &&
-			currentMapping.HistogramOptions.Buckets != nil {
-			return fmt.Errorf("cannot use buckets in both the top level and histogram options at the same time in %s", currentMapping.Match)
+		if err := initAggregateLabels(currentMapping); err != nil {
+			return err
 		}
 
-		if currentMapping.ObserverType == ObserverTypeHistogram {
-			if currentMapping.SummaryOptions != nil {
-				return fmt.Errorf("cannot use histogram observer and summary options at the same time")
-			}
-			if currentMapping.HistogramOptions == nil {
-				currentMapping.HistogramOptions = &HistogramOptions{}
-			}
-			if currentMapping.LegacyBuckets != nil && len(currentMapping.LegacyBuckets) != 0 {
-				currentMapping.HistogramOptions.Buckets = currentMapping.LegacyBuckets
-			}
-			if currentMapping.HistogramOptions.Buckets == nil || len(currentMapping.HistogramOptions.Buckets) == 0 {
-				currentMapping.HistogramOptions.Buckets = n.Defaults.HistogramOptions.Buckets
-			}
+		if err := initTransform(currentMapping); err != nil {
+			return err
 		}
 
-		if currentMapping.ObserverType == ObserverTypeSummary {
-			if currentMapping.HistogramOptions != nil {
-				return fmt.Errorf("cannot use summary observer and histogram options at the same time")
-			}
-			if currentMapping.SummaryOptions == nil {
-				currentMapping.SummaryOptions = &SummaryOptions{}
-			}
-			if currentMapping.LegacyQuantiles != nil && len(currentMapping.LegacyQuantiles) != 0 {
-				currentMapping.SummaryOptions.Quantiles = currentMapping.LegacyQuantiles
-			}
-			if currentMapping.SummaryOptions.Quantiles == nil || len(currentMapping.SummaryOptions.Quantiles) == 0 {
-				currentMapping.SummaryOptions.Quantiles = n.Defaults.SummaryOptions.Quantiles
-			}
-			if currentMapping.SummaryOptions.MaxAge == 0 {
-				currentMapping.SummaryOptions.MaxAge = n.Defaults.SummaryOptions.MaxAge
-			}
-			if currentMapping.SummaryOptions.AgeBuckets == 0 {
-				currentMapping.SummaryOptions.AgeBuckets = n.Defaults.SummaryOptions.AgeBuckets
-			}
-			if currentMapping.SummaryOptions.BufCap == 0 {
-				currentMapping.SummaryOptions.BufCap = n.Defaults.SummaryOptions.BufCap
-			}
+		if err := n.initTargets(currentMapping, captureCount); err != nil {
+			return err
 		}
 
-		if currentMapping.Ttl == 0 && n.Defaults.Ttl > 0 {
-			currentMapping.Ttl = n.Defaults.Ttl
+		currentMapping.origin = mappingOrigin(currentMapping.MatchType, currentMapping.Match, currentMapping)
+		origins[currentMapping.origin] = currentMapping
+		for _, target := range currentMapping.Targets {
+			target.origin = mappingOrigin(currentMapping.MatchType, currentMapping.Match, target)
+			origins[target.origin] = target
 		}
+	}
 
+	for i := range n.RelayRules {
+		if err := n.RelayRules[i].init(n.Defaults.MatchType); err != nil {
+			return err
+		}
 	}
 
+	reconcileHelp(n.Mappings, n.logger())
+
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	// Keep the cached results of mappings that did not change, so that
+	// reloads do not cause a burst of lookups.
+	cacheKept := m.cache != nil && m.invalidateCache(&n, cacheSize, options)
+
+	m.config = fileContents
+	m.Version = n.Version
+	m.ConfigVersion = n.ConfigVersion
 	m.Defaults = n.Defaults
 	m.Mappings = n.Mappings
-	m.InitCache(cacheSize, options...)
+	m.RelayRules = n.RelayRules
+	m.origins = origins
+	previousHits, _ := m.hits.Load().(mappingHits)
+	m.hits.Store(newMappingHits(n.Mappings, previousHits))
+	if !cacheKept {
+		m.InitCache(cacheSize, options...)
+	}
+	atomic.AddUint64(&m.generation, 1)
 
 	if n.doFSM {
 		var mappings []string
@@ -239,7 +369,7 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 				mappings = append(mappings, mapping.Match)
 			}
 		}
-		n.FSM.BacktrackingNeeded = fsm.TestIfNeedBacktracking(mappings, n.FSM.OrderingDisabled)
+		n.FSM.BacktrackingNeeded = fsm.TestIfNeedBacktracking(mappings, n.FSM.OrderingDisabled, n.logger())
 
 		m.FSM = n.FSM
 		m.doRegex = n.doRegex
@@ -249,28 +379,270 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 	if m.MappingsCount != nil {
 		m.MappingsCount.Set(float64(len(n.Mappings)))
 	}
+	if m.ConfigInfo != nil {
+		m.ConfigInfo.Reset()
+		m.ConfigInfo.WithLabelValues(n.ConfigVersion).Set(1)
+	}
 	return nil
 }
 
+// initLabelTemplates validates the label names of a mapping and parses their
+// value templates.
+func initLabelTemplates(mapping *MetricMapping) error {
+	mapping.labelTemplates = make(map[string]*labelTemplate, len(mapping.Labels))
+	for k, valueExpr := range mapping.Labels {
+		if !labelNameRE.MatchString(k) {
+			return fmt.Errorf("invalid label key: %s", k)
+		}
+		template, err := parseLabelTemplate(valueExpr)
+		if err != nil {
+			return err
+		}
+		mapping.labelTemplates[k] = template
+	}
+	return nil
+}
+
+// initGlobFormatters prepares the name and label templates of a mapping for
+// expansion with the captures of a glob match.
+func initGlobFormatters(mapping *MetricMapping, captureCount int) {
+	mapping.nameFormatter = fsm.NewTemplateFormatter(mapping.Name, captureCount)
+
+	labelKeys := make([]string, 0, len(mapping.Labels))
+	for label, template := range mapping.labelTemplates {
+		labelKeys = append(labelKeys, label)
+		template.initFormatters(captureCount)
+	}
+	mapping.labelKeys = labelKeys
+}
+
+// initObserverOptions fills in the observer type, histogram and summary
+// options, and TTL of a mapping from the defaults.
+func (n *MetricMapper) initObserverOptions(mapping *MetricMapping) error {
+	if mapping.ObserverType == "" {
+		mapping.ObserverType = n.Defaults.ObserverType
+	}
+
+	if mapping.LegacyQuantiles != nil &&
+		(mapping.SummaryOptions == nil || mapping.SummaryOptions.Quantiles != nil) {
+		level.Warn(n.logger()).Log("msg", "using the top level quantiles is deprecated, please use quantiles in the summary_options hierarchy", "match", mapping.Match)
+	}
+
+	if mapping.LegacyBuckets != nil &&
+		(mapping.HistogramOptions == nil || mapping.HistogramOptions.Buckets != nil) {
+		level.Warn(n.logger()).Log("msg", "using the top level buckets is deprecated, please use buckets in the histogram_options hierarchy", "match", mapping.Match)
+	}
+
+	if mapping.SummaryOptions != nil &&
+		mapping.LegacyQuantiles != nil &&
+		mapping.SummaryOptions.Quantiles != nil {
+		return fmt.Errorf("cannot use quantiles in both the top level and summary options at the same time in %s", mapping.Match)
+	}
+
+	if mapping.HistogramOptions != nil &&
+		mapping.LegacyBuckets != nil &&
+		mapping.HistogramOptions.Buckets != nil {
+		return fmt.Errorf("cannot use buckets in both the top level and histogram options at the same time in %s", mapping.Match)
+	}
+
+	if mapping.ObserverType == ObserverTypeHistogram {
+		if mapping.SummaryOptions != nil {
+			return fmt.Errorf("cannot use histogram observer and summary options at the same time")
+		}
+		if mapping.HistogramOptions == nil {
+			mapping.HistogramOptions = &HistogramOptions{}
+		}
+		if mapping.LegacyBuckets != nil && len(mapping.LegacyBuckets) != 0 {
+			mapping.HistogramOptions.Buckets = mapping.LegacyBuckets
+		}
+		if mapping.HistogramOptions.Buckets == nil || len(mapping.HistogramOptions.Buckets) == 0 {
+			mapping.HistogramOptions.Buckets = n.Defaults.HistogramOptions.Buckets
+		}
+	}
+
+	if mapping.ObserverType == ObserverTypeSummary {
+		if mapping.HistogramOptions != nil {
+			return fmt.Errorf("cannot use summary observer and histogram options at the same time")
+		}
+		if mapping.SummaryOptions == nil {
+			mapping.SummaryOptions = &SummaryOptions{}
+		}
+		if mapping.LegacyQuantiles != nil && len(mapping.LegacyQuantiles) != 0 {
+			mapping.SummaryOptions.Quantiles = mapping.LegacyQuantiles
+		}
+	}
+
+	// Mappings without an explicit observer type also become summaries,
+	// so fill in their summary options whenever they are set.
+	if mapping.SummaryOptions != nil {
+		if mapping.SummaryOptions.Quantiles == nil || len(mapping.SummaryOptions.Quantiles) == 0 {
+			mapping.SummaryOptions.Quantiles = n.Defaults.SummaryOptions.Quantiles
+		}
+		if mapping.SummaryOptions.MaxAge == 0 {
+			mapping.SummaryOptions.MaxAge = n.Defaults.SummaryOptions.MaxAge
+		}
+		if mapping.SummaryOptions.AgeBuckets == 0 {
+			mapping.SummaryOptions.AgeBuckets = n.Defaults.SummaryOptions.AgeBuckets
+		}
+		if mapping.SummaryOptions.BufCap == 0 {
+			mapping.SummaryOptions.BufCap = n.Defaults.SummaryOptions.BufCap
+		}
+		if n.Defaults.SummaryOptions.NoQuantiles {
+			mapping.SummaryOptions.NoQuantiles = true
+		}
+		if mapping.SummaryOptions.MaxAge < 0 {
+			return fmt.Errorf("summary max_age must not be negative in %s", mapping.Match)
+		}
+	}
+
+	if mapping.Ttl == 0 && n.Defaults.Ttl > 0 {
+		mapping.Ttl = n.Defaults.Ttl
+	}
+	if mapping.TtlJitter == 0 {
+		mapping.TtlJitter = n.Defaults.TtlJitter
+	}
+	if mapping.TtlJitter < 0 || mapping.TtlJitter > 100 {
+		return fmt.Errorf("ttl_jitter must be between 0 and 100 in %s", mapping.Match)
+	}
+
+	return nil
+}
+
+// initEnumStates validates the states of an enum mapping.
+func initEnumStates(mapping *MetricMapping) error {
+	if len(mapping.EnumStates) == 0 {
+		return nil
+	}
+	if _, ok := mapping.Labels[EnumStateLabel]; ok {
+		return fmt.Errorf("mapping %s with enum_states cannot set the %s label", mapping.Match, EnumStateLabel)
+	}
+	seen := make(map[string]bool, len(mapping.EnumStates))
+	for _, state := range mapping.EnumStates {
+		if state == "" {
+			return fmt.Errorf("empty state in enum_states of mapping %s", mapping.Match)
+		}
+		if seen[state] {
+			return fmt.Errorf("duplicate state %s in enum_states of mapping %s", state, mapping.Match)
+		}
+		seen[state] = true
+	}
+	return nil
+}
+
+// initAggregateLabels validates the labels a mapping aggregates over, which
+// must not be set by the mapping itself.
+func initAggregateLabels(mapping *MetricMapping) error {
+	for _, label := range mapping.AggregateLabels {
+		if _, ok := mapping.Labels[label]; ok {
+			return fmt.Errorf("mapping %s cannot aggregate over the label %s it sets", mapping.Match, label)
+		}
+	}
+	return nil
+}
+
+// reconcileHelp gives all mappings and targets with the same metric name the
+// same help text, as a metric can only have one. The first help text set for
+// a name wins, and others are warned about.
+func reconcileHelp(mappings []MetricMapping, logger log.Logger) {
+	var all []*MetricMapping
+	for i := range mappings {
+		all = append(all, &mappings[i])
+		all = append(all, mappings[i].Targets...)
+	}
+
+	help := map[string]string{}
+	for _, mapping := range all {
+		if mapping.HelpText == "" || mapping.Action == ActionTypeDrop {
+			continue
+		}
+		first, ok := help[mapping.Name]
+		if !ok {
+			help[mapping.Name] = mapping.HelpText
+			continue
+		}
+		if first != mapping.HelpText {
+			level.Warn(logger).Log("msg", "mapping sets a help text for a metric that already has another, using the latter", "match", mapping.Match, "metric", mapping.Name, "help", mapping.HelpText, "used_help", first)
+		}
+	}
+	for _, mapping := range all {
+		if h, ok := help[mapping.Name]; ok {
+			mapping.HelpText = h
+		}
+	}
+}
+
+// initTargets validates the additional targets of a mapping and prepares
+// them for expansion with the captures of the mapping's match.
+func (n *MetricMapper) initTargets(mapping *MetricMapping, captureCount int) error {
+	for _, target := range mapping.Targets {
+		if target.Match != "" || target.MatchType != "" || target.MatchMetricType != "" ||
+			target.Action != "" || target.Priority != 0 || len(target.Targets) > 0 || len(target.DropLabelValues) > 0 ||
+			target.MaxSeries != 0 || len(target.EnumStates) > 0 || target.HasBounds() {
+			return fmt.Errorf("targets of mapping %s can only set the metric name, type, labels and metric options", mapping.Match)
+		}
+		if target.Type != "" && target.Type != MetricTypeCounter {
+			return fmt.Errorf("invalid target type %s in mapping %s, only %s is supported", target.Type, mapping.Match, MetricTypeCounter)
+		}
+		if target.Name == "" {
+			return fmt.Errorf("a target of mapping %s didn't set a metric name", mapping.Match)
+		}
+		if !metricNameRE.MatchString(target.Name) {
+			return fmt.Errorf("metric name '%s' doesn't match regex '%s'", target.Name, metricNameRE)
+		}
+		if err := initLabelTemplates(target); err != nil {
+			return err
+		}
+		if mapping.MatchType == MatchTypeGlob {
+			initGlobFormatters(target, captureCount)
+		}
+		if err := n.initObserverOptions(target); err != nil {
+			return err
+		}
+		if err := initAggregateLabels(target); err != nil {
+			return err
+		}
+		// Series of targets count towards the limit of their mapping.
+		target.Match = mapping.Match
+		target.MaxSeries = mapping.MaxSeries
+	}
+	return nil
+}
+
+// InitFromFile loads the mapping config in a YAML or JSON file, see
+// ReadConfigFile and InitFromYAMLString.
 func (m *MetricMapper) InitFromFile(fileName string, cacheSize int, options ...CacheOption) error {
-	mappingStr, err := ioutil.ReadFile(fileName)
+	mappingStr, err := ReadConfigFile(fileName)
 	if err != nil {
 		return err
 	}
 
-	return m.InitFromYAMLString(string(mappingStr), cacheSize, options...)
+	return m.InitFromYAMLString(mappingStr, cacheSize, options...)
 }
 
+// InitCache sets up a new, empty mapping cache holding at most cacheSize
+// entries, one per StatsD metric name and type. A size of 0 disables caching.
 func (m *MetricMapper) InitCache(cacheSize int, options ...CacheOption) {
+	m.cacheSize = cacheSize
+	m.cacheOptions = options
+	atomic.AddUint64(&m.generation, 1)
+
+	if m.lookups == nil {
+		m.lookups = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_metric_mapper_lookups_total",
+				Help: "The count of metric mapping lookups by cache result and the match type of the mapping found.",
+			},
+			[]string{"cache", "match_type"},
+		)
+		if m.Registerer != nil {
+			m.lookups = registerCollector(m.Registerer, m.lookups).(*prometheus.CounterVec)
+		}
+	}
+
 	if cacheSize == 0 {
 		m.cache = NewMetricMapperNoopCache(m.Registerer)
 	} else {
-		o := cacheOptions{
-			cacheType: "lru",
-		}
-		for _, f := range options {
-			f(&o)
-		}
+		o := resolveCacheOptions(options)
 
 		var (
 			cache MetricMapperCache
@@ -278,39 +650,56 @@ func (m *MetricMapper) InitCache(cacheSize int, options ...CacheOption) {
 		)
 		switch o.cacheType {
 		case "lru":
-			cache, err = NewMetricMapperCache(m.Registerer, cacheSize)
+			var c *MetricMapperLRUCache
+			c, err = NewMetricMapperCache(m.Registerer, cacheSize)
+			c.missTTL = o.missTTL
+			cache = c
 		case "random":
-			cache, err = NewMetricMapperRRCache(m.Registerer, cacheSize)
+			var c *MetricMapperRRCache
+			c, err = NewMetricMapperRRCache(m.Registerer, cacheSize)
+			c.missTTL = o.missTTL
+			cache = c
 		default:
 			err = fmt.Errorf("unsupported cache type %q", o.cacheType)
 		}
 
 		if err != nil {
-			log.Fatalf("Unable to setup metric cache. Caused by: %s", err)
+			level.Error(m.logger()).Log("msg", "Unable to setup metric cache", "error", err)
+			os.Exit(1)
 		}
 		m.cache = cache
 	}
 }
 
+// GetMapping returns the mapping for a StatsD metric name and type, with the
+// labels it results in, and whether any mapping matched.
 func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricType) (*MetricMapping, prometheus.Labels, bool) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 	result, cached := m.cache.Get(statsdMetric, statsdMetricType)
 	if cached {
+		m.trackLookup("hit", result.Mapping)
 		return result.Mapping, result.Labels, result.Matched
 	}
+	mapping, labels, present := m.lookup(statsdMetric, statsdMetricType)
+	m.trackLookup("miss", mapping)
+	return mapping, labels, present
+}
+
+// lookup matches a StatsD metric against the mappings and caches the result.
+// It must be called with the mutex held.
+func (m *MetricMapper) lookup(statsdMetric string, statsdMetricType MetricType) (*MetricMapping, prometheus.Labels, bool) {
 	// glob matching
 	if m.doFSM {
 		finalState, captures := m.FSM.GetMapping(statsdMetric, string(statsdMetricType))
 		if finalState != nil && finalState.Result != nil {
 			v := finalState.Result.(*MetricMapping)
 			result := copyMetricMapping(v)
-			result.Name = result.nameFormatter.Format(captures)
-
-			labels := prometheus.Labels{}
-			for index, formatter := range result.labelFormatters {
-				labels[result.labelKeys[index]] = formatter.Format(captures)
-			}
+			var labels prometheus.Labels
+			result.Name, labels = v.expandGlob(captures)
+			result.Targets = expandTargets(v.Targets, func(target *MetricMapping) (string, prometheus.Labels) {
+				return target.expandGlob(captures)
+			})
 
 			m.cache.AddMatch(statsdMetric, statsdMetricType, result, labels)
 
@@ -333,22 +722,16 @@ func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricTy
 			continue
 		}
 
-		mapping.Name = string(mapping.regex.ExpandString(
-			[]byte{},
-			mapping.Name,
-			statsdMetric,
-			matches,
-		))
-
 		if mt := mapping.MatchMetricType; mt != "" && mt != statsdMetricType {
 			continue
 		}
 
-		labels := prometheus.Labels{}
-		for label, valueExpr := range mapping.Labels {
-			value := mapping.regex.ExpandString([]byte{}, valueExpr, statsdMetric, matches)
-			labels[label] = string(value)
-		}
+		var labels prometheus.Labels
+		regex := mapping.regex
+		mapping.Name, labels = mapping.expandRegex(regex, statsdMetric, matches)
+		mapping.Targets = expandTargets(mapping.Targets, func(target *MetricMapping) (string, prometheus.Labels) {
+			return target.expandRegex(regex, statsdMetric, matches)
+		})
 
 		m.cache.AddMatch(statsdMetric, statsdMetricType, &mapping, labels)
 
@@ -359,6 +742,31 @@ func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricTy
 	return nil, nil, false
 }
 
+// trackLookup counts a mapping lookup by cache result and the match type of
+// the mapping it found, so that the cost of regex mappings can be assessed.
+func (m *MetricMapper) trackLookup(cacheResult string, mapping *MetricMapping) {
+	matchType := "none"
+	if mapping != nil {
+		matchType = string(mapping.MatchType)
+		m.trackHit(mapping)
+	}
+	m.lookups.WithLabelValues(cacheResult, matchType).Inc()
+}
+
+// expandTargets returns copies of the targets of a mapping with their name
+// and labels expanded for a matched metric.
+func expandTargets(targets []*MetricMapping, expand func(*MetricMapping) (string, prometheus.Labels)) []*MetricMapping {
+	if len(targets) == 0 {
+		return nil
+	}
+	expanded := make([]*MetricMapping, len(targets))
+	for i, target := range targets {
+		expanded[i] = copyMetricMapping(target)
+		expanded[i].Name, expanded[i].Labels = expand(target)
+	}
+	return expanded
+}
+
 // make a shallow copy so that we do not overwrite name
 // as multiple names can be matched by same mapping
 func copyMetricMapping(in *MetricMapping) *MetricMapping {
@@ -998,3 +998,54 @@ mappings:` + duplicateRules(100, ruleTemplateSingleMatchGlob)
 		})
 	}
 }
+
+func BenchmarkCacheChurnParallel(b *testing.B) {
+	// Every lookup misses the cache and inserts a result, evicting another
+	// one, from many goroutines at once. This covers the cost of keeping the
+	// cache metrics up to date.
+	config := `---
+mappings:` + duplicateRules(10, ruleTemplateSingleMatchGlob)
+
+	mappings := duplicateMetrics(1000, "metric1.%d")
+
+	for _, cacheType := range []string{"lru", "random"} {
+		b.Run(cacheType, func(b *testing.B) {
+			mapper := MetricMapper{}
+			err := mapper.InitFromYAMLString(config, 100, WithCacheType(cacheType))
+			if err != nil {
+				b.Fatalf("Config load error: %s %s", config, err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Int()
+				for pb.Next() {
+					mapper.GetMapping(mappings[i%len(mappings)], MetricTypeCounter)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGlob100RulesCached100MetricsLocalCache(b *testing.B) {
+	config := `---
+mappings:` + duplicateRules(100, ruleTemplateSingleMatchGlob)
+
+	mappings := duplicateMetrics(100, "metric99.%d")
+
+	mapper := MetricMapper{}
+	err := mapper.InitFromYAMLString(config, 1000)
+	if err != nil {
+		b.Fatalf("Config load error: %s %s", config, err)
+	}
+	local := mapper.NewLocalCache(200)
+
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		for _, metric := range mappings {
+			local.GetMapping(metric, MetricTypeCounter)
+		}
+	}
+}
@@ -14,18 +14,28 @@
 package mapper
 
 import (
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
 )
 
+// CacheMetrics are the metrics exposed by mapping caches.
 type CacheMetrics struct {
-	CacheLength    prometheus.Gauge
-	CacheGetsTotal prometheus.Counter
-	CacheHitsTotal prometheus.Counter
+	CacheLength         prometheus.Gauge
+	CacheBytes          prometheus.Gauge
+	CacheGetsTotal      prometheus.Counter
+	CacheHitsTotal      prometheus.Counter
+	CacheEvictionsTotal prometheus.Counter
 }
 
+// NewCacheMetrics returns the cache metrics registered with reg, reusing
+// already registered ones. reg may be nil.
 func NewCacheMetrics(reg prometheus.Registerer) *CacheMetrics {
 	var m CacheMetrics
 
@@ -35,6 +45,12 @@ func NewCacheMetrics(reg prometheus.Registerer) *CacheMetrics {
 			Help: "The count of unique metrics currently cached.",
 		},
 	)
+	m.CacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_metric_mapper_cache_bytes",
+			Help: "The estimated memory used by the cached metrics.",
+		},
+	)
 	m.CacheGetsTotal = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "statsd_metric_mapper_cache_gets_total",
@@ -47,62 +63,163 @@ func NewCacheMetrics(reg prometheus.Registerer) *CacheMetrics {
 			Help: "The count of total metric cache hits.",
 		},
 	)
+	m.CacheEvictionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_metric_mapper_cache_evictions_total",
+			Help: "The count of metrics evicted from the cache to make room for others.",
+		},
+	)
 
 	if reg != nil {
-		reg.MustRegister(m.CacheLength)
-		reg.MustRegister(m.CacheGetsTotal)
-		reg.MustRegister(m.CacheHitsTotal)
+		m.CacheLength = registerCollector(reg, m.CacheLength).(prometheus.Gauge)
+		m.CacheBytes = registerCollector(reg, m.CacheBytes).(prometheus.Gauge)
+		m.CacheGetsTotal = registerCollector(reg, m.CacheGetsTotal).(prometheus.Counter)
+		m.CacheHitsTotal = registerCollector(reg, m.CacheHitsTotal).(prometheus.Counter)
+		m.CacheEvictionsTotal = registerCollector(reg, m.CacheEvictionsTotal).(prometheus.Counter)
 	}
 	return &m
 }
 
+// registerCollector registers the collector, or returns the equivalent one
+// that is already registered. Caches are set up again on every configuration
+// reload, and keep using the same metrics.
+func registerCollector(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
 type cacheOptions struct {
 	cacheType string
+	missTTL   time.Duration
 }
 
+// resolveCacheOptions applies the options to the default cache settings.
+func resolveCacheOptions(options []CacheOption) cacheOptions {
+	o := cacheOptions{
+		cacheType: "lru",
+	}
+	for _, f := range options {
+		f(&o)
+	}
+	return o
+}
+
+// CacheOption configures the cache set up by the MetricMapper.
 type CacheOption func(*cacheOptions)
 
+// WithCacheType selects the cache implementation, "lru" (the default) or
+// "random".
 func WithCacheType(cacheType string) CacheOption {
 	return func(o *cacheOptions) {
 		o.cacheType = cacheType
 	}
 }
 
+// WithMissTTL limits how long lookups that did not match any mapping are
+// cached. By default, they are cached as long as matches.
+func WithMissTTL(ttl time.Duration) CacheOption {
+	return func(o *cacheOptions) {
+		o.missTTL = ttl
+	}
+}
+
+// MetricMapperCacheResult is the cached result of a mapping lookup.
 type MetricMapperCacheResult struct {
 	Mapping *MetricMapping
 	Matched bool
 	Labels  prometheus.Labels
+	// expires is set for misses that are only cached for a while.
+	expires time.Time
 }
 
+// newMissResult returns the result of a lookup that did not match, which
+// expires after ttl if it is set.
+func newMissResult(ttl time.Duration) *MetricMapperCacheResult {
+	result := &MetricMapperCacheResult{Matched: false}
+	if ttl > 0 {
+		result.expires = clock.Now().Add(ttl)
+	}
+	return result
+}
+
+func (r *MetricMapperCacheResult) expired() bool {
+	return !r.expires.IsZero() && clock.Now().After(r.expires)
+}
+
+// Rough memory overhead of cache entries, on top of the strings they hold.
+const (
+	cacheEntryOverhead = 128
+	mappingOverhead    = 440
+	labelOverhead      = 16
+)
+
+// size estimates the memory of a cache entry. Matches hold a copy of the
+// mapping with its name, labels and targets expanded.
+func (r *MetricMapperCacheResult) size(key string) int64 {
+	size := int64(cacheEntryOverhead + len(key))
+	for k, v := range r.Labels {
+		size += int64(labelOverhead + len(k) + len(v))
+	}
+	if r.Mapping != nil {
+		size += int64(mappingOverhead + len(r.Mapping.Name))
+		for _, target := range r.Mapping.Targets {
+			size += int64(mappingOverhead + len(target.Name))
+			for k, v := range target.Labels {
+				size += int64(labelOverhead + len(k) + len(v))
+			}
+		}
+	}
+	return size
+}
+
+// MetricMapperCache caches the results of mapping lookups, including lookups
+// that did not match any mapping.
 type MetricMapperCache interface {
 	Get(metricString string, metricType MetricType) (*MetricMapperCacheResult, bool)
 	AddMatch(metricString string, metricType MetricType, mapping *MetricMapping, labels prometheus.Labels)
 	AddMiss(metricString string, metricType MetricType)
 }
 
+// MetricMapperLRUCache evicts the least recently used results.
 type MetricMapperLRUCache struct {
-	MetricMapperCache
+	// bytes is accessed atomically and kept first for 64-bit alignment.
+	bytes   int64
 	cache   *lru.Cache
 	metrics *CacheMetrics
+	missTTL time.Duration
+	// addLock makes replacing a result atomic, so that the size of every
+	// result is subtracted exactly once when it leaves the cache.
+	addLock sync.Mutex
 }
 
+// MetricMapperNoopCache does not cache anything.
 type MetricMapperNoopCache struct {
-	MetricMapperCache
 	metrics *CacheMetrics
 }
 
 func NewMetricMapperCache(reg prometheus.Registerer, size int) (*MetricMapperLRUCache, error) {
-	metrics := NewCacheMetrics(reg)
-	cache, err := lru.New(size)
+	m := &MetricMapperLRUCache{metrics: NewCacheMetrics(reg)}
+	cache, err := lru.NewWithEvict(size, m.onEvicted)
 	if err != nil {
 		return &MetricMapperLRUCache{}, err
 	}
-	return &MetricMapperLRUCache{metrics: metrics, cache: cache}, nil
+	m.cache = cache
+	return m, nil
 }
 
 func (m *MetricMapperLRUCache) Get(metricString string, metricType MetricType) (*MetricMapperCacheResult, bool) {
 	m.metrics.CacheGetsTotal.Inc()
-	if result, ok := m.cache.Get(formatKey(metricString, metricType)); ok {
+	key := formatKey(metricString, metricType)
+	if result, ok := m.cache.Get(key); ok {
+		if result.(*MetricMapperCacheResult).expired() {
+			m.cache.Remove(key)
+			return nil, false
+		}
 		m.metrics.CacheHitsTotal.Inc()
 		return result.(*MetricMapperCacheResult), true
 	} else {
@@ -111,23 +228,71 @@ func (m *MetricMapperLRUCache) Get(metricString string, metricType MetricType) (
 }
 
 func (m *MetricMapperLRUCache) AddMatch(metricString string, metricType MetricType, mapping *MetricMapping, labels prometheus.Labels) {
-	go m.trackCacheLength()
-	m.cache.Add(formatKey(metricString, metricType), &MetricMapperCacheResult{Mapping: mapping, Matched: true, Labels: labels})
+	m.add(formatKey(metricString, metricType), &MetricMapperCacheResult{Mapping: mapping, Matched: true, Labels: labels})
 }
 
 func (m *MetricMapperLRUCache) AddMiss(metricString string, metricType MetricType) {
-	go m.trackCacheLength()
-	m.cache.Add(formatKey(metricString, metricType), &MetricMapperCacheResult{Matched: false})
+	m.add(formatKey(metricString, metricType), newMissResult(m.missTTL))
+}
+
+func (m *MetricMapperLRUCache) add(key string, result *MetricMapperCacheResult) {
+	m.addLock.Lock()
+	defer m.addLock.Unlock()
+	// Replacing a result does not call onEvicted, removing it does.
+	m.cache.Remove(key)
+	atomic.AddInt64(&m.bytes, result.size(key))
+	if m.cache.Add(key, result) {
+		m.metrics.CacheEvictionsTotal.Inc()
+	}
+	m.trackCacheLength()
+}
+
+// onEvicted is called by the LRU cache for every result that is removed.
+func (m *MetricMapperLRUCache) onEvicted(key, value interface{}) {
+	atomic.AddInt64(&m.bytes, -value.(*MetricMapperCacheResult).size(key.(string)))
+}
+
+func (m *MetricMapperLRUCache) Invalidate(stale func(metricString string, metricType MetricType, result *MetricMapperCacheResult) bool) {
+	for _, key := range m.cache.Keys() {
+		result, ok := m.cache.Peek(key)
+		if !ok {
+			continue
+		}
+		metricString, metricType := parseKey(key.(string))
+		if stale(metricString, metricType, result.(*MetricMapperCacheResult)) {
+			m.cache.Remove(key)
+		}
+	}
+	m.trackCacheLength()
 }
 
+// Walk visits the cached results from the least to the most recently used.
+func (m *MetricMapperLRUCache) Walk(f func(metricString string, metricType MetricType, result *MetricMapperCacheResult)) {
+	for _, key := range m.cache.Keys() {
+		if result, ok := m.cache.Peek(key); ok {
+			metricString, metricType := parseKey(key.(string))
+			f(metricString, metricType, result.(*MetricMapperCacheResult))
+		}
+	}
+}
+
+// trackCacheLength updates the cache metrics. Setting a gauge is atomic and
+// cheap, so it is done synchronously on every change.
 func (m *MetricMapperLRUCache) trackCacheLength() {
 	m.metrics.CacheLength.Set(float64(m.cache.Len()))
+	m.metrics.CacheBytes.Set(float64(atomic.LoadInt64(&m.bytes)))
 }
 
 func formatKey(metricString string, metricType MetricType) string {
 	return string(metricType) + "." + metricString
 }
 
+// parseKey splits a key built by formatKey. Metric types contain no dots.
+func parseKey(key string) (string, MetricType) {
+	i := strings.Index(key, ".")
+	return key[i+1:], MetricType(key[:i])
+}
+
 func NewMetricMapperNoopCache(reg prometheus.Registerer) *MetricMapperNoopCache {
 	return &MetricMapperNoopCache{metrics: NewCacheMetrics(reg)}
 }
@@ -144,12 +309,14 @@ func (m *MetricMapperNoopCache) AddMiss(metricString string, metricType MetricTy
 	return
 }
 
+// MetricMapperRRCache evicts random results.
 type MetricMapperRRCache struct {
-	MetricMapperCache
 	lock    sync.RWMutex
 	size    int
 	items   map[string]*MetricMapperCacheResult
+	bytes   int64
 	metrics *CacheMetrics
+	missTTL time.Duration
 }
 
 func NewMetricMapperRRCache(reg prometheus.Registerer, size int) (*MetricMapperRRCache, error) {
@@ -169,25 +336,34 @@ func (m *MetricMapperRRCache) Get(metricString string, metricType MetricType) (*
 	result, ok := m.items[key]
 	m.lock.RUnlock()
 
+	if ok && result.expired() {
+		// The entry is replaced on the next lookup.
+		return nil, false
+	}
 	return result, ok
 }
 
 func (m *MetricMapperRRCache) addItem(metricString string, metricType MetricType, result *MetricMapperCacheResult) {
-	go m.trackCacheLength()
-
 	key := formatKey(metricString, metricType)
 
 	m.lock.Lock()
 
+	if old, ok := m.items[key]; ok {
+		m.bytes -= old.size(key)
+	}
 	m.items[key] = result
+	m.bytes += result.size(key)
 
 	// evict an item if needed
 	if len(m.items) > m.size {
-		for k := range m.items {
+		for k, evicted := range m.items {
 			delete(m.items, k)
+			m.bytes -= evicted.size(k)
+			m.metrics.CacheEvictionsTotal.Inc()
 			break
 		}
 	}
+	m.trackCacheLength()
 
 	m.lock.Unlock()
 }
@@ -198,13 +374,47 @@ func (m *MetricMapperRRCache) AddMatch(metricString string, metricType MetricTyp
 }
 
 func (m *MetricMapperRRCache) AddMiss(metricString string, metricType MetricType) {
-	e := &MetricMapperCacheResult{Matched: false}
+	e := newMissResult(m.missTTL)
 	m.addItem(metricString, metricType, e)
 }
 
-func (m *MetricMapperRRCache) trackCacheLength() {
+func (m *MetricMapperRRCache) Invalidate(stale func(metricString string, metricType MetricType, result *MetricMapperCacheResult) bool) {
+	m.lock.Lock()
+	for key, result := range m.items {
+		metricString, metricType := parseKey(key)
+		if stale(metricString, metricType, result) {
+			delete(m.items, key)
+			m.bytes -= result.size(key)
+		}
+	}
+	m.trackCacheLength()
+	m.lock.Unlock()
+}
+
+func (m *MetricMapperRRCache) Walk(f func(metricString string, metricType MetricType, result *MetricMapperCacheResult)) {
 	m.lock.RLock()
-	length := len(m.items)
-	m.lock.RUnlock()
-	m.metrics.CacheLength.Set(float64(length))
+	defer m.lock.RUnlock()
+	for key, result := range m.items {
+		metricString, metricType := parseKey(key)
+		f(metricString, metricType, result)
+	}
+}
+
+// trackCacheLength updates the cache metrics. It must be called with the lock
+// held.
+func (m *MetricMapperRRCache) trackCacheLength() {
+	m.metrics.CacheLength.Set(float64(len(m.items)))
+	m.metrics.CacheBytes.Set(float64(m.bytes))
 }
+
+var (
+	_ MetricMapperCache = &MetricMapperLRUCache{}
+	_ MetricMapperCache = &MetricMapperNoopCache{}
+	_ MetricMapperCache = &MetricMapperRRCache{}
+
+	_ MetricMapperCacheInvalidator = &MetricMapperLRUCache{}
+	_ MetricMapperCacheInvalidator = &MetricMapperRRCache{}
+
+	_ MetricMapperCacheWalker = &MetricMapperLRUCache{}
+	_ MetricMapperCacheWalker = &MetricMapperRRCache{}
+)
@@ -15,31 +15,43 @@ package mapper
 
 import "time"
 
-type mapperConfigDefaults struct {
+// MapperConfigDefaults are the settings of the defaults section of a mapping
+// config, which apply to mappings that do not set their own.
+type MapperConfigDefaults struct {
 	ObserverType        ObserverType     `yaml:"observer_type"`
 	MatchType           MatchType        `yaml:"match_type"`
 	GlobDisableOrdering bool             `yaml:"glob_disable_ordering"`
 	Ttl                 time.Duration    `yaml:"ttl"`
+	TtlJitter           float64          `yaml:"ttl_jitter"`
 	SummaryOptions      SummaryOptions   `yaml:"summary_options"`
 	HistogramOptions    HistogramOptions `yaml:"histogram_options"`
+	// Action applies to events that do not match any mapping.
+	Action    ActionType `yaml:"action"`
+	MaxSeries int        `yaml:"max_series"`
+	// ExpiryPolicies decide per metric type whether series expire by TTL.
+	ExpiryPolicies ExpiryPolicies `yaml:"expiry_policies"`
 }
 
-// mapperConfigDefaultsAlias is used to unmarshal the yaml config into mapperConfigDefaults and allows deprecated fields
+// mapperConfigDefaultsAlias is used to unmarshal the yaml config into MapperConfigDefaults and allows deprecated fields
 type mapperConfigDefaultsAlias struct {
 	ObserverType        ObserverType      `yaml:"observer_type"`
 	TimerType           ObserverType      `yaml:"timer_type,omitempty"` // DEPRECATED - field only present to preserve backwards compatibility in configs
 	Buckets             []float64         `yaml:"buckets"`              // DEPRECATED - field only present to preserve backwards compatibility in configs
-	Quantiles           []metricObjective `yaml:"quantiles"`            // DEPRECATED - field only present to preserve backwards compatibility in configs
+	Quantiles           []MetricObjective `yaml:"quantiles"`            // DEPRECATED - field only present to preserve backwards compatibility in configs
 	MatchType           MatchType         `yaml:"match_type"`
 	GlobDisableOrdering bool              `yaml:"glob_disable_ordering"`
 	Ttl                 time.Duration     `yaml:"ttl"`
+	TtlJitter           float64           `yaml:"ttl_jitter"`
 	SummaryOptions      SummaryOptions    `yaml:"summary_options"`
 	HistogramOptions    HistogramOptions  `yaml:"histogram_options"`
+	Action              ActionType        `yaml:"action"`
+	MaxSeries           int               `yaml:"max_series"`
+	ExpiryPolicies      ExpiryPolicies    `yaml:"expiry_policies"`
 }
 
 // UnmarshalYAML is a custom unmarshal function to allow use of deprecated config keys
 // observer_type will override timer_type
-func (d *mapperConfigDefaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
+func (d *MapperConfigDefaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var tmp mapperConfigDefaultsAlias
 	if err := unmarshal(&tmp); err != nil {
 		return err
@@ -50,8 +62,12 @@ func (d *mapperConfigDefaults) UnmarshalYAML(unmarshal func(interface{}) error)
 	d.MatchType = tmp.MatchType
 	d.GlobDisableOrdering = tmp.GlobDisableOrdering
 	d.Ttl = tmp.Ttl
+	d.TtlJitter = tmp.TtlJitter
 	d.SummaryOptions = tmp.SummaryOptions
 	d.HistogramOptions = tmp.HistogramOptions
+	d.Action = tmp.Action
+	d.MaxSeries = tmp.MaxSeries
+	d.ExpiryPolicies = tmp.ExpiryPolicies
 
 	// Use deprecated TimerType if necessary
 	if tmp.ObserverType == "" {
@@ -14,17 +14,31 @@
 package mapper
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper/fsm"
 )
 
 type mappings []struct {
 	statsdMetric string
 	name         string
 	labels       map[string]string
-	quantiles    []metricObjective
+	quantiles    []MetricObjective
 	notPresent   bool
 	ttl          time.Duration
 	metricType   MetricType
@@ -466,7 +480,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -493,7 +507,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -514,7 +528,7 @@ mappings:
 					statsdMetric: "test1.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.5, Error: 0.05},
 						{Quantile: 0.9, Error: 0.01},
 						{Quantile: 0.99, Error: 0.001},
@@ -536,7 +550,7 @@ mappings:
 					statsdMetric: "test1.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.5, Error: 0.05},
 						{Quantile: 0.9, Error: 0.01},
 						{Quantile: 0.99, Error: 0.001},
@@ -586,7 +600,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -616,7 +630,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -650,7 +664,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -715,7 +729,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -758,7 +772,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -805,7 +819,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -817,7 +831,7 @@ mappings:
 					statsdMetric: "test_default.*.*",
 					name:         "foo_default",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.9, Error: 0.1},
 						{Quantile: 0.99, Error: 0.01},
 					},
@@ -861,7 +875,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.42, Error: 0.04},
 						{Quantile: 0.7, Error: 0.002},
 					},
@@ -873,7 +887,7 @@ mappings:
 					statsdMetric: "test_default.*.*",
 					name:         "foo_default",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.9, Error: 0.1},
 						{Quantile: 0.99, Error: 0.01},
 					},
@@ -913,7 +927,7 @@ mappings:
 					statsdMetric: "test.*.*",
 					name:         "foo",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.9, Error: 0.1},
 						{Quantile: 0.99, Error: 0.01},
 					},
@@ -925,7 +939,7 @@ mappings:
 					statsdMetric: "test_default.*.*",
 					name:         "foo_default",
 					labels:       map[string]string{},
-					quantiles: []metricObjective{
+					quantiles: []MetricObjective{
 						{Quantile: 0.9, Error: 0.1},
 						{Quantile: 0.99, Error: 0.01},
 					},
@@ -1376,6 +1390,424 @@ mappings:
 				},
 			},
 		},
+		{
+			testName: "Config with drop_label_values",
+			config: `---
+mappings:
+- match: test.*.*
+  name: "test"
+  labels:
+    env: "$1"
+  drop_label_values:
+    env: "dev|test"
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.prod.a",
+					name:         "test",
+					labels: map[string]string{
+						"env": "prod",
+					},
+				},
+			},
+		},
+		{
+			testName: "Config with invalid drop_label_values regex",
+			config: `---
+mappings:
+- match: test.*.*
+  name: "test"
+  drop_label_values:
+    env: "(dev"
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with summary options without observer type",
+			config: `---
+defaults:
+  summary_options:
+    max_age: 1m
+    age_buckets: 3
+    buf_cap: 800
+mappings:
+- match: test.*
+  name: "test"
+  summary_options:
+    max_age: 30s
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.a",
+					name:         "test",
+					maxAge:       30 * time.Second,
+					ageBuckets:   3,
+					bufCap:       800,
+				},
+			},
+		},
+		{
+			testName: "Config with negative summary max_age",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  observer_type: summary
+  summary_options:
+    max_age: -1m
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with mapping priorities",
+			config: `---
+mappings:
+- match: test.*.*
+  name: "test_generic"
+- match: test.*.total
+  name: "test_total"
+  priority: 10
+- match: test.a.*
+  name: "test_a"
+  priority: 5
+- match: regex\.(.*)
+  match_type: regex
+  name: "regex_generic"
+- match: regex\.special
+  match_type: regex
+  name: "regex_special"
+  priority: 1
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.a.total",
+					name:         "test_total",
+				},
+				{
+					statsdMetric: "test.a.count",
+					name:         "test_a",
+				},
+				{
+					statsdMetric: "test.b.count",
+					name:         "test_generic",
+				},
+				{
+					statsdMetric: "regex.special",
+					name:         "regex_special",
+				},
+				{
+					statsdMetric: "regex.other",
+					name:         "regex_generic",
+				},
+			},
+		},
+		{
+			testName: "Config with label value functions",
+			config: `---
+mappings:
+- match: test.*.*.*
+  name: "test"
+  labels:
+    service: "lowercase($1)"
+    endpoint: 'replace($2,"-","_")'
+    user: "sha1_short($3)"
+    nested: 'uppercase(replace(prefix-$1,"-","."))'
+    literal: "unknown($1)"
+    concatenated: "lowercase($1)-uppercase($2)"
+    suffixed: "lowercase($1)_x"
+    literal_call: "replace(x)"
+    literal_unknown: "count(foo)"
+- match: regex\.(.*)\.(.*)
+  match_type: regex
+  name: "regex"
+  labels:
+    service: "lowercase($1)"
+    endpoint: 'replace(${2},"-","_")'
+    concatenated: "${1}/lowercase($1)-uppercase(${2})"
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.MyService.get-users.alice",
+					name:         "test",
+					labels: map[string]string{
+						"service":  "myservice",
+						"endpoint": "get_users",
+						"user":     "522b276a",
+						"nested":   "PREFIX.MYSERVICE",
+						"literal":  "unknown(MyService)",
+
+						"concatenated":    "myservice-GET-USERS",
+						"suffixed":        "myservice_x",
+						"literal_call":    "replace(x)",
+						"literal_unknown": "count(foo)",
+					},
+				},
+				{
+					statsdMetric: "regex.MyService.get-users",
+					name:         "regex",
+					labels: map[string]string{
+						"service":      "myservice",
+						"endpoint":     "get_users",
+						"concatenated": "MyService/myservice-GET-USERS",
+					},
+				},
+			},
+		},
+		{
+			testName: "Config with wrong number of label function arguments",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  labels:
+    endpoint: 'replace($1,"-")'
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with wrong number of arguments to one of several label functions",
+			config: `---
+mappings:
+- match: test.*.*
+  name: "test"
+  labels:
+    endpoint: 'lowercase($1)-replace($2,"-")'
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with unquoted label function arguments",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  labels:
+    endpoint: 'replace($1,-,_)'
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with mapping targets",
+			config: `---
+mappings:
+- match: test.*.*
+  name: "test_$1"
+  labels:
+    endpoint: "$2"
+  targets:
+  - name: "test_${1}_requests"
+    type: counter
+  - name: "test_by_endpoint"
+    labels:
+      endpoint: "$2"
+    observer_type: histogram
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.api.login",
+					name:         "test_api",
+					labels: map[string]string{
+						"endpoint": "login",
+					},
+				},
+			},
+		},
+		{
+			testName: "Config with enum states",
+			config: `---
+mappings:
+- match: test.*.status
+  name: "test_status"
+  labels:
+    service: "$1"
+  enum_states: [starting, running, stopped]
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.api.status",
+					name:         "test_status",
+					labels: map[string]string{
+						"service": "api",
+					},
+				},
+			},
+		},
+		{
+			testName: "Config with duplicate enum states",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  enum_states: [running, running]
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with enum states and a state label",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  labels:
+    state: "$1"
+  enum_states: [running, stopped]
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with value bounds",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  min: 0
+  max: 100
+  out_of_bounds: clamp
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "test.latency",
+					name:         "test",
+				},
+			},
+		},
+		{
+			testName: "Config with min greater than max",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  min: 100
+  max: 0
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with invalid out_of_bounds",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  max: 100
+  out_of_bounds: ignore
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with bounds on a target",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  targets:
+  - name: "test_total"
+    max: 100
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config aggregating over a label it sets",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  labels:
+    host: "$1"
+  aggregate_labels: [host]
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with invalid on_expiry",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  ttl: 1m
+  on_expiry: keep
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with invalid expiry policy",
+			config: `---
+defaults:
+  ttl: 1m
+  expiry_policies:
+    counter: sometimes
+mappings:
+- match: test.*
+  name: "test"
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with negative max_series",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  max_series: -1
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with negative default max_series",
+			config: `---
+defaults:
+  max_series: -1
+mappings:
+- match: test.*
+  name: "test"
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with type outside of a target",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  type: counter
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with invalid target type",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  targets:
+  - name: "test_gauge"
+    type: gauge
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with match in a target",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  targets:
+  - match: other.*
+    name: "other"
+`,
+			configBad: true,
+		},
+		{
+			testName: "Config with target without name",
+			config: `---
+mappings:
+- match: test.*
+  name: "test"
+  targets:
+  - labels:
+      a: "$1"
+`,
+			configBad: true,
+		},
 	}
 
 	mapper := MetricMapper{}
@@ -1612,3 +2044,832 @@ mappings:
 	}
 
 }
+
+func TestMappingTargets(t *testing.T) {
+	for _, matchType := range []string{"glob", "regex"} {
+		t.Run(matchType, func(t *testing.T) {
+			match := "test.*.*"
+			if matchType == "regex" {
+				match = `test\.(.*)\.(.*)`
+			}
+			config := fmt.Sprintf(`---
+mappings:
+- match: %s
+  match_type: %s
+  name: "test_$1"
+  targets:
+  - name: "test_${1}_requests"
+    type: counter
+  - name: "test_by_endpoint"
+    observer_type: histogram
+    labels:
+      endpoint: "$2"
+`, match, matchType)
+
+			mapper := MetricMapper{}
+			if err := mapper.InitFromYAMLString(config, 1000); err != nil {
+				t.Fatalf("Config load error: %s", err)
+			}
+
+			// The second lookup is served from the cache.
+			for i := 0; i < 2; i++ {
+				for _, service := range []string{"api", "web"} {
+					m, _, present := mapper.GetMapping("test."+service+".login", MetricTypeObserver)
+					if !present {
+						t.Fatalf("expected a mapping for %s", service)
+					}
+					if len(m.Targets) != 2 {
+						t.Fatalf("expected 2 targets, got %d", len(m.Targets))
+					}
+					if m.Targets[0].Name != "test_"+service+"_requests" || m.Targets[0].Type != MetricTypeCounter {
+						t.Errorf("unexpected first target %s of type %s", m.Targets[0].Name, m.Targets[0].Type)
+					}
+					if m.Targets[1].Name != "test_by_endpoint" || m.Targets[1].Labels["endpoint"] != "login" {
+						t.Errorf("unexpected second target %s with labels %v", m.Targets[1].Name, m.Targets[1].Labels)
+					}
+					if m.Targets[1].ObserverType != ObserverTypeHistogram || len(m.Targets[1].HistogramOptions.Buckets) == 0 {
+						t.Errorf("expected the second target to be a histogram with default buckets")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTemporaryMappings(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+	defer func() { clock.ClockInstance = nil }()
+
+	mapper := MetricMapper{}
+	err := mapper.InitFromYAMLString(`---
+mappings:
+- match: test.*
+  name: "test"
+`, 1000)
+	if err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+
+	// Prime the cache.
+	mapper.GetMapping("test.a", MetricTypeCounter)
+
+	if err := mapper.AddTemporaryMapping(`match: test.*
+name: "test_debug"
+labels:
+  suffix: "$1"
+`, time.Unix(60, 0)); err != nil {
+		t.Fatalf("Adding temporary mapping failed: %s", err)
+	}
+	if err := mapper.AddTemporaryMapping(`match: test.*
+labels:
+  suffix: "$1"
+`, time.Unix(60, 0)); err == nil {
+		t.Fatalf("Adding a temporary mapping without name should fail")
+	}
+	if err := mapper.AddTemporaryMapping(`match: test.*
+name: "test_debug"
+unknown: true
+`, time.Unix(60, 0)); err == nil {
+		t.Fatalf("Adding a temporary mapping with unknown attributes should fail")
+	}
+
+	m, labels, _ := mapper.GetMapping("test.a", MetricTypeCounter)
+	if m.Name != "test_debug" || labels["suffix"] != "a" {
+		t.Fatalf("Expected the temporary mapping, got %s with labels %v", m.Name, labels)
+	}
+	if n := len(mapper.TemporaryMappings()); n != 1 {
+		t.Fatalf("Expected 1 temporary mapping, got %d", n)
+	}
+
+	// Temporary mappings survive reloads of the config.
+	err = mapper.InitFromYAMLString(`---
+mappings:
+- match: test.*
+  name: "test_reloaded"
+`, 1000)
+	if err != nil {
+		t.Fatalf("Config reload error: %s", err)
+	}
+	m, _, _ = mapper.GetMapping("test.a", MetricTypeCounter)
+	if m.Name != "test_debug" {
+		t.Fatalf("Expected the temporary mapping after reload, got %s", m.Name)
+	}
+
+	clock.ClockInstance.Instant = time.Unix(61, 0)
+	if err := mapper.RemoveExpiredMappings(); err != nil {
+		t.Fatalf("Removing expired mappings failed: %s", err)
+	}
+	m, _, _ = mapper.GetMapping("test.a", MetricTypeCounter)
+	if m.Name != "test_reloaded" {
+		t.Fatalf("Expected the configured mapping after expiry, got %s", m.Name)
+	}
+	if n := len(mapper.TemporaryMappings()); n != 0 {
+		t.Fatalf("Expected no temporary mappings, got %d", n)
+	}
+}
+
+func TestLookupMetrics(t *testing.T) {
+	config := `---
+mappings:
+- match: glob.*
+  name: "glob"
+- match: regex\.(.*)
+  match_type: regex
+  name: "regex"
+`
+	mapper := MetricMapper{Registerer: prometheus.NewRegistry()}
+	// Load twice, as on a reload, to ensure the metrics can be set up again.
+	for i := 0; i < 2; i++ {
+		if err := mapper.InitFromYAMLString(config, 1000); err != nil {
+			t.Fatalf("config load error: %s ", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		mapper.GetMapping("glob.a", MetricTypeCounter)
+		mapper.GetMapping("regex.a", MetricTypeCounter)
+		mapper.GetMapping("none", MetricTypeCounter)
+	}
+
+	scenarios := []struct {
+		cache     string
+		matchType string
+		expected  float64
+	}{
+		{cache: "miss", matchType: "glob", expected: 1},
+		{cache: "hit", matchType: "glob", expected: 2},
+		{cache: "miss", matchType: "regex", expected: 1},
+		{cache: "hit", matchType: "regex", expected: 2},
+		{cache: "miss", matchType: "none", expected: 1},
+		{cache: "hit", matchType: "none", expected: 2},
+	}
+	for _, s := range scenarios {
+		var metric dto.Metric
+		if err := mapper.lookups.WithLabelValues(s.cache, s.matchType).Write(&metric); err != nil {
+			t.Fatalf("Failed to read lookups metric: %v", err)
+		}
+		if v := metric.GetCounter().GetValue(); v != s.expected {
+			t.Fatalf("Expected %v lookups with cache %s and match type %s, got %v", s.expected, s.cache, s.matchType, v)
+		}
+	}
+}
+
+func TestConfigInfo(t *testing.T) {
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "config_info"}, []string{"version"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(info)
+	mapper := MetricMapper{ConfigInfo: info}
+
+	versions := func() []string {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Failed to gather config info: %v", err)
+		}
+		versions := []string{}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				versions = append(versions, m.GetLabel()[0].GetValue())
+			}
+		}
+		return versions
+	}
+
+	for _, version := range []string{"2021.03.1", "2021.03.2"} {
+		config := fmt.Sprintf("config_version: %q\nmappings:\n- match: test.*\n  name: test\n", version)
+		if err := mapper.InitFromYAMLString(config, 0); err != nil {
+			t.Fatalf("config load error: %s", err)
+		}
+		if mapper.ConfigVersion != version {
+			t.Fatalf("Expected config version %s, got %s", version, mapper.ConfigVersion)
+		}
+		if got := versions(); len(got) != 1 || got[0] != version {
+			t.Fatalf("Expected only config version %s to be exposed, got %v", version, got)
+		}
+	}
+
+	if err := mapper.InitFromYAMLString("mappings: [", 0); err == nil {
+		t.Fatal("Expected an invalid config to fail to load")
+	}
+	if got := versions(); len(got) != 1 || got[0] != "2021.03.2" {
+		t.Fatalf("Expected config version 2021.03.2 to be kept after a failed load, got %v", got)
+	}
+}
+
+func TestCacheMissTTL(t *testing.T) {
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+	defer func() { clock.ClockInstance = nil }()
+
+	config := `---
+mappings:
+- match: test.*
+  name: "test"
+`
+	for _, cacheType := range []string{"lru", "random"} {
+		t.Run(cacheType, func(t *testing.T) {
+			clock.ClockInstance.Instant = time.Unix(0, 0)
+			mapper := MetricMapper{}
+			if err := mapper.InitFromYAMLString(config, 100, WithCacheType(cacheType), WithMissTTL(time.Minute)); err != nil {
+				t.Fatalf("config load error: %s", err)
+			}
+
+			mapper.GetMapping("test.a", MetricTypeCounter)
+			mapper.GetMapping("other", MetricTypeCounter)
+			if _, cached := mapper.cache.Get("other", MetricTypeCounter); !cached {
+				t.Fatalf("Expected the miss to be cached")
+			}
+
+			clock.ClockInstance.Instant = time.Unix(61, 0)
+			if _, cached := mapper.cache.Get("other", MetricTypeCounter); cached {
+				t.Fatalf("Expected the miss to expire")
+			}
+			if _, cached := mapper.cache.Get("test.a", MetricTypeCounter); !cached {
+				t.Fatalf("Expected the match to stay cached")
+			}
+		})
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	config := `---
+mappings:
+- match: a.*
+  name: "a"
+- match: b.*
+  name: "b"
+- match: (c)\.(.*)
+  match_type: regex
+  name: "c"
+`
+	changed := `---
+mappings:
+- match: a.*
+  name: "a"
+- match: b.*
+  name: "b_changed"
+- match: (c)\.(.*)
+  match_type: regex
+  name: "c"
+- match: d.*
+  name: "d"
+`
+	for _, cacheType := range []string{"lru", "random"} {
+		t.Run(cacheType, func(t *testing.T) {
+			mapper := MetricMapper{}
+			if err := mapper.InitFromYAMLString(config, 100, WithCacheType(cacheType)); err != nil {
+				t.Fatalf("config load error: %s", err)
+			}
+			for _, metric := range []string{"a.x", "b.x", "c.x", "d.x", "e.x"} {
+				mapper.GetMapping(metric, MetricTypeCounter)
+			}
+
+			if err := mapper.InitFromYAMLString(changed, 100, WithCacheType(cacheType)); err != nil {
+				t.Fatalf("config load error: %s", err)
+			}
+			for metric, expected := range map[string]bool{
+				"a.x": true,
+				"b.x": false,
+				"c.x": true,
+				"d.x": false,
+				"e.x": true,
+			} {
+				if _, cached := mapper.cache.Get(metric, MetricTypeCounter); cached != expected {
+					t.Errorf("%s: expected cached to be %v", metric, expected)
+				}
+			}
+			if mapping, _, _ := mapper.GetMapping("b.x", MetricTypeCounter); mapping.Name != "b_changed" {
+				t.Errorf("expected the changed mapping, got %s", mapping.Name)
+			}
+			if mapping, _, present := mapper.GetMapping("d.x", MetricTypeCounter); !present || mapping.Name != "d" {
+				t.Errorf("expected the added mapping to match d.x")
+			}
+
+			// Changing the defaults resets the whole cache.
+			if err := mapper.InitFromYAMLString("defaults:\n  ttl: 1m\n"+changed[4:], 100, WithCacheType(cacheType)); err != nil {
+				t.Fatalf("config load error: %s", err)
+			}
+			if _, cached := mapper.cache.Get("a.x", MetricTypeCounter); cached {
+				t.Errorf("expected the cache to be reset")
+			}
+		})
+	}
+}
+
+func TestCachePersistence(t *testing.T) {
+	config := `---
+mappings:
+- match: test.*
+  name: "test"
+  labels:
+    name: "$1"
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 100); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	mapper.GetMapping("test.a", MetricTypeCounter)
+	mapper.GetMapping("test.b", MetricTypeGauge)
+	mapper.GetMapping("other", MetricTypeObserver)
+
+	var saved bytes.Buffer
+	if count, err := mapper.SaveCache(&saved); err != nil || count != 3 {
+		t.Fatalf("expected 3 saved entries, got %d (%v)", count, err)
+	}
+	saved.WriteString("invalid\n")
+
+	restarted := MetricMapper{}
+	if err := restarted.InitFromYAMLString(config, 100); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	if count, err := restarted.WarmCache(&saved); err != nil || count != 3 {
+		t.Fatalf("expected 3 warmed entries, got %d (%v)", count, err)
+	}
+	result, cached := restarted.cache.Get("test.b", MetricTypeGauge)
+	if !cached || !result.Matched || result.Labels["name"] != "b" {
+		t.Errorf("expected test.b to be cached as a match, got %+v", result)
+	}
+	if result, cached := restarted.cache.Get("other", MetricTypeObserver); !cached || result.Matched {
+		t.Errorf("expected other to be cached as a miss")
+	}
+}
+
+func TestCacheSizeAndEvictions(t *testing.T) {
+	config := `---
+mappings:
+- match: test.*
+  name: "test"
+  labels:
+    name: "$1"
+`
+	for _, cacheType := range []string{"lru", "random"} {
+		t.Run(cacheType, func(t *testing.T) {
+			mapper := MetricMapper{}
+			if err := mapper.InitFromYAMLString(config, 2, WithCacheType(cacheType)); err != nil {
+				t.Fatalf("config load error: %s", err)
+			}
+			for _, metric := range []string{"test.a", "test.b", "test.c", "other"} {
+				mapper.GetMapping(metric, MetricTypeCounter)
+			}
+
+			var (
+				metrics *CacheMetrics
+				bytes   func() int64
+			)
+			switch c := mapper.cache.(type) {
+			case *MetricMapperLRUCache:
+				metrics, bytes = c.metrics, func() int64 { return c.bytes }
+			case *MetricMapperRRCache:
+				metrics, bytes = c.metrics, func() int64 { return c.bytes }
+			}
+
+			var evictions dto.Metric
+			if err := metrics.CacheEvictionsTotal.Write(&evictions); err != nil {
+				t.Fatalf("Failed to read evictions metric: %v", err)
+			}
+			if v := evictions.GetCounter().GetValue(); v != 2 {
+				t.Errorf("Expected 2 evictions, got %v", v)
+			}
+			if bytes() <= 0 {
+				t.Errorf("Expected the cached entries to take memory, got %d bytes", bytes())
+			}
+
+			mapper.cache.(MetricMapperCacheInvalidator).Invalidate(func(string, MetricType, *MetricMapperCacheResult) bool {
+				return true
+			})
+			if bytes() != 0 {
+				t.Errorf("Expected an empty cache to take no memory, got %d bytes", bytes())
+			}
+		})
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString("mappings:\n- match: test.*\n  name: test\n", 100); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	local := mapper.NewLocalCache(2)
+
+	for _, metric := range []string{"test.a", "test.b", "test.c", "other"} {
+		local.GetMapping(metric, MetricTypeCounter)
+	}
+	if len(local.items) != 2 {
+		t.Fatalf("Expected the local cache to hold 2 matches, got %d", len(local.items))
+	}
+	if _, ok := local.items[localCacheKey{"other", MetricTypeCounter}]; ok {
+		t.Fatalf("Expected misses not to be held in the local cache")
+	}
+
+	if err := mapper.InitFromYAMLString("mappings:\n- match: test.*\n  name: reloaded\n", 100); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	if mapping, _, _ := local.GetMapping("test.c", MetricTypeCounter); mapping.Name != "reloaded" {
+		t.Fatalf("Expected the local cache to be cleared on reload, got %s", mapping.Name)
+	}
+	if len(local.items) != 1 {
+		t.Fatalf("Expected only the new match in the local cache, got %d", len(local.items))
+	}
+}
+
+func TestHelpConflicts(t *testing.T) {
+	config := `mappings:
+- match: test.a.*
+  name: "test"
+  labels:
+    la: "$1"
+- match: test.b.*
+  name: "test"
+  help: "First help."
+  labels:
+    lb: "$1"
+- match: test.c.*
+  name: "test"
+  help: "Second help."
+  labels:
+    lc: "$1"
+  targets:
+  - name: "test_total"
+    help: "Target help."
+- match: other.*
+  name: "test_total"
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	for metric, help := range map[string]string{
+		"test.a.x":  "First help.",
+		"test.b.x":  "First help.",
+		"test.c.x":  "First help.",
+		"other.foo": "Target help.",
+	} {
+		m, _, present := mapper.GetMapping(metric, MetricTypeCounter)
+		if !present {
+			t.Fatalf("Expected %s to match", metric)
+		}
+		if m.HelpText != help {
+			t.Errorf("Expected help %q for %s, got %q", help, metric, m.HelpText)
+		}
+	}
+}
+
+func TestEnvExpansion(t *testing.T) {
+	os.Setenv("STATSD_TEST_PREFIX", "prod")
+	os.Setenv("STATSD_TEST_REGION", "eu-west-1")
+	defer os.Unsetenv("STATSD_TEST_PREFIX")
+	defer os.Unsetenv("STATSD_TEST_REGION")
+
+	config := `mappings:
+- match: test.*
+  name: "${STATSD_TEST_PREFIX}_test"
+  help: "Test events in ${STATSD_TEST_REGION}"
+  labels:
+    name: "${1}"
+    region: "${STATSD_TEST_REGION}"
+  targets:
+  - name: "${STATSD_TEST_PREFIX}_test_total"
+- match: 'regex\.(?P<STATSD_TEST_REGION>.*)'
+  match_type: regex
+  name: "regex"
+  labels:
+    region: "${STATSD_TEST_REGION}"
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+
+	m, labels, present := mapper.GetMapping("test.foo", MetricTypeCounter)
+	if !present {
+		t.Fatal("Expected test.foo to match")
+	}
+	if m.Name != "prod_test" || m.HelpText != "Test events in eu-west-1" {
+		t.Errorf("Unexpected name %q and help %q", m.Name, m.HelpText)
+	}
+	if labels["name"] != "foo" || labels["region"] != "eu-west-1" {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+	if m.Targets[0].Name != "prod_test_total" {
+		t.Errorf("Unexpected target name %q", m.Targets[0].Name)
+	}
+
+	// A named capture group takes precedence over the environment.
+	_, labels, present = mapper.GetMapping("regex.us", MetricTypeCounter)
+	if !present || labels["region"] != "us" {
+		t.Errorf("Expected the capture group to be expanded, got %v", labels)
+	}
+
+	err := mapper.InitFromYAMLString("mappings:\n- match: test.*\n  name: ${STATSD_TEST_UNSET}_test\n", 0)
+	if err == nil {
+		t.Fatal("Expected an error for an unset environment variable")
+	}
+}
+
+func TestJSONConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "json-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "mapping.json")
+	if err := ioutil.WriteFile(fileName, []byte(`{
+	"defaults": {"ttl": "1m", "max_series": 1000000},
+	"mappings": [
+		{
+			"match": "test.*",
+			"name": "test",
+			"observer_type": "histogram",
+			"histogram_options": {"buckets": [0.5, 1, 2.5]},
+			"labels": {"name": "$1"}
+		}
+	]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mapper := MetricMapper{}
+	if err := mapper.InitFromFile(fileName, 0); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	m, labels, present := mapper.GetMapping("test.foo", MetricTypeObserver)
+	if !present || labels["name"] != "foo" {
+		t.Fatalf("Expected test.foo to match, got %v", labels)
+	}
+	if m.Ttl != time.Minute || m.MaxSeries != 1000000 {
+		t.Errorf("Expected the defaults to apply, got ttl %v and max series %d", m.Ttl, m.MaxSeries)
+	}
+	if buckets := m.HistogramOptions.Buckets; len(buckets) != 3 || buckets[0] != 0.5 || buckets[1] != 1 {
+		t.Errorf("Unexpected buckets %v", buckets)
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte(`{"mappings": [}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mapper.InitFromFile(fileName, 0); err == nil {
+		t.Fatal("Expected an error for invalid JSON")
+	}
+}
+
+func TestDumpFSM(t *testing.T) {
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString("mappings:\n- match: (.*)\n  match_type: regex\n  name: regex\n", 0); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	if err := mapper.DumpFSM(&bytes.Buffer{}, FSMFormatDot); err != ErrNoFSM {
+		t.Fatalf("Expected ErrNoFSM without glob mappings, got %v", err)
+	}
+
+	config := `---
+mappings:
+- match: test.*.a
+  name: "test_a"
+- match: test.*.b
+  name: "test_b"
+  match_metric_type: counter
+`
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+
+	var dump bytes.Buffer
+	if err := mapper.DumpFSM(&dump, FSMFormatJSON); err != nil {
+		t.Fatalf("JSON dump error: %s", err)
+	}
+	var parsed fsm.JSONFSM
+	if err := json.Unmarshal(dump.Bytes(), &parsed); err != nil {
+		t.Fatalf("Invalid JSON dump: %s", err)
+	}
+	results := map[string]bool{}
+	for _, state := range parsed.States {
+		if state.Result != "" {
+			results[state.Result] = true
+		}
+	}
+	// test.*.a ends in a state for each metric type, test.*.b only for
+	// counters.
+	if !results["test.*.a -> test_a"] || !results["test.*.b -> test_b"] || len(parsed.Transitions) != len(parsed.States)-1 {
+		t.Fatalf("Unexpected JSON dump: %s", dump.String())
+	}
+
+	dump.Reset()
+	if err := mapper.DumpFSM(&dump, FSMFormatMermaid); err != nil {
+		t.Fatalf("Mermaid dump error: %s", err)
+	}
+	if !strings.HasPrefix(dump.String(), "flowchart LR\n") || !strings.Contains(dump.String(), `["test.*.b -> test_b"]`) {
+		t.Fatalf("Unexpected Mermaid dump: %s", dump.String())
+	}
+
+	if err := mapper.DumpFSM(&dump, "svg"); err == nil {
+		t.Fatalf("Expected an unsupported format to fail")
+	}
+}
+
+func TestRelayRules(t *testing.T) {
+	mapper := MetricMapper{}
+	if rule, ok := mapper.RelayRule("anything"); rule != nil || !ok {
+		t.Fatalf("Expected all lines to be relayed without rules")
+	}
+
+	config := `---
+relay_rules:
+- match: legacy.*.*
+  sample_rate: 0.1
+- match: ^billing\..*
+  match_type: regex
+`
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	for name, expected := range map[string]float64{
+		"legacy.app.requests": 0.1,
+		"billing.a.b.c":       1,
+		"legacy.app":          0,
+		"legacy.app.a.b":      0,
+		"other.app.requests":  0,
+	} {
+		rule, ok := mapper.RelayRule(name)
+		if expected == 0 {
+			if ok {
+				t.Errorf("%s: expected not to be relayed", name)
+			}
+			continue
+		}
+		if !ok || rule.SampleRate != expected {
+			t.Errorf("%s: expected a sample rate of %v, got %v", name, expected, rule)
+		}
+	}
+
+	if err := mapper.InitFromYAMLString("relay_rules:\n- match: a.*\n  sample_rate: 2\n", 0); err == nil {
+		t.Fatalf("Expected a sample rate above 1 to fail")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	config := `---
+mappings:
+- match: cpu.load.*
+  name: load
+templates:
+- measurement.measurement.field.region
+- cpu.* measurement.field host=shared
+- mem.*.* measurement.host.field*
+- "*.app.* ..measurement* env=prod"
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	for name, expected := range map[string]struct {
+		name   string
+		labels prometheus.Labels
+	}{
+		"cpu.load.total":         {"load", prometheus.Labels{}},
+		"cpu.idle":               {"cpu_idle", prometheus.Labels{"host": "shared"}},
+		"net.in.bytes.eu":        {"net_in_bytes", prometheus.Labels{"region": "eu"}},
+		"mem.web1.free":          {"mem_free", prometheus.Labels{"host": "web1"}},
+		"mem.web1.heap.free.max": {"mem_heap_free_max", prometheus.Labels{"host": "web1"}},
+		"a.app.requests.get":     {"requests_get", prometheus.Labels{"env": "prod"}},
+	} {
+		m, labels, ok := mapper.GetMapping(name, MetricTypeCounter)
+		if !ok {
+			t.Errorf("%s: expected a mapping", name)
+			continue
+		}
+		if m.Name != expected.name || !reflect.DeepEqual(labels, expected.labels) {
+			t.Errorf("%s: expected %s%v, got %s%v", name, expected.name, expected.labels, m.Name, labels)
+		}
+	}
+	if _, _, ok := mapper.GetMapping("net.in.bytes", MetricTypeCounter); ok {
+		t.Errorf("expected names shorter than the template not to match")
+	}
+
+	for _, invalid := range []string{
+		"templates: [host.field]",
+		"templates: [measurement*.host]",
+		"templates: [measurement.in-valid]",
+		"templates: [a.b measurement x=1 y]",
+		"templates: [measurement.field]\ntemplate_separator: .",
+	} {
+		if err := mapper.InitFromYAMLString(invalid, 0); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	mapper := MetricMapper{Logger: log.NewLogfmtLogger(&buf)}
+	config := `---
+mappings:
+- match: test.*.a
+  name: "test_total"
+  help: "First help."
+- match: test.*.b
+  name: "test_total"
+  help: "Second help."
+`
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("config load error: %s", err)
+	}
+	if !strings.Contains(buf.String(), `match=test.*.b metric=test_total`) {
+		t.Errorf("expected a warning about the help text of test.*.b, got %q", buf.String())
+	}
+}
+
+func TestBound(t *testing.T) {
+	min, max := 0.0, 100.0
+	scenarios := []struct {
+		mapping MetricMapping
+		value   float64
+		want    float64
+		ok      bool
+	}{
+		{mapping: MetricMapping{}, value: -5, want: -5, ok: true},
+		{mapping: MetricMapping{Min: &min, Max: &max}, value: 50, want: 50, ok: true},
+		{mapping: MetricMapping{Min: &min, Max: &max}, value: 100, want: 100, ok: true},
+		{mapping: MetricMapping{Min: &min, Max: &max}, value: -1, want: -1, ok: false},
+		{mapping: MetricMapping{Min: &min, Max: &max}, value: 1e9, want: 1e9, ok: false},
+		{mapping: MetricMapping{Max: &max}, value: -1e9, want: -1e9, ok: true},
+		{mapping: MetricMapping{Min: &min, Max: &max, OutOfBounds: BoundsActionClamp}, value: -1, want: 0, ok: true},
+		{mapping: MetricMapping{Min: &min, Max: &max, OutOfBounds: BoundsActionClamp}, value: 1e9, want: 100, ok: true},
+		{mapping: MetricMapping{Min: &min, OutOfBounds: BoundsActionClamp}, value: math.NaN(), ok: false},
+	}
+
+	for i, s := range scenarios {
+		got, ok := s.mapping.Bound(s.value)
+		if ok != s.ok || (ok && got != s.want) {
+			t.Errorf("%d: expected %v to be bounded to %v, %t, got %v, %t", i, s.value, s.want, s.ok, got, ok)
+		}
+	}
+}
+
+func TestActiveConfig(t *testing.T) {
+	config := `
+defaults:
+  ttl: 1m
+mappings:
+- match: test.*
+  name: test_total
+  labels:
+    name: $1
+- match: other.*
+  name: other_total
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range []string{"test.a", "test.b", "other.a", "unmatched"} {
+		mapper.GetMapping(metric, MetricTypeCounter)
+	}
+
+	active, err := mapper.ActiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Defaults struct {
+			TTL string `json:"ttl"`
+		} `json:"defaults"`
+		Mappings []struct {
+			Match string `json:"match"`
+			TTL   string `json:"ttl"`
+			Hits  uint64 `json:"hits"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Defaults.TTL != "1m0s" || len(decoded.Mappings) != 2 {
+		t.Fatalf("unexpected active config %s", b)
+	}
+	for i, want := range []struct {
+		match string
+		hits  uint64
+	}{{"test.*", 2}, {"other.*", 1}} {
+		m := decoded.Mappings[i]
+		if m.Match != want.match || m.Hits != want.hits || m.TTL != "1m0s" {
+			t.Errorf("expected mapping %s with %d hits and the default TTL, got %+v", want.match, want.hits, m)
+		}
+	}
+
+	// Unchanged mappings keep their hits across reloads.
+	if err := mapper.InitFromYAMLString(strings.Replace(config, "other_total", "renamed_total", 1), 0); err != nil {
+		t.Fatal(err)
+	}
+	active, err = mapper.ActiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings := active["mappings"].([]interface{})
+	if hits := mappings[0].(map[string]interface{})["hits"]; hits != uint64(2) {
+		t.Errorf("expected test.* to keep its 2 hits, got %v", hits)
+	}
+	if hits := mappings[1].(map[string]interface{})["hits"]; hits != uint64(0) {
+		t.Errorf("expected the changed other.* to have no hits, got %v", hits)
+	}
+}
@@ -22,25 +22,66 @@ import (
 	"github.com/prometheus/statsd_exporter/pkg/mapper/fsm"
 )
 
+// MetricMapping is one mapping of a mapping config. It translates the StatsD
+// metrics it matches into a Prometheus metric name and labels.
 type MetricMapping struct {
-	Match            string `yaml:"match"`
-	Name             string `yaml:"name"`
-	nameFormatter    *fsm.TemplateFormatter
-	regex            *regexp.Regexp
-	Labels           prometheus.Labels `yaml:"labels"`
-	labelKeys        []string
-	labelFormatters  []*fsm.TemplateFormatter
+	Match          string `yaml:"match"`
+	Name           string `yaml:"name"`
+	nameFormatter  *fsm.TemplateFormatter
+	regex          *regexp.Regexp
+	Labels         prometheus.Labels `yaml:"labels"`
+	labelKeys      []string
+	labelTemplates map[string]*labelTemplate
+	// key identifies the mapping in its config, see mappingKey, and origin
+	// the series it creates, see mappingOrigin.
+	key, origin      string
 	ObserverType     ObserverType      `yaml:"observer_type"`
 	TimerType        ObserverType      `yaml:"timer_type,omitempty"` // DEPRECATED - field only present to preserve backwards compatibility in configs. Always empty
 	LegacyBuckets    []float64         `yaml:"buckets"`
-	LegacyQuantiles  []metricObjective `yaml:"quantiles"`
+	LegacyQuantiles  []MetricObjective `yaml:"quantiles"`
 	MatchType        MatchType         `yaml:"match_type"`
 	HelpText         string            `yaml:"help"`
 	Action           ActionType        `yaml:"action"`
 	MatchMetricType  MetricType        `yaml:"match_metric_type"`
 	Ttl              time.Duration     `yaml:"ttl"`
+	TtlJitter        float64           `yaml:"ttl_jitter"`
+	OnExpiry         ExpiryAction      `yaml:"on_expiry"`
 	SummaryOptions   *SummaryOptions   `yaml:"summary_options"`
 	HistogramOptions *HistogramOptions `yaml:"histogram_options"`
+	Scale            float64           `yaml:"scale"`
+	Offset           float64           `yaml:"offset"`
+	// NoUnitConversion records the values of StatsD timers as received
+	// instead of converting them from milliseconds to seconds.
+	NoUnitConversion bool              `yaml:"no_unit_conversion"`
+	Group            string            `yaml:"group"`
+	Priority         int               `yaml:"priority"`
+	DropLabelValues  map[string]string `yaml:"drop_label_values"`
+	dropLabelRegexes map[string]*regexp.Regexp
+	MaxSeries        int `yaml:"max_series"`
+	// EnumStates turns gauges into one series per state with a state label.
+	// The gauge value is the index of the current state, whose series is 1.
+	EnumStates []string `yaml:"enum_states"`
+	// Targets are additional metrics the matched events are recorded in. In
+	// mappings returned by GetMapping, their names and labels are expanded.
+	Targets []*MetricMapping `yaml:"targets"`
+	// Type, only valid on targets, records events of any type as a counter of
+	// events if set to counter.
+	Type MetricType `yaml:"type"`
+	// Min and Max, if set, bound the values of the matched events as
+	// received. Events with values out of the bounds are dropped, or
+	// recorded with the closest bound if OutOfBounds is clamp.
+	Min         *float64     `yaml:"min"`
+	Max         *float64     `yaml:"max"`
+	OutOfBounds BoundsAction `yaml:"out_of_bounds"`
+	// EmitRate exports the per-second rate of counters over the last rate
+	// window as an additional gauge, named after the counter with "_rate".
+	EmitRate bool `yaml:"emit_rate"`
+	// AggregateLabels are removed from the labels of the matched events, so
+	// that the events of all their values are recorded in the same series.
+	AggregateLabels []string `yaml:"aggregate_labels"`
+	// Transform, if set, rewrites the values and labels of the matched
+	// events with expressions.
+	Transform *Transform `yaml:"transform"`
 }
 
 // UnmarshalYAML is a custom unmarshal function to allow use of deprecated config keys
@@ -64,8 +105,26 @@ func (m *MetricMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	m.Action = tmp.Action
 	m.MatchMetricType = tmp.MatchMetricType
 	m.Ttl = tmp.Ttl
+	m.TtlJitter = tmp.TtlJitter
+	m.OnExpiry = tmp.OnExpiry
 	m.SummaryOptions = tmp.SummaryOptions
 	m.HistogramOptions = tmp.HistogramOptions
+	m.Scale = tmp.Scale
+	m.Offset = tmp.Offset
+	m.NoUnitConversion = tmp.NoUnitConversion
+	m.DropLabelValues = tmp.DropLabelValues
+	m.Group = tmp.Group
+	m.Priority = tmp.Priority
+	m.Targets = tmp.Targets
+	m.Type = tmp.Type
+	m.MaxSeries = tmp.MaxSeries
+	m.EnumStates = tmp.EnumStates
+	m.Min = tmp.Min
+	m.Max = tmp.Max
+	m.OutOfBounds = tmp.OutOfBounds
+	m.EmitRate = tmp.EmitRate
+	m.AggregateLabels = tmp.AggregateLabels
+	m.Transform = tmp.Transform
 
 	// Use deprecated TimerType if necessary
 	if tmp.ObserverType == "" {
@@ -74,3 +133,70 @@ func (m *MetricMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 	return nil
 }
+
+// expandGlob returns the metric name and labels of the mapping for the
+// captures of a glob match.
+func (m *MetricMapping) expandGlob(captures []string) (string, prometheus.Labels) {
+	labels := prometheus.Labels{}
+	for _, label := range m.labelKeys {
+		labels[label] = m.labelTemplates[label].expandGlob(captures)
+	}
+	return m.nameFormatter.Format(captures), labels
+}
+
+// expandRegex returns the metric name and labels of the mapping for the
+// submatches of a regex match.
+func (m *MetricMapping) expandRegex(regex *regexp.Regexp, statsdMetric string, matches []int) (string, prometheus.Labels) {
+	labels := prometheus.Labels{}
+	for label, template := range m.labelTemplates {
+		labels[label] = template.expandRegex(regex, statsdMetric, matches)
+	}
+	return string(regex.ExpandString([]byte{}, m.Name, statsdMetric, matches)), labels
+}
+
+// ScaleValue applies the scale and offset of the mapping to an absolute
+// value. An unset scale leaves the value unchanged.
+func (m *MetricMapping) ScaleValue(value float64) float64 {
+	return m.ScaleDelta(value) + m.Offset
+}
+
+// ScaleDelta applies only the scale of the mapping, for values that are
+// relative changes such as counter increments. Adding the offset to every
+// increment would skew the result.
+func (m *MetricMapping) ScaleDelta(value float64) float64 {
+	if m.Scale == 0 {
+		return value
+	}
+	return value * m.Scale
+}
+
+// EnumState returns the state of an enum mapping that a gauge value selects,
+// and false if the value is not the index of a state.
+func (m *MetricMapping) EnumState(value float64) (string, bool) {
+	i := int(value)
+	if float64(i) != value || i < 0 || i >= len(m.EnumStates) {
+		return "", false
+	}
+	return m.EnumStates[i], true
+}
+
+// AggregateAway removes the labels the mapping aggregates over.
+func (m *MetricMapping) AggregateAway(labels prometheus.Labels) {
+	if m == nil {
+		return
+	}
+	for _, label := range m.AggregateLabels {
+		delete(labels, label)
+	}
+}
+
+// DropsLabels reports whether any of the labels has a value matching the
+// drop_label_values patterns of the mapping.
+func (m *MetricMapping) DropsLabels(labels prometheus.Labels) bool {
+	for label, re := range m.dropLabelRegexes {
+		if value, ok := labels[label]; ok && re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -15,6 +15,8 @@ package mapper
 
 import "fmt"
 
+// MatchType selects how the match of a mapping is interpreted, as a glob
+// pattern or as a regular expression.
 type MatchType string
 
 const (
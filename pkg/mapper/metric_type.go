@@ -15,6 +15,8 @@ package mapper
 
 import "fmt"
 
+// MetricType is the type of a StatsD event, used to restrict mappings to
+// events of one type.
 type MetricType string
 
 const (
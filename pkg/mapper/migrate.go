@@ -0,0 +1,228 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// CurrentConfigVersion is the latest mapping configuration schema version.
+// Configurations without a version are treated as version 0.
+const CurrentConfigVersion = 1
+
+// configMigrations[i] upgrades a configuration from version i to i+1.
+var configMigrations = []func(yaml.MapSlice) (yaml.MapSlice, error){
+	migrateConfigV0,
+}
+
+// legacyConfigKeys maps attributes that are no longer accepted from version 1
+// on to the section and key replacing them. An empty section means the key is
+// renamed in place.
+var legacyConfigKeys = []struct {
+	key, section, newKey string
+}{
+	{key: "timer_type", newKey: "observer_type"},
+	{key: "buckets", section: "histogram_options", newKey: "buckets"},
+	{key: "quantiles", section: "summary_options", newKey: "quantiles"},
+}
+
+// MigrateConfig upgrades a mapping configuration to CurrentConfigVersion.
+// Unknown attributes and the order of attributes are preserved, comments are
+// not.
+func MigrateConfig(in []byte) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(in, &doc); err != nil {
+		return nil, err
+	}
+
+	version, err := configVersion(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; version < CurrentConfigVersion; version++ {
+		if doc, err = configMigrations[version](doc); err != nil {
+			return nil, fmt.Errorf("migrating from version %d: %v", version, err)
+		}
+	}
+	doc = append(yaml.MapSlice{{Key: "version", Value: CurrentConfigVersion}}, mapSliceDelete(doc, "version")...)
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the result is something we can actually load.
+	var m MetricMapper
+	if err := m.InitFromYAMLString(string(out), 0); err != nil {
+		return nil, fmt.Errorf("migrated configuration is invalid: %v", err)
+	}
+	return out, nil
+}
+
+// migrateConfigV0 moves deprecated attributes to the places that replaced
+// them. Empty defaults and mappings are treated as an empty map and list, as
+// when loading the configuration.
+func migrateConfigV0(doc yaml.MapSlice) (yaml.MapSlice, error) {
+	if v, ok := mapSliceGet(doc, "defaults"); ok {
+		if v == nil {
+			v = yaml.MapSlice{}
+		}
+		defaults, ok := v.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("defaults must be a map")
+		}
+		defaults, err := moveLegacyKeys(defaults, true)
+		if err != nil {
+			return nil, fmt.Errorf("defaults: %v", err)
+		}
+		doc = mapSliceSet(doc, "defaults", defaults)
+	}
+
+	if v, ok := mapSliceGet(doc, "mappings"); ok {
+		if v == nil {
+			v = []interface{}{}
+		}
+		mappings, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("mappings must be a list")
+		}
+		for i, m := range mappings {
+			mapping, ok := m.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("mapping %d must be a map", i)
+			}
+			mapping, err := moveLegacyKeys(mapping, false)
+			if err != nil {
+				return nil, fmt.Errorf("mapping %d: %v", i, err)
+			}
+			mappings[i] = mapping
+		}
+		doc = mapSliceSet(doc, "mappings", mappings)
+	}
+
+	return doc, nil
+}
+
+// moveLegacyKeys replaces the legacy attributes in a defaults or mapping
+// section. In the defaults, the new attributes have always taken precedence,
+// while in mappings setting both is an error.
+func moveLegacyKeys(section yaml.MapSlice, newKeyWins bool) (yaml.MapSlice, error) {
+	for _, l := range legacyConfigKeys {
+		value, ok := mapSliceGet(section, l.key)
+		if !ok {
+			continue
+		}
+		section = mapSliceDelete(section, l.key)
+
+		target := section
+		if l.section != "" {
+			sub, _ := mapSliceGet(section, l.section)
+			if sub == nil {
+				sub = yaml.MapSlice{}
+			}
+			if target, ok = sub.(yaml.MapSlice); !ok {
+				return nil, fmt.Errorf("%s must be a map", l.section)
+			}
+		}
+
+		if _, exists := mapSliceGet(target, l.newKey); exists {
+			if newKeyWins || l.section == "" {
+				continue
+			}
+			return nil, fmt.Errorf("both %s and %s.%s are set", l.key, l.section, l.newKey)
+		}
+		target = mapSliceSet(target, l.newKey, value)
+
+		if l.section != "" {
+			section = mapSliceSet(section, l.section, target)
+		} else {
+			section = target
+		}
+	}
+	return section, nil
+}
+
+// legacyKeysInConfig lists the deprecated attributes used in a configuration.
+func legacyKeysInConfig(doc yaml.MapSlice) []string {
+	var found []string
+	check := func(where string, v interface{}) {
+		section, ok := v.(yaml.MapSlice)
+		if !ok {
+			return
+		}
+		for _, l := range legacyConfigKeys {
+			if _, ok := mapSliceGet(section, l.key); ok {
+				found = append(found, where+l.key)
+			}
+		}
+	}
+
+	if v, ok := mapSliceGet(doc, "defaults"); ok {
+		check("defaults.", v)
+	}
+	if v, ok := mapSliceGet(doc, "mappings"); ok {
+		mappings, _ := v.([]interface{})
+		for i, m := range mappings {
+			check(fmt.Sprintf("mappings[%d].", i), m)
+		}
+	}
+	return found
+}
+
+func configVersion(doc yaml.MapSlice) (int, error) {
+	v, ok := mapSliceGet(doc, "version")
+	if !ok || v == nil {
+		return 0, nil
+	}
+	version, ok := v.(int)
+	if !ok || version < 0 {
+		return 0, fmt.Errorf("invalid config version %v", v)
+	}
+	if version > CurrentConfigVersion {
+		return 0, fmt.Errorf("config version %d is newer than the supported version %d", version, CurrentConfigVersion)
+	}
+	return version, nil
+}
+
+func mapSliceGet(m yaml.MapSlice, key string) (interface{}, bool) {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+func mapSliceSet(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
+
+func mapSliceDelete(m yaml.MapSlice, key string) yaml.MapSlice {
+	out := make(yaml.MapSlice, 0, len(m))
+	for _, item := range m {
+		if item.Key != key {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	scenarios := []struct {
+		testName string
+		config   string
+		expected string
+		bad      bool
+	}{
+		{
+			testName: "implicit version with deprecated attributes",
+			config: `defaults:
+  timer_type: histogram
+  buckets: [1, 2]
+mappings:
+- match: test.*
+  name: test
+  timer_type: summary
+  quantiles:
+  - quantile: 0.5
+    error: 0.05
+`,
+			expected: `version: 1
+defaults:
+  observer_type: histogram
+  histogram_options:
+    buckets:
+    - 1
+    - 2
+mappings:
+- match: test.*
+  name: test
+  observer_type: summary
+  summary_options:
+    quantiles:
+    - quantile: 0.5
+      error: 0.05
+`,
+		},
+		{
+			testName: "observer_type overrides timer_type",
+			config: `mappings:
+- match: test.*
+  name: test
+  observer_type: histogram
+  timer_type: summary
+`,
+			expected: `version: 1
+mappings:
+- match: test.*
+  name: test
+  observer_type: histogram
+`,
+		},
+		{
+			testName: "already current",
+			config: `version: 1
+mappings:
+- match: test.*
+  name: test
+`,
+			expected: `version: 1
+mappings:
+- match: test.*
+  name: test
+`,
+		},
+		{
+			testName: "conflicting buckets",
+			config: `mappings:
+- match: test.*
+  name: test
+  observer_type: histogram
+  buckets: [1]
+  histogram_options:
+    buckets: [2]
+`,
+			bad: true,
+		},
+		{
+			testName: "future version",
+			config:   `version: 99`,
+			bad:      true,
+		},
+		{
+			testName: "empty mappings",
+			config: `mappings:
+`,
+			expected: `version: 1
+mappings: []
+`,
+		},
+		{
+			testName: "empty defaults and mappings",
+			config: `defaults:
+mappings: null
+`,
+			expected: `version: 1
+defaults: {}
+mappings: []
+`,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.testName, func(t *testing.T) {
+			out, err := MigrateConfig([]byte(scenario.config))
+			if err != nil && !scenario.bad {
+				t.Fatalf("Migration failed: %v", err)
+			}
+			if err == nil && scenario.bad {
+				t.Fatalf("Expected migration to fail, got:\n%s", out)
+			}
+			if !scenario.bad && string(out) != scenario.expected {
+				t.Fatalf("Expected:\n%s\ngot:\n%s", scenario.expected, out)
+			}
+		})
+	}
+}
+
+func TestConfigVersion(t *testing.T) {
+	scenarios := []struct {
+		testName  string
+		config    string
+		configBad bool
+	}{
+		{
+			testName: "deprecated attributes without version",
+			config: `mappings:
+- match: test.*
+  name: test
+  timer_type: histogram
+`,
+		},
+		{
+			testName: "deprecated attributes in version 1",
+			config: `version: 1
+mappings:
+- match: test.*
+  name: test
+  timer_type: histogram
+`,
+			configBad: true,
+		},
+		{
+			testName: "deprecated defaults in version 1",
+			config: `version: 1
+defaults:
+  quantiles:
+  - quantile: 0.5
+    error: 0.05
+`,
+			configBad: true,
+		},
+		{
+			testName:  "unsupported version",
+			config:    `version: 2`,
+			configBad: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.testName, func(t *testing.T) {
+			mapper := MetricMapper{}
+			err := mapper.InitFromYAMLString(scenario.config, 0)
+			if err != nil && !scenario.configBad {
+				t.Fatalf("Config load error: %s %s", scenario.config, err)
+			}
+			if err == nil && scenario.configBad {
+				t.Fatalf("Expected bad config, but loaded ok: %s", scenario.config)
+			}
+		})
+	}
+}
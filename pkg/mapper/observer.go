@@ -15,6 +15,8 @@ package mapper
 
 import "fmt"
 
+// ObserverType selects whether timer and distribution events are recorded in
+// histograms or summaries.
 type ObserverType string
 
 const (
@@ -0,0 +1,76 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// mappingOrigin identifies the series a mapping or target creates across
+// reloads, by its match, unexpanded name and label names. Changes to the
+// mapping in other respects, such as its help text or TTL, keep its origin.
+func mappingOrigin(matchType MatchType, match string, mapping *MetricMapping) string {
+	labels := make([]string, 0, len(mapping.Labels))
+	for label := range mapping.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return strings.Join(append([]string{string(matchType), match, mapping.Name}, labels...), "\x00")
+}
+
+// Origin identifies the mapping the metrics of a matched event come from, see
+// MetricMapper.HasOrigin. It is empty for mappings that are not part of a
+// mapping config.
+func (m *MetricMapping) Origin() string {
+	return m.origin
+}
+
+// HasOrigin reports whether a mapping of the current config creates the
+// series of the given origin. The empty origin is always current.
+func (m *MetricMapper) HasOrigin(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.origins[origin] != nil
+}
+
+// MappingForOrigin returns the mapping or target of the current config that
+// creates the series of the given origin, or nil if there is none.
+func (m *MetricMapper) MappingForOrigin(origin string) *MetricMapping {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.origins[origin]
+}
+
+// EmitsRates reports whether a mapping or target of the current config has
+// emit_rate set.
+func (m *MetricMapper) EmitsRates() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, mapping := range m.origins {
+		if mapping.EmitRate {
+			return true
+		}
+	}
+	return false
+}
+
+// Generation changes whenever a config is loaded or the cache is reset.
+func (m *MetricMapper) Generation() uint64 {
+	return atomic.LoadUint64(&m.generation)
+}
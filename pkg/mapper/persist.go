@@ -0,0 +1,77 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MetricMapperCacheWalker is implemented by caches that can list their
+// results, which allows saving the cached metrics.
+type MetricMapperCacheWalker interface {
+	Walk(f func(metricString string, metricType MetricType, result *MetricMapperCacheResult))
+}
+
+// SaveCache writes the StatsD metric names and types in the cache to w, one
+// per line, so that WarmCache can look them up again after a restart. Only
+// the names are saved, since the results depend on the config.
+func (m *MetricMapper) SaveCache(w io.Writer) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	walker, ok := m.cache.(MetricMapperCacheWalker)
+	if !ok {
+		return 0, nil
+	}
+	bw := bufio.NewWriter(w)
+	count := 0
+	walker.Walk(func(metricString string, metricType MetricType, result *MetricMapperCacheResult) {
+		bw.WriteString(formatKey(metricString, metricType))
+		bw.WriteByte('\n')
+		count++
+	})
+	return count, bw.Flush()
+}
+
+// WarmCache looks up the metrics saved by SaveCache, filling the cache
+// without counting them as lookups. Lines that are not valid are skipped.
+func (m *MetricMapper) WarmCache(r io.Reader) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		metricString, metricType, err := parseSavedKey(scanner.Text())
+		if err != nil {
+			continue
+		}
+		m.lookup(metricString, metricType)
+		count++
+	}
+	return count, scanner.Err()
+}
+
+func parseSavedKey(key string) (string, MetricType, error) {
+	for _, metricType := range []MetricType{MetricTypeCounter, MetricTypeGauge, MetricTypeObserver} {
+		prefix := string(metricType) + "."
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return strings.TrimPrefix(key, prefix), metricType, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid cache key %q", key)
+}
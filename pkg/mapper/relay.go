@@ -0,0 +1,77 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RelayRule selects the StatsD lines that are relayed, and the fraction of
+// them that is. Its match is a glob, in which * matches one component of the
+// metric name like in mappings, or a regular expression.
+type RelayRule struct {
+	Match     string    `yaml:"match"`
+	MatchType MatchType `yaml:"match_type"`
+	// SampleRate is the fraction of matching lines that are relayed. 0
+	// relays all of them.
+	SampleRate float64 `yaml:"sample_rate"`
+	regex      *regexp.Regexp
+}
+
+// init validates the rule and compiles its match.
+func (r *RelayRule) init(defaultMatchType MatchType) error {
+	if r.SampleRate < 0 || r.SampleRate > 1 {
+		return fmt.Errorf("relay rule %s: sample_rate must be between 0 and 1", r.Match)
+	}
+	if r.SampleRate == 0 {
+		r.SampleRate = 1
+	}
+	if r.MatchType == MatchTypeDefault {
+		r.MatchType = defaultMatchType
+	}
+
+	pattern := r.Match
+	if r.MatchType == MatchTypeGlob {
+		parts := strings.Split(r.Match, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		pattern = "^" + strings.Join(parts, "[^.]*") + "$"
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid regex %s in relay rule: %v", r.Match, err)
+	}
+	r.regex = regex
+	return nil
+}
+
+// RelayRule returns the first relay rule that matches the metric name, and
+// whether lines of the metric are relayed at all: without relay rules, all
+// lines are relayed without a rule.
+func (m *MetricMapper) RelayRule(metricName string) (*RelayRule, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if len(m.RelayRules) == 0 {
+		return nil, true
+	}
+	for i := range m.RelayRules {
+		if rule := &m.RelayRules[i]; rule.regex.MatchString(metricName) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxTemplateComponents is the number of components up to which templates
+// ending in a greedy measurement* or field* part match metric names.
+const maxTemplateComponents = 16
+
+// templateSeparatorRE matches the separators that keep joined metric names
+// valid.
+var templateSeparatorRE = regexp.MustCompile(`^[a-zA-Z0-9_]*$`)
+
+// template is a parsed Telegraf-style name template, "[filter] template
+// [tag=value,...]".
+type template struct {
+	source string
+	filter []string
+	parts  []string
+	greedy bool
+	tags   map[string]string
+}
+
+// parseTemplate parses a name template, as accepted by the graphite and
+// statsd inputs of Telegraf.
+func parseTemplate(s string) (*template, error) {
+	fields := strings.Fields(s)
+	t := &template{source: s, tags: map[string]string{}}
+	var tags string
+	switch {
+	case len(fields) == 1:
+		t.parts = strings.Split(fields[0], ".")
+	case len(fields) == 2 && strings.Contains(fields[1], "="):
+		t.parts, tags = strings.Split(fields[0], "."), fields[1]
+	case len(fields) == 2:
+		t.filter, t.parts = strings.Split(fields[0], "."), strings.Split(fields[1], ".")
+	case len(fields) == 3:
+		t.filter, t.parts, tags = strings.Split(fields[0], "."), strings.Split(fields[1], "."), fields[2]
+	default:
+		return nil, fmt.Errorf("template %q is not of the form [filter] template [tags]", s)
+	}
+
+	measurement := false
+	for i, part := range t.parts {
+		switch {
+		case part == "measurement*" || part == "field*":
+			if i != len(t.parts)-1 {
+				return nil, fmt.Errorf("template %q: %s must be the last part", s, part)
+			}
+			t.parts[i], t.greedy = strings.TrimSuffix(part, "*"), true
+		case part == "" || part == "measurement" || part == "field":
+		case !labelNameRE.MatchString(part):
+			return nil, fmt.Errorf("template %q: invalid tag %q", s, part)
+		}
+		measurement = measurement || t.parts[i] == "measurement"
+	}
+	if !measurement {
+		return nil, fmt.Errorf("template %q has no measurement part", s)
+	}
+
+	if tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || !labelNameRE.MatchString(kv[0]) {
+				return nil, fmt.Errorf("template %q: invalid tag %q", s, tag)
+			}
+			t.tags[kv[0]] = kv[1]
+		}
+	}
+	return t, nil
+}
+
+// literals counts the parts of the filter that are not wildcards. Templates
+// with more specific filters are tried first, like in Telegraf.
+func (t *template) literals() int {
+	n := 0
+	for _, part := range t.filter {
+		if part != "*" {
+			n++
+		}
+	}
+	return n
+}
+
+// mappings compiles the template into a glob mapping for each number of
+// components of the metric names it applies to. Templates apply to names with
+// at least as many components as their filter. Names with more components
+// than the template only match greedy templates.
+func (t *template) mappings(separator string) []MetricMapping {
+	min, max := len(t.parts), len(t.parts)
+	if len(t.filter) > min {
+		min, max = len(t.filter), len(t.filter)
+	}
+	if t.greedy {
+		max = maxTemplateComponents
+	}
+	// Single components are not valid globs, and are exported as is anyway.
+	if min < 2 {
+		min = 2
+	}
+
+	var mappings []MetricMapping
+	for n := min; n <= max; n++ {
+		match := make([]string, n)
+		values := make([]string, n)
+		captures := 0
+		for i := range match {
+			if i < len(t.filter) && t.filter[i] != "*" {
+				match[i], values[i] = t.filter[i], t.filter[i]
+				continue
+			}
+			captures++
+			match[i], values[i] = "*", "${"+strconv.Itoa(captures)+"}"
+		}
+
+		joined := map[string][]string{}
+		var order []string
+		for i, value := range values {
+			part := ""
+			switch {
+			case i < len(t.parts):
+				part = t.parts[i]
+			case t.greedy:
+				part = t.parts[len(t.parts)-1]
+			}
+			if part == "" {
+				continue
+			}
+			if _, ok := joined[part]; !ok {
+				order = append(order, part)
+			}
+			joined[part] = append(joined[part], value)
+		}
+
+		mapping := MetricMapping{
+			Match:     strings.Join(match, "."),
+			MatchType: MatchTypeGlob,
+			Name:      strings.Join(joined["measurement"], separator),
+			Labels:    map[string]string{},
+		}
+		if fields := joined["field"]; len(fields) > 0 {
+			mapping.Name += separator + strings.Join(fields, separator)
+		}
+		for _, part := range order {
+			if part != "measurement" && part != "field" {
+				mapping.Labels[part] = strings.Join(joined[part], separator)
+			}
+		}
+		for k, v := range t.tags {
+			mapping.Labels[k] = v
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// compileTemplates compiles name templates into mappings, most specific
+// filter first.
+func compileTemplates(templates []string, separator string) ([]MetricMapping, error) {
+	if !templateSeparatorRE.MatchString(separator) {
+		return nil, fmt.Errorf("template_separator %q would make invalid metric names", separator)
+	}
+	parsed := make([]*template, 0, len(templates))
+	for _, s := range templates {
+		t, err := parseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, t)
+	}
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return parsed[i].literals() > parsed[j].literals()
+	})
+
+	var mappings []MetricMapping
+	for _, t := range parsed {
+		for _, mapping := range t.mappings(separator) {
+			if !metricLineRE.MatchString(mapping.Match) {
+				return nil, fmt.Errorf("template %q: invalid filter", t.source)
+			}
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+// TemporaryMapping is a mapping that is only used until it expires.
+type TemporaryMapping struct {
+	Config  string    `json:"config"`
+	Expires time.Time `json:"expires"`
+}
+
+// AddTemporaryMapping adds a mapping, given in YAML, that is matched before
+// the mappings of the config until it expires. This resets the mapping cache.
+func (m *MetricMapper) AddTemporaryMapping(config string, expires time.Time) error {
+	var mapping MetricMapping
+	if err := yaml.UnmarshalStrict([]byte(config), &mapping); err != nil {
+		return err
+	}
+
+	m.temporaryMutex.Lock()
+	defer m.temporaryMutex.Unlock()
+
+	temporary := &TemporaryMapping{Config: config, Expires: expires}
+	m.temporary = append(m.temporary, temporary)
+	if err := m.reload(); err != nil {
+		m.temporary = m.temporary[:len(m.temporary)-1]
+		return err
+	}
+
+	time.AfterFunc(expires.Sub(clock.Now()), func() {
+		if err := m.RemoveExpiredMappings(); err != nil {
+			level.Error(m.logger()).Log("msg", "Error removing expired temporary mappings", "error", err)
+		}
+	})
+	return nil
+}
+
+// RemoveExpiredMappings removes the temporary mappings that have expired.
+func (m *MetricMapper) RemoveExpiredMappings() error {
+	m.temporaryMutex.Lock()
+	defer m.temporaryMutex.Unlock()
+
+	now := clock.Now()
+	remaining := m.temporary[:0]
+	for _, t := range m.temporary {
+		if t.Expires.After(now) {
+			remaining = append(remaining, t)
+		}
+	}
+	if len(remaining) == len(m.temporary) {
+		return nil
+	}
+	m.temporary = remaining
+	return m.reload()
+}
+
+// TemporaryMappings returns the temporary mappings that have not expired yet.
+func (m *MetricMapper) TemporaryMappings() []TemporaryMapping {
+	m.temporaryMutex.Lock()
+	defer m.temporaryMutex.Unlock()
+
+	now := clock.Now()
+	var mappings []TemporaryMapping
+	for _, t := range m.temporary {
+		if t.Expires.After(now) {
+			mappings = append(mappings, *t)
+		}
+	}
+	return mappings
+}
+
+// reload applies the last loaded config again, together with the current
+// temporary mappings. It must be called with the temporaryMutex held.
+func (m *MetricMapper) reload() error {
+	m.mutex.RLock()
+	config, cacheSize, cacheOptions := m.config, m.cacheSize, m.cacheOptions
+	m.mutex.RUnlock()
+	return m.initFromYAMLString(config, cacheSize, cacheOptions...)
+}
+
+// temporaryMappings parses the temporary mappings that have not expired yet.
+// It must be called with the temporaryMutex held.
+func (m *MetricMapper) temporaryMappings() ([]MetricMapping, error) {
+	now := clock.Now()
+	var mappings []MetricMapping
+	for _, t := range m.temporary {
+		if !t.Expires.After(now) {
+			continue
+		}
+		var mapping MetricMapping
+		if err := yaml.Unmarshal([]byte(t.Config), &mapping); err != nil {
+			return nil, fmt.Errorf("invalid temporary mapping: %v", err)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper/expr"
+)
+
+// Transform rewrites the value and labels of the events a mapping matches
+// with expressions, for cases the other mapping options can't express. The
+// expressions see the event as mapped, before the transform.
+type Transform struct {
+	// Value, if set, computes the new value of the event.
+	Value string `yaml:"value,omitempty"`
+	// Labels compute new label values. Labels that evaluate to "" are
+	// removed.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	value  *expr.Expr
+	labels map[string]*expr.Expr
+}
+
+// initTransform compiles the expressions of the transform of a mapping.
+func initTransform(mapping *MetricMapping) error {
+	t := mapping.Transform
+	if t == nil {
+		return nil
+	}
+	if t.Value != "" {
+		e, err := expr.Compile(t.Value)
+		if err != nil {
+			return fmt.Errorf("transform of %s: %v", mapping.Match, err)
+		}
+		t.value = e
+	}
+	t.labels = make(map[string]*expr.Expr, len(t.Labels))
+	for label, source := range t.Labels {
+		if !labelNameRE.MatchString(label) {
+			return fmt.Errorf("transform of %s: invalid label key %s", mapping.Match, label)
+		}
+		e, err := expr.Compile(source)
+		if err != nil {
+			return fmt.Errorf("transform of %s: label %s: %v", mapping.Match, label, err)
+		}
+		t.labels[label] = e
+	}
+	return nil
+}
+
+// HasTransform reports whether the mapping transforms its events.
+func (m *MetricMapping) HasTransform() bool {
+	return m != nil && m.Transform != nil && (m.Transform.value != nil || len(m.Transform.labels) > 0)
+}
+
+// TransformLabels evaluates the label expressions of the transform for an
+// event and applies them to its labels.
+func (m *MetricMapping) TransformLabels(name string, metricType MetricType, value float64, labels map[string]string) error {
+	if !m.HasTransform() || len(m.Transform.labels) == 0 {
+		return nil
+	}
+	env := &expr.Env{Name: name, Type: string(metricType), Value: value, Labels: labels}
+	values := make(map[string]string, len(m.Transform.labels))
+	for label, e := range m.Transform.labels {
+		v, err := e.Eval(env)
+		if err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case string:
+			values[label] = v
+		case float64:
+			values[label] = strconv.FormatFloat(v, 'g', -1, 64)
+		default:
+			return fmt.Errorf("label %s evaluated to %v, not a string or number", label, v)
+		}
+	}
+	for label, value := range values {
+		if value == "" {
+			delete(labels, label)
+		} else {
+			labels[label] = value
+		}
+	}
+	return nil
+}
+
+// TransformValue evaluates the value expression of the transform for an event
+// with a value as received, before scaling and unit conversion.
+func (m *MetricMapping) TransformValue(name string, metricType MetricType, value float64, labels map[string]string) (float64, error) {
+	if !m.HasTransform() || m.Transform.value == nil {
+		return value, nil
+	}
+	v, err := m.Transform.value.Eval(&expr.Env{Name: name, Type: string(metricType), Value: value, Labels: labels})
+	if err != nil {
+		return 0, err
+	}
+	f, ok := v.(float64)
+	if !ok || math.IsNaN(f) {
+		return 0, fmt.Errorf("value evaluated to %v, not a number", v)
+	}
+	return f, nil
+}
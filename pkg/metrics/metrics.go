@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type MetricType int
@@ -28,6 +29,22 @@ const (
 	HistogramMetricType
 )
 
+// String returns the name of the metric type as used in the exposition
+// format.
+func (t MetricType) String() string {
+	switch t {
+	case CounterMetricType:
+		return "counter"
+	case GaugeMetricType:
+		return "gauge"
+	case SummaryMetricType:
+		return "summary"
+	case HistogramMetricType:
+		return "histogram"
+	}
+	return "unknown"
+}
+
 type NameHash uint64
 
 type ValueHash uint64
@@ -50,6 +67,33 @@ type Vector struct {
 	RefCount uint64
 }
 
+// Delete removes a metric of the vector. Its labels are read back from the
+// metric, so that they do not have to be kept for every series.
+func (v *Vector) Delete(m MetricHolder) bool {
+	labels, ok := LabelsOf(m)
+	if !ok {
+		return false
+	}
+	return v.Holder.Delete(labels)
+}
+
+// LabelsOf reads the labels of a series back from its metric.
+func LabelsOf(m MetricHolder) (prometheus.Labels, bool) {
+	metric, ok := m.(prometheus.Metric)
+	if !ok {
+		return nil, false
+	}
+	var out dto.Metric
+	if err := metric.Write(&out); err != nil {
+		return nil, false
+	}
+	labels := make(prometheus.Labels, len(out.Label))
+	for _, pair := range out.Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels, true
+}
+
 type Metric struct {
 	MetricType MetricType
 	// Vectors key is the hash of the label names
@@ -60,8 +104,35 @@ type Metric struct {
 
 type RegisteredMetric struct {
 	LastRegisteredAt time.Time
-	Labels           prometheus.Labels
 	TTL              time.Duration
 	Metric           MetricHolder
 	VecKey           NameHash
+	// Jitter, between 0 and 1, is the fraction of the TTL jitter of the
+	// mapping this series is kept for beyond its TTL.
+	Jitter float64
+	// Origin is the origin of the mapping that last updated the series, see
+	// mapper.MetricMapping.Origin.
+	Origin string
+	// MappingSeries counts the series of the mapping this series belongs to.
+	MappingSeries *MappingSeries
+	// TenantSeries counts the series of the tenant this series belongs to,
+	// if any.
+	TenantSeries *TenantSeries
+	// ZeroOnExpiry keeps expired gauges at 0 instead of deleting them.
+	ZeroOnExpiry bool
+	// Expired is set for series that were kept at 0 after expiry.
+	Expired bool
+}
+
+// MappingSeries counts the series created by one mapping, to enforce its
+// max_series.
+type MappingSeries struct {
+	Count int
+}
+
+// TenantSeries counts the series of one tenant, to enforce the series limit
+// of tenants.
+type TenantSeries struct {
+	Tenant string
+	Count  int
 }
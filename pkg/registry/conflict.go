@@ -0,0 +1,96 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+)
+
+// ConflictPolicy decides what happens when a metric name that is registered
+// with one type is used with another.
+type ConflictPolicy string
+
+const (
+	// ConflictReject drops the events of the new type.
+	ConflictReject ConflictPolicy = "reject"
+	// ConflictReplace deletes the registered metric and registers the name
+	// with the new type.
+	ConflictReplace ConflictPolicy = "replace"
+	// ConflictSuffix records the events of the new type in a metric named
+	// with the type as a suffix, such as foo_gauge.
+	ConflictSuffix ConflictPolicy = "suffix"
+)
+
+var typeSuffixes = map[metrics.MetricType]string{
+	metrics.CounterMetricType:   "_counter",
+	metrics.GaugeMetricType:     "_gauge",
+	metrics.HistogramMetricType: "_histogram",
+	metrics.SummaryMetricType:   "_summary",
+}
+
+// conflictingNames returns the names registered with another type that a
+// metric of the type would conflict with.
+func (r *Registry) conflictingNames(metricName string, metricType metrics.MetricType) []string {
+	names := []string{metricName}
+	switch metricType {
+	case metrics.HistogramMetricType:
+		names = append(names, metricName+"_sum", metricName+"_count", metricName+"_bucket")
+	case metrics.SummaryMetricType:
+		names = append(names, metricName+"_sum", metricName+"_count")
+	}
+	var conflicting []string
+	for _, name := range names {
+		if r.MetricConflicts(name, metricType) {
+			conflicting = append(conflicting, name)
+		}
+	}
+	return conflicting
+}
+
+// resolveConflict returns the name to register a new metric of the type
+// under according to the ConflictPolicy, or an error if it is rejected.
+func (r *Registry) resolveConflict(metricName string, metricType metrics.MetricType) (string, error) {
+	conflicting := r.conflictingNames(metricName, metricType)
+	if len(conflicting) == 0 {
+		return metricName, nil
+	}
+
+	switch r.ConflictPolicy {
+	case ConflictReplace:
+		for _, name := range conflicting {
+			r.RemoveMetric(name)
+		}
+		return metricName, nil
+	case ConflictSuffix:
+		suffixed := metricName + typeSuffixes[metricType]
+		if len(r.conflictingNames(suffixed, metricType)) == 0 {
+			return suffixed, nil
+		}
+	}
+	return "", fmt.Errorf("metric with name %s is already registered", metricName)
+}
+
+// RemoveMetric deletes all series of a metric. It must not run concurrently
+// with the Get methods.
+func (r *Registry) RemoveMetric(metricName string) {
+	metric, ok := r.Metrics[metricName]
+	if !ok {
+		return
+	}
+	for hash, rm := range metric.Metrics {
+		r.removeSeries(metricName, metric, hash, rm)
+	}
+}
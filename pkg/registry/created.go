@@ -0,0 +1,155 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+)
+
+const createdHelp = "Time the series was first seen, in seconds since the epoch."
+
+// createdCollector exports the time each counter and histogram series was
+// created as a <name>_created gauge, like the created timestamps of
+// OpenMetrics, which the client library cannot expose. Downstream systems use
+// it to tell a counter reset, for example after an exporter restart, from a
+// counter that stopped increasing.
+type createdCollector struct {
+	mutex  sync.RWMutex
+	series map[metrics.MetricHolder]createdSeries
+	// owners is keyed by the name of each created gauge.
+	owners map[string]*createdOwner
+	// hidden points to the hidden flag of the registry.
+	hidden *uint32
+}
+
+type createdSeries struct {
+	name   string
+	metric prometheus.Metric
+}
+
+// createdOwner is the metric a created gauge belongs to. Both foo and
+// foo_total would get foo_created, but only the first one seen does.
+type createdOwner struct {
+	metricName string
+	series     int
+}
+
+func (c *createdCollector) Describe(_ chan<- *prometheus.Desc) {}
+func (c *createdCollector) Collect(ch chan<- prometheus.Metric) {
+	if atomic.LoadUint32(c.hidden) != 0 {
+		return
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, s := range c.series {
+		ch <- s.metric
+	}
+}
+
+// createdName returns the name of the created gauge of a metric. Like in
+// OpenMetrics, the _total suffix of counters is replaced.
+func createdName(metricName string) string {
+	return strings.TrimSuffix(metricName, "_total") + "_created"
+}
+
+// trackCreated records the creation of a series, if created timestamps are
+// enabled. Series whose created gauge would clash with a metric from events,
+// or with the created gauge of another metric, are skipped.
+func (r *Registry) trackCreated(metricName string, labelNames []string, labels prometheus.Labels, mh metrics.MetricHolder) error {
+	if !r.CreatedTimestamps {
+		return nil
+	}
+	name := createdName(metricName)
+	if _, ok := r.Metrics[name]; ok {
+		return nil
+	}
+	if owner, ok := r.created.owners[name]; ok && owner.metricName != metricName {
+		return nil
+	}
+	if !r.createdRegistered {
+		if err := r.Registerer.Register(r.created); err != nil {
+			return err
+		}
+		r.createdRegistered = true
+	}
+
+	labelValues := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		labelValues[i] = labels[name]
+	}
+	desc := prometheus.NewDesc(name, createdHelp, labelNames, nil)
+	m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, float64(clock.Now().UnixNano())/1e9, labelValues...)
+	if err != nil {
+		return err
+	}
+
+	r.created.mutex.Lock()
+	defer r.created.mutex.Unlock()
+	owner, ok := r.created.owners[name]
+	if !ok {
+		owner = &createdOwner{metricName: metricName}
+		r.created.owners[name] = owner
+	}
+	if _, ok := r.created.series[mh]; !ok {
+		owner.series++
+	}
+	r.created.series[mh] = createdSeries{name: name, metric: m}
+	return nil
+}
+
+// untrackCreated forgets the creation of a removed series.
+func (r *Registry) untrackCreated(mh metrics.MetricHolder) {
+	if !r.CreatedTimestamps {
+		return
+	}
+	r.created.mutex.Lock()
+	defer r.created.mutex.Unlock()
+	s, ok := r.created.series[mh]
+	if !ok {
+		return
+	}
+	delete(r.created.series, mh)
+	owner := r.created.owners[s.name]
+	owner.series--
+	if owner.series == 0 {
+		delete(r.created.owners, s.name)
+	}
+}
+
+// dropCreated forgets the created gauge named metricName, before a metric
+// from events with the same name is created. Otherwise both would be
+// exported with different types and help texts, which fails the scrape.
+func (r *Registry) dropCreated(metricName string) {
+	if !r.CreatedTimestamps {
+		return
+	}
+	r.created.mutex.Lock()
+	defer r.created.mutex.Unlock()
+	if _, ok := r.created.owners[metricName]; !ok {
+		return
+	}
+	for mh, s := range r.created.series {
+		if s.name == metricName {
+			delete(r.created.series, mh)
+		}
+	}
+	delete(r.created.owners, metricName)
+}
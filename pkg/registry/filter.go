@@ -0,0 +1,127 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// LabelMatcher selects series by the value of one label, like a label
+// matcher in a PromQL selector. A missing label has the empty value.
+type LabelMatcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// ParseLabelMatcher parses a matcher of the form name=value, name!=value,
+// name=~regex or name!~regex. Regular expressions are anchored.
+func ParseLabelMatcher(s string) (*LabelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid label matcher %q", s)
+	}
+	m := &LabelMatcher{Name: s[:i]}
+	rest := s[i:]
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(rest, op) {
+			m.Op = op
+			m.Value = rest[len(op):]
+			break
+		}
+	}
+	switch m.Op {
+	case "":
+		return nil, fmt.Errorf("invalid label matcher %q", s)
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression in label matcher %q: %v", s, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches reports whether the labels of a series satisfy the matcher.
+func (m *LabelMatcher) Matches(labels []*dto.LabelPair) bool {
+	value := ""
+	for _, l := range labels {
+		if l.GetName() == m.Name {
+			value = l.GetValue()
+			break
+		}
+	}
+	switch m.Op {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// FilterGatherer only returns the metric families with one of the given
+// names, if any, and within them the series matching all label matchers.
+type FilterGatherer struct {
+	Gatherer prometheus.Gatherer
+	Names    []string
+	Matchers []*LabelMatcher
+}
+
+func (g FilterGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+
+	names := make(map[string]bool, len(g.Names))
+	for _, name := range g.Names {
+		names[name] = true
+	}
+
+	filtered := mfs[:0]
+	for _, mf := range mfs {
+		if len(names) > 0 && !names[mf.GetName()] {
+			continue
+		}
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			if g.matches(m.GetLabel()) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		mf.Metric = metrics
+		filtered = append(filtered, mf)
+	}
+	return filtered, err
+}
+
+func (g FilterGatherer) matches(labels []*dto.LabelPair) bool {
+	for _, m := range g.Matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
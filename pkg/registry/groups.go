@@ -0,0 +1,68 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricGroups tracks the group that mappings assigned to each metric. It is
+// safe for concurrent use, as it is read while serving scrapes.
+type MetricGroups struct {
+	mutex  sync.RWMutex
+	groups map[string]string
+}
+
+func NewMetricGroups() *MetricGroups {
+	return &MetricGroups{groups: make(map[string]string)}
+}
+
+// Set assigns a metric to a group. An empty group removes the assignment.
+func (g *MetricGroups) Set(metricName, group string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if group == "" {
+		delete(g.groups, metricName)
+		return
+	}
+	g.groups[metricName] = group
+}
+
+// Get returns the group of a metric, or the empty string if it has none.
+func (g *MetricGroups) Get(metricName string) string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.groups[metricName]
+}
+
+// GroupGatherer only returns the metric families belonging to one group.
+type GroupGatherer struct {
+	Gatherer prometheus.Gatherer
+	Groups   *MetricGroups
+	Group    string
+}
+
+func (g GroupGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	filtered := mfs[:0]
+	for _, mf := range mfs {
+		if g.Groups.Get(mf.GetName()) == g.Group {
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered, err
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// internHelp returns a shared copy of the help text. Help texts come from the
+// mapping configuration, which is parsed again on every reload, so without
+// this metrics created before and after a reload hold separate copies.
+func (r *Registry) internHelp(help string) string {
+	if shared, ok := r.helpTexts[help]; ok {
+		return shared
+	}
+	r.helpTexts[help] = help
+	return help
+}
+
+// metricHelp returns the help text of a metric. All vectors of a metric have
+// to share one help text, so once a metric is registered, its help text is
+// used for vectors with other label names too, which may come from mappings
+// with another help text.
+func (r *Registry) metricHelp(metricName, help string) string {
+	if registered, ok := r.metricHelpTexts[metricName]; ok {
+		return registered
+	}
+	help = r.internHelp(help)
+	r.metricHelpTexts[metricName] = help
+	return help
+}
+
+// OmitHelpGatherer removes the HELP text from metric families that carry the
+// given help text, typically the one of autogenerated metrics. With many
+// autogenerated metrics this saves a considerable amount of scrape bandwidth.
+type OmitHelpGatherer struct {
+	Gatherer prometheus.Gatherer
+	Help     string
+}
+
+func (g OmitHelpGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		if mf.GetHelp() == g.Help {
+			mf.Help = nil
+		}
+	}
+	return mfs, err
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+)
+
+// Series describes a series of the registry and when it expires.
+type Series struct {
+	Metric           string            `json:"metric"`
+	Type             string            `json:"type"`
+	Labels           prometheus.Labels `json:"labels"`
+	LastRegisteredAt time.Time         `json:"last_registered_at"`
+	// TTL is empty and ExpiresAt nil for series that do not expire.
+	TTL       string     `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Expired is set for gauges that were kept at 0 after they expired.
+	Expired bool `json:"expired,omitempty"`
+}
+
+// Series lists the series of a metric, or of all metrics if metricName is
+// empty, sorted by metric name and labels. It must not run concurrently with
+// the Get methods.
+func (r *Registry) Series(metricName string) []Series {
+	series := []Series{}
+	for name, metric := range r.Metrics {
+		if metricName != "" && name != metricName {
+			continue
+		}
+		for _, rm := range metric.Metrics {
+			labels, ok := metrics.LabelsOf(rm.Metric)
+			if !ok {
+				continue
+			}
+			s := Series{
+				Metric:           name,
+				Type:             metric.MetricType.String(),
+				Labels:           labels,
+				LastRegisteredAt: rm.LastRegisteredAt,
+				Expired:          rm.Expired,
+			}
+			if rm.TTL > 0 {
+				expiresAt := rm.LastRegisteredAt.Add(rm.TTL)
+				s.TTL = rm.TTL.String()
+				s.ExpiresAt = &expiresAt
+			}
+			series = append(series, s)
+		}
+	}
+
+	sort.Slice(series, func(i, j int) bool {
+		return seriesSortKey(&series[i]) < seriesSortKey(&series[j])
+	})
+	return series
+}
+
+// seriesSortKey orders series by metric name, then by their labels.
+func seriesSortKey(s *Series) string {
+	names := make([]string, 0, len(s.Labels))
+	for name := range s.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(s.Metric)
+	for _, name := range names {
+		b.WriteByte(model.SeparatorByte)
+		b.WriteString(name)
+		b.WriteByte(model.SeparatorByte)
+		b.WriteString(s.Labels[name])
+	}
+	return b.String()
+}
+
+// DeleteSeries removes the series of a metric that have all the given label
+// values, or all its series if labels is empty, and returns how many were
+// removed. It must not run concurrently with the Get methods.
+func (r *Registry) DeleteSeries(metricName string, labels prometheus.Labels) int {
+	metric, ok := r.Metrics[metricName]
+	if !ok {
+		return 0
+	}
+	deleted := 0
+	for hash, rm := range metric.Metrics {
+		if len(labels) > 0 {
+			seriesLabels, ok := metrics.LabelsOf(rm.Metric)
+			if !ok || !hasLabels(seriesLabels, labels) {
+				continue
+			}
+		}
+		r.removeSeries(metricName, metric, hash, rm)
+		deleted++
+	}
+	return deleted
+}
+
+// hasLabels reports whether the series has all the given label values. Like
+// in Prometheus, an empty value matches series without the label.
+func hasLabels(seriesLabels, labels prometheus.Labels) bool {
+	for name, value := range labels {
+		if seriesLabels[name] != value {
+			return false
+		}
+	}
+	return true
+}
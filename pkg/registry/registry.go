@@ -14,11 +14,11 @@
 package registry
 
 import (
-	"bytes"
-	"fmt"
-	"hash"
-	"hash/fnv"
+	"errors"
+	"math/rand"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -29,35 +29,99 @@ import (
 	"github.com/prometheus/statsd_exporter/pkg/metrics"
 )
 
-// uncheckedCollector wraps a Collector but its Describe method yields no Desc.
-// This allows incoming metrics to have inconsistent label sets
-type uncheckedCollector struct {
-	c prometheus.Collector
+// ErrSeriesLimit is returned when a mapping already has its max_series.
+var ErrSeriesLimit = errors.New("series limit of the mapping reached")
+
+// vectorCollector collects the vectors of a registry. Its Describe method
+// yields no Desc, which allows incoming metrics to have inconsistent label
+// sets. Such unchecked collectors cannot be unregistered, so the vectors are
+// added to and removed from this single collector instead.
+type vectorCollector struct {
+	mutex   sync.RWMutex
+	vectors map[prometheus.Collector]struct{}
+	// hidden points to the hidden flag of the registry.
+	hidden *uint32
 }
 
-func (u uncheckedCollector) Describe(_ chan<- *prometheus.Desc) {}
-func (u uncheckedCollector) Collect(c chan<- prometheus.Metric) {
-	u.c.Collect(c)
+func (c *vectorCollector) Describe(_ chan<- *prometheus.Desc) {}
+func (c *vectorCollector) Collect(ch chan<- prometheus.Metric) {
+	if atomic.LoadUint32(c.hidden) != 0 {
+		return
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for v := range c.vectors {
+		v.Collect(ch)
+	}
 }
 
+// Registry tracks the metrics created from events. It is not safe for
+// concurrent use: lookups, creation and expiry of series have to happen on a
+// single goroutine, as Exporter.Listen does. This makes expiring a series
+// atomic with respect to getting it, so an expired series is never handed out
+// again, only re-created. Only SeriesCount may be called from other goroutines.
 type Registry struct {
+	// series is the number of series currently exported. It is read from
+	// other goroutines and must stay first in the struct for 64-bit
+	// alignment of atomic operations.
+	series int64
+
 	Registerer prometheus.Registerer
 	Metrics    map[string]metrics.Metric
 	Mapper     *mapper.MetricMapper
-	// The below value and label variables are allocated in the registry struct
-	// so that we don't have to allocate them every time have to compute a label
-	// hash.
-	ValueBuf, NameBuf bytes.Buffer
-	Hasher            hash.Hash64
+	Groups     *MetricGroups
+	// ConflictPolicy applies when a metric name is used with another type
+	// than it is registered with. The default rejects the new type.
+	ConflictPolicy ConflictPolicy
+	helpTexts      map[string]string
+	// metricHelpTexts holds the help text each metric is registered with.
+	metricHelpTexts map[string]string
+	// mappingSeries is keyed by the match of the mapping.
+	mappingSeries map[string]*metrics.MappingSeries
+	// collector is registered with the Registerer on first use.
+	collector           *vectorCollector
+	collectorRegistered bool
+	// CreatedTimestamps exports the creation time of counter and histogram
+	// series as <name>_created gauges.
+	CreatedTimestamps bool
+	created           *createdCollector
+	createdRegistered bool
+	// Tenancy, if set, limits and exports the series of each tenant.
+	Tenancy *Tenancy
+	// hidden is set while the series are not exported, see SetHidden.
+	hidden uint32
 }
 
 func NewRegistry(reg prometheus.Registerer, mapper *mapper.MetricMapper) *Registry {
-	return &Registry{
+	r := &Registry{
 		Registerer: reg,
 		Metrics:    make(map[string]metrics.Metric),
 		Mapper:     mapper,
-		Hasher:     fnv.New64a(),
+		Groups:     NewMetricGroups(),
+		helpTexts:  make(map[string]string),
+
+		metricHelpTexts: make(map[string]string),
+		mappingSeries:   make(map[string]*metrics.MappingSeries),
+		collector:       &vectorCollector{vectors: make(map[prometheus.Collector]struct{})},
+		created: &createdCollector{
+			series: make(map[metrics.MetricHolder]createdSeries),
+			owners: make(map[string]*createdOwner),
+		},
+	}
+	r.collector.hidden = &r.hidden
+	r.created.hidden = &r.hidden
+	return r
+}
+
+// SetHidden stops or resumes exporting the series of the registry. Hidden
+// series are still updated. Unlike most methods, it may be called from any
+// goroutine.
+func (r *Registry) SetHidden(hidden bool) {
+	var v uint32
+	if hidden {
+		v = 1
 	}
+	atomic.StoreUint32(&r.hidden, v)
 }
 
 func (r *Registry) MetricConflicts(metricName string, metricType metrics.MetricType) bool {
@@ -78,23 +142,23 @@ func (r *Registry) MetricConflicts(metricName string, metricType metrics.MetricT
 	return true
 }
 
-func (r *Registry) StoreCounter(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *prometheus.CounterVec, c prometheus.Counter, ttl time.Duration) {
-	r.Store(metricName, hash, labels, vec, c, metrics.CounterMetricType, ttl)
+func (r *Registry) StoreCounter(metricName string, hash metrics.LabelHash, vec *prometheus.CounterVec, c prometheus.Counter, mapping *mapper.MetricMapping) {
+	r.Store(metricName, hash, vec, c, metrics.CounterMetricType, mapping)
 }
 
-func (r *Registry) StoreGauge(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *prometheus.GaugeVec, g prometheus.Gauge, ttl time.Duration) {
-	r.Store(metricName, hash, labels, vec, g, metrics.GaugeMetricType, ttl)
+func (r *Registry) StoreGauge(metricName string, hash metrics.LabelHash, vec *prometheus.GaugeVec, g prometheus.Gauge, mapping *mapper.MetricMapping) {
+	r.Store(metricName, hash, vec, g, metrics.GaugeMetricType, mapping)
 }
 
-func (r *Registry) StoreHistogram(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *prometheus.HistogramVec, o prometheus.Observer, ttl time.Duration) {
-	r.Store(metricName, hash, labels, vec, o, metrics.HistogramMetricType, ttl)
+func (r *Registry) StoreHistogram(metricName string, hash metrics.LabelHash, vec *prometheus.HistogramVec, o prometheus.Observer, mapping *mapper.MetricMapping) {
+	r.Store(metricName, hash, vec, o, metrics.HistogramMetricType, mapping)
 }
 
-func (r *Registry) StoreSummary(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *prometheus.SummaryVec, o prometheus.Observer, ttl time.Duration) {
-	r.Store(metricName, hash, labels, vec, o, metrics.SummaryMetricType, ttl)
+func (r *Registry) StoreSummary(metricName string, hash metrics.LabelHash, vec *prometheus.SummaryVec, o prometheus.Observer, mapping *mapper.MetricMapping) {
+	r.Store(metricName, hash, vec, o, metrics.SummaryMetricType, mapping)
 }
 
-func (r *Registry) Store(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vh metrics.VectorHolder, mh metrics.MetricHolder, metricType metrics.MetricType, ttl time.Duration) {
+func (r *Registry) Store(metricName string, hash metrics.LabelHash, vh metrics.VectorHolder, mh metrics.MetricHolder, metricType metrics.MetricType, mapping *mapper.MetricMapping) {
 	metric, hasMetrics := r.Metrics[metricName]
 	if !hasMetrics {
 		metric.MetricType = metricType
@@ -115,18 +179,53 @@ func (r *Registry) Store(metricName string, hash metrics.LabelHash, labels prome
 	if !ok {
 		rm = &metrics.RegisteredMetric{
 			LastRegisteredAt: now,
-			Labels:           labels,
-			TTL:              ttl,
+			Jitter:           rand.Float64(),
+			Origin:           mapping.Origin(),
+			ZeroOnExpiry:     zeroOnExpiry(mapping, metricType),
 			Metric:           mh,
 			VecKey:           hash.Names,
+			MappingSeries:    r.mappingSeriesFor(mapping),
 		}
+		rm.TTL = r.ttl(mapping, metricType, rm.Jitter)
 		metric.Metrics[hash.Values] = rm
 		v.RefCount++
+		rm.MappingSeries.Count++
+		atomic.AddInt64(&r.series, 1)
 		return
 	}
 	rm.LastRegisteredAt = now
+	rm.Expired = false
+	rm.Origin = mapping.Origin()
 	// Update ttl from mapping
-	rm.TTL = ttl
+	rm.TTL = r.ttl(mapping, metricType, rm.Jitter)
+	rm.ZeroOnExpiry = zeroOnExpiry(mapping, metricType)
+}
+
+// ttl returns the TTL of a series of the mapping, extended by the given
+// fraction of its TTL jitter, or 0 if the expiry policy of its type keeps it
+// regardless.
+func (r *Registry) ttl(mapping *mapper.MetricMapping, metricType metrics.MetricType, jitter float64) time.Duration {
+	ttl := mapping.Ttl + time.Duration(float64(mapping.Ttl)*mapping.TtlJitter/100*jitter)
+	if r.Mapper == nil {
+		return ttl
+	}
+	t := mapper.MetricTypeObserver
+	switch metricType {
+	case metrics.CounterMetricType:
+		t = mapper.MetricTypeCounter
+	case metrics.GaugeMetricType:
+		t = mapper.MetricTypeGauge
+	}
+	if !r.Mapper.Defaults.ExpiryPolicies.Expires(t) {
+		return 0
+	}
+	return ttl
+}
+
+// zeroOnExpiry reports whether series of the type are kept at 0 when they
+// expire. Only gauges can be.
+func zeroOnExpiry(mapping *mapper.MetricMapping, metricType metrics.MetricType) bool {
+	return metricType == metrics.GaugeMetricType && mapping.OnExpiry == mapper.ExpiryActionZero
 }
 
 func (r *Registry) Get(metricName string, hash metrics.LabelHash, metricType metrics.MetricType) (metrics.VectorHolder, metrics.MetricHolder) {
@@ -143,6 +242,7 @@ func (r *Registry) Get(metricName string, hash metrics.LabelHash, metricType met
 	if ok {
 		now := clock.Now()
 		rm.LastRegisteredAt = now
+		rm.Expired = false
 		return metric.Vectors[hash.Names].Holder, rm.Metric
 	}
 
@@ -161,19 +261,32 @@ func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help
 		return mh.(prometheus.Counter), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.CounterMetricType) {
-		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
+	name, err := r.resolveConflict(metricName, metrics.CounterMetricType)
+	if err != nil {
+		return nil, err
+	}
+	if name != metricName {
+		return r.GetCounter(name, labels, help, mapping, metricsCount)
+	}
+
+	if err := r.checkSeriesLimit(mapping); err != nil {
+		return nil, err
+	}
+	if err := r.checkTenantSeriesLimit(labels); err != nil {
+		return nil, err
 	}
 
 	var counterVec *prometheus.CounterVec
 	if vh == nil {
 		metricsCount.WithLabelValues("counter").Inc()
+		r.Groups.Set(metricName, mapping.Group)
+		r.dropCreated(metricName)
 		counterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: metricName,
-			Help: help,
+			Help: r.metricHelp(metricName, help),
 		}, labelNames)
 
-		if err := r.Registerer.Register(uncheckedCollector{counterVec}); err != nil {
+		if err := r.register(counterVec); err != nil {
 			return nil, err
 		}
 	} else {
@@ -181,11 +294,14 @@ func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help
 	}
 
 	var counter prometheus.Counter
-	var err error
 	if counter, err = counterVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.StoreCounter(metricName, hash, labels, counterVec, counter, mapping.Ttl)
+	r.StoreCounter(metricName, hash, counterVec, counter, mapping)
+	r.trackTenant(metricName, hash, labels)
+	if err := r.trackCreated(metricName, labelNames, labels, counter); err != nil {
+		return nil, err
+	}
 
 	return counter, nil
 }
@@ -197,19 +313,32 @@ func (r *Registry) GetGauge(metricName string, labels prometheus.Labels, help st
 		return mh.(prometheus.Gauge), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.GaugeMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	name, err := r.resolveConflict(metricName, metrics.GaugeMetricType)
+	if err != nil {
+		return nil, err
+	}
+	if name != metricName {
+		return r.GetGauge(name, labels, help, mapping, metricsCount)
+	}
+
+	if err := r.checkSeriesLimit(mapping); err != nil {
+		return nil, err
+	}
+	if err := r.checkTenantSeriesLimit(labels); err != nil {
+		return nil, err
 	}
 
 	var gaugeVec *prometheus.GaugeVec
 	if vh == nil {
 		metricsCount.WithLabelValues("gauge").Inc()
+		r.Groups.Set(metricName, mapping.Group)
+		r.dropCreated(metricName)
 		gaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: metricName,
-			Help: help,
+			Help: r.metricHelp(metricName, help),
 		}, labelNames)
 
-		if err := r.Registerer.Register(uncheckedCollector{gaugeVec}); err != nil {
+		if err := r.register(gaugeVec); err != nil {
 			return nil, err
 		}
 	} else {
@@ -217,11 +346,11 @@ func (r *Registry) GetGauge(metricName string, labels prometheus.Labels, help st
 	}
 
 	var gauge prometheus.Gauge
-	var err error
 	if gauge, err = gaugeVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.StoreGauge(metricName, hash, labels, gaugeVec, gauge, mapping.Ttl)
+	r.StoreGauge(metricName, hash, gaugeVec, gauge, mapping)
+	r.trackTenant(metricName, hash, labels)
 
 	return gauge, nil
 }
@@ -233,33 +362,37 @@ func (r *Registry) GetHistogram(metricName string, labels prometheus.Labels, hel
 		return mh.(prometheus.Observer), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.HistogramMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	name, err := r.resolveConflict(metricName, metrics.HistogramMetricType)
+	if err != nil {
+		return nil, err
 	}
-	if r.MetricConflicts(metricName+"_sum", metrics.HistogramMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	if name != metricName {
+		return r.GetHistogram(name, labels, help, mapping, metricsCount)
 	}
-	if r.MetricConflicts(metricName+"_count", metrics.HistogramMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+
+	if err := r.checkSeriesLimit(mapping); err != nil {
+		return nil, err
 	}
-	if r.MetricConflicts(metricName+"_bucket", metrics.HistogramMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	if err := r.checkTenantSeriesLimit(labels); err != nil {
+		return nil, err
 	}
 
 	var histogramVec *prometheus.HistogramVec
 	if vh == nil {
 		metricsCount.WithLabelValues("histogram").Inc()
+		r.Groups.Set(metricName, mapping.Group)
+		r.dropCreated(metricName)
 		buckets := r.Mapper.Defaults.HistogramOptions.Buckets
 		if mapping.HistogramOptions != nil && len(mapping.HistogramOptions.Buckets) > 0 {
 			buckets = mapping.HistogramOptions.Buckets
 		}
 		histogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    metricName,
-			Help:    help,
+			Help:    r.metricHelp(metricName, help),
 			Buckets: buckets,
 		}, labelNames)
 
-		if err := prometheus.Register(uncheckedCollector{histogramVec}); err != nil {
+		if err := r.register(histogramVec); err != nil {
 			return nil, err
 		}
 	} else {
@@ -267,11 +400,14 @@ func (r *Registry) GetHistogram(metricName string, labels prometheus.Labels, hel
 	}
 
 	var observer prometheus.Observer
-	var err error
 	if observer, err = histogramVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.StoreHistogram(metricName, hash, labels, histogramVec, observer, mapping.Ttl)
+	r.StoreHistogram(metricName, hash, histogramVec, observer, mapping)
+	r.trackTenant(metricName, hash, labels)
+	if err := r.trackCreated(metricName, labelNames, labels, observer); err != nil {
+		return nil, err
+	}
 
 	return observer, nil
 }
@@ -283,28 +419,36 @@ func (r *Registry) GetSummary(metricName string, labels prometheus.Labels, help
 		return mh.(prometheus.Observer), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.SummaryMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	name, err := r.resolveConflict(metricName, metrics.SummaryMetricType)
+	if err != nil {
+		return nil, err
 	}
-	if r.MetricConflicts(metricName+"_sum", metrics.SummaryMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	if name != metricName {
+		return r.GetSummary(name, labels, help, mapping, metricsCount)
 	}
-	if r.MetricConflicts(metricName+"_count", metrics.SummaryMetricType) {
-		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+
+	if err := r.checkSeriesLimit(mapping); err != nil {
+		return nil, err
+	}
+	if err := r.checkTenantSeriesLimit(labels); err != nil {
+		return nil, err
 	}
 
 	var summaryVec *prometheus.SummaryVec
 	if vh == nil {
 		metricsCount.WithLabelValues("summary").Inc()
+		r.Groups.Set(metricName, mapping.Group)
+		r.dropCreated(metricName)
 		quantiles := r.Mapper.Defaults.SummaryOptions.Quantiles
 		if mapping != nil && mapping.SummaryOptions != nil && len(mapping.SummaryOptions.Quantiles) > 0 {
 			quantiles = mapping.SummaryOptions.Quantiles
 		}
 
 		summaryOptions := mapper.SummaryOptions{
-			MaxAge:     r.Mapper.Defaults.SummaryOptions.MaxAge,
-			AgeBuckets: r.Mapper.Defaults.SummaryOptions.AgeBuckets,
-			BufCap:     r.Mapper.Defaults.SummaryOptions.BufCap,
+			MaxAge:      r.Mapper.Defaults.SummaryOptions.MaxAge,
+			AgeBuckets:  r.Mapper.Defaults.SummaryOptions.AgeBuckets,
+			BufCap:      r.Mapper.Defaults.SummaryOptions.BufCap,
+			NoQuantiles: r.Mapper.Defaults.SummaryOptions.NoQuantiles,
 		}
 
 		if mapping != nil && mapping.SummaryOptions != nil {
@@ -319,16 +463,19 @@ func (r *Registry) GetSummary(metricName string, labels prometheus.Labels, help
 		if len(objectives) == 0 {
 			objectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
 		}
+		if summaryOptions.NoQuantiles {
+			objectives = map[float64]float64{}
+		}
 		summaryVec = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 			Name:       metricName,
-			Help:       help,
+			Help:       r.metricHelp(metricName, help),
 			Objectives: objectives,
 			MaxAge:     summaryOptions.MaxAge,
 			AgeBuckets: summaryOptions.AgeBuckets,
 			BufCap:     summaryOptions.BufCap,
 		}, labelNames)
 
-		if err := prometheus.Register(uncheckedCollector{summaryVec}); err != nil {
+		if err := r.register(summaryVec); err != nil {
 			return nil, err
 		}
 	} else {
@@ -336,37 +483,150 @@ func (r *Registry) GetSummary(metricName string, labels prometheus.Labels, help
 	}
 
 	var observer prometheus.Observer
-	var err error
 	if observer, err = summaryVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.StoreSummary(metricName, hash, labels, summaryVec, observer, mapping.Ttl)
+	r.StoreSummary(metricName, hash, summaryVec, observer, mapping)
+	r.trackTenant(metricName, hash, labels)
 
 	return observer, nil
 }
 
+// RemoveStaleMetrics deletes the series that were not updated within their
+// TTL. It must not run concurrently with the Get methods.
 func (r *Registry) RemoveStaleMetrics() {
 	now := clock.Now()
 	// delete timeseries with expired ttl
-	for _, metric := range r.Metrics {
+	for metricName, metric := range r.Metrics {
 		for hash, rm := range metric.Metrics {
-			if rm.TTL == 0 {
+			if rm.TTL == 0 || rm.Expired {
 				continue
 			}
 			if rm.LastRegisteredAt.Add(rm.TTL).Before(now) {
-				metric.Vectors[rm.VecKey].Holder.Delete(rm.Labels)
-				metric.Vectors[rm.VecKey].RefCount--
-				delete(metric.Metrics, hash)
+				if rm.ZeroOnExpiry {
+					rm.Metric.(prometheus.Gauge).Set(0)
+					rm.Expired = true
+					continue
+				}
+				r.removeSeries(metricName, metric, hash, rm)
 			}
 		}
 	}
 }
 
+// RemoveOrphanedMetrics deletes the series that were created by mappings
+// that no longer exist, according to exists, for example after a reload. It
+// must not run concurrently with the Get methods.
+func (r *Registry) RemoveOrphanedMetrics(exists func(origin string) bool) int {
+	removed := 0
+	for metricName, metric := range r.Metrics {
+		for hash, rm := range metric.Metrics {
+			if !exists(rm.Origin) {
+				r.removeSeries(metricName, metric, hash, rm)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// removeSeries deletes a series, and its vector and metric if it was their
+// last series.
+func (r *Registry) removeSeries(metricName string, metric metrics.Metric, hash metrics.ValueHash, rm *metrics.RegisteredMetric) {
+	vector := metric.Vectors[rm.VecKey]
+	vector.Delete(rm.Metric)
+	r.untrackCreated(rm.Metric)
+	r.untrackTenant(rm)
+	vector.RefCount--
+	delete(metric.Metrics, hash)
+	rm.MappingSeries.Count--
+	atomic.AddInt64(&r.series, -1)
+	if vector.RefCount > 0 {
+		return
+	}
+	r.unregister(vector.Holder.(prometheus.Collector))
+	delete(metric.Vectors, rm.VecKey)
+	// Forget metrics without series, so that their name can be used again
+	// with another type or help text.
+	if len(metric.Vectors) == 0 {
+		delete(r.Metrics, metricName)
+		delete(r.metricHelpTexts, metricName)
+		r.Groups.Set(metricName, "")
+	}
+}
+
+// register adds a vector to the metrics collected from the registry.
+func (r *Registry) register(vector prometheus.Collector) error {
+	if !r.collectorRegistered {
+		if err := r.Registerer.Register(r.collector); err != nil {
+			return err
+		}
+		r.collectorRegistered = true
+	}
+	r.collector.mutex.Lock()
+	defer r.collector.mutex.Unlock()
+	r.collector.vectors[vector] = struct{}{}
+	return nil
+}
+
+// unregister stops collecting a vector.
+func (r *Registry) unregister(vector prometheus.Collector) {
+	r.collector.mutex.Lock()
+	defer r.collector.mutex.Unlock()
+	delete(r.collector.vectors, vector)
+}
+
+// mappingSeriesFor returns the series count of a mapping.
+func (r *Registry) mappingSeriesFor(mapping *mapper.MetricMapping) *metrics.MappingSeries {
+	series, ok := r.mappingSeries[mapping.Match]
+	if !ok {
+		series = &metrics.MappingSeries{}
+		r.mappingSeries[mapping.Match] = series
+	}
+	return series
+}
+
+// checkSeriesLimit returns ErrSeriesLimit if a new series would exceed the
+// max_series of the mapping.
+func (r *Registry) checkSeriesLimit(mapping *mapper.MetricMapping) error {
+	if mapping.MaxSeries <= 0 {
+		return nil
+	}
+	if r.mappingSeriesFor(mapping).Count >= mapping.MaxSeries {
+		return ErrSeriesLimit
+	}
+	return nil
+}
+
+// SeriesCount returns the number of series currently exported. It is safe to
+// call from any goroutine.
+func (r *Registry) SeriesCount() int64 {
+	return atomic.LoadInt64(&r.series)
+}
+
+// FNV-1a, computed inline so that hashing labels needs no shared state.
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+func hashAdd(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+func hashAddByte(h uint64, b byte) uint64 {
+	h ^= uint64(b)
+	h *= prime64
+	return h
+}
+
 // Calculates a hash of both the label names and the label names and values.
+// It is safe for concurrent use.
 func (r *Registry) HashLabels(labels prometheus.Labels) (metrics.LabelHash, []string) {
-	r.Hasher.Reset()
-	r.NameBuf.Reset()
-	r.ValueBuf.Reset()
 	labelNames := make([]string, 0, len(labels))
 
 	for labelName := range labels {
@@ -374,22 +634,21 @@ func (r *Registry) HashLabels(labels prometheus.Labels) (metrics.LabelHash, []st
 	}
 	sort.Strings(labelNames)
 
-	r.ValueBuf.WriteByte(model.SeparatorByte)
+	h := uint64(offset64)
 	for _, labelName := range labelNames {
-		r.ValueBuf.WriteString(labels[labelName])
-		r.ValueBuf.WriteByte(model.SeparatorByte)
-
-		r.NameBuf.WriteString(labelName)
-		r.NameBuf.WriteByte(model.SeparatorByte)
+		h = hashAdd(h, labelName)
+		h = hashAddByte(h, model.SeparatorByte)
 	}
-
 	lh := metrics.LabelHash{}
-	r.Hasher.Write(r.NameBuf.Bytes())
-	lh.Names = metrics.NameHash(r.Hasher.Sum64())
+	lh.Names = metrics.NameHash(h)
 
 	// Now add the values to the names we've already hashed.
-	r.Hasher.Write(r.ValueBuf.Bytes())
-	lh.Values = metrics.ValueHash(r.Hasher.Sum64())
+	h = hashAddByte(h, model.SeparatorByte)
+	for _, labelName := range labelNames {
+		h = hashAdd(h, labels[labelName])
+		h = hashAddByte(h, model.SeparatorByte)
+	}
+	lh.Values = metrics.ValueHash(h)
 
 	return lh, labelNames
 }
@@ -0,0 +1,153 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+)
+
+// State is a snapshot of the counters and gauges of a registry, which can be
+// restored after a restart. Histograms and summaries are not included, as
+// their observations cannot be restored.
+type State struct {
+	SavedAt time.Time     `json:"saved_at"`
+	Series  []SeriesState `json:"series"`
+}
+
+// SeriesState is the saved value and expiry bookkeeping of a series.
+type SeriesState struct {
+	Metric string            `json:"metric"`
+	Type   string            `json:"type"`
+	Labels prometheus.Labels `json:"labels"`
+	Help   string            `json:"help,omitempty"`
+	// Origin identifies the mapping of the series, see
+	// mapper.MetricMapping.Origin.
+	Origin           string    `json:"origin,omitempty"`
+	Value            float64   `json:"value"`
+	LastRegisteredAt time.Time `json:"last_registered_at"`
+	Expired          bool      `json:"expired,omitempty"`
+}
+
+// Snapshot saves the counters and gauges of the registry, sorted by metric
+// name and labels. It must not run concurrently with the Get methods.
+func (r *Registry) Snapshot() State {
+	state := State{SavedAt: clock.Now(), Series: []SeriesState{}}
+	for name, metric := range r.Metrics {
+		if metric.MetricType != metrics.CounterMetricType && metric.MetricType != metrics.GaugeMetricType {
+			continue
+		}
+		for _, rm := range metric.Metrics {
+			labels, value, ok := seriesValue(rm.Metric)
+			if !ok {
+				continue
+			}
+			state.Series = append(state.Series, SeriesState{
+				Metric:           name,
+				Type:             metric.MetricType.String(),
+				Labels:           labels,
+				Help:             r.metricHelpTexts[name],
+				Origin:           rm.Origin,
+				Value:            value,
+				LastRegisteredAt: rm.LastRegisteredAt,
+				Expired:          rm.Expired,
+			})
+		}
+	}
+
+	sort.Slice(state.Series, func(i, j int) bool {
+		return stateSortKey(&state.Series[i]) < stateSortKey(&state.Series[j])
+	})
+	return state
+}
+
+func stateSortKey(s *SeriesState) string {
+	return seriesSortKey(&Series{Metric: s.Metric, Labels: s.Labels})
+}
+
+// seriesValue reads the labels and the value of a counter or gauge.
+func seriesValue(m metrics.MetricHolder) (prometheus.Labels, float64, bool) {
+	metric, ok := m.(prometheus.Metric)
+	if !ok {
+		return nil, 0, false
+	}
+	var out dto.Metric
+	if err := metric.Write(&out); err != nil {
+		return nil, 0, false
+	}
+	labels := make(prometheus.Labels, len(out.Label))
+	for _, pair := range out.Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	switch {
+	case out.Counter != nil:
+		return labels, out.Counter.GetValue(), true
+	case out.Gauge != nil:
+		return labels, out.Gauge.GetValue(), true
+	}
+	return nil, 0, false
+}
+
+// RestoreSeries creates a saved series for the given mapping, and sets its
+// value and the time it was last updated, so that it expires as if the
+// exporter had not restarted. It must run before events are handled, and not
+// concurrently with the Get methods.
+func (r *Registry) RestoreSeries(s SeriesState, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) error {
+	labels := prometheus.Labels{}
+	for name, value := range s.Labels {
+		labels[name] = value
+	}
+
+	var metricType metrics.MetricType
+	switch s.Type {
+	case metrics.CounterMetricType.String():
+		if s.Value < 0 {
+			return fmt.Errorf("negative counter value %v", s.Value)
+		}
+		counter, err := r.GetCounter(s.Metric, labels, s.Help, mapping, metricsCount)
+		if err != nil {
+			return err
+		}
+		counter.Add(s.Value)
+		metricType = metrics.CounterMetricType
+	case metrics.GaugeMetricType.String():
+		gauge, err := r.GetGauge(s.Metric, labels, s.Help, mapping, metricsCount)
+		if err != nil {
+			return err
+		}
+		gauge.Set(s.Value)
+		metricType = metrics.GaugeMetricType
+	default:
+		return fmt.Errorf("cannot restore series of type %q", s.Type)
+	}
+
+	metric, ok := r.Metrics[s.Metric]
+	if !ok || metric.MetricType != metricType {
+		return nil
+	}
+	hash, _ := r.HashLabels(labels)
+	if rm, ok := metric.Metrics[hash.Values]; ok {
+		rm.LastRegisteredAt = s.LastRegisteredAt
+		rm.Expired = s.Expired
+	}
+	return nil
+}
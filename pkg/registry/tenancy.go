@@ -0,0 +1,104 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/metrics"
+)
+
+// ErrTenantSeriesLimit is returned when the tenant of a new series already
+// has the maximum number of series.
+var ErrTenantSeriesLimit = errors.New("series limit of the tenant reached")
+
+// Tenancy limits the number of series of each tenant, as found in the tenant
+// label, and exports the activity of each tenant. Series without the label
+// are not limited.
+type Tenancy struct {
+	Label string
+	// MaxSeries is the maximum number of series of a tenant. 0 means no
+	// limit.
+	MaxSeries int
+	// Events counts the handled events of each tenant.
+	Events *prometheus.CounterVec
+	// Series is the number of series of each tenant.
+	Series *prometheus.GaugeVec
+	// Limited counts the events of each tenant dropped by MaxSeries.
+	Limited *prometheus.CounterVec
+	series  map[string]*metrics.TenantSeries
+}
+
+// tenantOf returns the tenant of a series, or "" if it has none.
+func (t *Tenancy) tenantOf(labels prometheus.Labels) string {
+	if t == nil {
+		return ""
+	}
+	return labels[t.Label]
+}
+
+// checkTenantSeriesLimit returns ErrTenantSeriesLimit if a new series would
+// exceed the series limit of its tenant.
+func (r *Registry) checkTenantSeriesLimit(labels prometheus.Labels) error {
+	tenant := r.Tenancy.tenantOf(labels)
+	if tenant == "" || r.Tenancy.MaxSeries <= 0 {
+		return nil
+	}
+	if s := r.Tenancy.series[tenant]; s != nil && s.Count >= r.Tenancy.MaxSeries {
+		r.Tenancy.Limited.WithLabelValues(tenant).Inc()
+		return ErrTenantSeriesLimit
+	}
+	return nil
+}
+
+// trackTenant counts a new series towards its tenant.
+func (r *Registry) trackTenant(metricName string, hash metrics.LabelHash, labels prometheus.Labels) {
+	tenant := r.Tenancy.tenantOf(labels)
+	if tenant == "" {
+		return
+	}
+	rm := r.Metrics[metricName].Metrics[hash.Values]
+	if rm == nil || rm.TenantSeries != nil {
+		return
+	}
+	if r.Tenancy.series == nil {
+		r.Tenancy.series = make(map[string]*metrics.TenantSeries)
+	}
+	s, ok := r.Tenancy.series[tenant]
+	if !ok {
+		s = &metrics.TenantSeries{Tenant: tenant}
+		r.Tenancy.series[tenant] = s
+	}
+	s.Count++
+	rm.TenantSeries = s
+	r.Tenancy.Series.WithLabelValues(tenant).Set(float64(s.Count))
+}
+
+// untrackTenant stops counting a removed series towards its tenant, and
+// forgets tenants without series.
+func (r *Registry) untrackTenant(rm *metrics.RegisteredMetric) {
+	s := rm.TenantSeries
+	if s == nil {
+		return
+	}
+	s.Count--
+	if s.Count > 0 {
+		r.Tenancy.Series.WithLabelValues(s.Tenant).Set(float64(s.Count))
+		return
+	}
+	delete(r.Tenancy.series, s.Tenant)
+	r.Tenancy.Series.DeleteLabelValues(s.Tenant)
+}
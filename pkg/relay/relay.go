@@ -0,0 +1,246 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package relay forwards the raw StatsD lines received by the exporter to
+// other StatsD servers, for example while migrating from one to Prometheus.
+package relay
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// Mode decides which targets a line is relayed to.
+type Mode string
+
+const (
+	// ModeFanout relays every line to every target.
+	ModeFanout Mode = "fanout"
+	// ModeHash relays every line to one target, chosen by consistent
+	// hashing of the metric name and tags, so that each target receives all
+	// samples of the metrics it is responsible for.
+	ModeHash Mode = "hash"
+)
+
+// flushInterval is how long lines wait for more lines to fill a packet.
+const flushInterval = time.Second
+
+// Relay forwards lines to its targets over UDP. Lines are batched into
+// packets of up to the packet length. Lines that arrive faster than they can
+// be sent are dropped rather than holding up the listeners.
+type Relay struct {
+	// Mapper, if set, filters and samples the lines by its relay rules.
+	Mapper *mapper.MetricMapper
+	// Filtered, if set, counts the lines not relayed by the relay rules.
+	Filtered prometheus.Counter
+	// Self, if set, is the address of this exporter among the targets of a
+	// cluster, see Forward.
+	Self string
+
+	mode    Mode
+	targets []*target
+}
+
+type target struct {
+	address      string
+	conn         net.Conn
+	lines        chan string
+	packetLength int
+	logger       log.Logger
+	relayed      prometheus.Counter
+	dropped      prometheus.Counter
+	errors       prometheus.Counter
+}
+
+// NewRelay connects to the target addresses and starts sending to them.
+// relayed, dropped and errors count the relayed and dropped lines and the
+// failed sends, labeled by target.
+func NewRelay(addresses []string, mode Mode, packetLength int, logger log.Logger, relayed, dropped, errors *prometheus.CounterVec) (*Relay, error) {
+	if mode != ModeFanout && mode != ModeHash {
+		return nil, fmt.Errorf("unknown relay mode %q", mode)
+	}
+	r := &Relay{mode: mode}
+	for _, address := range addresses {
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		t := &target{
+			address:      address,
+			conn:         conn,
+			lines:        make(chan string, 1000),
+			packetLength: packetLength,
+			logger:       log.With(logger, "relay", address),
+			relayed:      relayed.WithLabelValues(address),
+			dropped:      dropped.WithLabelValues(address),
+			errors:       errors.WithLabelValues(address),
+		}
+		r.targets = append(r.targets, t)
+		go t.run()
+	}
+	return r, nil
+}
+
+// RelayLine queues a line to be relayed. It is safe for concurrent use.
+func (r *Relay) RelayLine(line string) {
+	if line == "" {
+		return
+	}
+	if r.Mapper != nil && !r.selected(line) {
+		if r.Filtered != nil {
+			r.Filtered.Inc()
+		}
+		return
+	}
+	if r.mode == ModeHash {
+		r.targetFor(line).queue(line)
+		return
+	}
+	for _, t := range r.targets {
+		t.queue(line)
+	}
+}
+
+// selected reports whether a line is relayed according to the relay rule of
+// its metric.
+func (r *Relay) selected(line string) bool {
+	rule, ok := r.Mapper.RelayRule(metricName(line))
+	if !ok {
+		return false
+	}
+	return rule == nil || rule.SampleRate >= 1 || rand.Float64() < rule.SampleRate
+}
+
+// Forward relays a line to the exporter of a cluster that is responsible for
+// its metric name, and reports whether it did. Lines that this exporter, Self,
+// is responsible for are not relayed. Each exporter thus receives all lines of
+// the metrics it is responsible for, and exports all their series.
+func (r *Relay) Forward(line string) bool {
+	if line == "" {
+		return false
+	}
+	t := r.targetForKey(metricName(line))
+	if t.address == r.Self {
+		return false
+	}
+	t.queue(line)
+	return true
+}
+
+// metricName returns the StatsD metric name of a line, without tags.
+func metricName(line string) string {
+	if i := strings.IndexAny(line, ":,#["); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// targetFor picks the target of a line by rendezvous hashing of its metric
+// name, which moves only the metrics of a removed or added target.
+func (r *Relay) targetFor(line string) *target {
+	key := line
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		key = line[:i]
+	}
+	return r.targetForKey(key)
+}
+
+func (r *Relay) targetForKey(key string) *target {
+	var (
+		best      *target
+		bestScore uint64
+	)
+	for _, t := range r.targets {
+		if score := hash(t.address, key); best == nil || score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+	return best
+}
+
+// hash is FNV-1a of the target address and key. FNV-1a alone spreads
+// similar keys unevenly between the targets, so its result is mixed with the
+// finalizer of MurmurHash3.
+func hash(address, key string) uint64 {
+	h := uint64(14695981039346656037)
+	for _, s := range []string{address, "\xff", key} {
+		for i := 0; i < len(s); i++ {
+			h ^= uint64(s[i])
+			h *= 1099511628211
+		}
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (t *target) queue(line string) {
+	select {
+	case t.lines <- line:
+	default:
+		t.dropped.Inc()
+	}
+}
+
+// run batches the queued lines into packets and sends them.
+func (t *target) run() {
+	ticker := clock.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var (
+		packet []byte
+		lines  int
+	)
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := t.conn.Write(packet); err != nil {
+			level.Debug(t.logger).Log("msg", "Error relaying packet", "error", err)
+			t.errors.Inc()
+			t.dropped.Add(float64(lines))
+		} else {
+			t.relayed.Add(float64(lines))
+		}
+		packet, lines = packet[:0], 0
+	}
+
+	for {
+		select {
+		case line := <-t.lines:
+			if len(packet) > 0 && len(packet)+1+len(line) > t.packetLength {
+				flush()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+			lines++
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package relay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+func newTestRelay(t *testing.T, mode Mode, packetLength int, addresses ...string) *Relay {
+	counter := func() *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "relay_test_total"}, []string{"target"})
+	}
+	r, err := NewRelay(addresses, mode, packetLength, log.NewNopLogger(), counter(), counter(), counter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func readPacket(t *testing.T, conn *net.UDPConn) string {
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestRelayFanout(t *testing.T) {
+	a, b := listenUDP(t), listenUDP(t)
+	defer a.Close()
+	defer b.Close()
+
+	r := newTestRelay(t, ModeFanout, 1400, a.LocalAddr().String(), b.LocalAddr().String())
+	r.RelayLine("foo:1|c")
+	r.RelayLine("")
+	r.RelayLine("bar:2|g|#la:foo")
+
+	for _, conn := range []*net.UDPConn{a, b} {
+		if packet := readPacket(t, conn); packet != "foo:1|c\nbar:2|g|#la:foo" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+	}
+}
+
+func TestRelayPacketLength(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+
+	r := newTestRelay(t, ModeFanout, 16, conn.LocalAddr().String())
+	for _, line := range []string{"foo:1|c", "bar:2|c", "baz:3|c"} {
+		r.RelayLine(line)
+	}
+	for _, expected := range []string{"foo:1|c\nbar:2|c", "baz:3|c"} {
+		if packet := readPacket(t, conn); packet != expected {
+			t.Errorf("expected packet %q, got %q", expected, packet)
+		}
+	}
+}
+
+func TestRelayRules(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+
+	m := &mapper.MetricMapper{}
+	if err := m.InitFromYAMLString("relay_rules:\n- match: legacy.*\n", 0); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRelay(t, ModeFanout, 1400, conn.LocalAddr().String())
+	r.Mapper = m
+	r.Filtered = prometheus.NewCounter(prometheus.CounterOpts{Name: "relay_filtered_test_total"})
+	for _, line := range []string{"other.requests:1|c", "legacy.requests:1|c|#la:foo", "legacy.a.b:1|c"} {
+		r.RelayLine(line)
+	}
+	if packet := readPacket(t, conn); packet != "legacy.requests:1|c|#la:foo" {
+		t.Errorf("unexpected packet %q", packet)
+	}
+}
+
+func TestRelayHash(t *testing.T) {
+	r := &Relay{mode: ModeHash}
+	for _, address := range []string{"a:8125", "b:8125", "c:8125"} {
+		r.targets = append(r.targets, &target{address: address})
+	}
+
+	assigned := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("metric.%d", i)
+		address := r.targetFor(key + ":1|c").address
+		if again := r.targetFor(key + ":2|c|#la:foo").address; again != address {
+			t.Fatalf("%s was relayed to %s and %s", key, address, again)
+		}
+		assigned[key] = address
+		counts[address]++
+	}
+	for address, count := range counts {
+		if count < 800 {
+			t.Errorf("%s got only %d of 3000 metrics", address, count)
+		}
+	}
+
+	// Removing a target only moves its metrics.
+	r.targets = r.targets[:2]
+	for key, address := range assigned {
+		if address == "c:8125" {
+			continue
+		}
+		if moved := r.targetFor(key + ":1|c").address; moved != address {
+			t.Errorf("%s moved from %s to %s", key, address, moved)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	a, b := listenUDP(t), listenUDP(t)
+	defer a.Close()
+	defer b.Close()
+
+	r := newTestRelay(t, ModeHash, 65000, a.LocalAddr().String(), b.LocalAddr().String())
+	r.Self = a.LocalAddr().String()
+	var forwarded []string
+	local := 0
+	for i := 0; i < 20; i++ {
+		// All lines of a metric go to the same exporter, whatever their tags.
+		for _, line := range []string{fmt.Sprintf("metric.%d:1|c", i), fmt.Sprintf("metric.%d,host=a:2|c|#la:foo", i)} {
+			if r.Forward(line) {
+				forwarded = append(forwarded, line)
+			} else {
+				local++
+			}
+		}
+	}
+	if local == 0 || len(forwarded) == 0 || local%2 != 0 {
+		t.Fatalf("expected the metrics to be split between the exporters, forwarded %v", forwarded)
+	}
+	if r.Forward("") {
+		t.Error("expected an empty line not to be forwarded")
+	}
+	if packet := readPacket(t, b); packet != strings.Join(forwarded, "\n") {
+		t.Errorf("unexpected packet %q", packet)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remotewrite pushes the exported metrics to a Prometheus remote
+// write endpoint, for exporters that cannot be scraped.
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+// Results are the values of the result label of the Requests counter.
+const (
+	ResultSuccess = "success"
+	ResultRetry   = "retry"
+	ResultFailure = "failure"
+)
+
+// Writer gathers the metrics every Interval and pushes them to URL. Failed
+// pushes are retried Retries times, waiting RetryBackoff and twice as long
+// after every attempt. Pushes that still fail are kept in WAL, if set, and
+// sent before the next push that gets through.
+type Writer struct {
+	URL          string
+	Interval     time.Duration
+	Gatherer     prometheus.Gatherer
+	Client       *http.Client
+	Retries      int
+	RetryBackoff time.Duration
+	WAL          *WAL
+	Logger       log.Logger
+	// Requests counts the push attempts by result label.
+	Requests *prometheus.CounterVec
+}
+
+// permanentError is a push the endpoint rejected, which is not retried.
+type permanentError struct {
+	status string
+}
+
+func (e permanentError) Error() string {
+	return "remote write endpoint rejected the request: " + e.status
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// Run pushes the metrics every Interval until the process exits.
+func (w *Writer) Run() {
+	ticker := clock.NewTicker(w.Interval)
+	for range ticker.C {
+		w.Push()
+	}
+}
+
+// Push gathers the metrics and pushes them, after the requests in the WAL.
+func (w *Writer) Push() {
+	mfs, err := w.Gatherer.Gather()
+	if err != nil {
+		level.Warn(w.Logger).Log("msg", "Error gathering metrics for remote write", "error", err)
+	}
+	now := clock.Now().UnixNano() / int64(time.Millisecond)
+	body := snappyEncode(encodeWriteRequest(toSeries(mfs, now)))
+
+	if w.WAL != nil {
+		if err := w.WAL.Replay(w.send); err != nil {
+			level.Warn(w.Logger).Log("msg", "Error sending remote write requests from the WAL", "error", err)
+			w.keep(body)
+			return
+		}
+	}
+	err = w.send(body)
+	switch {
+	case err == nil:
+	case isPermanent(err) || w.WAL == nil:
+		level.Warn(w.Logger).Log("msg", "Error sending remote write request", "error", err)
+	default:
+		level.Warn(w.Logger).Log("msg", "Error sending remote write request, keeping it in the WAL", "error", err)
+		w.keep(body)
+	}
+}
+
+// keep appends a request that could not be sent to the WAL.
+func (w *Writer) keep(body []byte) {
+	if err := w.WAL.Append(body); err != nil {
+		level.Error(w.Logger).Log("msg", "Error writing remote write request to the WAL", "error", err)
+	}
+}
+
+// send pushes a request, retrying it on network errors, server errors and
+// throttling.
+func (w *Writer) send(body []byte) error {
+	backoff := w.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			w.Requests.WithLabelValues(ResultSuccess).Inc()
+			return nil
+		}
+		if isPermanent(err) || attempt >= w.Retries {
+			w.Requests.WithLabelValues(ResultFailure).Inc()
+			return err
+		}
+		w.Requests.WithLabelValues(ResultRetry).Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *Writer) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{status: err.Error()}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "statsd_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		return permanentError{status: resp.Status}
+	default:
+		return fmt.Errorf("remote write endpoint returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// snappyDecode decodes the literals written by snappyEncode.
+func snappyDecode(t *testing.T, src []byte) []byte {
+	n, l := binary.Uvarint(src)
+	src = src[l:]
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		if tag&3 != 0 {
+			t.Fatalf("unexpected snappy element %d", tag&3)
+		}
+		length := int(tag >> 2)
+		switch length {
+		case 60:
+			length, src = int(src[1]), src[2:]
+		case 61:
+			length, src = int(src[1])|int(src[2])<<8, src[3:]
+		default:
+			src = src[1:]
+		}
+		length++
+		dst, src = append(dst, src[:length]...), src[length:]
+	}
+	if uint64(len(dst)) != n {
+		t.Fatalf("expected %d decoded bytes, got %d", n, len(dst))
+	}
+	return dst
+}
+
+// decodeWriteRequest decodes the series of a WriteRequest.
+func decodeWriteRequest(t *testing.T, b []byte) []series {
+	fields := func(b []byte, f func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = f(num, typ, b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+
+	var ss []series
+	fields(b, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		var s series
+		fields(ts, func(num protowire.Number, _ protowire.Type, b []byte) int {
+			msg, n := protowire.ConsumeBytes(b)
+			if num == timeSeriesLabels {
+				var l label
+				fields(msg, func(num protowire.Number, _ protowire.Type, b []byte) int {
+					v, n := protowire.ConsumeString(b)
+					if num == labelName {
+						l.name = v
+					} else {
+						l.value = v
+					}
+					return n
+				})
+				s.labels = append(s.labels, l)
+				return n
+			}
+			fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				if num == sampleValue {
+					v, n := protowire.ConsumeFixed64(b)
+					s.value = math.Float64frombits(v)
+					return n
+				}
+				v, n := protowire.ConsumeVarint(b)
+				s.timestamp = int64(v)
+				return n
+			})
+			return n
+		})
+		ss = append(ss, s)
+		return n
+	})
+	return ss
+}
+
+func newTestWriter(url string) *Writer {
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rw_requests_total", Help: "Requests."}, []string{"la"})
+	c.WithLabelValues("foo").Add(3)
+	reg.MustRegister(c)
+	return &Writer{
+		URL:      url,
+		Gatherer: reg,
+		Logger:   log.NewNopLogger(),
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total"}, []string{"result"}),
+	}
+}
+
+func TestPush(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		bodies [][]byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		bodies = append(bodies, body)
+		mtx.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w := newTestWriter(server.URL)
+	w.Push()
+
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(bodies))
+	}
+	ss := decodeWriteRequest(t, snappyDecode(t, bodies[0]))
+	if len(ss) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(ss))
+	}
+	expected := []label{{"__name__", "rw_requests_total"}, {"la", "foo"}}
+	if !reflect.DeepEqual(ss[0].labels, expected) || ss[0].value != 3 || ss[0].timestamp == 0 {
+		t.Errorf("unexpected series %+v", ss[0])
+	}
+}
+
+func TestPushRetry(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w := newTestWriter(server.URL)
+	w.Retries = 1
+	w.Push()
+
+	if calls != 2 {
+		t.Fatalf("expected 2 requests, got %d", calls)
+	}
+	for result, expected := range map[string]float64{ResultRetry: 1, ResultSuccess: 1, ResultFailure: 0} {
+		if got := testCounterValue(t, w.Requests.WithLabelValues(result)); got != expected {
+			t.Errorf("expected %v %s requests, got %v", expected, result, got)
+		}
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		failing = true
+		bodies  [][]byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w := newTestWriter(server.URL)
+	w.WAL, err = OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Push()
+	w.Push()
+	if segments, _ := w.WAL.segments(); len(segments) != 2 {
+		t.Fatalf("expected 2 requests in the WAL, got %d", len(segments))
+	}
+
+	// A WAL opened again continues after the requests in it.
+	w.WAL, err = OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing = false
+	w.Push()
+	if len(bodies) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(bodies))
+	}
+	if segments, _ := w.WAL.segments(); len(segments) != 0 {
+		t.Fatalf("expected an empty WAL, got %d requests", len(segments))
+	}
+}
+
+func TestWALMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenWAL(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second", "third"} {
+		if err := wal.Append([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var replayed []string
+	if err := wal.Replay(func(body []byte) error {
+		replayed = append(replayed, string(body))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed, []string{"third"}) {
+		t.Errorf("expected only the newest request to be kept, got %v", replayed)
+	}
+}
+
+func TestSnappyEncode(t *testing.T) {
+	for _, n := range []int{0, 1, 60, 61, 300, maxLiteral, 3*maxLiteral + 7} {
+		src := bytes.Repeat([]byte{'x'}, n)
+		if got := snappyDecode(t, snappyEncode(src)); !bytes.Equal(got, src) {
+			t.Errorf("%d bytes: decoded %d bytes", n, len(got))
+		}
+	}
+}
+
+func testCounterValue(t *testing.T, c prometheus.Counter) float64 {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs[0].GetMetric()[0].GetCounter().GetValue()
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const segmentSuffix = ".wal"
+
+// WAL keeps the requests that could not be sent in a directory, one file per
+// request, so that they are sent once the endpoint is reachable again, even
+// after a restart. When the files exceed MaxBytes, the oldest are dropped.
+type WAL struct {
+	Dir      string
+	MaxBytes int64
+	next     uint64
+}
+
+// OpenWAL creates the directory of a WAL if needed and continues the
+// numbering of the requests already in it.
+func OpenWAL(dir string, maxBytes int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &WAL{Dir: dir, MaxBytes: maxBytes}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		n, _ := strconv.ParseUint(strings.TrimSuffix(last, segmentSuffix), 10, 64)
+		w.next = n + 1
+	}
+	return w, nil
+}
+
+// segments returns the file names of the requests in the WAL, oldest first.
+func (w *WAL) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(w.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, f := range files {
+		name := f.Name()
+		if f.Mode().IsRegular() && strings.HasSuffix(name, segmentSuffix) {
+			segments = append(segments, name)
+		}
+	}
+	// The names are zero padded, so they sort by their number.
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// Append adds a request to the WAL, then drops the oldest requests while the
+// WAL is larger than MaxBytes.
+func (w *WAL) Append(body []byte) error {
+	name := filepath.Join(w.Dir, fmt.Sprintf("%020d%s", w.next, segmentSuffix))
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	w.next++
+	return w.truncate()
+}
+
+// truncate drops the oldest requests while the WAL is larger than MaxBytes.
+func (w *WAL) truncate() error {
+	if w.MaxBytes <= 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(w.Dir)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), segmentSuffix) {
+			size += f.Size()
+		}
+	}
+	// ReadDir sorts by name, so the oldest requests come first.
+	for _, f := range files {
+		if size <= w.MaxBytes {
+			break
+		}
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(w.Dir, f.Name())); err != nil {
+			return err
+		}
+		size -= f.Size()
+	}
+	return nil
+}
+
+// Replay sends the requests in the WAL, oldest first, and removes those that
+// were sent or rejected by the endpoint. It stops at the first request that
+// could not be sent and returns its error.
+func (w *WAL) Replay(send func(body []byte) error) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		name := filepath.Join(w.Dir, segment)
+		body, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := send(body); err != nil && !isPermanent(err) {
+			return err
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runtimestats samples Go runtime latencies that delay reading from
+// the listeners, and relates them to the datagrams the kernel dropped.
+package runtimestats
+
+import (
+	"math"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Signals are the values of the signal label of the Correlation gauge.
+const (
+	SignalGCPause          = "gc_pause"
+	SignalSchedulerLatency = "scheduler_latency"
+)
+
+// Sampler takes a sample every Interval. The scheduler latency is how late
+// the sampling goroutine runs after its ticker fired, the GC pause the sum of
+// the pauses since the previous sample. If Drops is set, each of them is
+// correlated with the drops per interval over the last Window intervals.
+type Sampler struct {
+	Interval time.Duration
+	Window   int
+	// Drops, if set, reads the total number of dropped datagrams.
+	Drops  func() (uint64, error)
+	Logger log.Logger
+
+	SchedulerLatency prometheus.Observer
+	GCPauses         prometheus.Observer
+	DropsTotal       prometheus.Counter
+	// Correlation holds the Pearson correlation coefficient of each signal
+	// with the drops, by signal label.
+	Correlation *prometheus.GaugeVec
+
+	// readGCStats is replaced in tests.
+	readGCStats func(*debug.GCStats)
+	gcStats     debug.GCStats
+	lastNumGC   int64
+	lastDrops   uint64
+	samples     []sample
+}
+
+type sample struct {
+	schedulerLatency float64
+	gcPause          float64
+	drops            float64
+}
+
+// Run samples until the process exits.
+func (s *Sampler) Run() {
+	s.init()
+	ticker := time.NewTicker(s.Interval)
+	for tick := range ticker.C {
+		s.sample(time.Since(tick))
+	}
+}
+
+// init reads the current totals, so that the first sample only counts what
+// happened since.
+func (s *Sampler) init() {
+	if s.readGCStats == nil {
+		s.readGCStats = debug.ReadGCStats
+	}
+	s.readGCStats(&s.gcStats)
+	s.lastNumGC = s.gcStats.NumGC
+	if s.Drops != nil {
+		if drops, err := s.Drops(); err == nil {
+			s.lastDrops = drops
+		}
+	}
+}
+
+func (s *Sampler) sample(latency time.Duration) {
+	current := sample{schedulerLatency: latency.Seconds()}
+	s.SchedulerLatency.Observe(current.schedulerLatency)
+
+	s.readGCStats(&s.gcStats)
+	// Pause holds the most recent pauses first.
+	n := s.gcStats.NumGC - s.lastNumGC
+	if n > int64(len(s.gcStats.Pause)) {
+		n = int64(len(s.gcStats.Pause))
+	}
+	for _, pause := range s.gcStats.Pause[:n] {
+		s.GCPauses.Observe(pause.Seconds())
+		current.gcPause += pause.Seconds()
+	}
+	s.lastNumGC = s.gcStats.NumGC
+
+	if s.Drops == nil {
+		return
+	}
+	drops, err := s.Drops()
+	if err != nil {
+		level.Debug(s.Logger).Log("msg", "Unable to read dropped datagrams", "error", err)
+		return
+	}
+	if drops > s.lastDrops {
+		current.drops = float64(drops - s.lastDrops)
+		s.DropsTotal.Add(current.drops)
+	}
+	s.lastDrops = drops
+
+	s.samples = append(s.samples, current)
+	if len(s.samples) > s.Window {
+		s.samples = s.samples[len(s.samples)-s.Window:]
+	}
+
+	var latencies, pauses, dropped []float64
+	for _, sample := range s.samples {
+		latencies = append(latencies, sample.schedulerLatency)
+		pauses = append(pauses, sample.gcPause)
+		dropped = append(dropped, sample.drops)
+	}
+	s.Correlation.WithLabelValues(SignalGCPause).Set(pearson(pauses, dropped))
+	s.Correlation.WithLabelValues(SignalSchedulerLatency).Set(pearson(latencies, dropped))
+}
+
+// pearson returns the correlation coefficient of xs and ys, or NaN if either
+// of them does not vary.
+func pearson(xs, ys []float64) float64 {
+	n := float64(len(xs))
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var cov, varX, varY float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(varX*varY)
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtimestats
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestPearson(t *testing.T) {
+	scenarios := []struct {
+		xs, ys   []float64
+		expected float64
+	}{
+		{xs: []float64{1, 2, 3}, ys: []float64{2, 4, 6}, expected: 1},
+		{xs: []float64{1, 2, 3}, ys: []float64{3, 2, 1}, expected: -1},
+		{xs: []float64{1, 2, 3, 4}, ys: []float64{1, 3, 3, 1}, expected: 0},
+		{xs: []float64{1, 2, 3}, ys: []float64{0, 0, 0}, expected: math.NaN()},
+		{xs: nil, ys: nil, expected: math.NaN()},
+	}
+	for i, s := range scenarios {
+		got := pearson(s.xs, s.ys)
+		if math.IsNaN(s.expected) {
+			if !math.IsNaN(got) {
+				t.Errorf("%d: expected NaN, got %v", i, got)
+			}
+			continue
+		}
+		if math.Abs(got-s.expected) > 1e-9 {
+			t.Errorf("%d: expected %v, got %v", i, s.expected, got)
+		}
+	}
+}
+
+func TestSampler(t *testing.T) {
+	var (
+		numGC  int64
+		pauses []time.Duration
+		drops  uint64
+	)
+	s := &Sampler{
+		Window: 3,
+		Drops:  func() (uint64, error) { return drops, nil },
+		Logger: log.NewNopLogger(),
+
+		SchedulerLatency: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency"}),
+		GCPauses:         prometheus.NewHistogram(prometheus.HistogramOpts{Name: "pauses"}),
+		DropsTotal:       prometheus.NewCounter(prometheus.CounterOpts{Name: "drops"}),
+		Correlation:      prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "correlation"}, []string{"signal"}),
+
+		readGCStats: func(stats *debug.GCStats) {
+			stats.NumGC = numGC
+			stats.Pause = pauses
+		},
+	}
+	s.init()
+
+	// A GC pause in every interval that drops datagrams.
+	for _, pause := range []time.Duration{0, 10 * time.Millisecond, 0, 20 * time.Millisecond} {
+		if pause > 0 {
+			numGC++
+			pauses = append([]time.Duration{pause}, pauses...)
+			drops += uint64(pause / time.Millisecond)
+		}
+		s.sample(time.Millisecond)
+	}
+
+	if got := metricValue(s.DropsTotal); got != 30 {
+		t.Errorf("expected 30 drops, got %v", got)
+	}
+	if got := metricValue(s.Correlation.WithLabelValues(SignalGCPause)); math.Abs(got-1) > 1e-9 {
+		t.Errorf("expected a GC pause correlation of 1, got %v", got)
+	}
+	if got := metricValue(s.Correlation.WithLabelValues(SignalSchedulerLatency)); !math.IsNaN(got) {
+		t.Errorf("expected no scheduler latency correlation, got %v", got)
+	}
+	if len(s.samples) != 3 {
+		t.Errorf("expected the window to hold 3 samples, got %d", len(s.samples))
+	}
+}
+
+func metricValue(m prometheus.Metric) float64 {
+	d := &dto.Metric{}
+	if err := m.Write(d); err != nil {
+		return 0
+	}
+	if d.Counter != nil {
+		return d.GetCounter().GetValue()
+	}
+	return d.GetGauge().GetValue()
+}
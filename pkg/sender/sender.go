@@ -0,0 +1,109 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sender labels the series received by a shared exporter with the
+// host that sent them, by its address or a name looked up in a table.
+package sender
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// network names the hosts of a network.
+type network struct {
+	network *net.IPNet
+	name    string
+}
+
+// Labeler derives the source label of events from the IP address they were
+// sent from. Addresses are looked up in a table of IP addresses and CIDR
+// networks, and exported as is if the table does not name them.
+type Labeler struct {
+	// Label is the label the source is exported in.
+	Label string
+
+	hosts    map[string]string
+	networks []network
+}
+
+// NewLabeler returns a labeler with a table that maps IP addresses or CIDR
+// networks to names. Addresses match exact entries first, then the most
+// specific network that contains them.
+func NewLabeler(label string, table map[string]string) (*Labeler, error) {
+	l := &Labeler{Label: label, hosts: make(map[string]string)}
+	for address, name := range table {
+		if name == "" {
+			return nil, fmt.Errorf("empty name for source %q", address)
+		}
+		if ip := net.ParseIP(address); ip != nil {
+			l.hosts[ip.String()] = name
+			continue
+		}
+		_, n, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("source %q is neither an IP address nor a CIDR network", address)
+		}
+		l.networks = append(l.networks, network{network: n, name: name})
+	}
+	sort.Slice(l.networks, func(i, j int) bool {
+		a, _ := l.networks[i].network.Mask.Size()
+		b, _ := l.networks[j].network.Mask.Size()
+		if a != b {
+			return a > b
+		}
+		return l.networks[i].network.String() < l.networks[j].network.String()
+	})
+	return l, nil
+}
+
+// LoadLabeler returns a labeler with the table read from a YAML file, or with
+// an empty table if file is "".
+func LoadLabeler(label, file string) (*Labeler, error) {
+	table := map[string]string{}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &table); err != nil {
+			return nil, fmt.Errorf("source names %s: %v", file, err)
+		}
+	}
+	return NewLabeler(label, table)
+}
+
+// Source returns the name of the host with the IP address, or the address
+// itself if the table does not name it.
+func (l *Labeler) Source(ip net.IP) string {
+	address := ip.String()
+	if name, ok := l.hosts[address]; ok {
+		return name
+	}
+	for _, n := range l.networks {
+		if n.network.Contains(ip) {
+			return n.name
+		}
+	}
+	return address
+}
+
+// Set replaces any source label sent by the client with the source, as the
+// client can't choose where it sends from.
+func (l *Labeler) Set(labels map[string]string, source string) {
+	labels[l.Label] = source
+}
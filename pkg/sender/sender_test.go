@@ -0,0 +1,77 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sender
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestLabeler(t *testing.T) {
+	l, err := NewLabeler("source", map[string]string{
+		"10.0.0.5":    "web-1",
+		"10.0.0.0/24": "web",
+		"10.0.0.0/8":  "internal",
+		"2001:db8::1": "v6",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]string{
+		"10.0.0.5":        "web-1",
+		"10.0.0.6":        "web",
+		"10.1.0.1":        "internal",
+		"192.168.1.1":     "192.168.1.1",
+		"2001:db8::1":     "v6",
+		"::ffff:10.0.0.5": "web-1",
+	} {
+		if got := l.Source(net.ParseIP(ip)); got != expected {
+			t.Errorf("unexpected source %q of %s, expected %q", got, ip, expected)
+		}
+	}
+
+	for _, table := range []map[string]string{
+		{"web-1": "10.0.0.5"},
+		{"10.0.0.5": ""},
+	} {
+		if _, err := NewLabeler("source", table); err == nil {
+			t.Errorf("expected an error for %v", table)
+		}
+	}
+}
+
+func TestLoadLabeler(t *testing.T) {
+	f, err := ioutil.TempFile("", "sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("10.0.0.5: web-1\n10.0.1.0/24: batch\n")
+	f.Close()
+
+	l, err := LoadLabeler("host", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Source(net.ParseIP("10.0.1.9")); got != "batch" {
+		t.Errorf("unexpected source %q", got)
+	}
+	labels := map[string]string{"host": "spoofed"}
+	l.Set(labels, "batch")
+	if labels["host"] != "batch" {
+		t.Errorf("expected the source to replace the tag, got %v", labels)
+	}
+}
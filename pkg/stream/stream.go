@@ -0,0 +1,167 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// subscriberBuffer is the number of events buffered per subscriber. Events
+// are dropped for subscribers that can't keep up rather than blocking the
+// exporter.
+const subscriberBuffer = 100
+
+// HandledEvent describes a StatsD event after it went through the mapper.
+type HandledEvent struct {
+	Time       time.Time         `json:"time"`
+	StatsdName string            `json:"statsd_name"`
+	Type       string            `json:"type"`
+	Value      float64           `json:"value"`
+	Action     string            `json:"action"`
+	Match      string            `json:"match,omitempty"`
+	MetricName string            `json:"metric_name,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+type subscriber struct {
+	prefix     string
+	sampleRate float64
+	events     chan HandledEvent
+}
+
+func (s *subscriber) wants(e *HandledEvent) bool {
+	if !strings.HasPrefix(e.StatsdName, s.prefix) {
+		return false
+	}
+	return s.sampleRate >= 1 || rand.Float64() < s.sampleRate
+}
+
+// Broadcaster fans out handled events to HTTP clients as Server-Sent Events.
+type Broadcaster struct {
+	Logger log.Logger
+
+	active      int32
+	mutex       sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// NewBroadcaster returns a Broadcaster without subscribers.
+func NewBroadcaster(logger log.Logger) *Broadcaster {
+	return &Broadcaster{
+		Logger:      logger,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Active reports whether anyone is subscribed, so that callers can skip
+// building events nobody will see.
+func (b *Broadcaster) Active() bool {
+	return b != nil && atomic.LoadInt32(&b.active) > 0
+}
+
+// Publish sends the event to all subscribers whose filter matches it. It
+// never blocks.
+func (b *Broadcaster) Publish(e HandledEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for s := range b.subscribers {
+		if !s.wants(&e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+		}
+	}
+}
+
+func (b *Broadcaster) subscribe(s *subscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers[s] = struct{}{}
+	atomic.StoreInt32(&b.active, int32(len(b.subscribers)))
+}
+
+func (b *Broadcaster) unsubscribe(s *subscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers, s)
+	atomic.StoreInt32(&b.active, int32(len(b.subscribers)))
+}
+
+// ServeHTTP streams handled events until the client disconnects. The
+// optional "prefix" parameter restricts the stream to StatsD metric names
+// starting with it, and "sample" (between 0 and 1) the fraction of events
+// sent.
+func (b *Broadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	s := &subscriber{
+		prefix:     r.URL.Query().Get("prefix"),
+		sampleRate: 1,
+		events:     make(chan HandledEvent, subscriberBuffer),
+	}
+	if sample := r.URL.Query().Get("sample"); sample != "" {
+		rate, err := strconv.ParseFloat(sample, 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			http.Error(w, fmt.Sprintf("invalid sample rate %q", sample), http.StatusBadRequest)
+			return
+		}
+		s.sampleRate = rate
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	b.subscribe(s)
+	defer b.unsubscribe(s)
+	level.Debug(b.Logger).Log("msg", "Event stream client connected", "addr", r.RemoteAddr, "prefix", s.prefix)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			level.Debug(b.Logger).Log("msg", "Event stream client disconnected", "addr", r.RemoteAddr)
+			return
+		case e := <-s.events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				level.Debug(b.Logger).Log("msg", "Failed to encode event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestBroadcasterPrefixFilter(t *testing.T) {
+	b := NewBroadcaster(log.NewNopLogger())
+	server := httptest.NewServer(b)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?prefix=foo.")
+	if err != nil {
+		t.Fatalf("Failed to connect to stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type %q", ct)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.Active() {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscriber was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.Publish(HandledEvent{StatsdName: "bar.baz", Action: "map"})
+	b.Publish(HandledEvent{StatsdName: "foo.bar", Action: "map", MetricName: "foo_bar"})
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read from stream: %v", err)
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("Unexpected line %q", line)
+	}
+
+	var e HandledEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if e.StatsdName != "foo.bar" || e.MetricName != "foo_bar" {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+}
+
+func TestBroadcasterInvalidSampleRate(t *testing.T) {
+	b := NewBroadcaster(log.NewNopLogger())
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/debug/events/stream?sample=2", nil)
+	b.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if b.Active() {
+		t.Fatal("Rejected request should not subscribe")
+	}
+}
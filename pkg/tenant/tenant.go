@@ -0,0 +1,125 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tenant assigns the events received by a shared exporter to
+// tenants, by their source address, the port they were received on, or a
+// tag.
+package tenant
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultLabel is the label that holds the tenant of a series.
+const DefaultLabel = "tenant"
+
+// Rule assigns the events from a network, received on a port, or both, to
+// a tenant.
+type Rule struct {
+	Tenant string
+	// Network, if set, is the network the events come from.
+	Network *net.IPNet
+	// Port, if set, is the listener port the events are received on.
+	Port int
+}
+
+// Resolver derives the tenant of events. Rules are tried first, in order,
+// because the source of an event can't be chosen by the client. Events no
+// rule matches get the value of their Tag, if set, and otherwise Default.
+type Resolver struct {
+	// Label is the label the tenant is exported in.
+	Label   string
+	Rules   []Rule
+	Tag     string
+	Default string
+}
+
+// ParseNetworkRule parses a tenant=cidr rule.
+func ParseNetworkRule(s string) (Rule, error) {
+	tenant, cidr, err := split(s)
+	if err != nil {
+		return Rule{}, err
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return Rule{}, fmt.Errorf("tenant rule %q: %v", s, err)
+	}
+	return Rule{Tenant: tenant, Network: network}, nil
+}
+
+// ParsePortRule parses a tenant=port rule.
+func ParsePortRule(s string) (Rule, error) {
+	tenant, port, err := split(s)
+	if err != nil {
+		return Rule{}, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return Rule{}, fmt.Errorf("tenant rule %q: invalid port %q", s, port)
+	}
+	return Rule{Tenant: tenant, Port: p}, nil
+}
+
+func split(s string) (string, string, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("tenant rule %q is not of the form tenant=value", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+// Source returns the tenant of the first rule matching the source IP and
+// listener port of events, or "" if none matches. ip is nil and port 0 for
+// listeners without them.
+func (r *Resolver) Source(ip net.IP, port int) string {
+	for _, rule := range r.Rules {
+		if rule.Network != nil && (ip == nil || !rule.Network.Contains(ip)) {
+			continue
+		}
+		if rule.Port != 0 && rule.Port != port {
+			continue
+		}
+		return rule.Tenant
+	}
+	return ""
+}
+
+// Tenant returns the tenant of events with the labels, given the tenant of
+// their source.
+func (r *Resolver) Tenant(labels map[string]string, source string) string {
+	if source != "" {
+		return source
+	}
+	if r.Tag != "" {
+		if tenant := labels[r.Tag]; tenant != "" {
+			return tenant
+		}
+	}
+	return r.Default
+}
+
+// Set replaces the tag and any tenant label sent by the client with the
+// tenant. Without a tenant, the tenant label is removed.
+func (r *Resolver) Set(labels map[string]string, tenant string) {
+	if r.Tag != "" {
+		delete(labels, r.Tag)
+	}
+	if tenant == "" {
+		delete(labels, r.Label)
+		return
+	}
+	labels[r.Label] = tenant
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tenant
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func newTestResolver(t *testing.T) *Resolver {
+	r := &Resolver{Label: DefaultLabel, Tag: "team", Default: "shared"}
+	for _, s := range []string{"payments=10.1.0.0/16", "search=10.2.0.0/16"} {
+		rule, err := ParseNetworkRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Rules = append(r.Rules, rule)
+	}
+	rule, err := ParsePortRule("batch=9126")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Rules = append(r.Rules, rule)
+	return r
+}
+
+func TestSource(t *testing.T) {
+	r := newTestResolver(t)
+	for _, s := range []struct {
+		ip       net.IP
+		port     int
+		expected string
+	}{
+		{net.ParseIP("10.1.2.3"), 9125, "payments"},
+		{net.ParseIP("10.2.0.1"), 9126, "search"},
+		{net.ParseIP("10.3.0.1"), 9126, "batch"},
+		{net.ParseIP("10.3.0.1"), 9125, ""},
+		{nil, 0, ""},
+	} {
+		if got := r.Source(s.ip, s.port); got != s.expected {
+			t.Errorf("%v:%d: expected tenant %q, got %q", s.ip, s.port, s.expected, got)
+		}
+	}
+}
+
+func TestTenant(t *testing.T) {
+	r := newTestResolver(t)
+	for _, s := range []struct {
+		labels   map[string]string
+		source   string
+		expected map[string]string
+	}{
+		{
+			labels:   map[string]string{"team": "checkout", "la": "foo"},
+			expected: map[string]string{"tenant": "checkout", "la": "foo"},
+		},
+		{
+			labels:   map[string]string{"team": "checkout", "tenant": "spoofed"},
+			source:   "payments",
+			expected: map[string]string{"tenant": "payments"},
+		},
+		{
+			labels:   map[string]string{"tenant": "spoofed"},
+			expected: map[string]string{"tenant": "shared"},
+		},
+	} {
+		r.Set(s.labels, r.Tenant(s.labels, s.source))
+		if !reflect.DeepEqual(s.labels, s.expected) {
+			t.Errorf("expected labels %v, got %v", s.expected, s.labels)
+		}
+	}
+
+	r.Default = ""
+	labels := map[string]string{"tenant": "spoofed"}
+	r.Set(labels, r.Tenant(labels, ""))
+	if len(labels) != 0 {
+		t.Errorf("expected the tenant label to be removed, got %v", labels)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	for _, s := range []string{"payments", "=10.0.0.0/8", "payments=10.0.0.0", "payments="} {
+		if _, err := ParseNetworkRule(s); err == nil {
+			t.Errorf("expected network rule %q to fail", s)
+		}
+	}
+	for _, s := range []string{"batch=http", "batch=0", "batch=65536"} {
+		if _, err := ParsePortRule(s); err == nil {
+			t.Errorf("expected port rule %q to fail", s)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator decides whether a request is authorized.
+type Authenticator interface {
+	Authenticate(r *http.Request) bool
+}
+
+// BasicAuth authorizes requests with the password of one of its users. It
+// maps the users to the bcrypt hashes of their passwords.
+type BasicAuth map[string]string
+
+// unknownUserHash is compared against the password of unknown users, so that
+// their response takes as long as that of known users.
+const unknownUserHash = "$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"
+
+func (a BasicAuth) Authenticate(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := a[user]
+	if !known {
+		hash = unknownUserHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil && known
+}
+
+// BearerTokens authorizes requests with one of its tokens in the
+// Authorization header.
+type BearerTokens []string
+
+func (a BearerTokens) Authenticate(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	authorized := false
+	for _, expected := range a {
+		if secureCompare(token, expected) {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// ClientCertificates authorizes requests with a verified TLS client
+// certificate whose common name or one of its DNS names is in the list. "*"
+// accepts any verified certificate.
+type ClientCertificates []string
+
+func (a ClientCertificates) Authenticate(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, allowed := range a {
+		if allowed == "*" {
+			return true
+		}
+		for _, name := range names {
+			if name == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticators returns the authentication methods of the configuration.
+func (c *AuthConfig) Authenticators() []Authenticator {
+	if c == nil {
+		return nil
+	}
+	var auths []Authenticator
+	if len(c.BasicAuthUsers) > 0 {
+		auths = append(auths, BasicAuth(c.BasicAuthUsers))
+	}
+	if len(c.BearerTokens) > 0 {
+		auths = append(auths, BearerTokens(c.BearerTokens))
+	}
+	if len(c.ClientCertificates) > 0 {
+		auths = append(auths, ClientCertificates(c.ClientCertificates))
+	}
+	return auths
+}
+
+// Middleware only passes requests to the handler that any of the
+// authenticators authorizes. Without authenticators, all requests pass.
+func Middleware(auths []Authenticator, handler http.Handler) http.Handler {
+	if len(auths) == 0 {
+		return handler
+	}
+	basic := false
+	for _, auth := range auths {
+		if _, ok := auth.(BasicAuth); ok {
+			basic = true
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, auth := range auths {
+			if auth.Authenticate(r) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="statsd_exporter"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,280 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// secretHash is the bcrypt hash of "secret".
+const secretHash = "$2a$04$q6ZPTNTve9s9P5oADQqLEeLbBjf3PjXIUrWfl3tnDPP2MALDhiM2C"
+
+func TestMiddleware(t *testing.T) {
+	config := &Config{
+		EndpointGroups: map[string]*AuthConfig{
+			GroupLifecycle: {
+				BasicAuthUsers:     map[string]string{"admin": secretHash},
+				BearerTokens:       []string{"token"},
+				ClientCertificates: []string{"deployer"},
+			},
+		},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	clientCert := func(name string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	scenarios := []struct {
+		name     string
+		group    string
+		setup    func(r *http.Request)
+		expected int
+	}{
+		{name: "open group", group: GroupMetrics, expected: http.StatusOK},
+		{name: "no credentials", group: GroupLifecycle, expected: http.StatusUnauthorized},
+		{
+			name:     "basic auth",
+			group:    GroupLifecycle,
+			setup:    func(r *http.Request) { r.SetBasicAuth("admin", "secret") },
+			expected: http.StatusOK,
+		},
+		{
+			name:     "wrong password",
+			group:    GroupLifecycle,
+			setup:    func(r *http.Request) { r.SetBasicAuth("admin", "wrong") },
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown user",
+			group:    GroupLifecycle,
+			setup:    func(r *http.Request) { r.SetBasicAuth("nobody", "") },
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "bearer token",
+			group:    GroupLifecycle,
+			setup:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") },
+			expected: http.StatusOK,
+		},
+		{
+			name:     "wrong bearer token",
+			group:    GroupLifecycle,
+			setup:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") },
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "client certificate",
+			group:    GroupLifecycle,
+			setup:    func(r *http.Request) { r.TLS = clientCert("deployer") },
+			expected: http.StatusOK,
+		},
+		{
+			name:     "unknown client certificate",
+			group:    GroupLifecycle,
+			setup:    func(r *http.Request) { r.TLS = clientCert("intruder") },
+			expected: http.StatusUnauthorized,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if s.setup != nil {
+				s.setup(r)
+			}
+			w := httptest.NewRecorder()
+			config.Handler(s.group, ok).ServeHTTP(w, r)
+			if w.Code != s.expected {
+				t.Fatalf("Expected status %d, got %d", s.expected, w.Code)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatalf("Expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestTenantHandler(t *testing.T) {
+	config := &Config{
+		EndpointGroups: map[string]*AuthConfig{
+			GroupMetrics: {BearerTokens: []string{"admin"}},
+		},
+		Tenants: map[string]*AuthConfig{
+			"payments": {BearerTokens: []string{"payments"}},
+			"public":   nil,
+		},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := config.TenantHandler(func(r *http.Request) string { return r.URL.Query().Get("tenant") }, ok)
+
+	for _, s := range []struct {
+		tenant, token string
+		expected      int
+	}{
+		{tenant: "payments", token: "payments", expected: http.StatusOK},
+		{tenant: "payments", token: "admin", expected: http.StatusUnauthorized},
+		{tenant: "public", expected: http.StatusOK},
+		{tenant: "search", token: "admin", expected: http.StatusOK},
+		{tenant: "search", token: "payments", expected: http.StatusUnauthorized},
+		{token: "payments", expected: http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics?tenant="+s.tenant, nil)
+		if s.token != "" {
+			r.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != s.expected {
+			t.Errorf("tenant %q with token %q: expected status %d, got %d", s.tenant, s.token, s.expected, w.Code)
+		}
+	}
+}
+
+func TestAuthenticates(t *testing.T) {
+	var none *Config
+	if none.Authenticates(GroupAdmin) {
+		t.Errorf("expected no authentication without a config")
+	}
+	c := &Config{EndpointGroups: map[string]*AuthConfig{
+		GroupAdmin:   {BearerTokens: []string{"token"}},
+		GroupMetrics: {},
+	}}
+	if !c.Authenticates(GroupAdmin) {
+		t.Errorf("expected the admin group to require authentication")
+	}
+	if c.Authenticates(GroupMetrics) || c.Authenticates(GroupDebug) {
+		t.Errorf("expected groups without methods to be open")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config string
+		bad    bool
+	}{
+		{
+			name: "basic auth",
+			config: `
+endpoint_groups:
+  metrics:
+    basic_auth_users:
+      prometheus: $2a$04$q6ZPTNTve9s9P5oADQqLEeLbBjf3PjXIUrWfl3tnDPP2MALDhiM2C
+`,
+		},
+		{
+			name: "basic auth password in plain text",
+			config: `
+endpoint_groups:
+  metrics:
+    basic_auth_users:
+      prometheus: secret
+`,
+			bad: true,
+		},
+		{
+			name: "tenant basic auth password in plain text",
+			config: `
+tenants:
+  payments:
+    basic_auth_users:
+      payments: secret
+`,
+			bad: true,
+		},
+		{
+			name: "unknown group",
+			config: `
+endpoint_groups:
+  ingestion:
+    bearer_tokens: [token]
+`,
+			bad: true,
+		},
+		{
+			name: "client certificates without a CA",
+			config: `
+endpoint_groups:
+  lifecycle:
+    client_certificates: ["*"]
+`,
+			bad: true,
+		},
+		{
+			name: "tenant bearer tokens",
+			config: `
+tenants:
+  payments:
+    bearer_tokens: [token]
+`,
+		},
+		{
+			name: "tenant client certificates without a CA",
+			config: `
+tenants:
+  payments:
+    client_certificates: ["*"]
+`,
+			bad: true,
+		},
+		{
+			name: "TLS without a key",
+			config: `
+tls_server_config:
+  cert_file: server.crt
+`,
+			bad: true,
+		},
+		{
+			name: "unknown field",
+			config: `
+endpoint_groups:
+  metrics:
+    passwords: [secret]
+`,
+			bad: true,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "web-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			if _, err := f.WriteString(s.config); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			_, err = LoadConfig(f.Name())
+			if s.bad && err == nil {
+				t.Fatalf("Expected an error loading %s", s.config)
+			}
+			if !s.bad && err != nil {
+				t.Fatalf("Unexpected error loading %s: %v", s.config, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Endpoint groups that authentication can be configured for.
+const (
+	GroupMetrics   = "metrics"
+	GroupLifecycle = "lifecycle"
+	GroupDebug     = "debug"
+	GroupHealth    = "health"
+	GroupAdmin     = "admin"
+)
+
+var groups = map[string]bool{
+	GroupMetrics:   true,
+	GroupLifecycle: true,
+	GroupDebug:     true,
+	GroupHealth:    true,
+	GroupAdmin:     true,
+}
+
+// Config is the web configuration file, which sets up TLS for the web
+// interface and the authentication required by each endpoint group.
+type Config struct {
+	TLSConfig      *TLSConfig             `yaml:"tls_server_config"`
+	EndpointGroups map[string]*AuthConfig `yaml:"endpoint_groups"`
+	// Tenants configures the authentication of the metrics of each tenant,
+	// in place of that of the metrics group.
+	Tenants map[string]*AuthConfig `yaml:"tenants"`
+}
+
+// TLSConfig configures the certificate of the web interface, and the CA that
+// client certificates are verified against.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// AuthConfig configures the authentication of one endpoint group. A request
+// is authorized if it passes any of the configured methods.
+type AuthConfig struct {
+	// BasicAuthUsers maps the users to the bcrypt hashes of their passwords.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	BearerTokens   []string          `yaml:"bearer_tokens"`
+	// ClientCertificates accepts requests with a verified client certificate
+	// whose common name or DNS names are in the list. "*" accepts any
+	// verified client certificate.
+	ClientCertificates []string `yaml:"client_certificates"`
+}
+
+// LoadConfig reads and validates a web configuration file. An empty file
+// name returns a nil Config, which serves plain HTTP without authentication.
+func LoadConfig(fileName string) (*Config, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, err
+	}
+
+	for group, auth := range c.EndpointGroups {
+		if !groups[group] {
+			return nil, fmt.Errorf("unknown endpoint group %q", group)
+		}
+		if err := auth.validateHashes(); err != nil {
+			return nil, fmt.Errorf("endpoint group %q: %v", group, err)
+		}
+		if auth != nil && len(auth.ClientCertificates) > 0 && (c.TLSConfig == nil || c.TLSConfig.ClientCAFile == "") {
+			return nil, fmt.Errorf("client_certificates in endpoint group %q require a client_ca_file", group)
+		}
+	}
+	for tenant, auth := range c.Tenants {
+		if err := auth.validateHashes(); err != nil {
+			return nil, fmt.Errorf("tenant %q: %v", tenant, err)
+		}
+		if auth != nil && len(auth.ClientCertificates) > 0 && (c.TLSConfig == nil || c.TLSConfig.ClientCAFile == "") {
+			return nil, fmt.Errorf("client_certificates of tenant %q require a client_ca_file", tenant)
+		}
+	}
+	if c.TLSConfig != nil && (c.TLSConfig.CertFile == "" || c.TLSConfig.KeyFile == "") {
+		return nil, fmt.Errorf("tls_server_config requires a cert_file and key_file")
+	}
+	return c, nil
+}
+
+// validateHashes checks that the passwords of the basic auth users are
+// bcrypt hashes, so that a plain-text password is not taken for one.
+func (c *AuthConfig) validateHashes() error {
+	if c == nil {
+		return nil
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("password of basic auth user %q is not a bcrypt hash: %v", user, err)
+		}
+	}
+	return nil
+}
+
+// Handler wraps the handler of an endpoint with the authentication of its
+// group.
+func (c *Config) Handler(group string, handler http.Handler) http.Handler {
+	if c == nil {
+		return handler
+	}
+	return Middleware(c.EndpointGroups[group].Authenticators(), handler)
+}
+
+// Authenticates reports whether the endpoints of a group require
+// authentication.
+func (c *Config) Authenticates(group string) bool {
+	return c != nil && len(c.EndpointGroups[group].Authenticators()) > 0
+}
+
+// TenantHandler wraps the handler of the metrics endpoint with the
+// authentication of the tenant tenantOf returns for a request, if the tenant
+// is configured, and with that of the metrics group otherwise.
+func (c *Config) TenantHandler(tenantOf func(*http.Request) string, handler http.Handler) http.Handler {
+	if c == nil {
+		return handler
+	}
+	metrics := c.Handler(GroupMetrics, handler)
+	tenants := make(map[string]http.Handler, len(c.Tenants))
+	for tenant, auth := range c.Tenants {
+		tenants[tenant] = Middleware(auth.Authenticators(), handler)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := tenants[tenantOf(r)]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves the handler on the address, with TLS if configured.
+func (c *Config) ListenAndServe(address string, handler http.Handler) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return c.Serve(l, handler)
+}
+
+// Serve serves the handler on the listener, with TLS if configured.
+func (c *Config) Serve(l net.Listener, handler http.Handler) error {
+	if c == nil || c.TLSConfig == nil {
+		return http.Serve(l, handler)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSConfig.ClientCAFile != "" {
+		ca, err := ioutil.ReadFile(c.TLSConfig.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in %s", c.TLSConfig.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		// Client certificates are only required by the endpoint groups that
+		// authenticate with them.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	return server.ServeTLS(l, c.TLSConfig.CertFile, c.TLSConfig.KeyFile)
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// staticLabelEnvPrefix precedes the name of a static label in an environment
+// variable, so that the Kubernetes downward API can set labels such as
+// STATSD_EXPORTER_LABEL_pod from the pod metadata of a sidecar.
+const staticLabelEnvPrefix = "STATSD_EXPORTER_LABEL_"
+
+// staticLabels merges the static labels set in the environment with those set
+// by flags, which take precedence.
+func staticLabels(flags map[string]string, environ []string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, staticLabelEnvPrefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, staticLabelEnvPrefix)
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			labels[kv[:i]] = kv[i+1:]
+		}
+	}
+	for name, value := range flags {
+		labels[name] = value
+	}
+	for name, value := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid static label name %q", name)
+		}
+		if value == "" {
+			delete(labels, name)
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStaticLabels(t *testing.T) {
+	environ := []string{
+		"HOME=/root",
+		"STATSD_EXPORTER_LABEL_pod=web-7d4b9c-x2x8q",
+		"STATSD_EXPORTER_LABEL_namespace=shop",
+		"STATSD_EXPORTER_LABEL_node=",
+	}
+	labels, err := staticLabels(map[string]string{"namespace": "checkout", "team": "payments"}, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := prometheus.Labels{"pod": "web-7d4b9c-x2x8q", "namespace": "checkout", "team": "payments"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected %v, got %v", expected, labels)
+	}
+
+	if _, err := staticLabels(nil, []string{"STATSD_EXPORTER_LABEL_pod-name=web"}); err == nil {
+		t.Error("expected an invalid label name to fail")
+	}
+}
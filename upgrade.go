@@ -0,0 +1,132 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/statsd_exporter/pkg/handoff"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+)
+
+// namedSocket is a listening socket that is handed off on upgrades.
+type namedSocket struct {
+	name   string
+	socket handoff.Socket
+}
+
+// listenUDP takes over the named UDP socket of the process this one upgraded,
+// or binds a new one.
+func listenUDP(inherited *handoff.Inherited, name string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := inherited.PacketConn(name)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return net.ListenUDP("udp", addr)
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("inherited socket %v is not a UDP socket", conn.LocalAddr())
+	}
+	return udpConn, nil
+}
+
+// listenTCP takes over the named TCP or SCTP socket of the process this one
+// upgraded, or binds a new one with listen.
+func listenTCP(inherited *handoff.Inherited, name string, listen func() (*net.TCPListener, error)) (*net.TCPListener, error) {
+	l, err := inherited.Listener(name)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return listen()
+	}
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("inherited socket %v is not a %s socket", l.Addr(), name)
+	}
+	return tcpListener, nil
+}
+
+// listenSCTP is listener.ListenSCTP for listenTCP.
+func listenSCTP(addr *net.TCPAddr) func() (*net.TCPListener, error) {
+	return func() (*net.TCPListener, error) {
+		return listener.ListenSCTP(addr)
+	}
+}
+
+// inheritUnixgram takes over the Unixgram socket of the process this one
+// upgraded, if there is one.
+func inheritUnixgram(inherited *handoff.Inherited) (*net.UnixConn, error) {
+	conn, err := inherited.PacketConn("unixgram")
+	if err != nil || conn == nil {
+		return nil, err
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("inherited socket %v is not a Unixgram socket", conn.LocalAddr())
+	}
+	return unixConn, nil
+}
+
+// listenHTTP takes over the named web socket of the process this one
+// upgraded, or binds a new one, and adds it to the sockets to hand off. It
+// exits if neither works.
+func listenHTTP(inherited *handoff.Inherited, name, address string, sockets *[]namedSocket, logger log.Logger) net.Listener {
+	l, err := inherited.Listener(name)
+	if err == nil && l == nil {
+		l, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to listen for HTTP requests", "address", address, "error", err)
+		os.Exit(1)
+	}
+	if s, ok := l.(handoff.Socket); ok {
+		*sockets = append(*sockets, namedSocket{name, s})
+	}
+	return l
+}
+
+// prepareUpgrade checks that the new executable accepts the flags and the
+// configuration of this process, and duplicates the sockets to hand off to
+// it. Nothing has changed for this process if it returns an error.
+func prepareUpgrade(sockets []namedSocket, timeout time.Duration) (*handoff.Handoff, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	check := exec.CommandContext(ctx, os.Args[0], append(os.Args[1:], "--check-config")...)
+	if out, err := check.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("the new executable failed the configuration check: %v: %s", err, out)
+	}
+
+	h := &handoff.Handoff{}
+	for _, s := range sockets {
+		if err := h.Add(s.name, s.socket); err != nil {
+			h.Close()
+			return nil, fmt.Errorf("unable to hand off the %s socket: %v", s.name, err)
+		}
+	}
+	return h, nil
+}